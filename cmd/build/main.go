@@ -1,14 +1,27 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"math"
+	"net/http"
+	"net/url"
 	"os"
-	"regexp"
+	"os/signal"
+	"path"
 	"runtime/pprof"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/tilezen/go-tilepacks/tilepack"
@@ -16,54 +29,584 @@ import (
 
 const (
 	saveLogInterval = 10000
+
+	// defaultStateCheckpointInterval is how often saved tiles are recorded
+	// in the -state file if -checkpoint-interval isn't set.
+	defaultStateCheckpointInterval = 5 * time.Minute
 )
 
-func processResults(waitGroup *sync.WaitGroup, results chan *tilepack.TileResponse, processor tilepack.TileOutputter) {
+// headersFlag collects repeated -header "Name: Value" flags.
+type headersFlag struct {
+	headers http.Header
+}
+
+func (f *headersFlag) String() string {
+	return ""
+}
+
+func (f *headersFlag) Set(value string) error {
+	parts := strings.SplitN(value, ":", 2)
+
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return errors.New("Header must be in the form \"Name: Value\"")
+	}
+
+	if f.headers == nil {
+		f.headers = make(http.Header)
+	}
+
+	f.headers.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	return nil
+}
+
+// metadataFlag collects repeated -metadata "name=value" flags.
+type metadataFlag struct {
+	values map[string]string
+}
+
+func (f *metadataFlag) String() string {
+	return ""
+}
+
+func (f *metadataFlag) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+
+	if len(parts) != 2 || parts[0] == "" {
+		return errors.New("Metadata must be in the form name=value")
+	}
+
+	if f.values == nil {
+		f.values = make(map[string]string)
+	}
+
+	f.values[parts[0]] = parts[1]
+	return nil
+}
+
+// urlTemplateFormats maps tile URL extensions to mbtiles "format" values.
+var urlTemplateFormats = map[string]string{
+	".mvt":  tilepack.FormatPbf,
+	".pbf":  tilepack.FormatPbf,
+	".png":  tilepack.FormatPng,
+	".jpg":  tilepack.FormatJpeg,
+	".jpeg": tilepack.FormatJpeg,
+	".webp": tilepack.FormatWebp,
+	".avif": tilepack.FormatAvif,
+}
+
+// urlTemplateFormat returns the mbtiles "format" of the tiles requested from
+// urlTemplate, going by the extension of its path, or an empty string if it
+// doesn't have a known one.
+func urlTemplateFormat(urlTemplate string) string {
+	if i := strings.IndexAny(urlTemplate, "?#"); i >= 0 {
+		urlTemplate = urlTemplate[:i]
+	}
+
+	return urlTemplateFormats[strings.ToLower(path.Ext(urlTemplate))]
+}
+
+// authorizationHeader returns the Authorization header value for a bearer
+// token or "user:pass" basic auth credentials, only one of which may be set.
+// It returns an empty string if neither is.
+func authorizationHeader(bearerToken string, basicAuth string) (string, error) {
+	if bearerToken != "" && basicAuth != "" {
+		return "", errors.New("-bearer-token and -basic-auth can't be used together")
+	}
+
+	if bearerToken != "" {
+		return "Bearer " + bearerToken, nil
+	}
+
+	if basicAuth != "" {
+		if !strings.Contains(basicAuth, ":") {
+			return "", errors.New("-basic-auth must be in the form user:pass")
+		}
+
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(basicAuth)), nil
+	}
+
+	return "", nil
+}
+
+// parseBounds parses a semicolon-separated list of bounding boxes, each a
+// comma-separated list of south,west,north,east.
+func parseBounds(str string) ([]*tilepack.LngLatBbox, error) {
+	var boxes []*tilepack.LngLatBbox
+
+	for _, boxStr := range strings.Split(str, ";") {
+		boundingBoxStrSplit := strings.Split(boxStr, ",")
+		if len(boundingBoxStrSplit) != 4 {
+			return nil, errors.New("Bounding box string must be a comma-separated list of 4 numbers")
+		}
+
+		boundingBoxFloats := make([]float64, 4)
+		for i, bboxStr := range boundingBoxStrSplit {
+			bboxStr = strings.TrimSpace(bboxStr)
+			bboxFloat, err := strconv.ParseFloat(bboxStr, 64)
+			if err != nil {
+				return nil, errors.New("Bounding box string could not be parsed as numbers")
+			}
+
+			boundingBoxFloats[i] = bboxFloat
+		}
+
+		boxes = append(boxes, &tilepack.LngLatBbox{
+			South: boundingBoxFloats[0],
+			West:  boundingBoxFloats[1],
+			North: boundingBoxFloats[2],
+			East:  boundingBoxFloats[3],
+		})
+	}
+
+	return boxes, nil
+}
+
+// unionBounds returns the smallest bounding box covering all of boxes. If
+// there are several boxes and any of them crosses the antimeridian, it covers
+// every longitude.
+func unionBounds(boxes []*tilepack.LngLatBbox) *tilepack.LngLatBbox {
+	union := *boxes[0]
+
+	if len(boxes) == 1 {
+		return &union
+	}
+
+	for _, box := range boxes[1:] {
+		union.West = math.Min(union.West, box.West)
+		union.South = math.Min(union.South, box.South)
+		union.East = math.Max(union.East, box.East)
+		union.North = math.Max(union.North, box.North)
+	}
+
+	for _, box := range boxes {
+		if box.West > box.East {
+			union.West = -180.0
+			union.East = 180.0
+		}
+	}
+
+	return &union
+}
+
+// readExtent returns the bounds and zoom range of the existing mbtiles at dsn,
+// from its metadata or, if that's missing, from its tiles.
+func readExtent(dsn string) (*tilepack.LngLatBbox, uint, uint, error) {
+	// Opening a database that doesn't exist would create it
+	path := strings.TrimPrefix(dsn, "file:")
+	if i := strings.Index(path, "?"); i >= 0 {
+		path = path[:i]
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		return nil, 0, 0, err
+	}
+
+	reader, err := tilepack.NewMbtilesReader(dsn)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer reader.Close()
+
+	metadata, err := reader.Metadata()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	minZoom, minErr := strconv.ParseUint(metadata["minzoom"], 10, 32)
+	maxZoom, maxErr := strconv.ParseUint(metadata["maxzoom"], 10, 32)
+
+	if minErr != nil || maxErr != nil {
+		lowest, highest, err := reader.GetZoomRange()
+		if err != nil {
+			return nil, 0, 0, err
+		}
+
+		minZoom = uint64(lowest)
+		maxZoom = uint64(highest)
+	}
+
+	// The bounds metadata is west,south,east,north
+	var bounds *tilepack.LngLatBbox
+	boundsStrSplit := strings.Split(metadata["bounds"], ",")
+
+	if len(boundsStrSplit) == 4 {
+		boundsFloats := make([]float64, 4)
+
+		for i, boundStr := range boundsStrSplit {
+			boundsFloats[i], err = strconv.ParseFloat(strings.TrimSpace(boundStr), 64)
+			if err != nil {
+				break
+			}
+		}
+
+		if err == nil {
+			bounds = &tilepack.LngLatBbox{
+				West:  boundsFloats[0],
+				South: boundsFloats[1],
+				East:  boundsFloats[2],
+				North: boundsFloats[3],
+			}
+		}
+	}
+
+	if bounds == nil {
+		extent, err := reader.GetTileExtent()
+		if err != nil {
+			return nil, 0, 0, err
+		}
+
+		bounds = extent.Bounds
+	}
+
+	return bounds, uint(minZoom), uint(maxZoom), nil
+}
+
+// missingTiles reopens the mbtiles at dsn and returns how many of the tiles
+// that would be generated for bounds (or boxes) at each of zooms it doesn't
+// have. Zooms that aren't missing any tiles are left out.
+func missingTiles(dsn string, bounds *tilepack.LngLatBbox, boxes []*tilepack.LngLatBbox, zooms []uint) (map[uint]uint64, error) {
+	reader, err := tilepack.NewMbtilesReaderReadOnly(dsn)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	counts, err := reader.CountTilesByZoom()
+	if err != nil {
+		return nil, err
+	}
+
+	missing := make(map[uint]uint64)
+
+	for _, z := range zooms {
+		expected, err := tilepack.CountTiles(&tilepack.GenerateTilesOptions{Bounds: bounds, Boxes: boxes, Zooms: []uint{z}})
+		if err != nil {
+			return nil, err
+		}
+
+		if got := uint64(counts[z]); got < expected {
+			missing[z] = expected - got
+		}
+	}
+
+	return missing, nil
+}
+
+// parseZooms parses a comma-separated list of zoom levels and
+// {MIN_ZOOM}-{MAX_ZOOM} ranges, such as "0-5,7,9-11", into a sorted list of
+// distinct zoom levels.
+func parseZooms(str string) ([]uint, error) {
+	seen := make(map[uint]bool)
+	zooms := make([]uint, 0)
+
+	for _, part := range strings.Split(str, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+
+		min_zoom, err := strconv.ParseUint(bounds[0], 10, 32)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse zoom (%s), %s", bounds[0], err)
+		}
+
+		max_zoom := min_zoom
+
+		if len(bounds) == 2 {
+			max_zoom, err = strconv.ParseUint(bounds[1], 10, 32)
+
+			if err != nil {
+				return nil, fmt.Errorf("Failed to parse max zoom (%s), %s", bounds[1], err)
+			}
+
+			if min_zoom > max_zoom {
+				return nil, fmt.Errorf("Invalid zoom range %s", part)
+			}
+		}
+
+		for z := min_zoom; z <= max_zoom; z++ {
+			if !seen[uint(z)] {
+				seen[uint(z)] = true
+				zooms = append(zooms, uint(z))
+			}
+		}
+	}
+
+	sort.Slice(zooms, func(i, j int) bool { return zooms[i] < zooms[j] })
+
+	return zooms, nil
+}
+
+// workerSchedule is the number of workers to fetch tiles with from each of
+// its zoom levels on, in ascending zoom order.
+type workerSchedule struct {
+	zooms   []uint
+	workers []int
+}
+
+// parseWorkerSchedule parses a comma-separated list of {ZOOM}:{WORKERS} pairs,
+// such as "0:4,10:25,14:50", in ascending zoom order.
+func parseWorkerSchedule(str string) (*workerSchedule, error) {
+	schedule := &workerSchedule{}
+
+	for _, part := range strings.Split(str, ",") {
+		pair := strings.SplitN(strings.TrimSpace(part), ":", 2)
+
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("Invalid worker schedule entry %s, expected {ZOOM}:{WORKERS}", part)
+		}
+
+		z, err := strconv.ParseUint(pair[0], 10, 32)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse zoom (%s), %s", pair[0], err)
+		}
+
+		workers, err := strconv.Atoi(pair[1])
+
+		if err != nil || workers < 1 {
+			return nil, fmt.Errorf("Invalid number of workers %s", pair[1])
+		}
+
+		if n := len(schedule.zooms); n > 0 && uint(z) <= schedule.zooms[n-1] {
+			return nil, fmt.Errorf("Worker schedule zooms must be ascending, %d follows %d", z, schedule.zooms[n-1])
+		}
+
+		schedule.zooms = append(schedule.zooms, uint(z))
+		schedule.workers = append(schedule.workers, workers)
+	}
+
+	return schedule, nil
+}
+
+// workersFor returns the number of workers to fetch zoom's tiles with, or
+// defaultWorkers if zoom is below the schedule's first zoom.
+func (s *workerSchedule) workersFor(zoom uint, defaultWorkers int) int {
+	workers := defaultWorkers
+
+	for i, z := range s.zooms {
+		if z > zoom {
+			break
+		}
+
+		workers = s.workers[i]
+	}
+
+	return workers
+}
+
+// max returns the largest number of workers the schedule uses, or defaultWorkers
+// if that's more.
+func (s *workerSchedule) max(defaultWorkers int) int {
+	max := defaultWorkers
+
+	for _, workers := range s.workers {
+		if workers > max {
+			max = workers
+		}
+	}
+
+	return max
+}
+
+func processResults(waitGroup *sync.WaitGroup, results chan *tilepack.TileResponse, processor tilepack.TileOutputter, opts *tilepack.ProcessResultsOptions) {
 	defer waitGroup.Done()
 
-	start := time.Now()
+	opts.Progress = func(saved int, tps float64) {
+		tilepack.Logf(tilepack.LogLevelInfo, "Saved %dk tiles (%0.1f tiles per second)", saved/1000, tps)
+	}
+	opts.ProgressInterval = saveLogInterval
+
+	counter, err := tilepack.ProcessResults(results, processor, opts)
+	tilepack.Logf(tilepack.LogLevelInfo, "Saved %d tiles", counter)
+
+	if err != nil {
+		tilepack.Logf(tilepack.LogLevelError, "Error closing processor: %+v", err)
+	}
+}
+
+// skipExistingTiles forwards requests from queue to jobs, dropping the tiles that
+// checker already has, and closes jobs once queue has been closed.
+func skipExistingTiles(queue chan *tilepack.TileRequest, jobs chan *tilepack.TileRequest, checker tilepack.TileChecker) {
+	defer close(jobs)
+
+	skipped := 0
 
-	counter := 0
-	for result := range results {
-		err := processor.Save(result.Tile, result.Data)
+	for request := range queue {
+		exists, err := checker.HasTile(request.Tile)
 		if err != nil {
-			log.Printf("Couldn't save tile %+v", err)
+			tilepack.Logf(tilepack.LogLevelWarn, "Couldn't check for existing tile %s: %+v", request.Tile.ToString(), err)
+		}
+
+		if exists {
+			skipped++
+			continue
 		}
 
-		counter++
+		jobs <- request
+	}
+
+	tilepack.Logf(tilepack.LogLevelInfo, "Skipped %d existing tiles", skipped)
+}
 
-		if counter%saveLogInterval == 0 {
-			duration := time.Since(start)
-			start = time.Now()
-			log.Printf("Saved %dk tiles (%0.1f tiles per second)", counter/1000, saveLogInterval/duration.Seconds())
+// limitTiles forwards the first max requests from queue to jobs, dropping
+// the rest, and closes jobs once queue has been closed.
+func limitTiles(queue chan *tilepack.TileRequest, jobs chan *tilepack.TileRequest, max uint64) {
+	defer close(jobs)
+
+	var forwarded, dropped uint64
+
+	for request := range queue {
+		if forwarded == max {
+			if dropped == 0 {
+				tilepack.Logf(tilepack.LogLevelWarn, "Reached the -max-tiles limit of %d, not requesting any more tiles", max)
+			}
+
+			dropped++
+			continue
 		}
+
+		forwarded++
+		jobs <- request
+	}
+
+	if dropped > 0 {
+		tilepack.Logf(tilepack.LogLevelWarn, "Didn't request %d tiles over the -max-tiles limit", dropped)
 	}
-	log.Printf("Saved %d tiles", counter)
+}
+
+// fetchByZoom fetches the requests from queue with a new pool of workers,
+// started by start, each time their zoom level changes, waiting for the
+// previous pool to finish first. Requests ordered by zoom level therefore have
+// each zoom level fetched before the next begins.
+func fetchByZoom(queue chan *tilepack.TileRequest, workers func(zoom uint) int, start func(n int, jobs chan *tilepack.TileRequest) *sync.WaitGroup) {
+	var jobs chan *tilepack.TileRequest
+	var workerWG *sync.WaitGroup
+	var zoom uint
+
+	finish := func() {
+		close(jobs)
+		workerWG.Wait()
+		tilepack.Logf(tilepack.LogLevelInfo, "Finished requesting zoom %d", zoom)
+	}
+
+	for request := range queue {
+		if jobs == nil || request.Tile.Z != zoom {
+			if jobs != nil {
+				finish()
+			}
 
-	err := processor.Close()
+			zoom = request.Tile.Z
+			n := workers(zoom)
+
+			tilepack.Logf(tilepack.LogLevelInfo, "Requesting zoom %d with %d workers", zoom, n)
+
+			jobs = make(chan *tilepack.TileRequest, 2000)
+			workerWG = start(n, jobs)
+		}
+
+		jobs <- request
+	}
+
+	if jobs != nil {
+		finish()
+	}
+}
+
+// printJobs writes the URL of every job jobCreator creates to w instead of
+// fetching it.
+func printJobs(w io.Writer, jobCreator tilepack.JobGenerator) error {
+	jobs := make(chan *tilepack.TileRequest, 2000)
+	done := make(chan error)
+
+	go func() {
+		err := jobCreator.CreateJobs(jobs)
+		close(jobs)
+		done <- err
+	}()
+
+	buf := bufio.NewWriter(w)
+
+	for request := range jobs {
+		fmt.Fprintln(buf, request.URL)
+	}
+
+	err := <-done
 	if err != nil {
-		log.Printf("Error closing processor: %+v", err)
+		return err
 	}
+
+	return buf.Flush()
 }
 
 func main() {
 	generatorStr := flag.String("generator", "xyz", "Which tile fetcher to use. Options are xyz, metatile, tapalcatl2.")
 	fileTransportRoot := flag.String("file-transport-root", "", "The root directory for tiles if -url-template defines a file:// URL scheme")
-	outputMode := flag.String("output-mode", "mbtiles", "Valid modes are: disk, mbtiles.")
+	outputMode := flag.String("output-mode", "mbtiles", "Valid modes are: disk, mbtiles, pmtiles.")
 	outputDSN := flag.String("dsn", "", "Path, or DSN string, to output files.")
-	boundingBoxStr := flag.String("bounds", "-90.0,-180.0,90.0,180.0", "Comma-separated bounding box in south,west,north,east format. Defaults to the whole world.")
-	zoomsStr := flag.String("zooms", "0,1,2,3,4,5,6,7,8,9,10", "Comma-separated list of zoom levels or a '{MIN_ZOOM}-{MAX_ZOOM}' range string.")
+	checkpointInterval := flag.Duration("checkpoint-interval", 0, "How often to flush saved tiles to the output, e.g. 5m. For mbtiles output, this commits them, so that a crash loses at most one interval of tiles. By default tiles are only committed as the output requires. Disk output writes each tile as it's saved, so the interval only sets how often -state is updated. Not supported by the pmtiles output mode, which is only written when the build finishes.")
+	batchSize := flag.Int("batch-size", tilepack.DefaultMbtilesBatchSize, "(For mbtiles output) Number of tiles to save in each transaction. Larger batches load faster, but more downloaded tiles are lost if the build is killed before a batch is committed.")
+	pageSize := flag.Int("page-size", tilepack.DefaultMbtilesPageSize, "(For mbtiles output) SQLite page size in bytes, a power of two from 512 to 65536. Larger pages can make very large archives faster to build and smaller. Only applies to new archives, the page size is fixed once the schema is created.")
+	cacheSize := flag.Int("cache-size", tilepack.DefaultMbtilesCacheSize, "(For mbtiles output) SQLite cache size, in pages if positive or in KiB if negative.")
+	vacuum := flag.Bool("vacuum", false, "(For mbtiles output) Run VACUUM and ANALYZE once the build is done, to compact the archive and speed up queries of it. Needs as much free disk space as the archive takes up.")
+	geojsonPath := flag.String("geojson", "", "Path to a GeoJSON file of (Multi)Polygons to fetch tiles for instead of -bounds. With the xyz generator only tiles that intersect the polygons are fetched, otherwise their bounding box is used.")
+	boundingBoxStr := flag.String("bounds", "-90.0,-180.0,90.0,180.0", "Comma-separated bounding box in south,west,north,east format. Defaults to the whole world. Separate several boxes with ; to fetch each of them, overlaps only once (xyz generator only).")
+	zoomsStr := flag.String("zooms", "0,1,2,3,4,5,6,7,8,9,10", "Comma-separated list of zoom levels and '{MIN_ZOOM}-{MAX_ZOOM}' ranges, e.g. 0-5,7,9-11.")
 	numTileFetchWorkers := flag.Int("workers", 25, "Number of tile fetch workers to use.")
+	zoomByZoom := flag.Bool("zoom-by-zoom", false, "Request each zoom level's tiles before starting on the next, in ascending order, so an interrupted build has whole zoom levels up to the one it was requesting. With -tile-list, tiles are requested in the order they're listed, starting anew at each change of zoom level.")
+	workersPerZoomStr := flag.String("workers-per-zoom", "", "Comma-separated {ZOOM}:{WORKERS} pairs, e.g. 0:4,10:25,14:50, giving the number of workers to request the tiles from each zoom level on with. Zooms below the first use -workers. Implies -zoom-by-zoom.")
 	requestTimeout := flag.Int("timeout", 60, "HTTP client timeout for tile requests.")
 	cpuProfile := flag.String("cpuprofile", "", "Enables CPU profiling. Saves the dump to the given path.")
 	invertedY := flag.Bool("inverted-y", false, "Invert the Y-value of tiles to match the TMS (as opposed to ZXY) tile format.")
-	urlTemplateStr := flag.String("url-template", "", "(For xyz generator) URL template to make tile requests with. If URL template begins with file:// you must pass the -file-transport-root flag.")
+	urlTemplateStr := flag.String("url-template", "", "(For xyz generator) URL template to make tile requests with. It may contain the {z}, {x}, {y}, {-y} (TMS row, regardless of -inverted-y), {q} (Bing quadkey), {s} (see -subdomains) and {r} (see -scale) tokens. If URL template begins with file:// you must pass the -file-transport-root flag.")
 	layerNameStr := flag.String("layer-name", "", "(For metatile, tapalcatl2 generator) The layer name to use for hash building.")
 	pathTemplateStr := flag.String("path-template", "", "(For metatile, tapalcatl2 generator) The template to use for the path part of the S3 path to the t2 archive.")
 	bucketStr := flag.String("bucket", "", "(For metatile, tapalcatl2 generator) The name of the S3 bucket to request t2 archives from.")
+	subdomainsStr := flag.String("subdomains", "", "(For xyz generator) Comma-separated list of subdomains to substitute for the {s} token in the URL template, e.g. a,b,c.")
+	scale := flag.Int("scale", 1, "(For xyz generator) Pixel ratio of the tiles to request, 1 or 2. The {r} token in the URL template is replaced with @2x when it is 2. The scale is recorded in the output metadata.")
+	userAgent := flag.String("user-agent", tilepack.DefaultUserAgent, "(For xyz generator) The User-Agent header to send with tile requests. Some providers ask for one that identifies you.")
+	requestHeaders := &headersFlag{}
+	flag.Var(requestHeaders, "header", "(For xyz generator) A \"Name: Value\" HTTP header to send with every tile request, e.g. for API keys. May be repeated.")
+	metadata := &metadataFlag{}
+	flag.Var(metadata, "metadata", "A name=value pair, such as name=Basemap or attribution=..., to add to the output's metadata, replacing any value the build would set. May be repeated. Unless it's set, the format is taken from the -url-template extension, or otherwise from the tiles themselves.")
+	bearerToken := flag.String("bearer-token", "", "(For xyz generator) A token to send with every tile request in an \"Authorization: Bearer\" header.")
+	basicAuth := flag.String("basic-auth", "", "(For xyz generator) Credentials, in the form user:pass, to send with every tile request in an \"Authorization: Basic\" header.")
+	retries := flag.Int("retries", tilepack.DefaultRetries, "(For xyz generator) Number of times to attempt a tile request that fails with a server error or is rate limited. A Retry-After header in the response is honored.")
+	retryInitialDelay := flag.Duration("retry-initial-delay", tilepack.DefaultRetryInitialDelay, "(For xyz generator) The longest time to wait before retrying a failed tile request. It doubles with each retry, and each wait is a random time up to it.")
+	retryMaxDelay := flag.Duration("retry-max-delay", tilepack.DefaultRetryMaxDelay, "(For xyz generator) The maximum delay between retries of a failed tile request. A longer Retry-After is still honored, unless it ends after -tile-deadline.")
+	tileDeadline := flag.Duration("tile-deadline", 0, "(For xyz generator) If set, the longest to spend on a tile across all of its retries, e.g. 2m, after which it's abandoned and recorded in -failures. -timeout only limits each attempt.")
+	maxIdleConnsPerHost := flag.Int("max-idle-conns-per-host", 0, "(For xyz generator) Number of keep-alive connections to keep open to each tile server. Defaults to the number of -workers.")
+	proxyStr := flag.String("proxy", "", "(For xyz generator) URL of a proxy to make tile requests through, e.g. http://host:port or socks5://host:port. Defaults to the HTTP_PROXY and HTTPS_PROXY environment variables.")
+	rateLimit := flag.Float64("rate-limit", 0, "(For xyz generator) Maximum number of requests per second made by all workers together, including retries. 0 means unlimited.")
+	jitter := flag.Duration("jitter", tilepack.DefaultJitter, "(For xyz generator) Maximum random time each worker waits after fetching a tile, to avoid requesting tiles in lockstep. 0 disables it.")
+	gzipLevel := flag.Int("gzip-level", 0, "(For xyz generator) Compression level, 1 (fastest) to 9 (smallest), for tiles that are gzipped locally because the server didn't gzip them. Tiles the server gzipped are saved as they are. Defaults to gzip's default level, 6.")
+	storeGzip := flag.Bool("store-gzip", true, "(For xyz generator) Store tiles gzipped, gzipping any the server didn't. If false, tiles are stored uncompressed. Tiles are requested with gzip either way.")
+	expectContentType := flag.String("expect-content-type", "", "(For xyz generator) The Content-Type tile responses must have, e.g. application/x-protobuf or image/png. Other responses, such as HTML error pages, are treated as failed requests.")
+	failuresPath := flag.String("failures", "", "(For xyz generator) Path to a file to record tiles that could not be fetched in, as z/x/y lines.")
+	tileListPath := flag.String("tile-list", "", "(For xyz generator) Path to a file of z/x/y lines (for example a -failures file) listing the tiles to fetch, or - for stdin. If set, -bounds and -zooms are ignored.")
+	tilesFromStdin := flag.Bool("tiles-from-stdin", false, "(For xyz generator) Fetch the tiles listed in z/x/y lines on stdin as they arrive, until it's closed. The same as -tile-list -.")
+	statsPath := flag.String("stats", "", "Path to a CSV file to record the z, x, y, size in bytes, fetch time in seconds and HTTP status of every saved tile in.")
+	extend := flag.Bool("extend", false, "(For mbtiles output) Add tiles to the existing mbtiles at -dsn. Unless -bounds (or -geojson) and -zooms are set, they default to the bounds and zoom range in its metadata. The metadata is updated to cover the existing and new tiles.")
+	statePath := flag.String("state", "", "(For xyz generator) Path to a SQLite file recording the tiles that have been saved, created if it doesn't exist. Tiles already recorded in it aren't requested, so interrupted disk or mbtiles builds can be resumed by re-running them with the same flags, without querying the output. Saved tiles are recorded each -checkpoint-interval, which defaults to 5m with -state.")
+	skipExisting := flag.Bool("skip-existing", false, "(For xyz generator) Don't request tiles that are already in the output. This makes interrupted builds resumable by re-running them with the same flags.")
+	skipEmpty := flag.Bool("skip-empty", false, "Don't save empty tiles, as identified by -empty-tile or -min-tile-size. Gzipped tiles are compared once uncompressed.")
+	emptyTilePath := flag.String("empty-tile", "", "(With -skip-empty) Path to an empty tile. Tiles identical to it aren't saved.")
+	minTileSize := flag.Int("min-tile-size", 0, "(With -skip-empty) Tiles smaller than this many bytes aren't saved.")
+	recompress := flag.Bool("recompress", false, "Re-encode PNG tiles at the best compression level, as paletted images if they have no more than 256 colors, and JPEG tiles at -jpeg-quality, before they're saved. Tiles are only replaced if they get smaller.")
+	jpegQuality := flag.Int("jpeg-quality", 85, "(With -recompress) The quality, 1 to 100, to re-encode JPEG tiles at.")
+	vectorLayers := flag.Int("vector-layers", 0, "If set, describe the layers of vector tiles, and the types of their fields, in the output's json metadata, as decoded from up to this many tiles at each zoom. Layers only found in other tiles are missed. Ignored if -metadata sets json.")
+	verifyAfter := flag.Bool("verify-after", false, "(For mbtiles output) Once the build is done, check that the output has every tile in -bounds and -zooms, logging how many are missing at each zoom. Exits with an error if any are.")
+	maxTiles := flag.Uint64("max-tiles", 0, "If set, the maximum number of tiles to request. Builds of -bounds and -zooms that would request more refuse to start. Otherwise, such as with -geojson, -tile-list, -skip-existing or -state, no more tiles are requested once the limit is reached.")
+	logLevelStr := flag.String("log-level", "info", "The least important messages to log: error, warn, info or debug.")
+	dryRun := flag.Bool("dry-run", false, "Print the URLs that would be requested to stdout, along with an estimate of the number of tiles per zoom, instead of fetching them. No output is written.")
 	materializedZoomsStr := flag.String("materialized-zooms", "", "(For tapalcatl2 generator) Specifies the materialized zooms for t2 archives.")
 	flag.Parse()
 
+	logLevel, err := tilepack.ParseLogLevel(*logLevelStr)
+	if err != nil {
+		log.Fatalf("%+v", err)
+	}
+
+	tilepack.SetLogLevel(logLevel)
+
 	if *cpuProfile != "" {
 		f, err := os.Create(*cpuProfile)
 		if err != nil {
@@ -76,100 +619,287 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
-	if *outputDSN == "" {
+	if *outputDSN == "" && !*dryRun {
 		log.Fatalf("Output DSN (-dsn) is required")
 	}
 
-	boundingBoxStrSplit := strings.Split(*boundingBoxStr, ",")
-	if len(boundingBoxStrSplit) != 4 {
-		log.Fatalf("Bounding box string must be a comma-separated list of 4 numbers")
+	if *rateLimit < 0 || *jitter < 0 || *maxIdleConnsPerHost < 0 {
+		log.Fatalf("-rate-limit, -jitter and -max-idle-conns-per-host must not be negative")
+	}
+
+	if *tilesFromStdin {
+		if *tileListPath != "" && *tileListPath != "-" {
+			log.Fatalf("-tiles-from-stdin can't be used with -tile-list")
+		}
+
+		if *generatorStr != "xyz" {
+			log.Fatalf("-tiles-from-stdin is only supported by the xyz generator")
+		}
+
+		*tileListPath = "-"
 	}
 
-	boundingBoxFloats := make([]float64, 4)
-	for i, bboxStr := range boundingBoxStrSplit {
-		bboxStr = strings.TrimSpace(bboxStr)
-		bboxFloat, err := strconv.ParseFloat(bboxStr, 64)
+	var workersPerZoom *workerSchedule
+
+	if *workersPerZoomStr != "" {
+		workersPerZoom, err = parseWorkerSchedule(*workersPerZoomStr)
 		if err != nil {
-			log.Fatalf("Bounding box string could not be parsed as numbers")
+			log.Fatalf("Failed to parse -workers-per-zoom: %+v", err)
 		}
 
-		boundingBoxFloats[i] = bboxFloat
+		*zoomByZoom = true
+	}
+
+	if *batchSize < 1 {
+		log.Fatalf("-batch-size must be at least 1")
+	}
+
+	if *retries < 1 || *retryInitialDelay <= 0 || *retryMaxDelay < *retryInitialDelay {
+		log.Fatalf("-retries must be at least 1 and -retry-max-delay must be no less than -retry-initial-delay")
+	}
+
+	if *tileDeadline < 0 {
+		log.Fatalf("-tile-deadline must not be negative")
 	}
 
-	bounds := &tilepack.LngLatBbox{
-		South: boundingBoxFloats[0],
-		West:  boundingBoxFloats[1],
-		North: boundingBoxFloats[2],
-		East:  boundingBoxFloats[3],
+	authorization, err := authorizationHeader(*bearerToken, *basicAuth)
+
+	if err != nil {
+		log.Fatalf("%+v", err)
 	}
 
-	var zooms []uint
+	if authorization != "" {
+		if requestHeaders.headers.Get("Authorization") != "" {
+			log.Fatalf("-bearer-token and -basic-auth can't be used with an Authorization -header")
+		}
 
-	re_zoom, re_err := regexp.Compile(`^\d+\-\d+$`)
+		if requestHeaders.headers == nil {
+			requestHeaders.headers = make(http.Header)
+		}
 
-	if re_err != nil {
-		log.Fatal("Failed to compile zoom range regular expression")
+		requestHeaders.headers.Set("Authorization", authorization)
 	}
 
-	if re_zoom.MatchString(*zoomsStr) {
+	boxes, err := parseBounds(*boundingBoxStr)
 
-		zoom_range := strings.Split(*zoomsStr, "-")
+	if err != nil {
+		log.Fatalf("%+v", err)
+	}
 
-		min_zoom, err := strconv.ParseUint(zoom_range[0], 10, 32)
+	bounds := unionBounds(boxes)
 
+	// A single box is just the bounds
+	if len(boxes) == 1 {
+		boxes = nil
+	}
+
+	var area *tilepack.Polygons
+
+	if *geojsonPath != "" {
+		geojsonData, err := ioutil.ReadFile(*geojsonPath)
 		if err != nil {
-			log.Fatalf("Failed to parse min zoom (%s), %s\n", zoom_range[0], err)
+			log.Fatalf("Couldn't read GeoJSON file: %+v", err)
 		}
 
-		max_zoom, err := strconv.ParseUint(zoom_range[1], 10, 32)
-
+		area, err = tilepack.ParseGeoJSONPolygons(geojsonData)
 		if err != nil {
-			log.Fatalf("Failed to parse max zoom (%s), %s\n", zoom_range[1], err)
+			log.Fatalf("Couldn't parse GeoJSON file: %+v", err)
 		}
 
-		if min_zoom > max_zoom {
-			log.Fatal("Invalid zoom range")
+		bounds = area.Bounds()
+		boxes = nil
+	}
+
+	if len(boxes) > 1 && *generatorStr != "xyz" {
+		log.Fatalf("Multiple -bounds are only supported by the xyz generator")
+	}
+
+	// A pmtiles archive is only written when it's closed, so flushing it
+	// couldn't save any tiles from a crash
+	if *checkpointInterval > 0 && *outputMode == "pmtiles" {
+		log.Fatalf("-checkpoint-interval is not supported by the pmtiles output mode")
+	}
+
+	if *verifyAfter {
+		if *outputMode != "mbtiles" {
+			log.Fatalf("-verify-after is only supported by the mbtiles output mode")
+		}
+
+		// The number of tiles expected is only known for plain bounds and zooms
+		if *extend || *tileListPath != "" || *geojsonPath != "" || *skipEmpty {
+			log.Fatalf("-verify-after can't be used with -extend, -tile-list, -geojson or -skip-empty")
 		}
+	}
 
-		zooms = make([]uint, 0)
+	zooms, err := parseZooms(*zoomsStr)
 
-		for z := min_zoom; z <= max_zoom; z++ {
-			zooms = append(zooms, uint(z))
+	if err != nil {
+		log.Fatalf("Zoom list could not be parsed: %+v", err)
+	}
+
+	var extendBounds *tilepack.LngLatBbox
+	var extendMinZoom, extendMaxZoom uint
+
+	if *extend {
+		if *outputMode != "mbtiles" {
+			log.Fatalf("-extend is only supported by the mbtiles output mode")
 		}
 
-	} else {
+		extendBounds, extendMinZoom, extendMaxZoom, err = readExtent(*outputDSN)
 
-		zoomsStrSplit := strings.Split(*zoomsStr, ",")
-		zooms = make([]uint, len(zoomsStrSplit))
-		for i, zoomStr := range zoomsStrSplit {
-			z, err := strconv.ParseUint(zoomStr, 10, 32)
-			if err != nil {
-				log.Fatalf("Zoom list could not be parsed: %+v", err)
+		if err != nil {
+			log.Fatalf("Couldn't read the mbtiles to extend: %+v", err)
+		}
+
+		set := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) {
+			set[f.Name] = true
+		})
+
+		if !set["bounds"] && !set["geojson"] {
+			bounds = extendBounds
+		}
+
+		if !set["zooms"] {
+			zooms = make([]uint, 0)
+			for z := extendMinZoom; z <= extendMaxZoom; z++ {
+				zooms = append(zooms, z)
 			}
+		}
+	}
 
-			zooms[i] = uint(z)
+	minZoom := zooms[0]
+	maxZoom := zooms[0]
+
+	for _, z := range zooms {
+		if z < minZoom {
+			minZoom = z
+		}
+		if z > maxZoom {
+			maxZoom = z
+		}
+	}
+
+	// The metadata describes every tile in the output, including those that
+	// are already there
+	metadataBounds := bounds
+
+	if extendBounds != nil {
+		metadataBounds = unionBounds([]*tilepack.LngLatBbox{bounds, extendBounds})
+
+		if extendMinZoom < minZoom {
+			minZoom = extendMinZoom
+		}
+
+		if extendMaxZoom > maxZoom {
+			maxZoom = extendMaxZoom
 		}
 	}
 
 	var jobCreator tilepack.JobGenerator
-	var err error
 	switch *generatorStr {
 	case "xyz":
 		if *urlTemplateStr == "" {
 			log.Fatalf("URL template is required")
 		}
 
+		var failures *tilepack.TileListWriter
+
+		if *failuresPath != "" {
+			failuresFile, err := os.Create(*failuresPath)
+			if err != nil {
+				log.Fatalf("Couldn't create failures file: %+v", err)
+			}
+			defer failuresFile.Close()
+
+			failures = tilepack.NewTileListWriter(failuresFile)
+		}
+
+		var tileList *os.File
+
+		if *tileListPath == "-" {
+			tileList = os.Stdin
+
+			tilepack.Logf(tilepack.LogLevelInfo, "Reading tiles from stdin, ignoring -bounds and -zooms")
+		} else if *tileListPath != "" {
+			tileList, err = os.Open(*tileListPath)
+			if err != nil {
+				log.Fatalf("Couldn't open tile list: %+v", err)
+			}
+			defer tileList.Close()
+
+			tilepack.Logf(tilepack.LogLevelInfo, "Reading tiles from %s, ignoring -bounds and -zooms", *tileListPath)
+		}
+
+		xyzOpts := &tilepack.XYZJobGeneratorOptions{
+			URLTemplate: *urlTemplateStr,
+			Bounds:      bounds,
+			Boxes:       boxes,
+			Zooms:       zooms,
+			HTTPTimeout: time.Duration(*requestTimeout) * time.Second,
+			InvertedY:   *invertedY,
+			UserAgent:   *userAgent,
+			Headers:     requestHeaders.headers,
+
+			Retries:           *retries,
+			RetryInitialDelay: *retryInitialDelay,
+			RetryMaxDelay:     *retryMaxDelay,
+			TileDeadline:      *tileDeadline,
+
+			MaxIdleConnsPerHost: *maxIdleConnsPerHost,
+			RateLimit:           *rateLimit,
+			Jitter:              *jitter,
+			Scale:               *scale,
+			ExpectContentType:   *expectContentType,
+			GzipLevel:           *gzipLevel,
+			Uncompressed:        !*storeGzip,
+
+			Failures: failures,
+			Area:     area,
+		}
+
+		if tileList != nil {
+			xyzOpts.TileList = tileList
+		}
+
 		if strings.HasPrefix(*urlTemplateStr, "file://") {
 
 			if *fileTransportRoot == "" {
 				log.Fatalf("-file-transport-root flag is required when URL template uses file://")
 			}
 
-			jobCreator, err = tilepack.NewFileTransportXYZJobGenerator(*fileTransportRoot, *urlTemplateStr, bounds, zooms, time.Duration(*requestTimeout)*time.Second, *invertedY)
-		} else {
-			jobCreator, err = tilepack.NewXYZJobGenerator(*urlTemplateStr, bounds, zooms, time.Duration(*requestTimeout)*time.Second, *invertedY)
+			xyzOpts.FileTransportRoot = *fileTransportRoot
+		}
+
+		if xyzOpts.MaxIdleConnsPerHost == 0 {
+			xyzOpts.MaxIdleConnsPerHost = *numTileFetchWorkers
+
+			if workersPerZoom != nil {
+				xyzOpts.MaxIdleConnsPerHost = workersPerZoom.max(*numTileFetchWorkers)
+			}
+		}
+
+		if *proxyStr != "" {
+			proxyURL, err := url.Parse(*proxyStr)
+			if err != nil {
+				log.Fatalf("Couldn't parse proxy URL: %+v", err)
+			}
+
+			switch proxyURL.Scheme {
+			case "http", "https", "socks5":
+			default:
+				log.Fatalf("Proxy URL must use the http, https or socks5 scheme")
+			}
+
+			xyzOpts.Proxy = proxyURL
 		}
 
+		if *subdomainsStr != "" {
+			xyzOpts.Subdomains = strings.Split(*subdomainsStr, ",")
+		}
+
+		jobCreator, err = tilepack.NewXYZJobGeneratorWithOptions(xyzOpts)
+
 	case "metatile":
 		if *bucketStr == "" {
 			log.Fatalf("Bucket name is required")
@@ -224,6 +954,44 @@ func main() {
 		log.Fatalf("Failed to create jobCreator: %s", err)
 	}
 
+	if *dryRun {
+		if *tileListPath == "" {
+			var total uint64
+
+			for _, z := range zooms {
+				count, err := tilepack.CountTiles(&tilepack.GenerateTilesOptions{Bounds: bounds, Boxes: boxes, Zooms: []uint{z}})
+				if err != nil {
+					log.Fatalf("Couldn't count tiles: %+v", err)
+				}
+
+				tilepack.Logf(tilepack.LogLevelInfo, "Zoom %d: %d tiles", z, count)
+				total += count
+			}
+
+			tilepack.Logf(tilepack.LogLevelInfo, "Total: %d tiles", total)
+		}
+
+		err = printJobs(os.Stdout, jobCreator)
+		if err != nil {
+			log.Fatalf("Failed to create jobs: %+v", err)
+		}
+
+		return
+	}
+
+	// Builds whose tiles can all be counted up front are checked before
+	// anything is created, others are limited as tiles are requested
+	if *maxTiles > 0 && *tileListPath == "" && *geojsonPath == "" && !*skipExisting && *statePath == "" {
+		count, err := tilepack.CountTiles(&tilepack.GenerateTilesOptions{Bounds: bounds, Boxes: boxes, Zooms: zooms})
+		if err != nil {
+			log.Fatalf("Couldn't count tiles: %+v", err)
+		}
+
+		if count > *maxTiles {
+			log.Fatalf("This build would request %d tiles, exceeding the -max-tiles limit of %d", count, *maxTiles)
+		}
+	}
+
 	var outputter tilepack.TileOutputter
 	var outputter_err error
 
@@ -231,7 +999,14 @@ func main() {
 	case "disk":
 		outputter, outputter_err = tilepack.NewDiskOutputter(*outputDSN)
 	case "mbtiles":
-		outputter, outputter_err = tilepack.NewMbtilesOutputter(*outputDSN)
+		outputter, outputter_err = tilepack.NewMbtilesOutputterWithOptions(*outputDSN, &tilepack.MbtilesOutputterOptions{
+			BatchSize: *batchSize,
+			PageSize:  *pageSize,
+			CacheSize: *cacheSize,
+			Optimize:  *vacuum,
+		})
+	case "pmtiles":
+		outputter, outputter_err = tilepack.NewPMTilesOutputter(*outputDSN)
 	default:
 		log.Fatalf("Unknown outputter: %s", *outputMode)
 	}
@@ -240,49 +1015,301 @@ func main() {
 		log.Fatalf("Couldn't create %s output: %+v", *outputMode, outputter_err)
 	}
 
+	// Metadata is written once, up front, rather than as tiles are saved.
+	// Without a tile list it can be filled in from the flags, otherwise
+	// outputters that can derive it from the tiles themselves do so.
+	if metadataOutputter, ok := outputter.(tilepack.MetadataOutputter); ok && *tileListPath == "" {
+		err = metadataOutputter.AssignMetadata(metadataBounds, minZoom, maxZoom)
+
+		if err != nil {
+			log.Fatalf("Couldn't assign %s metadata: %+v", *outputMode, err)
+		}
+	}
+
+	if metadataSetter, ok := outputter.(tilepack.MetadataSetter); ok {
+		values := make(map[string]string)
+
+		if *generatorStr == "xyz" {
+			values["scale"] = strconv.Itoa(*scale)
+
+			values["compression"] = "gzip"
+			if !*storeGzip {
+				values["compression"] = "none"
+			}
+
+			// Tiles may be gzipped as they're fetched, which hides their format
+			// from the outputters. Disk outputs use the format they're given.
+			if format := urlTemplateFormat(*urlTemplateStr); format != "" && *outputMode != "disk" {
+				values["format"] = format
+			}
+		}
+
+		for name, value := range metadata.values {
+			values[name] = value
+		}
+
+		names := make([]string, 0, len(values))
+		for name := range values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			err = metadataSetter.SetMetadata(name, values[name])
+
+			if err != nil {
+				log.Fatalf("Couldn't assign %s metadata: %+v", *outputMode, err)
+			}
+		}
+	} else if len(metadata.values) > 0 {
+		log.Fatalf("-metadata is not supported by the %s output mode", *outputMode)
+	}
+
 	err = outputter.CreateTiles()
 
 	if err != nil {
 		log.Fatalf("Failed to create %s output: %+v", *outputMode, err)
 	}
 
-	log.Printf("Created %s output\n", *outputMode)
+	tilepack.Logf(tilepack.LogLevelInfo, "Created %s output\n", *outputMode)
+
+	// Tiles are checked against each of these in turn, cheapest first
+	var tileCheckers []tilepack.TileChecker
+	var state *tilepack.CrawlState
+
+	if *statePath != "" {
+		if *generatorStr != "xyz" {
+			log.Fatalf("-state is only supported by the xyz generator")
+		}
+
+		// PMTiles archives are only written once every tile has been saved
+		if *outputMode == "pmtiles" {
+			log.Fatalf("-state is not supported by the pmtiles output mode")
+		}
+
+		state, err = tilepack.NewCrawlState(*statePath)
+		if err != nil {
+			log.Fatalf("Couldn't open state file: %+v", err)
+		}
+		defer state.Close()
+
+		tileCheckers = append(tileCheckers, state)
+
+		// The state is only updated when the output is flushed
+		if *checkpointInterval == 0 {
+			*checkpointInterval = defaultStateCheckpointInterval
+		}
+	}
+
+	if *skipExisting {
+		if *generatorStr != "xyz" {
+			log.Fatalf("-skip-existing is only supported by the xyz generator")
+		}
+
+		checker, ok := outputter.(tilepack.TileChecker)
+		if !ok {
+			log.Fatalf("-skip-existing is not supported by the %s output mode", *outputMode)
+		}
+
+		tileCheckers = append(tileCheckers, checker)
+	}
+
+	var stats *tilepack.StatsWriter
+
+	if *statsPath != "" {
+		statsFile, err := os.Create(*statsPath)
+		if err != nil {
+			log.Fatalf("Couldn't create stats file: %+v", err)
+		}
+		defer statsFile.Close()
+
+		stats, err = tilepack.NewStatsWriter(statsFile)
+		if err != nil {
+			log.Fatalf("Couldn't write stats file: %+v", err)
+		}
+	}
+
+	resultsOpts := &tilepack.ProcessResultsOptions{
+		CheckpointInterval: *checkpointInterval,
+		Stats:              stats,
+		State:              state,
+	}
+
+	if *skipEmpty {
+		if *emptyTilePath == "" && *minTileSize <= 0 {
+			log.Fatalf("-skip-empty requires -empty-tile or -min-tile-size")
+		}
+
+		if *emptyTilePath != "" {
+			emptyTile, err := ioutil.ReadFile(*emptyTilePath)
+			if err != nil {
+				log.Fatalf("Couldn't read empty tile: %+v", err)
+			}
+
+			resultsOpts.EmptyTile = emptyTile
+		}
+
+		resultsOpts.MinSize = *minTileSize
+	}
+
+	if *recompress {
+		if *jpegQuality < 1 || *jpegQuality > 100 {
+			log.Fatalf("-jpeg-quality must be between 1 and 100")
+		}
+
+		resultsOpts.Recompress = &tilepack.RecompressOptions{
+			JPEGQuality: *jpegQuality,
+			PNG:         true,
+		}
+	}
+
+	if *vectorLayers < 0 {
+		log.Fatalf("-vector-layers must not be negative")
+	}
+
+	if _, ok := metadata.values["json"]; *vectorLayers > 0 && !ok {
+		resultsOpts.VectorLayers = tilepack.NewVectorLayers(*vectorLayers)
+	}
 
 	jobs := make(chan *tilepack.TileRequest, 2000)
 	results := make(chan *tilepack.TileResponse, 2000)
 
-	// Start up the HTTP workers that will fetch tiles
-	workerWG := &sync.WaitGroup{}
-	for w := 0; w < *numTileFetchWorkers; w++ {
-		worker, err := jobCreator.CreateWorker()
-		if err != nil {
-			log.Fatalf("Couldn't create %s worker: %+v", *generatorStr, err)
+	// startWorkers starts n HTTP workers fetching tiles from jobs
+	startWorkers := func(n int, jobs chan *tilepack.TileRequest) *sync.WaitGroup {
+		workerWG := &sync.WaitGroup{}
+
+		for w := 0; w < n; w++ {
+			worker, err := jobCreator.CreateWorker()
+			if err != nil {
+				log.Fatalf("Couldn't create %s worker: %+v", *generatorStr, err)
+			}
+
+			workerWG.Add(1)
+
+			go func(id int) {
+				defer workerWG.Done()
+				worker(id, jobs, results)
+			}(w)
 		}
 
+		return workerWG
+	}
+
+	// Start up the HTTP workers that will fetch tiles, or the goroutine that
+	// starts them for each zoom level in turn
+	var workerWG *sync.WaitGroup
+
+	if *zoomByZoom {
+		workers := func(zoom uint) int {
+			if workersPerZoom == nil {
+				return *numTileFetchWorkers
+			}
+
+			return workersPerZoom.workersFor(zoom, *numTileFetchWorkers)
+		}
+
+		workerWG = &sync.WaitGroup{}
+		workerWG.Add(1)
+
 		go func() {
-			workerWG.Add(1)
 			defer workerWG.Done()
-			worker(w, jobs, results)
+			fetchByZoom(jobs, workers, startWorkers)
 		}()
+	} else {
+		workerWG = startWorkers(*numTileFetchWorkers, jobs)
 	}
 
 	// Start the worker that receives data from HTTP workers
 	resultWG := &sync.WaitGroup{}
 	resultWG.Add(1)
-	go processResults(resultWG, results, outputter)
+	go processResults(resultWG, results, outputter, resultsOpts)
 
-	jobCreator.CreateJobs(jobs)
+	// Jobs are queued straight to the workers unless existing tiles need to be
+	// filtered out, or the number of tiles limited, first
+	queue := jobs
+
+	// Only the tiles that are requested count towards the limit
+	if *maxTiles > 0 {
+		queue = make(chan *tilepack.TileRequest, 2000)
+		go limitTiles(queue, jobs, *maxTiles)
+	}
+
+	for i := len(tileCheckers) - 1; i >= 0; i-- {
+		next := queue
+		queue = make(chan *tilepack.TileRequest, 2000)
+		go skipExistingTiles(queue, next, tileCheckers[i])
+	}
+
+	// On the first interrupt stop adding jobs and let the tiles that are being
+	// fetched be saved, so the output is closed cleanly. On the second, give up.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-signals
+		tilepack.Logf(tilepack.LogLevelWarn, "Interrupted, saving the tiles being fetched. Interrupt again to exit immediately.")
+		cancel()
+
+		<-signals
+		log.Fatal("Interrupted again, exiting without closing the output")
+	}()
 
 	// Add tile request jobs
-	close(jobs)
-	log.Print("Job queue closed")
+	err = jobCreator.CreateJobsWithContext(ctx, queue)
+	if err != nil && ctx.Err() == nil {
+		tilepack.Logf(tilepack.LogLevelError, "Failed to create jobs: %+v", err)
+	}
+
+	close(queue)
+	tilepack.Logf(tilepack.LogLevelDebug, "Job queue closed")
+
+	// Don't fetch the jobs that were queued but not yet started
+	if ctx.Err() != nil {
+		go func() {
+			for range jobs {
+			}
+		}()
+	}
 
 	// When the workers are done, close the results channel
 	workerWG.Wait()
 	close(results)
-	log.Print("Finished making tile requests")
+	tilepack.Logf(tilepack.LogLevelInfo, "Finished making tile requests")
+
+	// Generators sharing state between their pools of workers, like the xyz
+	// generator's rate limiter, release it once they've all finished
+	if closer, ok := jobCreator.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			tilepack.Logf(tilepack.LogLevelWarn, "Couldn't close the %s generator: %+v", *generatorStr, err)
+		}
+	}
 
 	// Wait for the results to be written out
 	resultWG.Wait()
-	log.Print("Finished processing tiles")
+	tilepack.Logf(tilepack.LogLevelInfo, "Finished processing tiles")
+
+	if *verifyAfter && ctx.Err() == nil {
+		missing, err := missingTiles(*outputDSN, bounds, boxes, zooms)
+		if err != nil {
+			log.Fatalf("Couldn't verify the output: %+v", err)
+		}
+
+		var total uint64
+
+		for _, z := range zooms {
+			if missing[z] > 0 {
+				tilepack.Logf(tilepack.LogLevelWarn, "Zoom %d: %d tiles missing", z, missing[z])
+				total += missing[z]
+			}
+		}
+
+		if total > 0 {
+			log.Fatalf("The output is missing %d tiles", total)
+		}
+
+		tilepack.Logf(tilepack.LogLevelInfo, "Verified the output has every tile")
+	}
 }
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/tilezen/go-tilepacks/tilepack"
+)
+
+func TestParseZooms(t *testing.T) {
+	tests := []struct {
+		str  string
+		want []uint
+	}{
+		{"0,1,2", []uint{0, 1, 2}},
+		{"0-3", []uint{0, 1, 2, 3}},
+		{"0-5,7,9-11", []uint{0, 1, 2, 3, 4, 5, 7, 9, 10, 11}},
+		{"9-11, 4, 10", []uint{4, 9, 10, 11}},
+		{"12", []uint{12}},
+	}
+
+	for _, test := range tests {
+		got, err := parseZooms(test.str)
+		if err != nil {
+			t.Errorf("parseZooms(%q) returned %v", test.str, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseZooms(%q) = %v, want %v", test.str, got, test.want)
+		}
+	}
+
+	for _, str := range []string{"", "a", "5-3", "1-", "1,,2"} {
+		if _, err := parseZooms(str); err == nil {
+			t.Errorf("parseZooms(%q) didn't return an error", str)
+		}
+	}
+}
+
+func TestParseWorkerSchedule(t *testing.T) {
+	schedule, err := parseWorkerSchedule("2:4, 10:25,14:50")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for zoom, want := range map[uint]int{0: 8, 2: 4, 9: 4, 10: 25, 13: 25, 14: 50, 20: 50} {
+		if got := schedule.workersFor(zoom, 8); got != want {
+			t.Errorf("workersFor(%d) = %d, want %d", zoom, got, want)
+		}
+	}
+
+	if got := schedule.max(8); got != 50 {
+		t.Errorf("max() = %d, want 50", got)
+	}
+
+	for _, str := range []string{"", "4", "a:4", "4:a", "4:0", "10:4,2:8", "4:4,4:8"} {
+		if _, err := parseWorkerSchedule(str); err == nil {
+			t.Errorf("parseWorkerSchedule(%q) didn't return an error", str)
+		}
+	}
+}
+
+func TestParseBounds(t *testing.T) {
+	boxes, err := parseBounds("37.6,-122.5,37.8,-122.3; 40.6,-74.1,40.9,-73.8")
+	if err != nil {
+		t.Fatalf("parseBounds returned %v", err)
+	}
+
+	want := []*tilepack.LngLatBbox{
+		{South: 37.6, West: -122.5, North: 37.8, East: -122.3},
+		{South: 40.6, West: -74.1, North: 40.9, East: -73.8},
+	}
+
+	if !reflect.DeepEqual(boxes, want) {
+		t.Errorf("parseBounds = %v, want %v", boxes, want)
+	}
+
+	union := unionBounds(boxes)
+	wantUnion := &tilepack.LngLatBbox{South: 37.6, West: -122.5, North: 40.9, East: -73.8}
+
+	if !reflect.DeepEqual(union, wantUnion) {
+		t.Errorf("unionBounds = %v, want %v", union, wantUnion)
+	}
+
+	for _, str := range []string{"", "1,2,3", "1,2,3,4;", "a,b,c,d"} {
+		if _, err := parseBounds(str); err == nil {
+			t.Errorf("parseBounds(%q) didn't return an error", str)
+		}
+	}
+}
+
+func TestMissingTiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "build")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dsn := filepath.Join(dir, "tiles.mbtiles")
+
+	outputter, err := tilepack.NewMbtilesOutputter(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := outputter.CreateTiles(); err != nil {
+		t.Fatal(err)
+	}
+
+	tiles := []*tilepack.Tile{{X: 0, Y: 0, Z: 0}, {X: 0, Y: 0, Z: 1}, {X: 1, Y: 1, Z: 1}}
+
+	for _, tile := range tiles {
+		if err := outputter.Save(tile, []byte(tile.ToString())); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := outputter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	world := &tilepack.LngLatBbox{West: -180, South: -85, East: 180, North: 85}
+
+	missing, err := missingTiles(dsn, world, nil, []uint{0, 1, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[uint]uint64{1: 2, 2: 16}
+
+	if !reflect.DeepEqual(missing, want) {
+		t.Errorf("missingTiles() = %v, want %v", missing, want)
+	}
+}
+
+func TestAuthorizationHeader(t *testing.T) {
+	tests := []struct {
+		bearerToken string
+		basicAuth   string
+		want        string
+		wantErr     bool
+	}{
+		{"", "", "", false},
+		{"abc123", "", "Bearer abc123", false},
+		{"", "Aladdin:open sesame", "Basic QWxhZGRpbjpvcGVuIHNlc2FtZQ==", false},
+		{"", "Aladdin", "", true},
+		{"abc123", "Aladdin:open sesame", "", true},
+	}
+
+	for _, test := range tests {
+		got, err := authorizationHeader(test.bearerToken, test.basicAuth)
+
+		if (err != nil) != test.wantErr {
+			t.Errorf("authorizationHeader(%q, %q) error = %v, wantErr %v", test.bearerToken, test.basicAuth, err, test.wantErr)
+			continue
+		}
+
+		if got != test.want {
+			t.Errorf("authorizationHeader(%q, %q) = %q, want %q", test.bearerToken, test.basicAuth, got, test.want)
+		}
+	}
+}
+
+func TestLimitTiles(t *testing.T) {
+	queue := make(chan *tilepack.TileRequest, 10)
+	jobs := make(chan *tilepack.TileRequest, 10)
+
+	for i := 0; i < 10; i++ {
+		queue <- &tilepack.TileRequest{Tile: &tilepack.Tile{Z: 4, X: uint(i), Y: 0}}
+	}
+	close(queue)
+
+	limitTiles(queue, jobs, 3)
+
+	var got []uint
+	for request := range jobs {
+		got = append(got, request.Tile.X)
+	}
+
+	if !reflect.DeepEqual(got, []uint{0, 1, 2}) {
+		t.Errorf("limitTiles() forwarded tiles %v, want [0 1 2]", got)
+	}
+}
+
+func TestFetchByZoom(t *testing.T) {
+	queue := make(chan *tilepack.TileRequest, 20)
+
+	for z := uint(0); z < 4; z++ {
+		for x := uint(0); x < 5; x++ {
+			queue <- &tilepack.TileRequest{Tile: &tilepack.Tile{Z: z, X: x, Y: 0}}
+		}
+	}
+	close(queue)
+
+	var mu sync.Mutex
+	var fetched []uint
+	var pools []int
+
+	start := func(n int, jobs chan *tilepack.TileRequest) *sync.WaitGroup {
+		pools = append(pools, n)
+
+		workerWG := &sync.WaitGroup{}
+
+		for w := 0; w < n; w++ {
+			workerWG.Add(1)
+
+			go func() {
+				defer workerWG.Done()
+
+				for request := range jobs {
+					mu.Lock()
+					fetched = append(fetched, request.Tile.Z)
+					mu.Unlock()
+				}
+			}()
+		}
+
+		return workerWG
+	}
+
+	fetchByZoom(queue, func(zoom uint) int { return int(zoom) + 1 }, start)
+
+	if !reflect.DeepEqual(pools, []int{1, 2, 3, 4}) {
+		t.Errorf("fetchByZoom() started pools of %v workers, want [1 2 3 4]", pools)
+	}
+
+	if len(fetched) != 20 {
+		t.Fatalf("fetchByZoom() fetched %d tiles, want 20", len(fetched))
+	}
+
+	for i := 1; i < len(fetched); i++ {
+		if fetched[i] < fetched[i-1] {
+			t.Fatalf("fetchByZoom() fetched zoom %d after zoom %d", fetched[i], fetched[i-1])
+		}
+	}
+}
+
+func TestMetadataFlag(t *testing.T) {
+	f := &metadataFlag{}
+
+	for _, value := range []string{"name=Basemap", "attribution=© Contributors, a=b", "description="} {
+		if err := f.Set(value); err != nil {
+			t.Fatalf("Set(%q) error = %v", value, err)
+		}
+	}
+
+	want := map[string]string{"name": "Basemap", "attribution": "© Contributors, a=b", "description": ""}
+
+	if !reflect.DeepEqual(f.values, want) {
+		t.Errorf("Set() = %v, want %v", f.values, want)
+	}
+
+	for _, value := range []string{"name", "=value"} {
+		if err := f.Set(value); err == nil {
+			t.Errorf("Set(%q) expected an error", value)
+		}
+	}
+}
+
+func TestURLTemplateFormat(t *testing.T) {
+	tests := []struct {
+		urlTemplate string
+		want        string
+	}{
+		{"https://tile.example.com/{z}/{x}/{y}.mvt?api_key=abc", tilepack.FormatPbf},
+		{"https://tile.example.com/{z}/{x}/{y}{r}.PNG", tilepack.FormatPng},
+		{"https://tile.example.com/{z}/{x}/{y}.jpeg", tilepack.FormatJpeg},
+		{"https://tile.example.com/{z}/{x}/{y}", ""},
+		{"https://tile.example.com/tiles?z={z}&x={x}&y={y}&f=.png", ""},
+	}
+
+	for _, test := range tests {
+		if got := urlTemplateFormat(test.urlTemplate); got != test.want {
+			t.Errorf("urlTemplateFormat(%q) = %q, want %q", test.urlTemplate, got, test.want)
+		}
+	}
+}
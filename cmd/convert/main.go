@@ -0,0 +1,154 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/aaronland/go-string/dsn"
+	"github.com/tilezen/go-tilepacks/tilepack"
+)
+
+// copyMetadata copies the metadata of reader to outputter, if it can store
+// metadata. The format isn't copied, as outputters know their own.
+func copyMetadata(reader tilepack.MbtilesReader, outputter tilepack.TileOutputter) error {
+	setter, ok := outputter.(tilepack.MetadataSetter)
+	if !ok {
+		return nil
+	}
+
+	metadata, err := reader.Metadata()
+	if err != nil {
+		return fmt.Errorf("Couldn't read metadata: %+v", err)
+	}
+
+	for name, value := range metadata {
+		if name == "format" {
+			continue
+		}
+
+		err = setter.SetMetadata(name, value)
+		if err != nil {
+			return fmt.Errorf("Couldn't write metadata: %+v", err)
+		}
+	}
+
+	return nil
+}
+
+// openReader returns a reader for the disk or mbtiles input DSN.
+func openReader(inputMode string, inputDSN string) (tilepack.MbtilesReader, error) {
+	switch inputMode {
+	case "disk":
+		dsnMap, err := dsn.StringToDSNWithKeys(inputDSN, "root", "format")
+		if err != nil {
+			return nil, err
+		}
+
+		return tilepack.NewDiskReader(dsnMap["root"])
+	case "mbtiles":
+		return tilepack.NewMbtilesReader(inputDSN)
+	default:
+		return nil, fmt.Errorf("Unknown input mode %s", inputMode)
+	}
+}
+
+// convert copies every tile from the input to the output, which may each be a
+// disk or mbtiles DSN. The output may also be the path of a PMTiles archive, in
+// which case invertY flips the rows of the tiles.
+func convert(inputMode string, inputDSN string, outputMode string, outputDSN string, invertY bool) error {
+	var outputter tilepack.TileOutputter
+	var err error
+
+	if outputMode == "pmtiles" {
+		reader, err := openReader(inputMode, inputDSN)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+
+		err = tilepack.ExportToPMTilesWithOptions(reader, outputDSN, &tilepack.PMTilesExportOptions{InvertY: invertY})
+		if err != nil {
+			return err
+		}
+
+		log.Printf("Converted tiles to %s", outputDSN)
+		return nil
+	}
+
+	switch outputMode {
+	case "disk":
+		outputter, err = tilepack.NewDiskOutputter(outputDSN)
+	case "mbtiles":
+		outputter, err = tilepack.NewMbtilesOutputter(outputDSN)
+	default:
+		return fmt.Errorf("Unknown output mode %s", outputMode)
+	}
+
+	if err != nil {
+		return fmt.Errorf("Couldn't create %s output: %+v", outputMode, err)
+	}
+
+	err = outputter.CreateTiles()
+	if err != nil {
+		outputter.Close()
+		return fmt.Errorf("Couldn't create %s output: %+v", outputMode, err)
+	}
+
+	counter := 0
+	var saveErr error
+
+	save := func(tile *tilepack.Tile, data []byte) {
+		if saveErr != nil {
+			return
+		}
+
+		saveErr = outputter.Save(tile, data)
+		counter++
+	}
+
+	reader, err := openReader(inputMode, inputDSN)
+
+	if err == nil {
+		err = copyMetadata(reader, outputter)
+
+		if err == nil {
+			err = reader.VisitAllTiles(save)
+		}
+
+		reader.Close()
+	}
+
+	if err == nil {
+		err = saveErr
+	}
+
+	if err != nil {
+		outputter.Close()
+		return err
+	}
+
+	log.Printf("Converted %d tiles", counter)
+
+	return outputter.Close()
+}
+
+func main() {
+	inputMode := flag.String("input-mode", "mbtiles", "The type of the input. Valid modes are: disk, mbtiles.")
+	inputDSN := flag.String("input", "", "Path, or DSN string, of the input tiles. Disk DSNs are in the form 'root={PATH} format={FORMAT}'.")
+	outputMode := flag.String("output-mode", "disk", "The type of the output. Valid modes are: disk, mbtiles, pmtiles.")
+	outputDSN := flag.String("output", "", "Path, or DSN string, of the output tiles. Disk DSNs are in the form 'root={PATH} format={FORMAT}'.")
+	invertedY := flag.Bool("inverted-y", false, "(For pmtiles output) Flip the rows of the tiles, for inputs that store TMS rather than XYZ rows.")
+	flag.Parse()
+
+	if *inputDSN == "" || *outputDSN == "" {
+		log.Fatalf("Must specify -input and -output")
+	}
+
+	log.Printf("Converting %s %s to %s %s", *inputMode, *inputDSN, *outputMode, *outputDSN)
+
+	err := convert(*inputMode, *inputDSN, *outputMode, *outputDSN, *invertedY)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tilezen/go-tilepacks/tilepack"
+)
+
+func TestConvertRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "convert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "input.mbtiles")
+	disk := fmt.Sprintf("root=%s format=mvt", filepath.Join(dir, "tiles"))
+	output := filepath.Join(dir, "output.mbtiles")
+
+	tiles := []*tilepack.Tile{
+		{Z: 0, X: 0, Y: 0},
+		{Z: 3, X: 1, Y: 6},
+		{Z: 12, X: 655, Y: 1583},
+	}
+
+	o, err := tilepack.NewMbtilesOutputter(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tile := range tiles {
+		if err := o.Save(tile, []byte(tile.ToString())); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := o.AssignMetadata(&tilepack.LngLatBbox{West: -122.5, South: 37.6, East: -122.3, North: 37.8}, 0, 12); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.SetMetadata("name", "San Francisco"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := convert("mbtiles", input, "disk", disk, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := convert("disk", disk, "mbtiles", output, false); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := tilepack.NewMbtilesReader(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	count := 0
+	err = reader.VisitAllTiles(func(tile *tilepack.Tile, data []byte) {
+		count++
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != len(tiles) {
+		t.Errorf("Converted %d tiles, want %d", count, len(tiles))
+	}
+
+	for _, tile := range tiles {
+		result, err := reader.GetTile(tile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if result.Data == nil || string(*result.Data) != tile.ToString() {
+			t.Errorf("GetTile(%s) = %v, want the original data", tile.ToString(), result.Data)
+		}
+	}
+
+	// The metadata survives the trip through the directory's metadata.json
+	metadata, err := reader.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"bounds":  "-122.500000,37.600000,-122.300000,37.800000",
+		"maxzoom": "12",
+		"name":    "San Francisco",
+	}
+
+	for name, value := range want {
+		if metadata[name] != value {
+			t.Errorf("Metadata %s = %q, want %q", name, metadata[name], value)
+		}
+	}
+}
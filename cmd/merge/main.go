@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
+	"math"
 	"os"
 	"strings"
 
@@ -17,51 +20,293 @@ func pathExists(path string) bool {
 	return true
 }
 
-func main() {
-	outputFilename := flag.String("output", "", "The output mbtiles to write to")
-	flag.Parse()
-	inputFilenames := flag.Args()
+func min(a uint, b uint) uint {
+	if a < b {
+		return a
+	}
+	return b
+}
 
-	if *outputFilename == "" {
-		log.Fatalf("Must specify --output path")
+func max(a uint, b uint) uint {
+	if a > b {
+		return a
 	}
+	return b
+}
 
-	if len(inputFilenames) == 0 {
-		log.Fatalf("Must specify at least one input path")
+// Ways of resolving tiles that are in more than one input.
+const (
+	// Keep the tile from the first input that has it
+	conflictSkip = "skip"
+	// Keep the tile from the last input that has it
+	conflictReplace = "replace"
+	// Stop merging
+	conflictError = "error"
+)
+
+// mergeOptions configures how the inputs are merged.
+type mergeOptions struct {
+	// onConflict is what to do with tiles that are in more than one input,
+	// one of conflictSkip, conflictReplace or conflictError.
+	onConflict string
+	// minZoom and maxZoom limit the zoom levels that are merged. -1 means
+	// there's no limit.
+	minZoom int
+	maxZoom int
+}
+
+// tileEncoding is how a tile is stored: its format, and whether it's gzipped.
+type tileEncoding struct {
+	format  string
+	gzipped bool
+}
+
+func (e tileEncoding) String() string {
+	format := e.format
+	if format == "" {
+		format = "an unrecognised format"
 	}
 
-	log.Printf("Reading %s and writing them to %s", strings.Join(inputFilenames, ", "), *outputFilename)
+	if e.gzipped {
+		return "gzipped " + format
+	}
 
-	// If the output file exists already we shouldn't overwrite it
-	if pathExists(*outputFilename) {
-		log.Fatalf("Output path %s already exists and cannot be overwritten", *outputFilename)
+	return format
+}
+
+// detectEncoding returns how data is stored.
+func detectEncoding(data []byte) tileEncoding {
+	return tileEncoding{format: tilepack.DetectFormat(data), gzipped: tilepack.IsGzipped(data)}
+}
+
+// merge copies every tile from the input mbtiles into the output mbtiles and
+// records the combined bounds and zoom range of the inputs in its metadata.
+// Tiles must all be stored the same way, as the same format and either all
+// gzipped or none, which is recorded in the format and compression metadata.
+func merge(outputFilename string, inputFilenames []string, opts *mergeOptions) error {
+	switch opts.onConflict {
+	case conflictSkip, conflictReplace, conflictError:
+	default:
+		return fmt.Errorf("Unknown conflict strategy %s", opts.onConflict)
+	}
+
+	if opts.minZoom >= 0 && opts.maxZoom >= 0 && opts.minZoom > opts.maxZoom {
+		return fmt.Errorf("Minimum zoom %d is greater than maximum zoom %d", opts.minZoom, opts.maxZoom)
 	}
 
 	// Create the output mbtiles
-	outputMbtiles, err := tilepack.NewMbtilesOutputter(*outputFilename)
+	outputMbtiles, err := tilepack.NewMbtilesOutputter(outputFilename)
 	if err != nil {
-		log.Fatalf("Couldn't create output mbtiles: %+v", err)
+		return fmt.Errorf("Couldn't create output mbtiles: %+v", err)
 	}
 
-	err = outputMbtiles.CreateTiles()
+	err = mergeTiles(outputMbtiles, inputFilenames, opts)
 	if err != nil {
-		log.Fatalf("Couldn't create output mbtiles: %+v", err)
+		// Don't leave a partial merge behind, it would stop the merge being re-run
+		outputMbtiles.Close()
+		os.Remove(outputFilename)
+		return err
 	}
 
+	return outputMbtiles.Close()
+}
+
+func mergeTiles(outputMbtiles tilepack.MetadataOutputter, inputFilenames []string, opts *mergeOptions) error {
+	err := outputMbtiles.CreateTiles()
+	if err != nil {
+		return fmt.Errorf("Couldn't create output mbtiles: %+v", err)
+	}
+
+	var outputBounds *tilepack.LngLatBbox
+	var outputMinZoom, outputMaxZoom uint
+
+	// The inputs that have already been merged, kept open to look for conflicts
+	var merged []tilepack.MbtilesReader
+	var mergedFilenames []string
+
+	// How the first tile merged is stored, and which input it came from
+	var encoding *tileEncoding
+	var encodingFilename string
+
+	defer func() {
+		for _, reader := range merged {
+			reader.Close()
+		}
+	}()
+
 	for _, inputFilename := range inputFilenames {
-		mbtilesReader, err := tilepack.NewMbtilesReader(inputFilename)
+		mbtilesReader, err := tilepack.NewReader(inputFilename)
+		if err != nil {
+			return fmt.Errorf("Couldn't read input mbtiles %s: %+v", inputFilename, err)
+		}
+
+		minZoom, maxZoom, err := mbtilesReader.GetZoomRange()
+		if err != nil {
+			tilepack.Logf(tilepack.LogLevelWarn, "Skipping %s: %+v", inputFilename, err)
+			mbtilesReader.Close()
+			continue
+		}
+
+		if opts.minZoom >= 0 && uint(opts.minZoom) > minZoom {
+			minZoom = uint(opts.minZoom)
+		}
+
+		if opts.maxZoom >= 0 && uint(opts.maxZoom) < maxZoom {
+			maxZoom = uint(opts.maxZoom)
+		}
+
+		if minZoom > maxZoom {
+			tilepack.Logf(tilepack.LogLevelInfo, "Skipping %s: it has no tiles in the zoom range", inputFilename)
+			mbtilesReader.Close()
+			continue
+		}
+
+		extent, err := mbtilesReader.GetTileExtent()
+		if err != nil {
+			mbtilesReader.Close()
+			return fmt.Errorf("Couldn't read extent of %s: %+v", inputFilename, err)
+		}
+
+		// Seed the running bounds and zoom range from the first input with tiles
+		if outputBounds == nil {
+			outputBounds = extent.Bounds
+			outputMinZoom = minZoom
+			outputMaxZoom = maxZoom
+		} else {
+			outputBounds = &tilepack.LngLatBbox{
+				West:  math.Min(outputBounds.West, extent.Bounds.West),
+				South: math.Min(outputBounds.South, extent.Bounds.South),
+				East:  math.Max(outputBounds.East, extent.Bounds.East),
+				North: math.Max(outputBounds.North, extent.Bounds.North),
+			}
+			outputMinZoom = min(outputMinZoom, minZoom)
+			outputMaxZoom = max(outputMaxZoom, maxZoom)
+		}
+
+		skipped := 0
+
+		visitor := func(t *tilepack.Tile, data []byte) error {
+			// Replacing is what saving does anyway, so there's no need to look
+			if opts.onConflict != conflictReplace {
+				for i, reader := range merged {
+					exists, err := reader.HasTile(t)
+					if err != nil {
+						return err
+					}
+
+					if !exists {
+						continue
+					}
+
+					if opts.onConflict == conflictError {
+						return fmt.Errorf("Tile %s is in both %s and %s", t.ToString(), mergedFilenames[i], inputFilename)
+					}
+
+					skipped++
+					return nil
+				}
+			}
+
+			// Servers can't tell how each tile is stored, so they must match
+			if len(data) > 0 {
+				tileEncoding := detectEncoding(data)
+
+				if encoding == nil {
+					encoding = &tileEncoding
+					encodingFilename = inputFilename
+				} else if tileEncoding != *encoding {
+					return fmt.Errorf("Tile %s is %s, but the tiles from %s are %s", t.ToString(), tileEncoding, encodingFilename, *encoding)
+				}
+			}
+
+			return outputMbtiles.Save(t, data)
+		}
+
+		// Only read the zoom levels that are being merged
+		for z := minZoom; z <= maxZoom && err == nil; z++ {
+			err = mbtilesReader.VisitTilesForZoomWithContext(context.Background(), z, visitor)
+		}
+
+		merged = append(merged, mbtilesReader)
+		mergedFilenames = append(mergedFilenames, inputFilename)
+
 		if err != nil {
-			log.Fatalf("Couldn't read input mbtiles %s: %+v", inputFilename, err)
+			return fmt.Errorf("Couldn't merge tiles from %s: %+v", inputFilename, err)
+		}
+
+		if skipped > 0 {
+			tilepack.Logf(tilepack.LogLevelInfo, "Skipped %d tiles from %s that are in earlier inputs", skipped, inputFilename)
+		}
+	}
+
+	if outputBounds == nil {
+		return nil
+	}
+
+	err = outputMbtiles.AssignMetadata(outputBounds, outputMinZoom, outputMaxZoom)
+	if err != nil {
+		return fmt.Errorf("Couldn't write output metadata: %+v", err)
+	}
+
+	if setter, ok := outputMbtiles.(tilepack.MetadataSetter); ok && encoding != nil && encoding.format != "" {
+		compression := "none"
+		if encoding.gzipped {
+			compression = "gzip"
+		}
+
+		err = setter.SetMetadata("format", encoding.format)
+
+		if err == nil {
+			err = setter.SetMetadata("compression", compression)
 		}
 
-		err = mbtilesReader.VisitAllTiles(func(t *tilepack.Tile, data []byte) {
-			outputMbtiles.Save(t, data)
-		})
 		if err != nil {
-			log.Fatalf("Couldn't read tiles from %s: %+v", inputFilename, err)
+			return fmt.Errorf("Couldn't write output metadata: %+v", err)
 		}
-		mbtilesReader.Close()
 	}
 
-	outputMbtiles.Close()
+	return nil
+}
+
+func main() {
+	outputFilename := flag.String("output", "", "The output mbtiles to write to")
+	minZoom := flag.Int("min-zoom", -1, "The lowest zoom level to merge. Defaults to the lowest zoom level of the inputs.")
+	maxZoom := flag.Int("max-zoom", -1, "The highest zoom level to merge. Defaults to the highest zoom level of the inputs.")
+	logLevelStr := flag.String("log-level", "info", "The least important messages to log: error, warn, info or debug.")
+	onConflict := flag.String("on-conflict", conflictReplace, "What to do with tiles that are in more than one input: skip (keep the first), replace (keep the last) or error (stop merging).")
+	flag.Parse()
+
+	logLevel, err := tilepack.ParseLogLevel(*logLevelStr)
+	if err != nil {
+		log.Fatalf("%+v", err)
+	}
+
+	tilepack.SetLogLevel(logLevel)
+	inputFilenames := flag.Args()
+
+	if *outputFilename == "" {
+		log.Fatalf("Must specify --output path")
+	}
+
+	if len(inputFilenames) == 0 {
+		log.Fatalf("Must specify at least one input path")
+	}
+
+	tilepack.Logf(tilepack.LogLevelInfo, "Reading %s and writing them to %s", strings.Join(inputFilenames, ", "), *outputFilename)
+
+	// If the output file exists already we shouldn't overwrite it
+	if pathExists(*outputFilename) {
+		log.Fatalf("Output path %s already exists and cannot be overwritten", *outputFilename)
+	}
+
+	opts := &mergeOptions{
+		onConflict: *onConflict,
+		minZoom:    *minZoom,
+		maxZoom:    *maxZoom,
+	}
+
+	err = merge(*outputFilename, inputFilenames, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
 }
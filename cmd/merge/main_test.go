@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tilezen/go-tilepacks/tilepack"
+)
+
+func writeTestMbtiles(t *testing.T, path string, minZoom uint, maxZoom uint) {
+	o, err := tilepack.NewMbtilesOutputter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for z := minZoom; z <= maxZoom; z++ {
+		if err := o.Save(&tilepack.Tile{X: 0, Y: 0, Z: z}, []byte{byte(z)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMergeZoomRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "merge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first := filepath.Join(dir, "first.mbtiles")
+	second := filepath.Join(dir, "second.mbtiles")
+	output := filepath.Join(dir, "output.mbtiles")
+
+	writeTestMbtiles(t, first, 4, 8)
+	writeTestMbtiles(t, second, 10, 12)
+
+	if err := merge(output, []string{first, second}, &mergeOptions{onConflict: conflictReplace, minZoom: -1, maxZoom: -1}); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite3", output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tests := map[string]string{
+		"minzoom": "4",
+		"maxzoom": "12",
+	}
+	for name, want := range tests {
+		var got string
+		if err := db.QueryRow("SELECT value FROM metadata WHERE name=?", name).Scan(&got); err != nil {
+			t.Fatalf("Couldn't read %s: %+v", name, err)
+		}
+		if got != want {
+			t.Errorf("%s = %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestMergeZoomFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "merge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first := filepath.Join(dir, "first.mbtiles")
+	second := filepath.Join(dir, "second.mbtiles")
+	third := filepath.Join(dir, "third.mbtiles")
+	output := filepath.Join(dir, "output.mbtiles")
+
+	writeTestMbtiles(t, first, 4, 8)
+	writeTestMbtiles(t, second, 10, 12)
+	writeTestMbtiles(t, third, 14, 16)
+
+	opts := &mergeOptions{onConflict: conflictReplace, minZoom: 6, maxZoom: 10}
+
+	if err := merge(output, []string{first, second, third}, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := tilepack.NewMbtilesReader(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	counts, err := reader.CountTilesByZoom()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(counts) != 4 || counts[6] != 1 || counts[10] != 1 {
+		t.Errorf("Unexpected tiles merged %+v", counts)
+	}
+
+	metadata, err := reader.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if metadata["minzoom"] != "6" || metadata["maxzoom"] != "10" {
+		t.Errorf("Unexpected metadata %+v", metadata)
+	}
+
+	opts = &mergeOptions{onConflict: conflictReplace, minZoom: 10, maxZoom: 6}
+
+	if err := merge(filepath.Join(dir, "invalid.mbtiles"), []string{first}, opts); err == nil {
+		t.Error("Expected an error for an empty zoom range")
+	}
+}
+
+func TestMergeConflicts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "merge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first := filepath.Join(dir, "first.mbtiles")
+	second := filepath.Join(dir, "second.mbtiles")
+
+	// Both inputs have z4, saved with different data
+	writeTestMbtiles(t, first, 2, 4)
+	writeTestMbtiles(t, second, 4, 6)
+
+	o, err := tilepack.NewMbtilesOutputter(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Save(&tilepack.Tile{X: 0, Y: 0, Z: 4}, []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		conflictSkip:    string([]byte{4}),
+		conflictReplace: "second",
+	}
+
+	for onConflict, want := range tests {
+		output := filepath.Join(dir, onConflict+".mbtiles")
+
+		if err := merge(output, []string{first, second}, &mergeOptions{onConflict: onConflict, minZoom: -1, maxZoom: -1}); err != nil {
+			t.Fatal(err)
+		}
+
+		reader, err := tilepack.NewMbtilesReader(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		count, err := reader.CountTiles()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tile, err := reader.GetTile(&tilepack.Tile{X: 0, Y: 0, Z: 4})
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader.Close()
+
+		if count != 5 {
+			t.Errorf("%s merged %d tiles, want 5", onConflict, count)
+		}
+
+		if tile.Data == nil || string(*tile.Data) != want {
+			t.Errorf("%s kept the wrong z4 tile", onConflict)
+		}
+	}
+
+	output := filepath.Join(dir, "error.mbtiles")
+
+	if err := merge(output, []string{first, second}, &mergeOptions{onConflict: conflictError, minZoom: -1, maxZoom: -1}); err == nil {
+		t.Error("Expected an error merging overlapping inputs")
+	}
+
+	if pathExists(output) {
+		t.Error("Failed merge left its output behind")
+	}
+}
+
+func TestMergeEncodings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "merge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	png := []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n', 0, 0, 0, 0}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(png)
+	gz.Close()
+	gzippedPNG := buf.Bytes()
+
+	inputs := map[string][]byte{
+		"png.mbtiles":          png,
+		"gzipped.mbtiles":      gzippedPNG,
+		"more_gzipped.mbtiles": gzippedPNG,
+	}
+
+	for name, data := range inputs {
+		o, err := tilepack.NewMbtilesOutputter(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for x := uint(0); x < 2; x++ {
+			if err := o.Save(&tilepack.Tile{X: x, Y: 0, Z: 1}, data); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := o.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := &mergeOptions{onConflict: conflictReplace, minZoom: -1, maxZoom: -1}
+
+	output := filepath.Join(dir, "mixed.mbtiles")
+
+	if err := merge(output, []string{filepath.Join(dir, "gzipped.mbtiles"), filepath.Join(dir, "png.mbtiles")}, opts); err == nil {
+		t.Error("Expected an error merging gzipped and uncompressed tiles")
+	}
+
+	output = filepath.Join(dir, "merged.mbtiles")
+
+	if err := merge(output, []string{filepath.Join(dir, "gzipped.mbtiles"), filepath.Join(dir, "more_gzipped.mbtiles")}, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := tilepack.NewMbtilesReader(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	metadata, err := reader.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if metadata["format"] != "png" || metadata["compression"] != "gzip" {
+		t.Errorf("Merged format %q and compression %q, want png and gzip", metadata["format"], metadata["compression"])
+	}
+}
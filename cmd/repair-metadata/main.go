@@ -0,0 +1,103 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/tilezen/go-tilepacks/tilepack"
+)
+
+// repairedKeys are the metadata values that repair recomputes.
+var repairedKeys = []string{"bounds", "center", "minzoom", "maxzoom"}
+
+// journalMode returns the SQLite journal mode of the database at path.
+func journalMode(path string) (string, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	var mode string
+	err = db.QueryRow("PRAGMA journal_mode").Scan(&mode)
+	return mode, err
+}
+
+// repair recomputes the bounds, center and zoom range metadata of the mbtiles
+// at path from its tiles, and logs the values that changed.
+func repair(path string) error {
+	// Opening a database that doesn't exist would create it
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+
+	// Keep the archive's journal mode, rather than switching it to WAL,
+	// which needs exclusive access
+	mode, err := journalMode(path)
+	if err != nil {
+		return fmt.Errorf("Couldn't read %s: %+v", path, err)
+	}
+
+	reader, err := tilepack.NewMbtilesReader(path)
+	if err != nil {
+		return fmt.Errorf("Couldn't read %s: %+v", path, err)
+	}
+	defer reader.Close()
+
+	before, err := reader.Metadata()
+	if err != nil {
+		return fmt.Errorf("Couldn't read metadata from %s: %+v", path, err)
+	}
+
+	// Don't risk corrupting the archive if the machine crashes
+	outputter, err := tilepack.NewMbtilesOutputterWithOptions(path, &tilepack.MbtilesOutputterOptions{
+		JournalMode: mode,
+		Synchronous: "FULL",
+	})
+	if err != nil {
+		return fmt.Errorf("Couldn't open %s for writing: %+v", path, err)
+	}
+
+	err = tilepack.RepairMetadata(reader, outputter)
+	if err != nil {
+		outputter.Close()
+		return fmt.Errorf("Couldn't repair metadata of %s: %+v", path, err)
+	}
+
+	err = outputter.Close()
+	if err != nil {
+		return fmt.Errorf("Couldn't write metadata to %s: %+v", path, err)
+	}
+
+	after, err := reader.Metadata()
+	if err != nil {
+		return fmt.Errorf("Couldn't read metadata from %s: %+v", path, err)
+	}
+
+	for _, key := range repairedKeys {
+		if before[key] != after[key] {
+			log.Printf("%s: changed %s from %q to %q", path, key, before[key], after[key])
+		}
+	}
+
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	inputFilenames := flag.Args()
+
+	if len(inputFilenames) == 0 {
+		log.Fatalf("Must specify at least one mbtiles path")
+	}
+
+	for _, inputFilename := range inputFilenames {
+		err := repair(inputFilename)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tilezen/go-tilepacks/tilepack"
+)
+
+func TestRepair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "repair")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "repair.mbtiles")
+
+	o, err := tilepack.NewMbtilesOutputterWithOptions(path, &tilepack.MbtilesOutputterOptions{JournalMode: "DELETE"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.AssignMetadata(&tilepack.LngLatBbox{West: 10.0, South: 10.0, East: 20.0, North: 20.0}, 5, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.Save(&tilepack.Tile{Z: 0, X: 0, Y: 0}, []byte("tile")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repair(path); err != nil {
+		t.Fatal(err)
+	}
+
+	mode, err := journalMode(path)
+	if err != nil || mode != "delete" {
+		t.Errorf("Journal mode is %q (%v), want delete", mode, err)
+	}
+
+	reader, err := tilepack.NewMbtilesReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	metadata, err := reader.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if metadata["minzoom"] != "0" || metadata["maxzoom"] != "0" {
+		t.Errorf("Zoom range is %s-%s, want 0-0", metadata["minzoom"], metadata["maxzoom"])
+	}
+
+	if err := repair(filepath.Join(dir, "missing.mbtiles")); err == nil {
+		t.Error("Expected an error for a missing input")
+	}
+}
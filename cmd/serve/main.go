@@ -1,63 +1,325 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	gohttp "net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/tilezen/go-tilepacks/http"
 	"github.com/tilezen/go-tilepacks/tilepack"
 )
 
+// shutdownTimeout is how long requests are given to finish when the server is
+// shutting down.
+const shutdownTimeout = 10 * time.Second
+
 func loggingMiddleware(logger *log.Logger) func(gohttp.Handler) gohttp.Handler {
 	return func(next gohttp.Handler) gohttp.Handler {
 		return gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
 			defer func() {
-				logger.Println(r.Method, r.URL.Path, r.RemoteAddr, r.UserAgent())
+				if tilepack.LogLevelEnabled(tilepack.LogLevelInfo) {
+					logger.Println(r.Method, r.URL.Path, r.RemoteAddr, r.UserAgent())
+				}
 			}()
 			next.ServeHTTP(w, r)
 		})
 	}
 }
 
+func corsMiddleware() func(gohttp.Handler) gohttp.Handler {
+	return func(next gohttp.Handler) gohttp.Handler {
+		return gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+
+			if r.Method == gohttp.MethodOptions {
+				w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+
+				if requestHeaders := r.Header.Get("Access-Control-Request-Headers"); requestHeaders != "" {
+					w.Header().Set("Access-Control-Allow-Headers", requestHeaders)
+				}
+
+				w.WriteHeader(gohttp.StatusNoContent)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// inputsFlag collects repeated -input flags, each either a path or a
+// "name=path" pair.
+type inputsFlag struct {
+	names []string
+	paths []string
+}
+
+func (f *inputsFlag) String() string {
+	return ""
+}
+
+func (f *inputsFlag) Set(value string) error {
+	name := ""
+	path := value
+
+	if parts := strings.SplitN(value, "=", 2); len(parts) == 2 {
+		name = parts[0]
+		path = parts[1]
+
+		if name == "" || strings.ContainsAny(name, "/{}") {
+			return errors.New("Input name must not be empty or contain /, { or }")
+		}
+	}
+
+	f.names = append(f.names, name)
+	f.paths = append(f.paths, path)
+	return nil
+}
+
+// openReader returns a disk reader if path is a directory, a PMTiles reader if
+// it ends in .pmtiles and a read-only mbtiles reader, which is safe to share
+// between requests, otherwise.
+func openReader(path string) (tilepack.MbtilesReader, error) {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return tilepack.NewDiskReader(path)
+	}
+
+	if strings.EqualFold(filepath.Ext(path), ".pmtiles") {
+		return tilepack.NewPMTilesReader(path)
+	}
+
+	return tilepack.NewMbtilesReaderReadOnly(path)
+}
+
+// layerPathTemplate returns the path template for tiles from a named input,
+// /{name}/{z}/{x}/{y}.{ext}, where the extension comes from the format of its
+// tiles. If template uses {-y} so does the layer.
+func layerPathTemplate(name string, reader tilepack.MbtilesReader, template string) (*http.PathTemplate, error) {
+	ext := "mvt"
+
+	metadata, err := reader.Metadata()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if format, ok := metadata["format"]; ok && format != "" && format != tilepack.FormatPbf {
+		ext = strings.ToLower(format)
+	}
+
+	y := "{y}"
+	if strings.Contains(template, "{-y}") {
+		y = "{-y}"
+	}
+
+	return http.CompilePathTemplate("/" + name + "/{z}/{x}/" + y + "." + ext)
+}
+
+// inputPathTemplate returns the path template to serve an input's tiles from:
+// template itself if the input has no name, or a template of its own under
+// /{name}/ if it does.
+func inputPathTemplate(name string, reader tilepack.MbtilesReader, template string) (*http.PathTemplate, error) {
+	if name == "" {
+		return http.CompilePathTemplate(template)
+	}
+
+	return layerPathTemplate(name, reader, template)
+}
+
+// prefixSet records the path prefixes inputs are served from.
+type prefixSet map[string]bool
+
+// add records the prefix of pathTemplate, or returns an error if another input
+// is already served from it.
+func (p prefixSet) add(pathTemplate *http.PathTemplate) error {
+	prefix := pathTemplate.Prefix()
+
+	if p[prefix] {
+		return fmt.Errorf("More than one --input would be served from %s", prefix)
+	}
+
+	p[prefix] = true
+	return nil
+}
+
 func main() {
-	mbtilesFile := flag.String("input", "", "The name of the mbtiles file to serve from.")
+	inputs := &inputsFlag{}
+	flag.Var(inputs, "input", "The name of the mbtiles or pmtiles file, or directory of z/x/y tiles, to serve from. May be repeated as name=path to serve several, each from /{name}/{z}/{x}/{y}.{ext} instead of -path.")
 	addr := flag.String("listen", ":8080", "The address and port to listen on")
+	pathTemplateStr := flag.String("path", http.DefaultPathTemplate, "The URL path template to serve tiles from. It must contain the {z}, {x} and {y} tokens. Use {-y} instead of {y} if requests use the opposite (TMS vs XYZ) Y ordering to the tiles in the mbtiles file.")
+	publicURL := flag.String("public-url", "", "The public base URL (scheme and host) used for tile URLs in /tiles.json. Defaults to the host of each request.")
+	maxAge := flag.Duration("max-age", 0, "If set, send a Cache-Control header telling clients to cache tiles for this long, e.g. 24h.")
+	metricsAddr := flag.String("metrics-listen", "", "If set, the address and port to serve Prometheus metrics from at /metrics, e.g. :9090.")
+	tlsCert := flag.String("tls-cert", "", "Path to a TLS certificate to serve HTTPS with. Requires -tls-key.")
+	tlsKey := flag.String("tls-key", "", "Path to the private key of -tls-cert.")
+	minTileBytes := flag.Int("min-tile-bytes", 0, "If set, respond with a 404 for tiles smaller than this many bytes, as they are stored, so that clients fall back to a parent tile.")
+	overzoom := flag.Bool("overzoom", false, "Serve requests above the maximum zoom with the closest ancestor tile, for clients to scale, instead of a 404. The zoom of the tile served is sent in an X-Overzoom header.")
+	logLevelStr := flag.String("log-level", "info", "The least important messages to log: error, warn, info or debug.")
+	cors := flag.Bool("cors", false, "Send CORS headers allowing tiles to be requested from any origin.")
 	flag.Parse()
 
 	logger := log.New(os.Stdout, "http: ", log.LstdFlags)
 
-	if *mbtilesFile == "" {
+	logLevel, err := tilepack.ParseLogLevel(*logLevelStr)
+	if err != nil {
+		logger.Fatalf("%+v", err)
+	}
+
+	tilepack.SetLogLevel(logLevel)
+
+	if len(inputs.paths) == 0 {
 		logger.Fatal("Need to provide --input parameter")
 	}
 
-	reader, err := tilepack.NewMbtilesReader(*mbtilesFile)
-	if err != nil {
-		logger.Fatalf("Couldn't create MBtilesReader, %v", err)
+	if (*tlsCert == "") != (*tlsKey == "") {
+		logger.Fatal("--tls-cert and --tls-key must be used together")
 	}
 
-	mbtilesHandler := http.MbtilesHandler(reader)
+	var metrics *http.Metrics
+
+	if *metricsAddr != "" {
+		metrics = http.NewMetrics()
+
+		metricsRouter := gohttp.NewServeMux()
+		metricsRouter.Handle("/metrics", metrics.Handler())
+
+		go func() {
+			if err := gohttp.ListenAndServe(*metricsAddr, metricsRouter); err != nil {
+				logger.Fatalf("Could not listen on %s: %v\n", *metricsAddr, err)
+			}
+		}()
+	}
 
 	router := gohttp.NewServeMux()
 	router.HandleFunc("/preview.html", previewHTMLHandler)
-	router.Handle("/tilezen/", mbtilesHandler)
-	router.HandleFunc("/", defaultHandler)
+
+	var readers []tilepack.MbtilesReader
+	var layers []*http.CatalogLayer
+	unnamed := false
+	prefixes := make(prefixSet)
+
+	for i, path := range inputs.paths {
+		name := inputs.names[i]
+
+		reader, err := openReader(path)
+		if err != nil {
+			logger.Fatalf("Couldn't create MBtilesReader for %s, %v", path, err)
+		}
+
+		readers = append(readers, reader)
+
+		tileJSONPath := "/tiles.json"
+		metadataPath := "/metadata.json"
+
+		if name == "" {
+			if unnamed {
+				logger.Fatal("Only one --input can be served without a name")
+			}
+			unnamed = true
+		} else {
+			tileJSONPath = "/" + name + "/tiles.json"
+			metadataPath = "/" + name + "/metadata.json"
+		}
+
+		pathTemplate, err := inputPathTemplate(name, reader, *pathTemplateStr)
+		if err != nil {
+			logger.Fatalf("Couldn't serve %s, %v", path, err)
+		}
+
+		if err := prefixes.add(pathTemplate); err != nil {
+			logger.Fatalf("%v", err)
+		}
+
+		mbtilesHandler := http.MbtilesHandlerWithOptions(reader, &http.MbtilesHandlerOptions{
+			PathTemplate: pathTemplate,
+			MaxAge:       *maxAge,
+			Metrics:      metrics,
+			MinTileBytes: *minTileBytes,
+			Overzoom:     *overzoom,
+		})
+
+		router.Handle(tileJSONPath, http.TileJSONHandler(reader, pathTemplate, *publicURL))
+		router.Handle(metadataPath, http.MetadataHandler(reader))
+		router.Handle(pathTemplate.Prefix(), mbtilesHandler)
+
+		if tilepack.LogLevelEnabled(tilepack.LogLevelInfo) {
+			logger.Printf("Serving %s from %s", path, pathTemplate)
+		}
+
+		layers = append(layers, &http.CatalogLayer{
+			Name:         name,
+			PathTemplate: pathTemplate,
+			TileJSONPath: tileJSONPath,
+		})
+	}
+
+	router.Handle("/catalog.json", http.CatalogHandler(layers, *publicURL))
+
+	// The tiles handlers will 404 anything they don't recognize themselves
+	if !prefixes["/"] {
+		router.HandleFunc("/", defaultHandler)
+	}
+
+	var handler gohttp.Handler = router
+
+	if *cors {
+		handler = corsMiddleware()(handler)
+	}
 
 	server := &gohttp.Server{
 		Addr:         *addr,
-		Handler:      loggingMiddleware(logger)(router),
+		Handler:      loggingMiddleware(logger)(handler),
 		ErrorLog:     logger,
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 5 * time.Second,
 		IdleTimeout:  30 * time.Second,
 	}
 
-	if err := server.ListenAndServe(); err != nil && err != gohttp.ErrServerClosed {
+	// Stop accepting connections on SIGINT or SIGTERM and give the requests
+	// being served a chance to finish before the archives are closed
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	shutdown := make(chan error, 1)
+
+	go func() {
+		sig := <-signals
+		if tilepack.LogLevelEnabled(tilepack.LogLevelInfo) {
+			logger.Printf("Received %s, shutting down", sig)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		shutdown <- server.Shutdown(ctx)
+	}()
+
+	if *tlsCert != "" {
+		err = server.ListenAndServeTLS(*tlsCert, *tlsKey)
+	} else {
+		err = server.ListenAndServe()
+	}
+
+	if err != nil && err != gohttp.ErrServerClosed {
 		logger.Fatalf("Could not listen on %s: %v\n", *addr, err)
 	}
 
+	if err := <-shutdown; err != nil && tilepack.LogLevelEnabled(tilepack.LogLevelWarn) {
+		logger.Printf("Couldn't finish serving requests, %v", err)
+	}
+
+	for _, reader := range readers {
+		reader.Close()
+	}
 }
 
 func previewHTMLHandler(w gohttp.ResponseWriter, r *gohttp.Request) {
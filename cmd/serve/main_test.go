@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	gohttp "net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/tilezen/go-tilepacks/tilepack"
+)
+
+func TestCorsMiddleware(t *testing.T) {
+	next := gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		w.Write([]byte("tile"))
+	})
+
+	handler := corsMiddleware()(next)
+
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest("GET", "/0/0/0.mvt", nil))
+
+	if resp.Code != gohttp.StatusOK || resp.Body.String() != "tile" {
+		t.Errorf("GET returned %d %q, want the tile", resp.Code, resp.Body.String())
+	}
+
+	if got := resp.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("GET returned Access-Control-Allow-Origin %q, want *", got)
+	}
+
+	req := httptest.NewRequest("OPTIONS", "/0/0/0.mvt", nil)
+	req.Header.Set("Access-Control-Request-Headers", "X-Requested-With")
+
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+
+	if resp.Code != gohttp.StatusNoContent || resp.Body.Len() != 0 {
+		t.Errorf("OPTIONS returned %d %q, want 204 without a body", resp.Code, resp.Body.String())
+	}
+
+	want := map[string]string{
+		"Access-Control-Allow-Origin":  "*",
+		"Access-Control-Allow-Methods": "GET, OPTIONS",
+		"Access-Control-Allow-Headers": "X-Requested-With",
+	}
+
+	for name, value := range want {
+		if got := resp.Header().Get(name); got != value {
+			t.Errorf("OPTIONS returned %s %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestInputsFlag(t *testing.T) {
+	inputs := &inputsFlag{}
+
+	for _, value := range []string{"world.mbtiles", "hillshade=/data/hillshade.pmtiles", "roads=a=b.mbtiles"} {
+		if err := inputs.Set(value); err != nil {
+			t.Fatalf("Set(%q) = %v", value, err)
+		}
+	}
+
+	if want := []string{"", "hillshade", "roads"}; !reflect.DeepEqual(inputs.names, want) {
+		t.Errorf("Got names %q, want %q", inputs.names, want)
+	}
+
+	if want := []string{"world.mbtiles", "/data/hillshade.pmtiles", "a=b.mbtiles"}; !reflect.DeepEqual(inputs.paths, want) {
+		t.Errorf("Got paths %q, want %q", inputs.paths, want)
+	}
+
+	for _, value := range []string{"=world.mbtiles", "a/b=world.mbtiles", "{z}=world.mbtiles"} {
+		if err := inputs.Set(value); err == nil {
+			t.Errorf("Set(%q) didn't return an error", value)
+		}
+	}
+}
+
+func TestLayerPathTemplate(t *testing.T) {
+	vector := tilepack.NewMemoryOutputter()
+	vector.SetMetadata("format", tilepack.FormatPbf)
+
+	raster := tilepack.NewMemoryOutputter()
+	raster.SetMetadata("format", "PNG")
+
+	tests := []struct {
+		name     string
+		reader   tilepack.MbtilesReader
+		template string
+		want     string
+	}{
+		{"roads", tilepack.NewMemoryReader(vector), "/tiles/{z}/{x}/{y}.mvt", "/roads/{z}/{x}/{y}.mvt"},
+		{"roads", tilepack.NewMemoryReader(tilepack.NewMemoryOutputter()), "/tiles/{z}/{x}/{y}.mvt", "/roads/{z}/{x}/{y}.mvt"},
+		{"hillshade", tilepack.NewMemoryReader(raster), "/tiles/{z}/{x}/{y}.mvt", "/hillshade/{z}/{x}/{y}.png"},
+		{"hillshade", tilepack.NewMemoryReader(raster), "/tiles/{z}/{x}/{-y}.mvt", "/hillshade/{z}/{x}/{-y}.png"},
+	}
+
+	for _, tt := range tests {
+		pathTemplate, err := layerPathTemplate(tt.name, tt.reader, tt.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := pathTemplate.String(); got != tt.want {
+			t.Errorf("layerPathTemplate(%q, %q) = %s, want %s", tt.name, tt.template, got, tt.want)
+		}
+	}
+}
+
+func TestPrefixSet(t *testing.T) {
+	reader := tilepack.NewMemoryReader(tilepack.NewMemoryOutputter())
+	prefixes := make(prefixSet)
+
+	tests := []struct {
+		name     string
+		template string
+		valid    bool
+	}{
+		{"", "/tiles/{z}/{x}/{y}.mvt", true},
+		{"roads", "/tiles/{z}/{x}/{y}.mvt", true},
+		{"hillshade", "/tiles/{z}/{x}/{y}.mvt", true},
+		// A named input served where another already is
+		{"tiles", "/tiles/{z}/{x}/{y}.mvt", false},
+		{"roads", "/tiles/{z}/{x}/{y}.mvt", false},
+	}
+
+	for _, tt := range tests {
+		pathTemplate, err := inputPathTemplate(tt.name, reader, tt.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = prefixes.add(pathTemplate)
+
+		if tt.valid && err != nil {
+			t.Errorf("add(%s) = %v, want nil", pathTemplate, err)
+		}
+
+		if !tt.valid && err == nil {
+			t.Errorf("add(%s) = nil, want an error", pathTemplate)
+		}
+	}
+
+	if _, err := inputPathTemplate("", reader, "/tiles/{z}/{x}.mvt"); err == nil {
+		t.Error("Expected an error for a template without {y}")
+	}
+}
+
+func TestOpenReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tiles := filepath.Join(dir, "tiles")
+
+	disk, err := tilepack.NewDiskOutputter("root=" + tiles + " format=mvt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pmtilesPath := filepath.Join(dir, "tiles.PMTiles")
+
+	pmtiles, err := tilepack.NewPMTilesOutputter(pmtilesPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mbtilesPath := filepath.Join(dir, "tiles.mbtiles")
+
+	mbtiles, err := tilepack.NewMbtilesOutputter(mbtilesPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, o := range []tilepack.TileOutputter{disk, pmtiles, mbtiles} {
+		if err := o.CreateTiles(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := o.Save(&tilepack.Tile{Z: 0, X: 0, Y: 0}, []byte{0x1f, 0x8b}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := o.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{tiles, "*tilepack.diskReader"},
+		{pmtilesPath, "*tilepack.pmtilesReader"},
+		{mbtilesPath, "*tilepack.mbtilesReader"},
+	}
+
+	for _, tt := range tests {
+		reader, err := openReader(tt.path)
+		if err != nil {
+			t.Fatalf("openReader(%s) = %v", tt.path, err)
+		}
+
+		if got := fmt.Sprintf("%T", reader); got != tt.want {
+			t.Errorf("openReader(%s) returned a %s, want a %s", tt.path, got, tt.want)
+		}
+
+		if has, err := reader.HasTile(&tilepack.Tile{Z: 0, X: 0, Y: 0}); err != nil || !has {
+			t.Errorf("openReader(%s) reader HasTile() = %t, %v, want true", tt.path, has, err)
+		}
+
+		reader.Close()
+	}
+}
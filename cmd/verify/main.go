@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/tilezen/go-tilepacks/tilepack"
+)
+
+// verify checks every tile in the mbtiles, or tile directory, at path against
+// the format in its metadata and logs the ones that are corrupt. It returns the
+// number of tiles checked and the number that are corrupt.
+func verify(path string, parseMVT bool) (int, int, error) {
+	if _, err := os.Stat(path); err != nil {
+		return 0, 0, err
+	}
+
+	reader, err := tilepack.NewReader(path)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Couldn't read %s: %+v", path, err)
+	}
+	defer reader.Close()
+
+	metadata, err := reader.Metadata()
+	if err != nil {
+		return 0, 0, fmt.Errorf("Couldn't read metadata from %s: %+v", path, err)
+	}
+
+	format := metadata["format"]
+
+	if format == "" {
+		log.Printf("%s has no format metadata, only checking that tiles decompress", path)
+	}
+
+	checked := 0
+	corrupt := 0
+
+	err = reader.VisitAllTiles(func(tile *tilepack.Tile, data []byte) {
+		checked++
+
+		err := tilepack.VerifyTile(data, format, parseMVT)
+		if err != nil {
+			corrupt++
+			log.Printf("%s: tile %s is corrupt: %v", path, tile.ToString(), err)
+		}
+	})
+
+	if err != nil {
+		return checked, corrupt, fmt.Errorf("Couldn't read tiles from %s: %+v", path, err)
+	}
+
+	return checked, corrupt, nil
+}
+
+func main() {
+	parseMVT := flag.Bool("mvt", false, "Also check that vector tiles are well-formed protobuf, and that their layers have names.")
+	flag.Parse()
+	inputFilenames := flag.Args()
+
+	if len(inputFilenames) == 0 {
+		log.Fatalf("Must specify at least one input path")
+	}
+
+	failed := false
+
+	for _, inputFilename := range inputFilenames {
+		checked, corrupt, err := verify(inputFilename, *parseMVT)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf("%s: checked %d tiles, %d corrupt", inputFilename, checked, corrupt)
+
+		if corrupt > 0 {
+			failed = true
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tilezen/go-tilepacks/tilepack"
+)
+
+func TestVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "tiles.mbtiles")
+
+	o, err := tilepack.NewMbtilesOutputter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	png := []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n', 0x00, 0x00, 0x00, 0x0d}
+
+	// The format metadata is detected from the first tile saved
+	tiles := []struct {
+		tile *tilepack.Tile
+		data []byte
+	}{
+		{&tilepack.Tile{Z: 1, X: 0, Y: 0}, png},
+		{&tilepack.Tile{Z: 1, X: 1, Y: 0}, png},
+		{&tilepack.Tile{Z: 1, X: 0, Y: 1}, []byte("<html>Oops</html>")},
+	}
+
+	for _, tile := range tiles {
+		if err := o.Save(tile.tile, tile.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	checked, corrupt, err := verify(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if checked != 3 || corrupt != 1 {
+		t.Errorf("verify() checked %d tiles, %d corrupt, want 3, 1", checked, corrupt)
+	}
+
+	if _, _, err := verify(filepath.Join(dir, "missing.mbtiles"), false); err == nil {
+		t.Error("Expected an error for a missing input")
+	}
+}
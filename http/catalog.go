@@ -0,0 +1,54 @@
+package http
+
+import (
+	"encoding/json"
+	gohttp "net/http"
+
+	"github.com/tilezen/go-tilepacks/tilepack"
+)
+
+// CatalogLayer is a tileset listed by CatalogHandler.
+type CatalogLayer struct {
+	Name string
+	// PathTemplate is the URL path its tiles are served from.
+	PathTemplate *PathTemplate
+	// TileJSONPath, if set, is the URL path of its TileJSON document.
+	TileJSONPath string
+}
+
+type catalogEntry struct {
+	Name     string `json:"name"`
+	Tiles    string `json:"tiles"`
+	TileJSON string `json:"tilejson,omitempty"`
+}
+
+// CatalogHandler returns a handler listing layers as a JSON array of their
+// names, tile URLs and TileJSON URLs. If publicURL is empty it is derived
+// from each request.
+func CatalogHandler(layers []*CatalogLayer, publicURL string) gohttp.HandlerFunc {
+
+	return func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		baseURL := requestBaseURL(r, publicURL)
+
+		entries := make([]*catalogEntry, len(layers))
+
+		for i, layer := range layers {
+			entries[i] = &catalogEntry{
+				Name:  layer.Name,
+				Tiles: baseURL + layer.PathTemplate.String(),
+			}
+
+			if layer.TileJSONPath != "" {
+				entries[i].TileJSON = baseURL + layer.TileJSONPath
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		err := json.NewEncoder(w).Encode(entries)
+
+		if err != nil {
+			tilepack.Logf(tilepack.LogLevelWarn, "Error writing catalog: %+v", err)
+		}
+	}
+}
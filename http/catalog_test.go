@@ -0,0 +1,38 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCatalogHandler(t *testing.T) {
+	layers := []*CatalogLayer{
+		{Name: "basemap", PathTemplate: MustCompilePathTemplate("/basemap/{z}/{x}/{y}.mvt"), TileJSONPath: "/basemap/tiles.json"},
+		{Name: "hillshade", PathTemplate: MustCompilePathTemplate("/hillshade/{z}/{x}/{y}.png")},
+	}
+
+	resp := httptest.NewRecorder()
+	CatalogHandler(layers, "https://tiles.example.com/")(resp, httptest.NewRequest("GET", "/catalog.json", nil))
+
+	var entries []*catalogEntry
+
+	if err := json.Unmarshal(resp.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []*catalogEntry{
+		{Name: "basemap", Tiles: "https://tiles.example.com/basemap/{z}/{x}/{y}.mvt", TileJSON: "https://tiles.example.com/basemap/tiles.json"},
+		{Name: "hillshade", Tiles: "https://tiles.example.com/hillshade/{z}/{x}/{y}.png"},
+	}
+
+	if len(entries) != len(want) {
+		t.Fatalf("Got %d layers, want %d", len(entries), len(want))
+	}
+
+	for i, entry := range entries {
+		if *entry != *want[i] {
+			t.Errorf("Got layer %+v, want %+v", entry, want[i])
+		}
+	}
+}
@@ -1,31 +1,129 @@
 package http
 
 import (
-	"fmt"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
 	"github.com/tilezen/go-tilepacks/tilepack"
-	"log"
 	gohttp "net/http"
-	"regexp"
 	"strconv"
 	"strings"
+	"time"
+)
+
+const (
+	defaultFormat = "pbf"
 )
 
 var (
-	tilezenRegex = regexp.MustCompile(`\/tilezen\/vector\/v1\/512\/all\/(\d+)\/(\d+)\/(\d+)\.mvt$`)
+	defaultPathTemplate = MustCompilePathTemplate(DefaultPathTemplate)
 )
 
+// MbtilesHandlerOptions configures the handler returned by MbtilesHandlerWithOptions.
+type MbtilesHandlerOptions struct {
+	// PathTemplate is the URL path that tiles are requested from.
+	PathTemplate *PathTemplate
+	// MaxAge, if set, is sent as the max-age of a Cache-Control header so
+	// that clients cache tiles.
+	MaxAge time.Duration
+	// Metrics, if set, records the tiles requested and how long they took to read.
+	Metrics *Metrics
+	// MinTileBytes, if set, serves tiles smaller than this many bytes, as
+	// they are stored, as 404s so that clients fall back to a parent tile.
+	MinTileBytes int
+	// Overzoom, if set, serves requests above the archive's maximum zoom
+	// that miss with the closest ancestor tile that exists, for the client to
+	// scale. The zoom of the served tile is sent in an X-Overzoom header.
+	Overzoom bool
+}
+
+// overzoomHeader is the zoom of the tile that was served in place of a
+// missing tile above the maximum zoom.
+const overzoomHeader = "X-Overzoom"
+
+// formatContentTypes maps the mbtiles "format" metadata value to a MIME type.
+var formatContentTypes = map[string]string{
+	"pbf":  "application/x-protobuf",
+	"mvt":  "application/x-protobuf",
+	"png":  "image/png",
+	"jpg":  "image/jpeg",
+	"jpeg": "image/jpeg",
+	"webp": "image/webp",
+	"avif": "image/avif",
+}
+
+// MbtilesHandler returns a handler serving tiles from reader at DefaultPathTemplate.
 func MbtilesHandler(reader tilepack.MbtilesReader) gohttp.HandlerFunc {
+	opts := &MbtilesHandlerOptions{
+		PathTemplate: defaultPathTemplate,
+	}
+
+	return MbtilesHandlerWithOptions(reader, opts)
+}
+
+// MbtilesHandlerWithOptions returns a handler serving tiles from reader.
+func MbtilesHandlerWithOptions(reader tilepack.MbtilesReader, opts *MbtilesHandlerOptions) gohttp.HandlerFunc {
+
+	pathTemplate := opts.PathTemplate
+
+	if pathTemplate == nil {
+		pathTemplate = defaultPathTemplate
+	}
+
+	format := defaultFormat
+
+	metadata, err := reader.Metadata()
+
+	if err != nil {
+		tilepack.Logf(tilepack.LogLevelWarn, "Couldn't read metadata, assuming %s tiles: %+v", format, err)
+	} else if f, ok := metadata["format"]; ok && f != "" {
+		format = strings.ToLower(f)
+	}
+
+	defaultContentType, ok := formatContentTypes[format]
+
+	if !ok {
+		tilepack.Logf(tilepack.LogLevelWarn, "Unknown tile format %s, serving as application/octet-stream", format)
+		defaultContentType = "application/octet-stream"
+	}
+
+	overzoom := opts.Overzoom
+	var maxZoom uint
+
+	if overzoom {
+		_, maxZoom, err = reader.GetZoomRange()
+
+		if err != nil {
+			tilepack.Logf(tilepack.LogLevelWarn, "Couldn't read zoom range, not overzooming: %+v", err)
+			overzoom = false
+		}
+	}
 
 	return func(w gohttp.ResponseWriter, r *gohttp.Request) {
-		requestedTile, err := parseTileFromPath(r.URL.Path)
+		requestedTile, err := pathTemplate.ParseTile(r.URL.Path)
 		if err != nil {
 			gohttp.NotFound(w, r)
 			return
 		}
 
+		start := time.Now()
 		result, err := reader.GetTile(requestedTile)
+
+		if overzoom && err == nil && result.Data == nil && requestedTile.Z > maxZoom {
+			result, err = getAncestorTile(reader, requestedTile, maxZoom)
+
+			if err == nil && result.Data != nil {
+				w.Header().Set(overzoomHeader, strconv.Itoa(int(result.Tile.Z)))
+			}
+		}
+
+		if opts.Metrics != nil {
+			// Errors are served as 404s too, so they count as missing
+			opts.Metrics.observeGetTile(requestedTile.Z, time.Since(start), err == nil && result.Data != nil)
+		}
+
 		if err != nil {
-			log.Printf("Error getting tile: %+v", err)
+			tilepack.Logf(tilepack.LogLevelError, "Error getting tile: %+v", err)
 			gohttp.NotFound(w, r)
 			return
 		}
@@ -35,27 +133,69 @@ func MbtilesHandler(reader tilepack.MbtilesReader) gohttp.HandlerFunc {
 			return
 		}
 
-		acceptEncoding := r.Header.Get("Accept-Encoding")
-		if strings.Contains(acceptEncoding, "gzip") {
-			w.Header().Set("Content-Encoding", "gzip")
-		} else {
-			log.Printf("Requester doesn't accept gzip but our mbtiles have gzip in them")
+		data := *result.Data
+
+		// Archives can contain tiny placeholder tiles for areas with no data
+		if len(data) < opts.MinTileBytes {
+			gohttp.NotFound(w, r)
+			return
 		}
 
-		w.Header().Set("Content-Type", "application/x-protobuf")
-		w.Write(*result.Data)
+		if tilepack.IsGzipped(data) {
+			// The same URL can be served with or without compression
+			w.Header().Set("Vary", "Accept-Encoding")
+
+			if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+				w.Header().Set("Content-Encoding", "gzip")
+			} else {
+				data, err = tilepack.Gunzip(data)
+				if err != nil {
+					tilepack.Logf(tilepack.LogLevelError, "Error decompressing tile: %+v", err)
+					gohttp.Error(w, "Couldn't decompress tile", gohttp.StatusInternalServerError)
+					return
+				}
+			}
+		}
+
+		// Tiles are identified by the md5 of the data sent, like the mbtiles
+		// outputter does, so compressed and uncompressed tiles differ
+		hash := md5.Sum(data)
+		etag := `"` + hex.EncodeToString(hash[:]) + `"`
+
+		w.Header().Set("ETag", etag)
+
+		if opts.MaxAge > 0 {
+			w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(opts.MaxAge.Seconds())))
+		}
+
+		// Archives can mix formats, so prefer what the tile itself looks like
+		contentType := defaultContentType
+
+		if detected := tilepack.DetectFormat(data); detected != "" {
+			contentType = formatContentTypes[detected]
+		}
+
+		w.Header().Set("Content-Type", contentType)
+
+		// ServeContent handles If-None-Match, using the ETag, and range requests
+		gohttp.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
 	}
 }
 
-func parseTileFromPath(url string) (*tilepack.Tile, error) {
-	match := tilezenRegex.FindStringSubmatch(url)
-	if match == nil {
-		return nil, fmt.Errorf("invalid tile path")
+// getAncestorTile returns the closest ancestor of tile, at or below maxZoom,
+// that's in reader. Its Data is nil if there isn't one.
+func getAncestorTile(reader tilepack.MbtilesReader, tile *tilepack.Tile, maxZoom uint) (*tilepack.TileData, error) {
+	for tile.Z > maxZoom {
+		tile = tile.Parent()
 	}
 
-	z, _ := strconv.ParseUint(match[1], 10, 32)
-	x, _ := strconv.ParseUint(match[2], 10, 32)
-	y, _ := strconv.ParseUint(match[3], 10, 32)
+	for {
+		result, err := reader.GetTile(tile)
 
-	return &tilepack.Tile{Z: uint(z), X: uint(x), Y: uint(y)}, nil
+		if err != nil || result.Data != nil || tile.Z == 0 {
+			return result, err
+		}
+
+		tile = tile.Parent()
+	}
 }
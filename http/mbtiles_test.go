@@ -0,0 +1,295 @@
+package http
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	gohttp "net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tilezen/go-tilepacks/tilepack"
+)
+
+func TestMbtilesHandler_ETag(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "4", "3"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "4", "3", "5.mvt"), []byte("tile"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := tilepack.NewDiskReader(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := MbtilesHandlerWithOptions(reader, &MbtilesHandlerOptions{
+		PathTemplate: MustCompilePathTemplate("/tiles/{z}/{x}/{y}.mvt"),
+		MaxAge:       time.Hour,
+	})
+
+	// md5 of "tile"
+	etag := `"13181d8cc01e390bf64c9e4b0d7a79f3"`
+
+	resp := httptest.NewRecorder()
+	handler(resp, httptest.NewRequest("GET", "/tiles/4/3/5.mvt", nil))
+
+	if resp.Code != gohttp.StatusOK {
+		t.Fatalf("Got status %d, want 200", resp.Code)
+	}
+
+	if got := resp.Header().Get("ETag"); got != etag {
+		t.Errorf("Got ETag %s, want %s", got, etag)
+	}
+
+	if got := resp.Header().Get("Cache-Control"); got != "max-age=3600" {
+		t.Errorf("Got Cache-Control %s, want max-age=3600", got)
+	}
+
+	tests := []struct {
+		ifNoneMatch string
+		status      int
+	}{
+		{etag, gohttp.StatusNotModified},
+		{`"other", ` + etag, gohttp.StatusNotModified},
+		{"W/" + etag, gohttp.StatusNotModified},
+		{`"other"`, gohttp.StatusOK},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/tiles/4/3/5.mvt", nil)
+		req.Header.Set("If-None-Match", test.ifNoneMatch)
+
+		resp := httptest.NewRecorder()
+		handler(resp, req)
+
+		if resp.Code != test.status {
+			t.Errorf("If-None-Match %s got status %d, want %d", test.ifNoneMatch, resp.Code, test.status)
+		}
+	}
+}
+
+func TestMbtilesHandler_Gzip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "4", "3"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// An empty layer
+	mvt := []byte{0x1a, 0x00}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(mvt)
+	gz.Close()
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "4", "3", "5.mvt"), buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tiles gzipped by older builds were flushed but not closed
+	var flushed bytes.Buffer
+	gz = gzip.NewWriter(&flushed)
+	gz.Write(mvt)
+	gz.Flush()
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "4", "3", "6.mvt"), flushed.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := tilepack.NewDiskReader(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := MbtilesHandlerWithOptions(reader, &MbtilesHandlerOptions{
+		PathTemplate: MustCompilePathTemplate("/tiles/{z}/{x}/{y}.mvt"),
+	})
+
+	tests := []struct {
+		path            string
+		acceptEncoding  string
+		contentEncoding string
+		body            []byte
+	}{
+		{"/tiles/4/3/5.mvt", "gzip, deflate", "gzip", buf.Bytes()},
+		{"/tiles/4/3/5.mvt", "", "", mvt},
+		{"/tiles/4/3/6.mvt", "", "", mvt},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.path, nil)
+		req.Header.Set("Accept-Encoding", test.acceptEncoding)
+
+		resp := httptest.NewRecorder()
+		handler(resp, req)
+
+		if got := resp.Header().Get("Content-Encoding"); got != test.contentEncoding {
+			t.Errorf("Accept-Encoding %q got Content-Encoding %q, want %q", test.acceptEncoding, got, test.contentEncoding)
+		}
+
+		if !bytes.Equal(resp.Body.Bytes(), test.body) {
+			t.Errorf("Accept-Encoding %q got body %v, want %v", test.acceptEncoding, resp.Body.Bytes(), test.body)
+		}
+
+		if got := resp.Header().Get("Content-Type"); got != "application/x-protobuf" {
+			t.Errorf("Accept-Encoding %q got Content-Type %s", test.acceptEncoding, got)
+		}
+	}
+}
+
+func TestMbtilesHandler_Range(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "4", "3"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "4", "3", "5.mvt"), []byte("tile"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := tilepack.NewDiskReader(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := MbtilesHandlerWithOptions(reader, &MbtilesHandlerOptions{
+		PathTemplate: MustCompilePathTemplate("/tiles/{z}/{x}/{y}.mvt"),
+	})
+
+	req := httptest.NewRequest("GET", "/tiles/4/3/5.mvt", nil)
+	req.Header.Set("Range", "bytes=1-2")
+
+	resp := httptest.NewRecorder()
+	handler(resp, req)
+
+	if resp.Code != gohttp.StatusPartialContent {
+		t.Fatalf("Got status %d, want 206", resp.Code)
+	}
+
+	if got := resp.Body.String(); got != "il" {
+		t.Errorf("Got body %q, want \"il\"", got)
+	}
+
+	if got := resp.Header().Get("Content-Range"); got != "bytes 1-2/4" {
+		t.Errorf("Got Content-Range %s, want bytes 1-2/4", got)
+	}
+}
+
+func TestMbtilesHandler_MinTileBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "4", "3"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "4", "3", "5.mvt"), []byte("tile"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "4", "3", "6.mvt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := tilepack.NewDiskReader(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := MbtilesHandlerWithOptions(reader, &MbtilesHandlerOptions{
+		PathTemplate: MustCompilePathTemplate("/tiles/{z}/{x}/{y}.mvt"),
+		MinTileBytes: 2,
+	})
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/tiles/4/3/5.mvt", gohttp.StatusOK},
+		{"/tiles/4/3/6.mvt", gohttp.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		resp := httptest.NewRecorder()
+		handler(resp, httptest.NewRequest("GET", test.path, nil))
+
+		if resp.Code != test.status {
+			t.Errorf("%s got status %d, want %d", test.path, resp.Code, test.status)
+		}
+	}
+}
+
+func TestMbtilesHandler_Overzoom(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "4", "3"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "4", "3", "5.mvt"), []byte("tile"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := tilepack.NewDiskReader(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := MbtilesHandlerWithOptions(reader, &MbtilesHandlerOptions{
+		PathTemplate: MustCompilePathTemplate("/tiles/{z}/{x}/{y}.mvt"),
+		Overzoom:     true,
+	})
+
+	tests := []struct {
+		path     string
+		status   int
+		overzoom string
+	}{
+		{"/tiles/4/3/5.mvt", gohttp.StatusOK, ""},
+		{"/tiles/6/13/22.mvt", gohttp.StatusOK, "4"},
+		{"/tiles/6/0/0.mvt", gohttp.StatusNotFound, ""},
+		{"/tiles/4/3/6.mvt", gohttp.StatusNotFound, ""},
+	}
+
+	for _, test := range tests {
+		resp := httptest.NewRecorder()
+		handler(resp, httptest.NewRequest("GET", test.path, nil))
+
+		if resp.Code != test.status {
+			t.Errorf("%s got status %d, want %d", test.path, resp.Code, test.status)
+		}
+
+		if got := resp.Header().Get("X-Overzoom"); got != test.overzoom {
+			t.Errorf("%s got X-Overzoom %q, want %q", test.path, got, test.overzoom)
+		}
+	}
+}
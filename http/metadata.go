@@ -0,0 +1,30 @@
+package http
+
+import (
+	"encoding/json"
+	"github.com/tilezen/go-tilepacks/tilepack"
+	gohttp "net/http"
+)
+
+// MetadataHandler returns a handler that writes the metadata of reader as a
+// JSON object of names to values, exactly as they are stored in the archive.
+func MetadataHandler(reader tilepack.MbtilesReader) gohttp.HandlerFunc {
+
+	return func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		metadata, err := reader.Metadata()
+
+		if err != nil {
+			tilepack.Logf(tilepack.LogLevelError, "Error reading metadata: %+v", err)
+			gohttp.Error(w, "Couldn't read metadata", gohttp.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		err = json.NewEncoder(w).Encode(metadata)
+
+		if err != nil {
+			tilepack.Logf(tilepack.LogLevelWarn, "Error writing metadata: %+v", err)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package http
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tilezen/go-tilepacks/tilepack"
+)
+
+func TestMetadataHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "metadata.mbtiles")
+
+	o, err := tilepack.NewMbtilesOutputter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.AssignMetadata(&tilepack.LngLatBbox{West: -1, South: -1, East: 1, North: 1}, 0, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.SetMetadata("json", `{"vector_layers":[]}`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := tilepack.NewMbtilesReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	resp := httptest.NewRecorder()
+	MetadataHandler(reader)(resp, httptest.NewRequest("GET", "/metadata.json", nil))
+
+	var metadata map[string]string
+
+	if err := json.Unmarshal(resp.Body.Bytes(), &metadata); err != nil {
+		t.Fatal(err)
+	}
+
+	if metadata["maxzoom"] != "4" || metadata["json"] != `{"vector_layers":[]}` {
+		t.Errorf("Unexpected metadata %+v", metadata)
+	}
+}
@@ -0,0 +1,93 @@
+package http
+
+import (
+	"fmt"
+	gohttp "net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// getTileBuckets are the upper bounds, in seconds, of the GetTile latency histogram.
+var getTileBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+// Metrics counts the tile requests served by MbtilesHandlers and how long they
+// took to read, for Prometheus to scrape from Handler.
+type Metrics struct {
+	mu             sync.Mutex
+	requests       map[uint]uint64
+	missing        uint64
+	bucketCounts   []uint64
+	getTileCount   uint64
+	getTileSeconds float64
+}
+
+// NewMetrics returns an empty Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:     make(map[uint]uint64),
+		bucketCounts: make([]uint64, len(getTileBuckets)),
+	}
+}
+
+// observeGetTile records a tile request at zoom whose GetTile call took elapsed.
+func (m *Metrics) observeGetTile(zoom uint, elapsed time.Duration, found bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[zoom]++
+
+	if !found {
+		m.missing++
+	}
+
+	secs := elapsed.Seconds()
+
+	for i, bound := range getTileBuckets {
+		if secs <= bound {
+			m.bucketCounts[i]++
+		}
+	}
+
+	m.getTileCount++
+	m.getTileSeconds += secs
+}
+
+// Handler returns a handler that writes the metrics in the Prometheus text format.
+func (m *Metrics) Handler() gohttp.HandlerFunc {
+
+	return func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		fmt.Fprintln(w, "# HELP tilepack_tile_requests_total Tile requests, by requested zoom level.")
+		fmt.Fprintln(w, "# TYPE tilepack_tile_requests_total counter")
+
+		zooms := make([]int, 0, len(m.requests))
+		for z := range m.requests {
+			zooms = append(zooms, int(z))
+		}
+		sort.Ints(zooms)
+
+		for _, z := range zooms {
+			fmt.Fprintf(w, "tilepack_tile_requests_total{zoom=\"%d\"} %d\n", z, m.requests[uint(z)])
+		}
+
+		fmt.Fprintln(w, "# HELP tilepack_tiles_missing_total Tile requests for tiles that aren't in the archive.")
+		fmt.Fprintln(w, "# TYPE tilepack_tiles_missing_total counter")
+		fmt.Fprintf(w, "tilepack_tiles_missing_total %d\n", m.missing)
+
+		fmt.Fprintln(w, "# HELP tilepack_get_tile_seconds Time taken to read tiles from the archive.")
+		fmt.Fprintln(w, "# TYPE tilepack_get_tile_seconds histogram")
+
+		for i, bound := range getTileBuckets {
+			fmt.Fprintf(w, "tilepack_get_tile_seconds_bucket{le=\"%g\"} %d\n", bound, m.bucketCounts[i])
+		}
+
+		fmt.Fprintf(w, "tilepack_get_tile_seconds_bucket{le=\"+Inf\"} %d\n", m.getTileCount)
+		fmt.Fprintf(w, "tilepack_get_tile_seconds_sum %g\n", m.getTileSeconds)
+		fmt.Fprintf(w, "tilepack_get_tile_seconds_count %d\n", m.getTileCount)
+	}
+}
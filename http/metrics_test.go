@@ -0,0 +1,36 @@
+package http
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics_Handler(t *testing.T) {
+	m := NewMetrics()
+
+	m.observeGetTile(4, 2*time.Millisecond, true)
+	m.observeGetTile(4, 20*time.Millisecond, false)
+	m.observeGetTile(12, 2*time.Second, true)
+
+	resp := httptest.NewRecorder()
+	m.Handler()(resp, httptest.NewRequest("GET", "/metrics", nil))
+
+	body := resp.Body.String()
+
+	for _, want := range []string{
+		`tilepack_tile_requests_total{zoom="4"} 2`,
+		`tilepack_tile_requests_total{zoom="12"} 1`,
+		`tilepack_tiles_missing_total 1`,
+		`tilepack_get_tile_seconds_bucket{le="0.0025"} 1`,
+		`tilepack_get_tile_seconds_bucket{le="0.025"} 2`,
+		`tilepack_get_tile_seconds_bucket{le="1"} 2`,
+		`tilepack_get_tile_seconds_bucket{le="+Inf"} 3`,
+		`tilepack_get_tile_seconds_count 3`,
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("Metrics don't contain %s", want)
+		}
+	}
+}
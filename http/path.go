@@ -0,0 +1,132 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"github.com/tilezen/go-tilepacks/tilepack"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultPathTemplate is the path tiles are served from if no other template is specified.
+const DefaultPathTemplate = "/tilezen/vector/v1/512/all/{z}/{x}/{y}.mvt"
+
+var (
+	pathTokenRegex = regexp.MustCompile(`\{(z|x|y|-y)\}`)
+)
+
+// PathTemplate is a compiled tile URL path, for example "/tiles/{z}/{x}/{y}.png".
+// A template may use {-y} instead of {y} to flip requested Y values (between TMS
+// and XYZ ordering) before they are looked up.
+type PathTemplate struct {
+	template  string
+	regex     *regexp.Regexp
+	invertedY bool
+}
+
+// CompilePathTemplate parses a path template containing exactly one each of the
+// {z}, {x} and {y} (or {-y}) tokens.
+func CompilePathTemplate(template string) (*PathTemplate, error) {
+	if !strings.HasPrefix(template, "/") {
+		return nil, errors.New("Path template must start with /")
+	}
+
+	counts := make(map[string]int)
+	expr := "^"
+	last := 0
+
+	for _, m := range pathTokenRegex.FindAllStringSubmatchIndex(template, -1) {
+		token := template[m[2]:m[3]]
+		counts[token]++
+
+		group := token
+		if token == "-y" {
+			group = "y"
+		}
+
+		expr += regexp.QuoteMeta(template[last:m[0]])
+		expr += fmt.Sprintf(`(?P<%s>\d+)`, group)
+		last = m[1]
+	}
+
+	expr += regexp.QuoteMeta(template[last:]) + "$"
+
+	if counts["z"] != 1 || counts["x"] != 1 || counts["y"]+counts["-y"] != 1 {
+		return nil, fmt.Errorf("Path template %s must contain exactly one each of {z}, {x} and {y} or {-y}", template)
+	}
+
+	regex, err := regexp.Compile(expr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	t := &PathTemplate{
+		template:  template,
+		regex:     regex,
+		invertedY: counts["-y"] == 1,
+	}
+
+	return t, nil
+}
+
+// MustCompilePathTemplate is like CompilePathTemplate but panics if the template is invalid.
+func MustCompilePathTemplate(template string) *PathTemplate {
+	t, err := CompilePathTemplate(template)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return t
+}
+
+// Prefix returns the static directory part of the template, suitable for
+// registering the handler with a http.ServeMux.
+func (t *PathTemplate) Prefix() string {
+	prefix := t.template[:strings.Index(t.template, "{")]
+	return prefix[:strings.LastIndex(prefix, "/")+1]
+}
+
+// String returns the uncompiled template.
+func (t *PathTemplate) String() string {
+	return t.template
+}
+
+// ParseTile returns the tile addressed by path.
+func (t *PathTemplate) ParseTile(path string) (*tilepack.Tile, error) {
+	match := t.regex.FindStringSubmatch(path)
+	if match == nil {
+		return nil, fmt.Errorf("invalid tile path")
+	}
+
+	var z, x, y uint64
+
+	for i, name := range t.regex.SubexpNames() {
+		var err error
+
+		switch name {
+		case "z":
+			z, err = strconv.ParseUint(match[i], 10, 32)
+		case "x":
+			x, err = strconv.ParseUint(match[i], 10, 32)
+		case "y":
+			y, err = strconv.ParseUint(match[i], 10, 32)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid tile path")
+		}
+	}
+
+	if z >= 32 || x >= 1<<z || y >= 1<<z {
+		return nil, fmt.Errorf("invalid tile path")
+	}
+
+	if t.invertedY {
+		y = (1 << z) - 1 - y
+	}
+
+	return &tilepack.Tile{Z: uint(z), X: uint(x), Y: uint(y)}, nil
+}
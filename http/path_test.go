@@ -0,0 +1,47 @@
+package http
+
+import (
+	"testing"
+
+	"github.com/tilezen/go-tilepacks/tilepack"
+)
+
+func TestPathTemplate_ParseTile(t *testing.T) {
+	tests := []struct {
+		template string
+		path     string
+		want     *tilepack.Tile
+	}{
+		{DefaultPathTemplate, "/tilezen/vector/v1/512/all/4/3/5.mvt", &tilepack.Tile{X: 3, Y: 5, Z: 4}},
+		{"/tiles/{z}/{x}/{y}.png", "/tiles/4/3/5.png", &tilepack.Tile{X: 3, Y: 5, Z: 4}},
+		{"/tiles/{z}/{x}/{-y}.png", "/tiles/4/3/5.png", &tilepack.Tile{X: 3, Y: 10, Z: 4}},
+		{"/tiles/{z}/{x}/{y}.png", "/tiles/4/3/5.jpg", nil},
+		{"/tiles/{z}/{x}/{y}.png", "/tiles/4/16/5.png", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			pathTemplate, err := CompilePathTemplate(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := pathTemplate.ParseTile(tt.path)
+			if tt.want == nil {
+				if err == nil {
+					t.Errorf("ParseTile() = %v, want error", got)
+				}
+				return
+			}
+			if err != nil || !got.Equals(tt.want) {
+				t.Errorf("ParseTile() = %v, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompilePathTemplate_Invalid(t *testing.T) {
+	for _, template := range []string{"tiles/{z}/{x}/{y}", "/tiles/{z}/{x}", "/tiles/{z}/{x}/{y}/{-y}"} {
+		if _, err := CompilePathTemplate(template); err == nil {
+			t.Errorf("CompilePathTemplate(%s) should fail", template)
+		}
+	}
+}
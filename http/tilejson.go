@@ -0,0 +1,155 @@
+package http
+
+import (
+	"encoding/json"
+	"github.com/tilezen/go-tilepacks/tilepack"
+	gohttp "net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	tileJSONVersion = "3.0.0"
+)
+
+// TileJSON is a TileJSON 3.0.0 document, see https://github.com/mapbox/tilejson-spec
+type TileJSON struct {
+	TileJSON     string            `json:"tilejson"`
+	Tiles        []string          `json:"tiles"`
+	Scheme       string            `json:"scheme,omitempty"`
+	Name         string            `json:"name,omitempty"`
+	Description  string            `json:"description,omitempty"`
+	Attribution  string            `json:"attribution,omitempty"`
+	MinZoom      *uint             `json:"minzoom,omitempty"`
+	MaxZoom      *uint             `json:"maxzoom,omitempty"`
+	Bounds       []float64         `json:"bounds,omitempty"`
+	Center       []float64         `json:"center,omitempty"`
+	VectorLayers []json.RawMessage `json:"vector_layers,omitempty"`
+}
+
+// TileJSONHandler returns a handler that describes the tiles served by a
+// MbtilesHandler at pathTemplate as a TileJSON document. The document is built
+// from the mbtiles metadata, falling back to the tiles themselves for the zoom
+// range and bounds. If publicURL is empty it is derived from each request.
+func TileJSONHandler(reader tilepack.MbtilesReader, pathTemplate *PathTemplate, publicURL string) gohttp.HandlerFunc {
+
+	return func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		doc, err := newTileJSON(reader, pathTemplate, requestBaseURL(r, publicURL))
+
+		if err != nil {
+			tilepack.Logf(tilepack.LogLevelError, "Error building TileJSON: %+v", err)
+			gohttp.Error(w, "Couldn't build TileJSON", gohttp.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		err = json.NewEncoder(w).Encode(doc)
+
+		if err != nil {
+			tilepack.Logf(tilepack.LogLevelWarn, "Error writing TileJSON: %+v", err)
+		}
+	}
+}
+
+// requestBaseURL returns publicURL, or the scheme and host of r if it's empty,
+// without a trailing slash.
+func requestBaseURL(r *gohttp.Request, publicURL string) string {
+	baseURL := publicURL
+
+	if baseURL == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		baseURL = scheme + "://" + r.Host
+	}
+
+	return strings.TrimRight(baseURL, "/")
+}
+
+func newTileJSON(reader tilepack.MbtilesReader, pathTemplate *PathTemplate, baseURL string) (*TileJSON, error) {
+	metadata, err := reader.Metadata()
+
+	if err != nil {
+		return nil, err
+	}
+
+	tilesURL := baseURL + pathTemplate.String()
+
+	doc := &TileJSON{
+		TileJSON:    tileJSONVersion,
+		Name:        metadata["name"],
+		Description: metadata["description"],
+		Attribution: metadata["attribution"],
+	}
+
+	if pathTemplate.invertedY {
+		tilesURL = strings.Replace(tilesURL, "{-y}", "{y}", 1)
+		doc.Scheme = "tms"
+	}
+
+	doc.Tiles = []string{tilesURL}
+
+	minZoom, minErr := strconv.ParseUint(metadata["minzoom"], 10, 32)
+	maxZoom, maxErr := strconv.ParseUint(metadata["maxzoom"], 10, 32)
+
+	if minErr == nil && maxErr == nil {
+		doc.MinZoom = uintPtr(uint(minZoom))
+		doc.MaxZoom = uintPtr(uint(maxZoom))
+	} else if min, max, err := reader.GetZoomRange(); err == nil {
+		doc.MinZoom = uintPtr(min)
+		doc.MaxZoom = uintPtr(max)
+	}
+
+	if bounds, err := parseFloats(metadata["bounds"], 4); err == nil {
+		doc.Bounds = bounds
+	} else if extent, err := reader.GetTileExtent(); err == nil {
+		doc.Bounds = []float64{extent.Bounds.West, extent.Bounds.South, extent.Bounds.East, extent.Bounds.North}
+	}
+
+	if center, err := parseFloats(metadata["center"], 3); err == nil {
+		doc.Center = center
+	} else if len(doc.Bounds) == 4 && doc.MinZoom != nil {
+		doc.Center = []float64{(doc.Bounds[0] + doc.Bounds[2]) / 2.0, (doc.Bounds[1] + doc.Bounds[3]) / 2.0, float64(*doc.MinZoom)}
+	}
+
+	// Vector tilesets describe their layers in the "json" metadata key
+	if layers, ok := metadata["json"]; ok {
+		var vectorJSON struct {
+			VectorLayers []json.RawMessage `json:"vector_layers"`
+		}
+
+		if err := json.Unmarshal([]byte(layers), &vectorJSON); err == nil {
+			doc.VectorLayers = vectorJSON.VectorLayers
+		}
+	}
+
+	return doc, nil
+}
+
+func parseFloats(str string, count int) ([]float64, error) {
+	parts := strings.Split(str, ",")
+
+	if len(parts) != count {
+		return nil, strconv.ErrSyntax
+	}
+
+	floats := make([]float64, count)
+
+	for i, part := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+
+		if err != nil {
+			return nil, err
+		}
+
+		floats[i] = f
+	}
+
+	return floats, nil
+}
+
+func uintPtr(v uint) *uint {
+	return &v
+}
@@ -0,0 +1,130 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/tilezen/go-tilepacks/tilepack"
+)
+
+func TestTileJSONHandler(t *testing.T) {
+	o := tilepack.NewMemoryOutputter()
+
+	if err := o.Save(&tilepack.Tile{Z: 2, X: 1, Y: 1}, []byte("tile")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.Save(&tilepack.Tile{Z: 3, X: 2, Y: 2}, []byte("tile")); err != nil {
+		t.Fatal(err)
+	}
+
+	metadata := map[string]string{
+		"name":        "basemap",
+		"attribution": "OpenStreetMap",
+		"json":        `{"vector_layers":[{"id":"water","fields":{}}]}`,
+	}
+
+	for name, value := range metadata {
+		if err := o.SetMetadata(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reader := tilepack.NewMemoryReader(o)
+
+	tests := []struct {
+		name      string
+		template  string
+		publicURL string
+		tiles     string
+		scheme    string
+	}{
+		{"host", "/basemap/{z}/{x}/{y}.mvt", "", "http://tiles.example.com/basemap/{z}/{x}/{y}.mvt", ""},
+		{"public URL", "/basemap/{z}/{x}/{y}.mvt", "https://cdn.example.com/", "https://cdn.example.com/basemap/{z}/{x}/{y}.mvt", ""},
+		{"tms", "/basemap/{z}/{x}/{-y}.mvt", "", "http://tiles.example.com/basemap/{z}/{x}/{y}.mvt", "tms"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := TileJSONHandler(reader, MustCompilePathTemplate(tt.template), tt.publicURL)
+
+			req := httptest.NewRequest("GET", "/basemap/tiles.json", nil)
+			req.Host = "tiles.example.com"
+
+			resp := httptest.NewRecorder()
+			handler(resp, req)
+
+			if got := resp.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("Got Content-Type %s, want application/json", got)
+			}
+
+			var doc TileJSON
+
+			if err := json.Unmarshal(resp.Body.Bytes(), &doc); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(doc.Tiles) != 1 || doc.Tiles[0] != tt.tiles {
+				t.Errorf("Got tiles %v, want %s", doc.Tiles, tt.tiles)
+			}
+
+			if doc.Scheme != tt.scheme {
+				t.Errorf("Got scheme %q, want %q", doc.Scheme, tt.scheme)
+			}
+		})
+	}
+
+	doc, err := newTileJSON(reader, MustCompilePathTemplate("/basemap/{z}/{x}/{y}.mvt"), "http://tiles.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if doc.TileJSON != tileJSONVersion || doc.Name != "basemap" || doc.Attribution != "OpenStreetMap" {
+		t.Errorf("Unexpected TileJSON %+v", doc)
+	}
+
+	// Without zoom or bounds metadata, they come from the tiles
+	if doc.MinZoom == nil || *doc.MinZoom != 2 || doc.MaxZoom == nil || *doc.MaxZoom != 3 {
+		t.Errorf("Got zoom range %v-%v, want 2-3", doc.MinZoom, doc.MaxZoom)
+	}
+
+	// The extent of the tiles at the maximum zoom level
+	b := (&tilepack.Tile{Z: 3, X: 2, Y: 2}).Bounds()
+
+	if want := []float64{b.West, b.South, b.East, b.North}; !reflect.DeepEqual(doc.Bounds, want) {
+		t.Errorf("Got bounds %v, want %v", doc.Bounds, want)
+	}
+
+	if want := []float64{(b.West + b.East) / 2, (b.South + b.North) / 2, 2}; !reflect.DeepEqual(doc.Center, want) {
+		t.Errorf("Got center %v, want %v", doc.Center, want)
+	}
+
+	if len(doc.VectorLayers) != 1 || string(doc.VectorLayers[0]) != `{"id":"water","fields":{}}` {
+		t.Errorf("Got vector layers %s, want the water layer", doc.VectorLayers)
+	}
+
+	// Metadata takes precedence over the tiles
+	o.SetMetadata("minzoom", "0")
+	o.SetMetadata("maxzoom", "14")
+	o.SetMetadata("bounds", "-180,-85,180,85")
+	o.SetMetadata("center", "1,2,3")
+
+	doc, err = newTileJSON(reader, MustCompilePathTemplate("/basemap/{z}/{x}/{y}.mvt"), "http://tiles.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *doc.MinZoom != 0 || *doc.MaxZoom != 14 {
+		t.Errorf("Got zoom range %d-%d, want 0-14", *doc.MinZoom, *doc.MaxZoom)
+	}
+
+	if want := []float64{-180, -85, 180, 85}; !reflect.DeepEqual(doc.Bounds, want) {
+		t.Errorf("Got bounds %v, want %v", doc.Bounds, want)
+	}
+
+	if want := []float64{1, 2, 3}; !reflect.DeepEqual(doc.Center, want) {
+		t.Errorf("Got center %v, want %v", doc.Center, want)
+	}
+}
@@ -1,5 +1,10 @@
 package tilepack
 
+import (
+	"bytes"
+	"time"
+)
+
 type TileRequest struct {
 	Tile *Tile
 	URL  string
@@ -9,4 +14,196 @@ type TileResponse struct {
 	Tile    *Tile
 	Data    []byte
 	Elapsed float64
+	// StatusCode is the HTTP status of the response the tile came from, if any.
+	StatusCode int
+}
+
+// DefaultProgressInterval is the number of tiles ProcessResults saves between
+// calls to its progress func.
+const DefaultProgressInterval = 10000
+
+// ProcessResultsOptions configures ProcessResults.
+type ProcessResultsOptions struct {
+	// Progress, if set, is called every ProgressInterval saved tiles with the
+	// total saved so far and the rate, in tiles per second, since the last call.
+	Progress func(saved int, tps float64)
+	// ProgressInterval defaults to DefaultProgressInterval.
+	ProgressInterval int
+	// CheckpointInterval, if set, is how often the outputter is flushed.
+	CheckpointInterval time.Duration
+	// Stats, if set, records the size and fetch time of every saved tile.
+	Stats *StatsWriter
+	// EmptyTile, if set, is the contents of an empty tile. Tiles that match
+	// it exactly, once uncompressed, are dropped instead of saved.
+	EmptyTile []byte
+	// MinSize, if set, drops tiles that are smaller than this many bytes
+	// once uncompressed.
+	MinSize int
+	// State, if set, records the saved tiles. They are committed to it each
+	// time the outputter is flushed, and once it has been closed, so it never
+	// has tiles the outputter could still lose.
+	State *CrawlState
+	// VectorLayers, if set, collects the layers of the saved tiles. If any
+	// are found they're described in the "json" metadata of outputters that
+	// are MetadataSetters before they're closed.
+	VectorLayers *VectorLayers
+	// Recompress, if set, re-encodes JPEG and PNG tiles with Recompress before
+	// they're saved. Tiles that can't be re-encoded are saved as they are.
+	Recompress *RecompressOptions
+}
+
+// isEmpty returns true if data matches the empty tile signature in opts.
+func (opts *ProcessResultsOptions) isEmpty(data []byte) bool {
+	if opts.EmptyTile == nil && opts.MinSize <= 0 {
+		return false
+	}
+
+	if IsGzipped(data) {
+		uncompressed, err := Gunzip(data)
+		if err != nil {
+			return false
+		}
+
+		data = uncompressed
+	}
+
+	if opts.EmptyTile != nil && bytes.Equal(data, opts.EmptyTile) {
+		return true
+	}
+
+	return len(data) < opts.MinSize
+}
+
+// ProcessResults saves every tile received from results to out until results
+// is closed, then closes out. It doesn't close opts.State. It returns the
+// number of tiles saved and the error from closing out. Tiles that can't be
+// saved are logged and skipped, as are empty tiles, and aren't counted,
+// recorded in opts.Stats or read for opts.VectorLayers. If out is a
+// NewTileSaver, the number of saved tiles that replaced existing ones is
+// logged too.
+func ProcessResults(results <-chan *TileResponse, out TileOutputter, opts *ProcessResultsOptions) (int, error) {
+	interval := opts.ProgressInterval
+	if interval <= 0 {
+		interval = DefaultProgressInterval
+	}
+
+	start := time.Now()
+	checkpoint := time.Now()
+
+	saver, _ := out.(NewTileSaver)
+
+	counter := 0
+	empty := 0
+	replaced := 0
+	for result := range results {
+		if opts.isEmpty(result.Data) {
+			empty++
+			continue
+		}
+
+		if opts.Recompress != nil {
+			data, err := Recompress(result.Data, opts.Recompress)
+
+			if err != nil {
+				Logf(LogLevelWarn, "Couldn't recompress tile %s: %+v", result.Tile.ToString(), err)
+			} else {
+				result.Data = data
+			}
+		}
+
+		var err error
+
+		if saver != nil {
+			var isNew bool
+			isNew, err = saver.SaveNew(result.Tile, result.Data)
+
+			if err == nil && !isNew {
+				replaced++
+			}
+		} else {
+			err = out.Save(result.Tile, result.Data)
+		}
+
+		if err != nil {
+			Logf(LogLevelError, "Couldn't save tile %+v", err)
+			continue
+		}
+
+		if opts.State != nil {
+			if err := opts.State.Add(result.Tile); err != nil {
+				Logf(LogLevelWarn, "Couldn't record saved tile %+v", err)
+			}
+		}
+
+		counter++
+
+		if opts.VectorLayers != nil {
+			if err := opts.VectorLayers.Add(result.Tile, result.Data); err != nil {
+				Logf(LogLevelWarn, "Couldn't read the layers of tile %s: %+v", result.Tile.ToString(), err)
+			}
+		}
+
+		if opts.Stats != nil {
+			err := opts.Stats.WriteResponse(result)
+			if err != nil {
+				Logf(LogLevelWarn, "Couldn't write tile stats %+v", err)
+			}
+		}
+
+		if opts.CheckpointInterval > 0 && time.Since(checkpoint) >= opts.CheckpointInterval {
+			err := out.Flush()
+			if err != nil {
+				Logf(LogLevelError, "Couldn't flush tiles %+v", err)
+			} else if opts.State != nil {
+				if err := opts.State.Commit(); err != nil {
+					Logf(LogLevelWarn, "Couldn't commit saved tiles %+v", err)
+				}
+			}
+
+			checkpoint = time.Now()
+		}
+
+		if counter%interval == 0 && opts.Progress != nil {
+			duration := time.Since(start)
+			start = time.Now()
+			opts.Progress(counter, float64(interval)/duration.Seconds())
+		}
+	}
+
+	if empty > 0 {
+		Logf(LogLevelInfo, "Skipped %d empty tiles", empty)
+	}
+
+	if replaced > 0 {
+		Logf(LogLevelInfo, "Replaced %d existing tiles", replaced)
+	}
+
+	if opts.Stats != nil {
+		err := opts.Stats.Flush()
+		if err != nil {
+			Logf(LogLevelWarn, "Couldn't write tile stats %+v", err)
+		}
+	}
+
+	if setter, ok := out.(MetadataSetter); ok && opts.VectorLayers != nil && opts.VectorLayers.Len() > 0 {
+		layers, err := opts.VectorLayers.JSON()
+
+		if err == nil {
+			err = setter.SetMetadata("json", layers)
+		}
+
+		if err != nil {
+			Logf(LogLevelWarn, "Couldn't write vector layers metadata %+v", err)
+		}
+	}
+
+	err := out.Close()
+
+	if err == nil && opts.State != nil {
+		if err := opts.State.Commit(); err != nil {
+			Logf(LogLevelWarn, "Couldn't commit saved tiles %+v", err)
+		}
+	}
+
+	return counter, err
 }
@@ -0,0 +1,176 @@
+package tilepack
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProcessResults(t *testing.T) {
+	dir, err := ioutil.TempDir("", "results")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	o, err := NewDiskOutputter("root=" + dir + " format=mvt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := make(chan *TileResponse, 25)
+
+	for i := 0; i < 25; i++ {
+		results <- &TileResponse{Tile: &Tile{Z: 5, X: uint(i), Y: 0}, Data: []byte("tile")}
+	}
+	close(results)
+
+	var progress []int
+
+	opts := &ProcessResultsOptions{
+		Progress: func(saved int, tps float64) {
+			progress = append(progress, saved)
+		},
+		ProgressInterval: 10,
+	}
+
+	saved, err := ProcessResults(results, o, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if saved != 25 {
+		t.Errorf("ProcessResults() saved %d tiles, want 25", saved)
+	}
+
+	if !reflect.DeepEqual(progress, []int{10, 20}) {
+		t.Errorf("Progress called with %v, want [10 20]", progress)
+	}
+}
+
+func TestProcessResults_Empty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "results")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	o, err := NewDiskOutputter("root=" + dir + " format=mvt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write([]byte("empty"))
+	gz.Close()
+
+	results := make(chan *TileResponse, 4)
+	results <- &TileResponse{Tile: &Tile{Z: 5, X: 0, Y: 0}, Data: []byte("empty")}
+	results <- &TileResponse{Tile: &Tile{Z: 5, X: 1, Y: 0}, Data: gzipped.Bytes()}
+	results <- &TileResponse{Tile: &Tile{Z: 5, X: 2, Y: 0}, Data: []byte("tiny")}
+	results <- &TileResponse{Tile: &Tile{Z: 5, X: 3, Y: 0}, Data: []byte("a real tile")}
+	close(results)
+
+	opts := &ProcessResultsOptions{
+		EmptyTile: []byte("empty"),
+		MinSize:   5,
+	}
+
+	saved, err := ProcessResults(results, o, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if saved != 1 {
+		t.Errorf("ProcessResults() saved %d tiles, want 1", saved)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "5", "3", "0.mvt")); err != nil {
+		t.Errorf("Non-empty tile wasn't saved: %v", err)
+	}
+}
+
+func TestProcessResults_State(t *testing.T) {
+	dir, err := ioutil.TempDir("", "results")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	state, err := NewCrawlState(filepath.Join(dir, "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	o, err := NewDiskOutputter("root=" + filepath.Join(dir, "tiles") + " format=mvt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := make(chan *TileResponse, 1)
+	results <- &TileResponse{Tile: &Tile{Z: 5, X: 1, Y: 2}, Data: []byte("tile")}
+	close(results)
+
+	if _, err := ProcessResults(results, o, &ProcessResultsOptions{State: state}); err != nil {
+		t.Fatal(err)
+	}
+
+	if has, err := state.HasTile(&Tile{Z: 5, X: 1, Y: 2}); err != nil || !has {
+		t.Errorf("HasTile() = %v, %v, want true", has, err)
+	}
+}
+
+func TestProcessResults_SaveError(t *testing.T) {
+	o := NewMemoryOutputter()
+
+	// Vector tiles with a layer named "water" and one named "roads"
+	water := []byte{0x1a, 0x09, 0x0a, 0x05, 'w', 'a', 't', 'e', 'r', 0x78, 0x02}
+	roads := []byte{0x1a, 0x09, 0x0a, 0x05, 'r', 'o', 'a', 'd', 's', 0x78, 0x02}
+
+	results := make(chan *TileResponse, 2)
+	results <- &TileResponse{Tile: &Tile{Z: 1, X: 1, Y: 0}, Data: water}
+	// The tile is outside the range of its zoom level, so it can't be saved
+	results <- &TileResponse{Tile: &Tile{Z: 1, X: 2, Y: 0}, Data: roads}
+	close(results)
+
+	var stats bytes.Buffer
+
+	statsWriter, err := NewStatsWriter(&stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &ProcessResultsOptions{
+		Stats:        statsWriter,
+		VectorLayers: NewVectorLayers(0),
+	}
+
+	saved, err := ProcessResults(results, o, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if saved != 1 {
+		t.Errorf("ProcessResults() saved %d tiles, want 1", saved)
+	}
+
+	if rows := strings.Count(stats.String(), "\n"); rows != 2 {
+		t.Errorf("Stats has %d rows, want a header and the saved tile:\n%s", rows, stats.String())
+	}
+
+	metadata, err := NewMemoryReader(o).Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(metadata["json"], "water") || strings.Contains(metadata["json"], "roads") {
+		t.Errorf("Vector layers metadata is %s, want only the saved tile's layers", metadata["json"])
+	}
+}
@@ -0,0 +1,102 @@
+package tilepack
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+)
+
+// CoverageGeoJSONOptions configures ExportCoverageGeoJSONWithOptions.
+type CoverageGeoJSONOptions struct {
+	// InvertY flips the rows of the tiles read from the reader. Tile bounds
+	// are calculated from XYZ rows, so set it for mbtiles that store TMS rows.
+	InvertY bool
+}
+
+type coverageFeature struct {
+	Type       string             `json:"type"`
+	Properties coverageProperties `json:"properties"`
+	Geometry   coverageGeometry   `json:"geometry"`
+}
+
+type coverageProperties struct {
+	Z uint `json:"z"`
+	X uint `json:"x"`
+	Y uint `json:"y"`
+}
+
+type coverageGeometry struct {
+	Type        string         `json:"type"`
+	Coordinates [][][2]float64 `json:"coordinates"`
+}
+
+// ExportCoverageGeoJSON writes a GeoJSON FeatureCollection to w with a polygon
+// for each tile in reader at zoom, showing exactly what the archive covers.
+// Rows are used as they are stored.
+func ExportCoverageGeoJSON(reader MbtilesReader, zoom uint, w io.Writer) error {
+	return ExportCoverageGeoJSONWithOptions(reader, zoom, w, &CoverageGeoJSONOptions{})
+}
+
+// ExportCoverageGeoJSONWithOptions writes a GeoJSON FeatureCollection to w with
+// a polygon for each tile in reader at zoom. Each feature's properties are the
+// tile's XYZ coordinates. Features are written as the tiles are visited, so
+// dense zoom levels aren't held in memory.
+func ExportCoverageGeoJSONWithOptions(reader MbtilesReader, zoom uint, w io.Writer, opts *CoverageGeoJSONOptions) error {
+	buf := bufio.NewWriter(w)
+
+	if _, err := buf.WriteString(`{"type":"FeatureCollection","features":[`); err != nil {
+		return err
+	}
+
+	first := true
+
+	visitor := func(tile *Tile, data []byte) error {
+		if opts.InvertY {
+			tile = &Tile{X: tile.X, Y: (1 << tile.Z) - 1 - tile.Y, Z: tile.Z}
+		}
+
+		b := tile.Bounds()
+
+		feature := &coverageFeature{
+			Type:       "Feature",
+			Properties: coverageProperties{Z: tile.Z, X: tile.X, Y: tile.Y},
+			Geometry: coverageGeometry{
+				Type: "Polygon",
+				Coordinates: [][][2]float64{{
+					{b.West, b.South},
+					{b.East, b.South},
+					{b.East, b.North},
+					{b.West, b.North},
+					{b.West, b.South},
+				}},
+			},
+		}
+
+		encoded, err := json.Marshal(feature)
+		if err != nil {
+			return err
+		}
+
+		if !first {
+			if err := buf.WriteByte(','); err != nil {
+				return err
+			}
+		}
+
+		first = false
+
+		_, err = buf.Write(encoded)
+		return err
+	}
+
+	if err := reader.VisitTilesForZoomWithContext(context.Background(), zoom, visitor); err != nil {
+		return err
+	}
+
+	if _, err := buf.WriteString("]}\n"); err != nil {
+		return err
+	}
+
+	return buf.Flush()
+}
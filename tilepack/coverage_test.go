@@ -0,0 +1,79 @@
+package tilepack
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestExportCoverageGeoJSON(t *testing.T) {
+	o := NewMemoryOutputter()
+
+	for _, tile := range []*Tile{{Z: 1, X: 0, Y: 0}, {Z: 1, X: 1, Y: 1}, {Z: 2, X: 3, Y: 1}} {
+		if err := o.Save(tile, []byte("tile")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reader := NewMemoryReader(o)
+
+	tests := []struct {
+		zoom uint
+		opts *CoverageGeoJSONOptions
+		want []coverageProperties
+	}{
+		{1, &CoverageGeoJSONOptions{}, []coverageProperties{{Z: 1, X: 0, Y: 0}, {Z: 1, X: 1, Y: 1}}},
+		{2, &CoverageGeoJSONOptions{InvertY: true}, []coverageProperties{{Z: 2, X: 3, Y: 2}}},
+		{3, &CoverageGeoJSONOptions{}, nil},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+
+		if err := ExportCoverageGeoJSONWithOptions(reader, test.zoom, &buf, test.opts); err != nil {
+			t.Fatal(err)
+		}
+
+		var collection struct {
+			Type     string             `json:"type"`
+			Features []*coverageFeature `json:"features"`
+		}
+
+		if err := json.Unmarshal(buf.Bytes(), &collection); err != nil {
+			t.Fatalf("Zoom %d: invalid GeoJSON %q: %+v", test.zoom, buf.String(), err)
+		}
+
+		if collection.Type != "FeatureCollection" || len(collection.Features) != len(test.want) {
+			t.Fatalf("Zoom %d: got %s, want %d features", test.zoom, buf.String(), len(test.want))
+		}
+
+		// The memory reader visits tiles in no particular order
+		found := make(map[coverageProperties]*coverageFeature)
+
+		for _, feature := range collection.Features {
+			found[feature.Properties] = feature
+		}
+
+		for _, want := range test.want {
+			feature, ok := found[want]
+
+			if !ok {
+				t.Errorf("Zoom %d: no feature for %+v in %s", test.zoom, want, buf.String())
+				continue
+			}
+
+			bounds := (&Tile{Z: want.Z, X: want.X, Y: want.Y}).Bounds()
+			ring := feature.Geometry.Coordinates[0]
+
+			if feature.Geometry.Type != "Polygon" || len(ring) != 5 || ring[0] != ring[4] {
+				t.Errorf("Zoom %d: %+v isn't a closed polygon", test.zoom, feature.Geometry)
+				continue
+			}
+
+			if math.Abs(ring[0][0]-bounds.West) > 1e-9 || math.Abs(ring[2][1]-bounds.North) > 1e-9 {
+				t.Errorf("Zoom %d: %v doesn't match the bounds of %+v, %+v", test.zoom, ring, want, bounds)
+			}
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package tilepack
+
+import (
+	"database/sql"
+
+	_ "github.com/mattn/go-sqlite3" // Register sqlite3 database driver
+)
+
+// crawlStateSchema records the coordinates of each saved tile.
+const crawlStateSchema = `
+	CREATE TABLE IF NOT EXISTS saved_tiles (
+		zoom_level INTEGER NOT NULL,
+		tile_column INTEGER NOT NULL,
+		tile_row INTEGER NOT NULL,
+		PRIMARY KEY (zoom_level, tile_column, tile_row)
+	);
+`
+
+// CrawlState records the tiles a build has saved in a small SQLite database,
+// separate from the output, so that a build of any output format can be
+// resumed by skipping the tiles it already has. It implements TileChecker.
+//
+// Tiles are added to a transaction that isn't committed until Commit is
+// called, which should only be done once the output has durably saved them.
+// It is safe to call HasTile while tiles are being added.
+type CrawlState struct {
+	db  *sql.DB
+	txn *sql.Tx
+}
+
+// NewCrawlState opens the crawl state database at path, creating it if it
+// doesn't exist.
+func NewCrawlState(path string) (*CrawlState, error) {
+	// WAL lets HasTile read the database while tiles are being added
+	db, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_synchronous=NORMAL")
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := db.Exec(crawlStateSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &CrawlState{db: db}, nil
+}
+
+// HasTile returns true if the tile has been added and committed.
+func (s *CrawlState) HasTile(tile *Tile) (bool, error) {
+	var exists int
+
+	result := s.db.QueryRow("SELECT 1 FROM saved_tiles WHERE zoom_level=? AND tile_column=? AND tile_row=? LIMIT 1", tile.Z, tile.X, tile.Y)
+	err := result.Scan(&exists)
+
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Add records that the tile has been saved, once Commit is called.
+func (s *CrawlState) Add(tile *Tile) error {
+	if s.txn == nil {
+		txn, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+
+		s.txn = txn
+	}
+
+	_, err := s.txn.Exec("INSERT OR IGNORE INTO saved_tiles (zoom_level, tile_column, tile_row) VALUES (?, ?, ?)", tile.Z, tile.X, tile.Y)
+
+	return err
+}
+
+// Commit commits the tiles added since the last commit.
+func (s *CrawlState) Commit() error {
+	if s.txn == nil {
+		return nil
+	}
+
+	err := s.txn.Commit()
+	s.txn = nil
+
+	return err
+}
+
+// Close closes the database, discarding any tiles that haven't been committed.
+func (s *CrawlState) Close() error {
+	if s.txn != nil {
+		s.txn.Rollback()
+		s.txn = nil
+	}
+
+	return s.db.Close()
+}
@@ -0,0 +1,63 @@
+package tilepack
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCrawlState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "state.db")
+
+	state, err := NewCrawlState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := &Tile{Z: 3, X: 2, Y: 1}
+	uncommitted := &Tile{Z: 3, X: 2, Y: 2}
+
+	if err := state.Add(saved); err != nil {
+		t.Fatal(err)
+	}
+
+	if has, err := state.HasTile(saved); err != nil || has {
+		t.Errorf("HasTile() before Commit() = %v, %v, want false", has, err)
+	}
+
+	if err := state.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Adding a tile twice isn't an error
+	for _, tile := range []*Tile{saved, uncommitted} {
+		if err := state.Add(tile); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := state.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err = NewCrawlState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	if has, err := state.HasTile(saved); err != nil || !has {
+		t.Errorf("HasTile(%s) = %v, %v, want true", saved.ToString(), has, err)
+	}
+
+	if has, err := state.HasTile(uncommitted); err != nil || has {
+		t.Errorf("HasTile(%s) = %v, %v, want false", uncommitted.ToString(), has, err)
+	}
+}
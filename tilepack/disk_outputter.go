@@ -1,21 +1,73 @@
 package tilepack
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/aaronland/go-string/dsn"
 )
 
+// Disk outputter layouts, the paths tiles are written to below the root.
+const (
+	// DiskLayoutXYZ writes tiles to {z}/{x}/{y}.{format}.
+	DiskLayoutXYZ = "xyz"
+	// DiskLayoutTMS writes tiles to {z}/{x}/{y}.{format} with the row
+	// flipped, so XYZ tiles are written to their TMS rows and vice versa.
+	DiskLayoutTMS = "tms"
+	// DiskLayoutQuadkey writes tiles to {z}/{q1}/{q2}/.../{quadkey}.{format},
+	// with a directory for each digit of the quadkey but the last. The zoom 0
+	// tile, whose quadkey is empty, is written to 0/root.{format}.
+	DiskLayoutQuadkey = "quadkey"
+)
+
+// DiskOutputterOptions configures the outputter returned by NewDiskOutputterWithOptions.
+type DiskOutputterOptions struct {
+	// Gzip compresses tiles that aren't already gzipped before they are
+	// written, for serving with Content-Encoding: gzip.
+	Gzip bool
+	// GzipSuffix appends .gz to the name of every tile file, as static file
+	// servers that serve precompressed assets expect. It implies Gzip.
+	GzipSuffix bool
+	// Layout is DiskLayoutXYZ, DiskLayoutTMS or DiskLayoutQuadkey. Defaults
+	// to DiskLayoutXYZ.
+	Layout string
+}
+
 type diskOutputter struct {
 	TileOutputter
 	root     string
 	format   string
+	gzip     bool
+	suffix   string
+	layout   string
 	hasTiles bool
+	metadata map[string]string
 }
 
+// diskMetadataFile is the name of the file, in the root directory, that disk
+// outputters write the tileset's metadata to.
+const diskMetadataFile = "metadata.json"
+
+// The metadata.json keys that record how tiles are written, when it isn't
+// {z}/{x}/{y}.{format}, so that disk readers can find them again. They
+// describe the directory rather than the tileset, so readers don't return them.
+const (
+	diskLayoutKey     = "layout"
+	diskGzipSuffixKey = "gzip_suffix"
+)
+
+// NewDiskOutputter returns an outputter writing to the directory described by
+// dsnStr, in the form "root={PATH} format={FORMAT}". The optional "gzip" and
+// "gzip_suffix" keys, "true" or "false", and "layout" key set the
+// DiskOutputterOptions.
 func NewDiskOutputter(dsnStr string) (*diskOutputter, error) {
 
 	dsnMap, err := dsn.StringToDSNWithKeys(dsnStr, "root", "format")
@@ -24,21 +76,143 @@ func NewDiskOutputter(dsnStr string) (*diskOutputter, error) {
 		return nil, err
 	}
 
-	abs_root, err := filepath.Abs(dsnMap["root"])
+	opts := &DiskOutputterOptions{}
+
+	if value, ok := dsnMap["gzip"]; ok {
+		opts.Gzip, err = strconv.ParseBool(value)
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid gzip value %s", value)
+		}
+	}
+
+	if value, ok := dsnMap["gzip_suffix"]; ok {
+		opts.GzipSuffix, err = strconv.ParseBool(value)
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid gzip_suffix value %s", value)
+		}
+	}
+
+	opts.Layout = dsnMap["layout"]
+
+	return NewDiskOutputterWithOptions(dsnMap["root"], dsnMap["format"], opts)
+}
+
+// NewDiskOutputterWithOptions returns an outputter writing tiles to paths
+// below root, laid out as opts.Layout.
+func NewDiskOutputterWithOptions(root string, format string, opts *DiskOutputterOptions) (*diskOutputter, error) {
+
+	layout := opts.Layout
+
+	switch layout {
+	case "":
+		layout = DiskLayoutXYZ
+	case DiskLayoutXYZ, DiskLayoutTMS, DiskLayoutQuadkey:
+	default:
+		return nil, fmt.Errorf("Unknown layout %s", layout)
+	}
+
+	abs_root, err := filepath.Abs(root)
 
 	if err != nil {
 		return nil, err
 	}
 
 	o := diskOutputter{
-		root:   abs_root,
-		format: dsnMap["format"],
+		root:     abs_root,
+		format:   format,
+		gzip:     opts.Gzip || opts.GzipSuffix,
+		layout:   layout,
+		metadata: make(map[string]string),
+	}
+
+	if opts.GzipSuffix {
+		o.suffix = ".gz"
 	}
 
 	return &o, nil
 }
 
+// AssignMetadata sets the bounds, center and zoom range written to
+// metadata.json when the outputter is closed.
+func (o *diskOutputter) AssignMetadata(bounds *LngLatBbox, minZoom uint, maxZoom uint) error {
+	for name, value := range boundsMetadata(bounds, minZoom, maxZoom) {
+		o.metadata[name] = value
+	}
+
+	return nil
+}
+
+// SetMetadata sets a value written to metadata.json when the outputter is closed.
+func (o *diskOutputter) SetMetadata(name string, value string) error {
+	o.metadata[name] = value
+	return nil
+}
+
+// Close writes metadata.json, in the same name/value form as the mbtiles
+// metadata table, unless the outputter was never used. Values already in the
+// file, from an earlier build into the same directory, are kept unless they
+// have been replaced. The layout and .gz suffix are recorded too, if they
+// aren't the defaults.
 func (o *diskOutputter) Close() error {
+	if len(o.metadata) == 0 && !o.hasTiles {
+		return nil
+	}
+
+	if err := o.CreateTiles(); err != nil {
+		return err
+	}
+
+	path := filepath.Join(o.root, diskMetadataFile)
+	metadata := make(map[string]string)
+
+	existing, err := ioutil.ReadFile(path)
+
+	if err == nil {
+		err = json.Unmarshal(existing, &metadata)
+	}
+
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// The format is the mbtiles name for the file extension
+	switch o.format {
+	case "mvt":
+		metadata["format"] = FormatPbf
+	case "jpeg":
+		metadata["format"] = FormatJpeg
+	default:
+		metadata["format"] = o.format
+	}
+
+	for name, value := range o.metadata {
+		metadata[name] = value
+	}
+
+	delete(metadata, diskLayoutKey)
+	delete(metadata, diskGzipSuffixKey)
+
+	if o.layout != DiskLayoutXYZ {
+		metadata[diskLayoutKey] = o.layout
+	}
+
+	if o.suffix != "" {
+		metadata[diskGzipSuffixKey] = "true"
+	}
+
+	data, err := json.MarshalIndent(metadata, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// Flush is a no-op, each tile is written to its own file as it is saved.
+func (o *diskOutputter) Flush() error {
 	return nil
 }
 
@@ -73,10 +247,70 @@ func (o *diskOutputter) CreateTiles() error {
 	return nil
 }
 
+func (o *diskOutputter) tilePath(tile *Tile) string {
+	var relPath string
+
+	switch o.layout {
+	case DiskLayoutTMS:
+		relPath = fmt.Sprintf("%d/%d/%d", tile.Z, tile.X, (1<<tile.Z)-1-tile.Y)
+	case DiskLayoutQuadkey:
+		quadkey := tile.Quadkey()
+
+		if quadkey == "" {
+			relPath = "0/root"
+		} else {
+			parts := []string{strconv.FormatUint(uint64(tile.Z), 10)}
+
+			for _, digit := range quadkey[:len(quadkey)-1] {
+				parts = append(parts, string(digit))
+			}
+
+			parts = append(parts, quadkey)
+			relPath = strings.Join(parts, "/")
+		}
+	default:
+		relPath = fmt.Sprintf("%d/%d/%d", tile.Z, tile.X, tile.Y)
+	}
+
+	return filepath.Join(o.root, relPath+"."+o.format+o.suffix)
+}
+
+// HasTile returns true if the file for the tile already exists.
+func (o *diskOutputter) HasTile(tile *Tile) (bool, error) {
+	_, err := os.Stat(o.tilePath(tile))
+
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// SaveNew saves the tile, and returns true if there wasn't already a file for it.
+func (o *diskOutputter) SaveNew(tile *Tile, data []byte) (bool, error) {
+	if !tile.Valid() {
+		return false, ErrInvalidTile
+	}
+
+	exists, err := o.HasTile(tile)
+
+	if err != nil {
+		return false, err
+	}
+
+	return !exists, o.Save(tile, data)
+}
+
 func (o *diskOutputter) Save(tile *Tile, data []byte) error {
+	if !tile.Valid() {
+		return ErrInvalidTile
+	}
 
-	relPath := fmt.Sprintf("%d/%d/%d.%s", tile.Z, tile.X, tile.Y, o.format)
-	absPath := filepath.Join(o.root, relPath)
+	absPath := o.tilePath(tile)
 
 	root := filepath.Dir(absPath)
 
@@ -90,7 +324,25 @@ func (o *diskOutputter) Save(tile *Tile, data []byte) error {
 		return err
 	}
 
-	fh, err := os.OpenFile(absPath, os.O_RDWR|os.O_CREATE, 0644)
+	if o.gzip && !IsGzipped(data) {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+
+		_, err = gz.Write(data)
+
+		if err == nil {
+			err = gz.Close()
+		}
+
+		if err != nil {
+			return err
+		}
+
+		data = buf.Bytes()
+	}
+
+	// Truncate any existing file, which may be longer than the new tile
+	fh, err := os.OpenFile(absPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
 
 	if err != nil {
 		return err
@@ -0,0 +1,210 @@
+package tilepack
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskOutputter_Gzip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		dsn  string
+		path string
+		gzip bool
+	}{
+		{"format=mvt", "0/0/0.mvt", false},
+		{"format=mvt gzip=true", "0/0/0.mvt", true},
+		{"format=mvt gzip_suffix=true", "0/0/0.mvt.gz", true},
+	}
+
+	for i, test := range tests {
+		root := filepath.Join(dir, string('a'+rune(i)))
+
+		o, err := NewDiskOutputter("root=" + root + " " + test.dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := o.CreateTiles(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := o.Save(&Tile{Z: 0, X: 0, Y: 0}, []byte("tile")); err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(root, test.path))
+		if err != nil {
+			t.Errorf("%s: %v", test.dsn, err)
+			continue
+		}
+
+		if IsGzipped(data) != test.gzip {
+			t.Errorf("%s: gzipped = %t, want %t", test.dsn, IsGzipped(data), test.gzip)
+			continue
+		}
+
+		if test.gzip {
+			reader, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data, err = ioutil.ReadAll(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if string(data) != "tile" {
+			t.Errorf("%s: got tile %q, want \"tile\"", test.dsn, data)
+		}
+	}
+
+	if _, err := NewDiskOutputter("root=" + dir + " format=mvt gzip=maybe"); err == nil {
+		t.Error("Expected an error for an invalid gzip value")
+	}
+}
+
+func TestDiskOutputter_Layout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		layout string
+		tile   *Tile
+		path   string
+	}{
+		{"", &Tile{Z: 3, X: 3, Y: 5}, "3/3/5.png"},
+		{DiskLayoutXYZ, &Tile{Z: 3, X: 3, Y: 5}, "3/3/5.png"},
+		{DiskLayoutTMS, &Tile{Z: 3, X: 3, Y: 5}, "3/3/2.png"},
+		{DiskLayoutQuadkey, &Tile{Z: 3, X: 3, Y: 5}, "3/2/1/213.png"},
+		{DiskLayoutQuadkey, &Tile{Z: 1, X: 1, Y: 0}, "1/1.png"},
+		{DiskLayoutQuadkey, &Tile{Z: 0, X: 0, Y: 0}, "0/root.png"},
+	}
+
+	for _, test := range tests {
+		o, err := NewDiskOutputterWithOptions(dir, "png", &DiskOutputterOptions{Layout: test.layout})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got, want := o.tilePath(test.tile), filepath.Join(dir, test.path); got != want {
+			t.Errorf("Layout %q wrote %s to %s, want %s", test.layout, test.tile.ToString(), got, want)
+		}
+	}
+
+	if _, err := NewDiskOutputter("root=" + dir + " format=png layout=s2"); err == nil {
+		t.Error("Expected an error for an unknown layout")
+	}
+}
+
+func TestDiskOutputter_SaveNew(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	o, err := NewDiskOutputter("root=" + dir + " format=mvt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tile := &Tile{Z: 3, X: 3, Y: 5}
+
+	for i, want := range []bool{true, false} {
+		isNew, err := o.SaveNew(tile, []byte("tile"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if isNew != want {
+			t.Errorf("Save %d returned new %t, want %t", i+1, isNew, want)
+		}
+	}
+
+	if exists, err := o.HasTile(tile); err != nil || !exists {
+		t.Errorf("HasTile() = %t, %v, want true", exists, err)
+	}
+}
+
+func TestDiskOutputter_Metadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	o, err := NewDiskOutputter("root=" + dir + " format=mvt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.AssignMetadata(&LngLatBbox{West: -180.0, South: -85.0, East: 180.0, North: 85.0}, 0, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.SetMetadata("name", "first"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.Save(&Tile{Z: 0, X: 0, Y: 0}, []byte("tile")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Building into the same directory again keeps the values it doesn't set
+	o, err = NewDiskOutputter("root=" + dir + " format=mvt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.SetMetadata("name", "second"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewDiskReader(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadata, err := reader.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"bounds":  "-180.000000,-85.000000,180.000000,85.000000",
+		"center":  "0.000000,0.000000,0",
+		"minzoom": "0",
+		"maxzoom": "3",
+		"format":  FormatPbf,
+		"name":    "second",
+	}
+
+	for name, value := range want {
+		if metadata[name] != value {
+			t.Errorf("Metadata %s = %q, want %q", name, metadata[name], value)
+		}
+	}
+}
@@ -0,0 +1,532 @@
+package tilepack
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// diskReaderExtensions are the tile file extensions a disk reader looks for,
+// in the order they are tried.
+var diskReaderExtensions = []string{"mvt", "pbf", "png", "jpg", "jpeg", "webp", "avif"}
+
+// NewDiskReader returns a reader for a directory of {z}/{x}/{y}.{ext} files, as
+// written by a disk outputter. Files with unknown extensions or whose path isn't
+// made of numbers are skipped. Unlike mbtiles, rows are assumed to be XYZ rows.
+//
+// If the directory's metadata.json says the outputter wrote it with the TMS
+// layout or .gz suffixes, rows are flipped and suffixes expected to match. The
+// quadkey layout isn't supported.
+func NewDiskReader(root string) (MbtilesReader, error) {
+	info, err := os.Stat(root)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return nil, errors.New("Root is not a directory")
+	}
+
+	o := &diskReader{root: root}
+
+	metadata, err := o.readMetadata()
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch layout := metadata[diskLayoutKey]; layout {
+	case "", DiskLayoutXYZ:
+	case DiskLayoutTMS:
+		o.tms = true
+	default:
+		return nil, fmt.Errorf("Unsupported layout %s", layout)
+	}
+
+	if value, ok := metadata[diskGzipSuffixKey]; ok {
+		gzipSuffix, err := strconv.ParseBool(value)
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid gzip_suffix value %s", value)
+		}
+
+		if gzipSuffix {
+			o.suffix = ".gz"
+		}
+	}
+
+	return o, nil
+}
+
+type diskReader struct {
+	MbtilesReader
+	root string
+	// tms is true if rows are flipped, as the TMS layout writes them
+	tms bool
+	// suffix follows the extension of every tile file
+	suffix string
+}
+
+// readMetadata returns the contents of the directory's metadata.json, or no
+// metadata if there isn't one.
+func (o *diskReader) readMetadata() (map[string]string, error) {
+	metadata := make(map[string]string)
+
+	data, err := ioutil.ReadFile(filepath.Join(o.root, diskMetadataFile))
+
+	if err == nil {
+		err = json.Unmarshal(data, &metadata)
+	}
+
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return metadata, nil
+}
+
+// flipRow returns the tile with its row flipped if the directory uses the TMS
+// layout, or the tile itself if it doesn't.
+func (o *diskReader) flipRow(tile *Tile) *Tile {
+	if !o.tms {
+		return tile
+	}
+
+	return &Tile{Z: tile.Z, X: tile.X, Y: (1 << tile.Z) - 1 - tile.Y}
+}
+
+// Close is a no-op, there is nothing to release.
+func (o *diskReader) Close() error {
+	return nil
+}
+
+// CountTiles returns the number of tile files in the directory.
+func (o *diskReader) CountTiles() (int, error) {
+	counts, err := o.CountTilesByZoom()
+
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+
+	for _, c := range counts {
+		count += c
+	}
+
+	return count, nil
+}
+
+// CountTilesByZoom returns the number of tile files at each zoom level of the
+// directory.
+func (o *diskReader) CountTilesByZoom() (map[uint]int, error) {
+	counts := make(map[uint]int)
+
+	err := o.walk(context.Background(), o.root, func(tile *Tile, path string) error {
+		counts[tile.Z]++
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
+
+func (o *diskReader) tileFile(tile *Tile) (string, string, error) {
+	stored := o.flipRow(tile)
+
+	for _, ext := range diskReaderExtensions {
+		path := filepath.Join(o.root, strconv.FormatUint(uint64(stored.Z), 10), strconv.FormatUint(uint64(stored.X), 10), strconv.FormatUint(uint64(stored.Y), 10)+"."+ext+o.suffix)
+
+		_, err := os.Stat(path)
+
+		if err == nil {
+			return path, ext, nil
+		}
+
+		if !os.IsNotExist(err) {
+			return "", "", err
+		}
+	}
+
+	return "", "", nil
+}
+
+// GetTile returns data for the given tile.
+func (o *diskReader) GetTile(tile *Tile) (*TileData, error) {
+	path, _, err := o.tileFile(tile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if path == "" {
+		return &TileData{Tile: tile, Data: nil}, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &TileData{Tile: tile, Data: &data}, nil
+}
+
+// HasTile returns true if there is a file for the given tile.
+func (o *diskReader) HasTile(tile *Tile) (bool, error) {
+	path, _, err := o.tileFile(tile)
+	return path != "", err
+}
+
+// GetTileExtent returns the extent of the tiles stored at the directory's
+// maximum zoom level.
+func (o *diskReader) GetTileExtent() (*TileExtent, error) {
+	_, maxZoom, err := o.GetZoomRange()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var minX, minY uint = math.MaxUint32, math.MaxUint32
+	var maxX, maxY uint
+
+	err = o.VisitTilesForZoom(maxZoom, func(tile *Tile, data []byte) {
+		if tile.X < minX {
+			minX = tile.X
+		}
+		if tile.X > maxX {
+			maxX = tile.X
+		}
+		if tile.Y < minY {
+			minY = tile.Y
+		}
+		if tile.Y > maxY {
+			maxY = tile.Y
+		}
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if minX > maxX {
+		return nil, errors.New("Archive has no tiles")
+	}
+
+	nw := (&Tile{X: minX, Y: minY, Z: maxZoom}).Bounds()
+	se := (&Tile{X: maxX, Y: maxY, Z: maxZoom}).Bounds()
+
+	extent := &TileExtent{
+		Zoom: maxZoom,
+		Bounds: &LngLatBbox{
+			West:  nw.West,
+			South: se.South,
+			East:  se.East,
+			North: nw.North,
+		},
+	}
+
+	return extent, nil
+}
+
+// GetTilesForBounds returns the tiles at one zoom level that intersect bounds,
+// ordered by column, then row.
+func (o *diskReader) GetTilesForBounds(bounds *LngLatBbox, zoom uint) ([]*TileData, error) {
+	var tiles []*TileData
+
+	for _, r := range tileRanges(generateTilesBoxes(bounds), zoom) {
+		for x := r[0]; x < r[1]; x++ {
+			for y := r[2]; y < r[3]; y++ {
+				tile, err := o.GetTile(&Tile{Z: zoom, X: x, Y: y})
+
+				if err != nil {
+					return nil, err
+				}
+
+				if tile.Data != nil {
+					tiles = append(tiles, tile)
+				}
+			}
+		}
+	}
+
+	return tiles, nil
+}
+
+// GetZoomRange returns the minimum and maximum zoom levels in the directory,
+// based on the names of its zoom directories.
+func (o *diskReader) GetZoomRange() (uint, uint, error) {
+	infos, err := ioutil.ReadDir(o.root)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	found := false
+	var minZoom, maxZoom uint
+
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+
+		z, err := strconv.ParseUint(info.Name(), 10, 32)
+
+		if err != nil {
+			continue
+		}
+
+		if !found || uint(z) < minZoom {
+			minZoom = uint(z)
+		}
+
+		if !found || uint(z) > maxZoom {
+			maxZoom = uint(z)
+		}
+
+		found = true
+	}
+
+	if !found {
+		return 0, 0, errors.New("Archive has no tiles")
+	}
+
+	return minZoom, maxZoom, nil
+}
+
+// Metadata returns the contents of the directory's metadata.json, as written
+// by a disk outputter, without the keys that describe its layout. Without one,
+// or if it has no format, the format is the extension of the first tile found.
+func (o *diskReader) Metadata() (map[string]string, error) {
+	metadata, err := o.readMetadata()
+
+	if err != nil {
+		return nil, err
+	}
+
+	delete(metadata, diskLayoutKey)
+	delete(metadata, diskGzipSuffixKey)
+
+	if metadata["format"] != "" {
+		return metadata, nil
+	}
+
+	stop := errors.New("stop")
+
+	err = o.walk(context.Background(), o.root, func(tile *Tile, path string) error {
+		metadata["format"] = strings.TrimPrefix(filepath.Ext(strings.TrimSuffix(path, o.suffix)), ".")
+		return stop
+	})
+
+	if err != nil && err != stop {
+		return nil, err
+	}
+
+	return metadata, nil
+}
+
+// VisitAllTiles runs the given function on all tiles in the directory.
+func (o *diskReader) VisitAllTiles(visitor func(*Tile, []byte)) error {
+	return o.VisitAllTilesWithContext(context.Background(), ignoreVisitorErrors(visitor))
+}
+
+// VisitAllTilesWithContext runs the given function on all tiles in the
+// directory until it returns an error or ctx is cancelled, and returns that error.
+func (o *diskReader) VisitAllTilesWithContext(ctx context.Context, visitor func(*Tile, []byte) error) error {
+	return o.visitTiles(ctx, o.root, visitor)
+}
+
+// VisitAllTilesOrdered runs the given function on all tiles in the directory,
+// ordered by zoom level, then column, then row.
+func (o *diskReader) VisitAllTilesOrdered(visitor func(*Tile, []byte)) error {
+	return o.VisitAllTilesOrderedWithContext(context.Background(), ignoreVisitorErrors(visitor))
+}
+
+// VisitAllTilesOrderedWithContext runs the given function on all tiles in the
+// directory, ordered by zoom level, then column, then row, until it returns an
+// error or ctx is cancelled, and returns that error. Only one column's paths
+// are held in memory at a time.
+func (o *diskReader) VisitAllTilesOrderedWithContext(ctx context.Context, visitor func(*Tile, []byte) error) error {
+	zooms, err := numberedDirs(o.root)
+	if err != nil {
+		return err
+	}
+
+	for _, z := range zooms {
+		zoomRoot := filepath.Join(o.root, z)
+
+		columns, err := numberedDirs(zoomRoot)
+		if err != nil {
+			return err
+		}
+
+		for _, x := range columns {
+			var tiles []*Tile
+			var paths []string
+
+			err := o.walk(ctx, filepath.Join(zoomRoot, x), func(tile *Tile, path string) error {
+				tiles = append(tiles, tile)
+				paths = append(paths, path)
+				return nil
+			})
+
+			if err != nil {
+				return err
+			}
+
+			order := make([]int, len(tiles))
+			for i := range order {
+				order[i] = i
+			}
+
+			sort.SliceStable(order, func(i, j int) bool { return tiles[order[i]].Y < tiles[order[j]].Y })
+
+			for _, i := range order {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+
+				data, err := ioutil.ReadFile(paths[i])
+				if err != nil {
+					return err
+				}
+
+				if err := visitor(tiles[i], data); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// numberedDirs returns the names of the directories in dir that are numbers,
+// such as zoom levels and columns, in numerical order.
+func numberedDirs(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	numbers := make(map[string]uint64)
+
+	for _, info := range infos {
+		n, err := strconv.ParseUint(info.Name(), 10, 32)
+
+		if err != nil || !info.IsDir() || strconv.FormatUint(n, 10) != info.Name() {
+			continue
+		}
+
+		names = append(names, info.Name())
+		numbers[info.Name()] = n
+	}
+
+	sort.Slice(names, func(i, j int) bool { return numbers[names[i]] < numbers[names[j]] })
+
+	return names, nil
+}
+
+// VisitTilesForZoom runs the given function on the tiles at one zoom level of
+// the directory.
+func (o *diskReader) VisitTilesForZoom(zoom uint, visitor func(*Tile, []byte)) error {
+	return o.VisitTilesForZoomWithContext(context.Background(), zoom, ignoreVisitorErrors(visitor))
+}
+
+// VisitTilesForZoomWithContext runs the given function on the tiles at one zoom
+// level of the directory until it returns an error or ctx is cancelled, and
+// returns that error.
+func (o *diskReader) VisitTilesForZoomWithContext(ctx context.Context, zoom uint, visitor func(*Tile, []byte) error) error {
+	zoomRoot := filepath.Join(o.root, strconv.FormatUint(uint64(zoom), 10))
+
+	if _, err := os.Stat(zoomRoot); os.IsNotExist(err) {
+		return nil
+	}
+
+	return o.visitTiles(ctx, zoomRoot, visitor)
+}
+
+func (o *diskReader) visitTiles(ctx context.Context, root string, visitor func(*Tile, []byte) error) error {
+	return o.walk(ctx, root, func(tile *Tile, path string) error {
+		data, err := ioutil.ReadFile(path)
+
+		if err != nil {
+			return err
+		}
+
+		return visitor(tile, data)
+	})
+}
+
+// walk calls fn with every tile file below root, which is the directory's root
+// or one of its zoom directories.
+func (o *diskReader) walk(ctx context.Context, root string, fn func(*Tile, string) error) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		tile, ok := o.parseTilePath(path)
+
+		if !ok {
+			return nil
+		}
+
+		return fn(tile, path)
+	})
+}
+
+// parseTilePath returns the tile for a {z}/{x}/{y}.{ext} path below the root,
+// followed by the directory's suffix.
+func (o *diskReader) parseTilePath(path string) (*Tile, bool) {
+	rel, err := filepath.Rel(o.root, path)
+
+	if err != nil || !strings.HasSuffix(rel, o.suffix) {
+		return nil, false
+	}
+
+	rel = strings.TrimSuffix(rel, o.suffix)
+
+	ext := filepath.Ext(rel)
+	known := false
+
+	for _, e := range diskReaderExtensions {
+		if ext == "."+e {
+			known = true
+			break
+		}
+	}
+
+	if !known {
+		return nil, false
+	}
+
+	tile, err := ParseTile(strings.TrimSuffix(filepath.ToSlash(rel), ext))
+
+	if err != nil {
+		return nil, false
+	}
+
+	return o.flipRow(tile), true
+}
@@ -0,0 +1,207 @@
+package tilepack
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDiskReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	o, err := NewDiskOutputter("root=" + dir + " format=mvt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tiles := []*Tile{
+		{Z: 1, X: 0, Y: 0},
+		{Z: 2, X: 1, Y: 1},
+		{Z: 2, X: 2, Y: 1},
+	}
+
+	for _, tile := range tiles {
+		if err := o.Save(tile, []byte(tile.ToString())); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Files that aren't tiles are skipped
+	junk := []string{"README.txt", "1/a/0.mvt", "1/0/1.txt", "tiles/1/0.mvt"}
+
+	for _, path := range junk {
+		path = filepath.Join(dir, filepath.FromSlash(path))
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(path, []byte("junk"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reader, err := NewDiskReader(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	visited := 0
+	err = reader.VisitAllTiles(func(tile *Tile, data []byte) {
+		visited++
+
+		if string(data) != tile.ToString() {
+			t.Errorf("Visited %s with data %s", tile.ToString(), data)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if visited != len(tiles) {
+		t.Errorf("Visited %d tiles, want %d", visited, len(tiles))
+	}
+
+	result, err := reader.GetTile(tiles[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Data == nil || string(*result.Data) != tiles[2].ToString() {
+		t.Errorf("GetTile(%s) = %v, want the saved data", tiles[2].ToString(), result.Data)
+	}
+
+	if exists, err := reader.HasTile(&Tile{Z: 2, X: 0, Y: 0}); err != nil || exists {
+		t.Errorf("HasTile(2/0/0) = %v, %v, want false", exists, err)
+	}
+
+	minZoom, maxZoom, err := reader.GetZoomRange()
+	if err != nil || minZoom != 1 || maxZoom != 2 {
+		t.Errorf("GetZoomRange() = %d, %d, %v, want 1, 2", minZoom, maxZoom, err)
+	}
+
+	extent, err := reader.GetTileExtent()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if extent.Zoom != 2 || extent.Bounds.West != -90.0 || extent.Bounds.East != 90.0 || extent.Bounds.South != 0.0 {
+		t.Errorf("Unexpected extent %+v", extent.Bounds)
+	}
+
+	count, err := reader.CountTiles()
+	if err != nil || count != len(tiles) {
+		t.Errorf("CountTiles() = %d, %v, want %d", count, err, len(tiles))
+	}
+
+	metadata, err := reader.Metadata()
+	if err != nil || metadata["format"] != "mvt" {
+		t.Errorf("Metadata() = %v, %v, want mvt format", metadata, err)
+	}
+}
+
+func TestDiskReader_Layout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	o, err := NewDiskOutputter("root=" + dir + " format=mvt layout=tms gzip_suffix=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.CreateTiles(); err != nil {
+		t.Fatal(err)
+	}
+
+	tiles := []*Tile{
+		{Z: 2, X: 1, Y: 0},
+		{Z: 2, X: 1, Y: 3},
+	}
+
+	for _, tile := range tiles {
+		if err := o.Save(tile, []byte(tile.ToString())); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewDiskReader(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tile := range tiles {
+		result, err := reader.GetTile(tile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if result.Data == nil {
+			t.Errorf("GetTile(%s) found no tile", tile.ToString())
+			continue
+		}
+
+		data, err := Gunzip(*result.Data)
+		if err != nil || string(data) != tile.ToString() {
+			t.Errorf("GetTile(%s) = %q, %v, want %q", tile.ToString(), data, err, tile.ToString())
+		}
+	}
+
+	var visited []string
+
+	err = reader.VisitAllTilesOrdered(func(tile *Tile, data []byte) {
+		visited = append(visited, tile.ToString())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"{2/1/0}", "{2/1/3}"}; !reflect.DeepEqual(visited, want) {
+		t.Errorf("VisitAllTilesOrdered() visited %v, want %v", visited, want)
+	}
+
+	metadata, err := reader.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := metadata["layout"]; ok || metadata["format"] != FormatPbf {
+		t.Errorf("Metadata() = %v, want a pbf format without the layout", metadata)
+	}
+
+	quadkey := filepath.Join(dir, "quadkey")
+
+	o, err = NewDiskOutputter("root=" + quadkey + " format=mvt layout=quadkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.CreateTiles(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.Save(&Tile{Z: 1, X: 1, Y: 0}, []byte("tile")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewDiskReader(quadkey); err == nil {
+		t.Error("Expected an error reading a quadkey layout")
+	}
+}
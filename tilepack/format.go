@@ -0,0 +1,73 @@
+package tilepack
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+)
+
+// Tile formats, as used by the mbtiles "format" metadata key.
+const (
+	FormatPbf  = "pbf"
+	FormatPng  = "png"
+	FormatJpeg = "jpg"
+	FormatWebp = "webp"
+	FormatAvif = "avif"
+)
+
+// DetectFormat guesses the format of a tile from its first few bytes, or the
+// first few bytes of its uncompressed data if it's gzipped. It returns an
+// empty string if the format isn't recognised.
+func DetectFormat(data []byte) string {
+	switch {
+	case IsGzipped(data):
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return ""
+		}
+
+		head := make([]byte, 16)
+		n, _ := io.ReadFull(reader, head)
+
+		return DetectFormat(head[:n])
+	case bytes.HasPrefix(data, []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n'}):
+		return FormatPng
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8, 0xff}):
+		return FormatJpeg
+	case len(data) >= 12 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return FormatWebp
+	case len(data) >= 12 && string(data[4:8]) == "ftyp" && (string(data[8:12]) == "avif" || string(data[8:12]) == "avis"):
+		return FormatAvif
+	case len(data) > 0 && data[0] == 0x1a:
+		// A vector tile is a protobuf message whose only field is its
+		// repeated layers (field 3, length delimited)
+		return FormatPbf
+	default:
+		return ""
+	}
+}
+
+// IsGzipped returns true if data starts with the gzip magic number.
+func IsGzipped(data []byte) bool {
+	return bytes.HasPrefix(data, []byte{0x1f, 0x8b})
+}
+
+// Gunzip returns the uncompressed contents of a gzipped tile. Older builds
+// flushed tiles they gzipped themselves instead of closing them, so their data
+// ends without a gzip footer. Data like that is accepted, as long as some of it
+// decompresses, so stored tiles are treated alike wherever they're read.
+func Gunzip(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	decompressed, err := ioutil.ReadAll(reader)
+	if err == io.ErrUnexpectedEOF && len(decompressed) > 0 {
+		return decompressed, nil
+	}
+
+	return decompressed, err
+}
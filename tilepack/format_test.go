@@ -0,0 +1,92 @@
+package tilepack
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+)
+
+func TestDetectFormat(t *testing.T) {
+	gzipped := func(data []byte) []byte {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(data)
+		gz.Close()
+		return buf.Bytes()
+	}
+
+	mvt := []byte{0x1a, 0x2e, 0x78, 0x02, 0x0a, 0x05, 'w', 'a', 't', 'e', 'r'}
+	png := []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n', 0x00, 0x00, 0x00, 0x0d}
+	jpeg := []byte{0xff, 0xd8, 0xff, 0xe0, 0x00, 0x10, 'J', 'F', 'I', 'F'}
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"mvt", mvt, FormatPbf},
+		{"png", png, FormatPng},
+		{"jpeg", jpeg, FormatJpeg},
+		// Tiles are gzipped whatever their format, so it's their
+		// uncompressed data that tells
+		{"gzipped mvt", gzipped(mvt), FormatPbf},
+		{"gzipped png", gzipped(png), FormatPng},
+		{"gzipped jpeg", gzipped(jpeg), FormatJpeg},
+		{"gzipped text", gzipped([]byte("tile 1/0/0")), ""},
+		{"gzip header", []byte{0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00}, ""},
+		{"webp", []byte{'R', 'I', 'F', 'F', 0x24, 0x00, 0x00, 0x00, 'W', 'E', 'B', 'P', 'V', 'P', '8', ' '}, FormatWebp},
+		{"avif", []byte{0x00, 0x00, 0x00, 0x1c, 'f', 't', 'y', 'p', 'a', 'v', 'i', 'f', 0x00, 0x00, 0x00, 0x00}, FormatAvif},
+		{"heic", []byte{0x00, 0x00, 0x00, 0x18, 'f', 't', 'y', 'p', 'h', 'e', 'i', 'c', 0x00, 0x00, 0x00, 0x00}, ""},
+		{"truncated png", []byte{0x89, 'P', 'N', 'G'}, ""},
+		{"text", []byte("tile 1/0/0"), ""},
+		{"empty", []byte{}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DetectFormat(tt.data); got != tt.want {
+				t.Errorf("DetectFormat() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGunzip(t *testing.T) {
+	var buf bytes.Buffer
+
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte("tile"))
+	gz.Close()
+
+	gzipped := buf.Bytes()
+
+	tests := []struct {
+		name  string
+		data  []byte
+		want  string
+		valid bool
+	}{
+		{"gzipped", gzipped, "tile", true},
+		{"missing footer", gzipped[:len(gzipped)-8], "tile", true},
+		{"header only", gzipped[:10], "", false},
+		{"not gzipped", []byte("tile"), "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Gunzip(tt.data)
+
+			if tt.valid && err != nil {
+				t.Fatalf("Gunzip() = %v, want nil", err)
+			}
+
+			if !tt.valid && err == nil {
+				t.Fatal("Gunzip() = nil, want an error")
+			}
+
+			if tt.valid && string(got) != tt.want {
+				t.Errorf("Gunzip() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
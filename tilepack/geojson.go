@@ -0,0 +1,202 @@
+package tilepack
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Polygons is a set of (multi)polygons read from GeoJSON, used to limit the
+// tiles generated for a bounding box to those that cover an irregular area.
+type Polygons struct {
+	// Each polygon is a list of rings, the outer ring followed by any holes,
+	// and each ring is a list of [lng, lat] positions.
+	polygons [][][][2]float64
+	bounds   *LngLatBbox
+}
+
+type geoJSONObject struct {
+	Type        string           `json:"type"`
+	Coordinates json.RawMessage  `json:"coordinates"`
+	Geometry    *geoJSONObject   `json:"geometry"`
+	Geometries  []*geoJSONObject `json:"geometries"`
+	Features    []*geoJSONObject `json:"features"`
+}
+
+// ParseGeoJSONPolygons reads the Polygon and MultiPolygon geometries from a
+// GeoJSON geometry, Feature or FeatureCollection.
+func ParseGeoJSONPolygons(data []byte) (*Polygons, error) {
+	var obj geoJSONObject
+
+	err := json.Unmarshal(data, &obj)
+
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Polygons{}
+
+	err = p.add(&obj)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(p.polygons) == 0 {
+		return nil, errors.New("GeoJSON doesn't contain any polygons")
+	}
+
+	return p, nil
+}
+
+func (p *Polygons) add(obj *geoJSONObject) error {
+	switch obj.Type {
+	case "FeatureCollection":
+		for _, f := range obj.Features {
+			if err := p.add(f); err != nil {
+				return err
+			}
+		}
+	case "Feature":
+		if obj.Geometry != nil {
+			return p.add(obj.Geometry)
+		}
+	case "GeometryCollection":
+		for _, g := range obj.Geometries {
+			if err := p.add(g); err != nil {
+				return err
+			}
+		}
+	case "Polygon":
+		var polygon [][][2]float64
+		if err := json.Unmarshal(obj.Coordinates, &polygon); err != nil {
+			return err
+		}
+		p.addPolygon(polygon)
+	case "MultiPolygon":
+		var multi [][][][2]float64
+		if err := json.Unmarshal(obj.Coordinates, &multi); err != nil {
+			return err
+		}
+		for _, polygon := range multi {
+			p.addPolygon(polygon)
+		}
+	default:
+		return fmt.Errorf("Unsupported GeoJSON type %s", obj.Type)
+	}
+
+	return nil
+}
+
+func (p *Polygons) addPolygon(polygon [][][2]float64) {
+	if len(polygon) == 0 || len(polygon[0]) == 0 {
+		return
+	}
+
+	for _, pt := range polygon[0] {
+		if p.bounds == nil {
+			p.bounds = &LngLatBbox{West: pt[0], South: pt[1], East: pt[0], North: pt[1]}
+			continue
+		}
+
+		p.bounds.West = math.Min(p.bounds.West, pt[0])
+		p.bounds.South = math.Min(p.bounds.South, pt[1])
+		p.bounds.East = math.Max(p.bounds.East, pt[0])
+		p.bounds.North = math.Max(p.bounds.North, pt[1])
+	}
+
+	p.polygons = append(p.polygons, polygon)
+}
+
+// Bounds returns the bounding box of all the polygons.
+func (p *Polygons) Bounds() *LngLatBbox {
+	b := *p.bounds
+	return &b
+}
+
+// Intersects returns true if b overlaps the area covered by any of the polygons.
+func (p *Polygons) Intersects(b *LngLatBbox) bool {
+	if !p.bounds.Intersects(b) {
+		return false
+	}
+
+	for _, polygon := range p.polygons {
+		if polygonIntersects(polygon, b) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func polygonIntersects(polygon [][][2]float64, b *LngLatBbox) bool {
+	// Either part of the polygon's boundary is in the box...
+	for _, ring := range polygon {
+		for i, pt := range ring {
+			if pt[0] > b.West && pt[0] < b.East && pt[1] > b.South && pt[1] < b.North {
+				return true
+			}
+
+			if i > 0 && segmentIntersectsBox(ring[i-1], pt, b) {
+				return true
+			}
+		}
+	}
+
+	// ...or the box is entirely inside the polygon
+	center := [2]float64{(b.West + b.East) / 2.0, (b.South + b.North) / 2.0}
+
+	if !ringContains(polygon[0], center) {
+		return false
+	}
+
+	for _, hole := range polygon[1:] {
+		if ringContains(hole, center) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ringContains tests whether pt is inside ring using the even-odd rule.
+func ringContains(ring [][2]float64, pt [2]float64) bool {
+	inside := false
+
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a := ring[i]
+		c := ring[j]
+
+		if (a[1] > pt[1]) != (c[1] > pt[1]) && pt[0] < (c[0]-a[0])*(pt[1]-a[1])/(c[1]-a[1])+a[0] {
+			inside = !inside
+		}
+	}
+
+	return inside
+}
+
+func segmentIntersectsBox(a [2]float64, c [2]float64, b *LngLatBbox) bool {
+	sw := [2]float64{b.West, b.South}
+	se := [2]float64{b.East, b.South}
+	ne := [2]float64{b.East, b.North}
+	nw := [2]float64{b.West, b.North}
+
+	return segmentsIntersect(a, c, sw, se) ||
+		segmentsIntersect(a, c, se, ne) ||
+		segmentsIntersect(a, c, ne, nw) ||
+		segmentsIntersect(a, c, nw, sw)
+}
+
+func orientation(a [2]float64, b [2]float64, c [2]float64) float64 {
+	return (b[0]-a[0])*(c[1]-a[1]) - (b[1]-a[1])*(c[0]-a[0])
+}
+
+func segmentsIntersect(p1 [2]float64, p2 [2]float64, q1 [2]float64, q2 [2]float64) bool {
+	d1 := orientation(q1, q2, p1)
+	d2 := orientation(q1, q2, p2)
+	d3 := orientation(p1, p2, q1)
+	d4 := orientation(p1, p2, q2)
+
+	return ((d1 > 0 && d2 < 0) || (d1 < 0 && d2 > 0)) && ((d3 > 0 && d4 < 0) || (d3 < 0 && d4 > 0))
+}
@@ -0,0 +1,46 @@
+package tilepack
+
+import "testing"
+
+func TestPolygons_Intersects(t *testing.T) {
+	// A square from 0,0 to 10,10 with a hole from 4,4 to 6,6
+	geojson := `{"type": "FeatureCollection", "features": [{"type": "Feature", "properties": {}, "geometry": {"type": "Polygon", "coordinates": [
+		[[0, 0], [10, 0], [10, 10], [0, 10], [0, 0]],
+		[[4, 4], [6, 4], [6, 6], [4, 6], [4, 4]]
+	]}}]}`
+
+	p, err := ParseGeoJSONPolygons([]byte(geojson))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bounds := p.Bounds()
+	if bounds.West != 0 || bounds.South != 0 || bounds.East != 10 || bounds.North != 10 {
+		t.Errorf("Unexpected bounds %+v", bounds)
+	}
+
+	tests := []struct {
+		name string
+		bbox *LngLatBbox
+		want bool
+	}{
+		{"inside", &LngLatBbox{West: 1, South: 1, East: 2, North: 2}, true},
+		{"crossing edge", &LngLatBbox{West: 9, South: 9, East: 11, North: 11}, true},
+		{"containing polygon", &LngLatBbox{West: -1, South: -1, East: 11, North: 11}, true},
+		{"outside", &LngLatBbox{West: 11, South: 11, East: 12, North: 12}, false},
+		{"in hole", &LngLatBbox{West: 4.5, South: 4.5, East: 5.5, North: 5.5}, false},
+	}
+
+	for _, test := range tests {
+		if got := p.Intersects(test.bbox); got != test.want {
+			t.Errorf("%s: Intersects() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseGeoJSONPolygons_Unsupported(t *testing.T) {
+	_, err := ParseGeoJSONPolygons([]byte(`{"type": "Point", "coordinates": [0, 0]}`))
+	if err == nil {
+		t.Error("Expected an error for a Point")
+	}
+}
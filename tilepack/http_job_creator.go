@@ -3,14 +3,17 @@ package tilepack
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"math/rand"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -29,68 +32,331 @@ func (e *HTTPError) String() string {
 }
 
 const (
-	httpUserAgent = "go-tilepacks/1.0"
+	DefaultUserAgent = "go-tilepacks/1.0"
+
+	DefaultRetries           = 30
+	DefaultRetryInitialDelay = 500 * time.Millisecond
+	DefaultRetryMaxDelay     = 30 * time.Second
+	DefaultJitter            = 50 * time.Millisecond
+
+	DefaultMaxIdleConnsPerHost = 500
 )
 
+// HTTPDoer makes HTTP requests. *http.Client is one, and tests can use a mock
+// instead of a server.
+type HTTPDoer interface {
+	Do(*http.Request) (*http.Response, error)
+}
+
+// XYZJobGeneratorOptions configures the JobGenerator returned by NewXYZJobGeneratorWithOptions.
+type XYZJobGeneratorOptions struct {
+	// URLTemplate is the URL to request tiles from. It may contain the {z}, {x}, {y}, {-y}, {q} (quadkey), {s} and {r} tokens.
+	// {-y} is the TMS row of the tile, whether or not InvertedY is set, for servers
+	// that use TMS rows in their URLs.
+	URLTemplate string
+	Bounds      *LngLatBbox
+	// Boxes, if set, are fetched instead of Bounds, fetching tiles where they
+	// overlap only once.
+	Boxes       []*LngLatBbox
+	Zooms       []uint
+	HTTPTimeout time.Duration
+	InvertedY   bool
+	// FileTransportRoot is the root directory for tiles if URLTemplate uses the file:// scheme.
+	FileTransportRoot string
+	// Subdomains are substituted for the {s} token in URLTemplate, rotating between tiles.
+	Subdomains []string
+	// Scale is the pixel ratio of the tiles to request, 1 or 2. The {r} token
+	// in URLTemplate is replaced with "@2x" when it is 2 and removed otherwise.
+	Scale int
+	// MaxIdleConnsPerHost is the number of keep-alive connections kept open to
+	// each tile server. There's no benefit to it being more than the number of
+	// workers. Defaults to DefaultMaxIdleConnsPerHost.
+	MaxIdleConnsPerHost int
+	// Proxy, if set, is the http, https or socks5 proxy to make tile requests
+	// through. Otherwise the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment
+	// variables are used.
+	Proxy *url.URL
+	// UserAgent is sent with every tile request. Defaults to DefaultUserAgent.
+	UserAgent string
+	// Headers are added to every tile request, replacing any defaults with the same name.
+	Headers http.Header
+	// Retries is the number of times a tile request that fails with a 5xx (other
+	// than 500) or 429 error is attempted. Defaults to DefaultRetries. Responses
+	// with a Retry-After header are retried after the time the server asks for,
+	// even if it's longer than RetryMaxDelay, unless that's after TileDeadline.
+	Retries int
+	// RetryInitialDelay is the longest time to wait before the first retry.
+	// It doubles after each retry up to RetryMaxDelay, and the actual wait is
+	// a random time up to it. These default to DefaultRetryInitialDelay and
+	// DefaultRetryMaxDelay.
+	RetryInitialDelay time.Duration
+	RetryMaxDelay     time.Duration
+	// TileDeadline, if set, is the longest a tile is given across all of its
+	// attempts, including the waits between them. HTTPTimeout only limits each
+	// attempt. Tiles that run out of time are abandoned and recorded as failures.
+	TileDeadline time.Duration
+	// RateLimit is the maximum number of requests per second made by all of the
+	// generator's workers together, including retries. 0 means unlimited.
+	RateLimit float64
+	// Jitter is the maximum random time each worker sleeps for after fetching a
+	// tile, to avoid making requests in lockstep. 0 disables it.
+	Jitter time.Duration
+	// ExpectContentType, if set, is the media type tile responses must have,
+	// e.g. "image/png". Responses with any other Content-Type, such as an HTML
+	// error page, are treated as failures. Parameters like charset are ignored.
+	ExpectContentType string
+	// GzipLevel is the compression level, 1 to 9, that responses the server
+	// didn't gzip are gzipped with. Responses that are already gzipped are
+	// stored as they are. Defaults to gzip.DefaultCompression.
+	GzipLevel int
+	// Uncompressed stores tiles uncompressed, as the server sent them once any
+	// Content-Encoding is decoded, rather than gzipped. Tiles are requested with
+	// gzip either way, to save on transfer.
+	Uncompressed bool
+	// Failures, if set, records the tiles that could not be fetched.
+	Failures *TileListWriter
+	// Area, if set, limits the tiles generated from Bounds to those that
+	// intersect its polygons.
+	Area *Polygons
+	// TileList, if set, is read for the "z/x/y" tiles to request instead of
+	// generating them from Bounds and Zooms. Tiles are requested as they're
+	// read, so it may be a stream, such as stdin. See ReadTileList.
+	TileList io.Reader
+	// Client, if set, makes the tile requests instead of a client configured
+	// by HTTPTimeout, FileTransportRoot, MaxIdleConnsPerHost and Proxy, which
+	// are ignored. It must not transparently decompress responses.
+	Client HTTPDoer
+}
+
 func NewXYZJobGenerator(urlTemplate string, bounds *LngLatBbox, zooms []uint, httpTimeout time.Duration, invertedY bool) (JobGenerator, error) {
-	// Configure the HTTP client with a timeout and connection pools
-	httpClient := &http.Client{}
-	httpClient.Timeout = httpTimeout
-	httpTransport := &http.Transport{
-		MaxIdleConnsPerHost: 500,
-		DisableCompression:  true,
+	opts := &XYZJobGeneratorOptions{
+		URLTemplate: urlTemplate,
+		Bounds:      bounds,
+		Zooms:       zooms,
+		HTTPTimeout: httpTimeout,
+		InvertedY:   invertedY,
+		Jitter:      DefaultJitter,
 	}
-	httpClient.Transport = httpTransport
 
-	return &xyzJobGenerator{
-		httpClient:  httpClient,
-		urlTemplate: urlTemplate,
-		bounds:      bounds,
-		zooms:       zooms,
-		invertedY:   invertedY,
-	}, nil
+	return NewXYZJobGeneratorWithOptions(opts)
 }
 
 func NewFileTransportXYZJobGenerator(root string, urlTemplate string, bounds *LngLatBbox, zooms []uint, httpTimeout time.Duration, invertedY bool) (JobGenerator, error) {
+	opts := &XYZJobGeneratorOptions{
+		URLTemplate:       urlTemplate,
+		Bounds:            bounds,
+		Zooms:             zooms,
+		HTTPTimeout:       httpTimeout,
+		InvertedY:         invertedY,
+		FileTransportRoot: root,
+		Jitter:            DefaultJitter,
+	}
 
-	info, err := os.Stat(root)
+	return NewXYZJobGeneratorWithOptions(opts)
+}
 
-	if err != nil {
-		return nil, err
+func NewXYZJobGeneratorWithOptions(opts *XYZJobGeneratorOptions) (JobGenerator, error) {
+	httpClient := opts.Client
+
+	if httpClient == nil {
+		client, err := newXYZHTTPClient(opts)
+		if err != nil {
+			return nil, err
+		}
+
+		httpClient = client
 	}
 
-	if !info.IsDir() {
-		return nil, errors.New("Invalid root directory")
+	if strings.Contains(opts.URLTemplate, "{s}") && len(opts.Subdomains) == 0 {
+		return nil, errors.New("URL template contains {s} but no subdomains were specified")
 	}
 
-	httpClient := &http.Client{}
-	httpClient.Timeout = httpTimeout
+	retry := &retryPolicy{
+		retries:      opts.Retries,
+		initialDelay: opts.RetryInitialDelay,
+		maxDelay:     opts.RetryMaxDelay,
+	}
+
+	if opts.Scale != 0 && opts.Scale != 1 && opts.Scale != 2 {
+		return nil, errors.New("Scale must be 1 or 2")
+	}
+
+	gzipLevel := opts.GzipLevel
+
+	if gzipLevel == 0 {
+		gzipLevel = gzip.DefaultCompression
+	} else if gzipLevel < gzip.BestSpeed || gzipLevel > gzip.BestCompression {
+		return nil, errors.New("Gzip level must be between 1 and 9")
+	}
 
-	httpTransport := &http.Transport{}
-	httpTransport.RegisterProtocol("file", http.NewFileTransport(http.Dir(root)))
-	httpClient.Transport = httpTransport
+	userAgent := opts.UserAgent
+
+	if userAgent == "" {
+		userAgent = DefaultUserAgent
+	}
+
+	if retry.retries == 0 {
+		retry.retries = DefaultRetries
+	}
+
+	if retry.initialDelay == 0 {
+		retry.initialDelay = DefaultRetryInitialDelay
+	}
+
+	if retry.maxDelay == 0 {
+		retry.maxDelay = DefaultRetryMaxDelay
+	}
 
 	return &xyzJobGenerator{
-		httpClient:  httpClient,
-		urlTemplate: urlTemplate,
-		bounds:      bounds,
-		zooms:       zooms,
-		invertedY:   invertedY,
+		httpClient:   httpClient,
+		urlTemplate:  opts.URLTemplate,
+		bounds:       opts.Bounds,
+		boxes:        opts.Boxes,
+		zooms:        opts.Zooms,
+		invertedY:    opts.InvertedY,
+		subdomains:   opts.Subdomains,
+		scale:        opts.Scale,
+		userAgent:    userAgent,
+		headers:      opts.Headers,
+		retry:        retry,
+		contentType:  strings.ToLower(opts.ExpectContentType),
+		gzipLevel:    gzipLevel,
+		uncompressed: opts.Uncompressed,
+		failures:     opts.Failures,
+		tileList:     opts.TileList,
+		area:         opts.Area,
+		limiter:      newRateLimiter(opts.RateLimit),
+		jitter:       opts.Jitter,
+		tileDeadline: opts.TileDeadline,
 	}, nil
 }
 
+// newXYZHTTPClient returns the client an xyz generator makes requests with
+// when it isn't given one.
+func newXYZHTTPClient(opts *XYZJobGeneratorOptions) (*http.Client, error) {
+	// Configure the HTTP client with a timeout and connection pools
+	httpClient := &http.Client{}
+	httpClient.Timeout = opts.HTTPTimeout
+
+	if opts.FileTransportRoot != "" {
+
+		info, err := os.Stat(opts.FileTransportRoot)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !info.IsDir() {
+			return nil, errors.New("Invalid root directory")
+		}
+
+		httpTransport := &http.Transport{}
+		httpTransport.RegisterProtocol("file", http.NewFileTransport(http.Dir(opts.FileTransportRoot)))
+		httpClient.Transport = httpTransport
+
+	} else {
+
+		proxy := http.ProxyFromEnvironment
+
+		if opts.Proxy != nil {
+			proxy = http.ProxyURL(opts.Proxy)
+		}
+
+		maxIdleConnsPerHost := opts.MaxIdleConnsPerHost
+
+		if maxIdleConnsPerHost == 0 {
+			maxIdleConnsPerHost = DefaultMaxIdleConnsPerHost
+		}
+
+		// Workers ask for gzip themselves and store gzipped responses as-is,
+		// gzipping any that aren't, so the transport must not transparently
+		// decompress responses
+		httpTransport := &http.Transport{
+			Proxy:               proxy,
+			MaxIdleConnsPerHost: maxIdleConnsPerHost,
+			DisableCompression:  true,
+		}
+		httpClient.Transport = httpTransport
+	}
+
+	return httpClient, nil
+}
+
 type xyzJobGenerator struct {
-	httpClient  *http.Client
-	urlTemplate string
-	bounds      *LngLatBbox
-	zooms       []uint
-	invertedY   bool
+	httpClient   HTTPDoer
+	urlTemplate  string
+	bounds       *LngLatBbox
+	boxes        []*LngLatBbox
+	zooms        []uint
+	invertedY    bool
+	subdomains   []string
+	scale        int
+	userAgent    string
+	headers      http.Header
+	retry        *retryPolicy
+	contentType  string
+	gzipLevel    int
+	uncompressed bool
+	failures     *TileListWriter
+	tileList     io.Reader
+	area         *Polygons
+	limiter      *rateLimiter
+	jitter       time.Duration
+	tileDeadline time.Duration
+}
+
+// retryPolicy controls how often, and how patiently, doHTTPWithRetry retries a request.
+type retryPolicy struct {
+	retries      int
+	initialDelay time.Duration
+	maxDelay     time.Duration
+	// sleep waits between attempts. Defaults to time.Sleep.
+	sleep func(time.Duration)
+}
+
+// backoff returns the longest time to wait after the given failed attempt,
+// counting from 0: initialDelay, doubling with each attempt up to maxDelay.
+func (r *retryPolicy) backoff(attempt int) time.Duration {
+	delay := r.initialDelay
+
+	for i := 0; i < attempt && delay < r.maxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > r.maxDelay {
+		delay = r.maxDelay
+	}
+
+	return delay
+}
+
+// wait returns a random time up to the backoff of the given failed attempt,
+// so that workers whose requests failed together don't retry together.
+func (r *retryPolicy) wait(attempt int) time.Duration {
+	return time.Duration(rand.Int63n(int64(r.backoff(attempt)) + 1))
 }
 
-func doHTTPWithRetry(client *http.Client, request *http.Request, nRetries int) (*http.Response, error) {
-	sleep := 500 * time.Millisecond
+func (r *retryPolicy) pause(d time.Duration) {
+	if r.sleep != nil {
+		r.sleep(d)
+		return
+	}
+
+	time.Sleep(d)
+}
+
+func doHTTPWithRetry(client HTTPDoer, request *http.Request, retry *retryPolicy, limiter *rateLimiter) (*http.Response, error) {
+	ctx := request.Context()
+
+	for i := 0; i < retry.retries; i++ {
+		if err := limiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 
-	for i := 0; i < nRetries; i++ {
 		resp, err := client.Do(request)
 		if err != nil {
 			return nil, err
@@ -107,120 +373,347 @@ func doHTTPWithRetry(client *http.Client, request *http.Request, nRetries int) (
 		// was previously
 		// if resp.StatusCode > 500 && resp.StatusCode < 600 { sleep... }
 
-		if resp.StatusCode <= 500 || resp.StatusCode >= 600 {
+		tooManyRequests := resp.StatusCode == http.StatusTooManyRequests
+
+		if !tooManyRequests && (resp.StatusCode <= 500 || resp.StatusCode >= 600) {
 			return nil, &HTTPError{Code: resp.StatusCode, Status: resp.Status}
 		}
 
-		time.Sleep(sleep)
-		sleep *= 2.0
-		if sleep > 30.0 {
-			sleep = 30 * time.Second
+		// There's no point waiting after the last attempt
+		if i == retry.retries-1 {
+			break
 		}
+
+		wait := retry.wait(i)
+
+		// Rate limited and unavailable servers may tell us exactly how long to wait
+		if tooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+			if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+				wait = retryAfter
+			}
+		}
+
+		// Don't wait for a retry that couldn't be made before the request's deadline
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			return nil, context.DeadlineExceeded
+		}
+
+		retry.pause(wait)
 	}
 
 	return nil, fmt.Errorf("ran out of HTTP GET retries for %s", request.URL)
 }
 
+// parseRetryAfter parses the value of a Retry-After header, which is either a
+// number of seconds or a HTTP date.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	when, err := http.ParseTime(value)
+
+	if err != nil {
+		return 0, false
+	}
+
+	wait := time.Until(when)
+
+	if wait < 0 {
+		wait = 0
+	}
+
+	return wait, true
+}
+
+// skip logs that a tile request is being abandoned and records it as a failure.
+func (x *xyzJobGenerator) skip(request *TileRequest, err error) {
+	Logf(LogLevelDebug, "Skipping %+v: %+v", request, err)
+
+	if x.failures == nil {
+		return
+	}
+
+	if err := x.failures.WriteTile(request.Tile); err != nil {
+		Logf(LogLevelWarn, "Couldn't record failed tile %s: %+v", request.Tile.ToString(), err)
+	}
+}
+
 func (x *xyzJobGenerator) CreateWorker() (func(id int, jobs chan *TileRequest, results chan *TileResponse), error) {
 	f := func(id int, jobs chan *TileRequest, results chan *TileResponse) {
-
 		// Instantiate the gzip support stuff once instead on every iteration
-		bodyBuffer := bytes.NewBuffer(nil)
-		bodyGzipper := gzip.NewWriter(bodyBuffer)
+		gzipper := x.newGzipper()
 
-		for request := range jobs {
-			start := time.Now()
+		// Each worker has its own source, seeded differently, so that workers
+		// and runs don't all wait for the same times
+		random := rand.New(rand.NewSource(time.Now().UnixNano() + int64(id)))
 
-			httpReq, err := http.NewRequest("GET", request.URL, nil)
+		for request := range jobs {
+			response, err := x.fetchTile(request, gzipper)
 			if err != nil {
-				log.Printf("Unable to create HTTP request: %+v", err)
+				x.skip(request, err)
 				continue
 			}
 
-			httpReq.Header.Add("User-Agent", httpUserAgent)
-			httpReq.Header.Add("Accept-Encoding", "gzip")
+			results <- response
 
-			resp, err := doHTTPWithRetry(x.httpClient, httpReq, 30)
-			if err != nil {
-				log.Printf("Skipping %+v: %+v", request, err)
-				continue
+			// Sleep a tiny bit to try to prevent thundering herd
+			if x.jitter > 0 {
+				time.Sleep(time.Duration(random.Int63n(int64(x.jitter))))
 			}
+		}
+	}
 
-			var bodyData []byte
-			contentEncoding := resp.Header.Get("Content-Encoding")
-
-			switch contentEncoding {
-			case "gzip":
-				// If the server reports content encoding of gzip, we can just copy the bytes as-is
-				bodyData, err = ioutil.ReadAll(resp.Body)
-			default:
-				// Otherwise we'll gzip the data, so we should
-				// reset at the top in case we ran into a continue below
-				bodyBuffer.Reset()
-				bodyGzipper.Reset(bodyBuffer)
-
-				_, err = io.Copy(bodyGzipper, resp.Body)
-				if err != nil {
-					log.Printf("Couldn't copy to gzipper: %+v", err)
-					continue
-				}
-
-				err = bodyGzipper.Flush()
-				if err != nil {
-					log.Printf("Couldn't flush gzipper: %+v", err)
-					continue
-				}
-
-				bodyData, err = ioutil.ReadAll(bodyBuffer)
-				if err != nil {
-					log.Printf("Couldn't read bytes into byte array: %+v", err)
-					continue
-				}
-			}
-			resp.Body.Close()
+	return f, nil
+}
 
-			if err != nil {
-				log.Printf("Error copying bytes from HTTP response: %+v", err)
-				continue
-			}
+// FetchTile requests a tile with client the way the workers of an xyz
+// generator with the default options do, retrying failed requests and
+// gzipping the response if the server didn't. It's the seam for testing
+// fetching with a mock client rather than a server.
+func FetchTile(client HTTPDoer, request *TileRequest) (*TileResponse, error) {
+	generator, err := NewXYZJobGeneratorWithOptions(&XYZJobGeneratorOptions{Client: client})
+	if err != nil {
+		return nil, err
+	}
 
-			secs := time.Since(start).Seconds()
+	x := generator.(*xyzJobGenerator)
 
-			results <- &TileResponse{
-				Tile:    request.Tile,
-				Data:    bodyData,
-				Elapsed: secs,
-			}
+	return x.fetchTile(request, x.newGzipper())
+}
 
-			// Sleep a tiny bit to try to prevent thundering herd
-			time.Sleep(time.Duration(rand.Intn(50)) * time.Millisecond)
+// tileGzipper gzips the responses a worker fetches, reusing its buffer.
+type tileGzipper struct {
+	buf    *bytes.Buffer
+	writer *gzip.Writer
+}
+
+func (x *xyzJobGenerator) newGzipper() *tileGzipper {
+	buf := bytes.NewBuffer(nil)
+	// The level was checked when the generator was created
+	writer, _ := gzip.NewWriterLevel(buf, x.gzipLevel)
+
+	return &tileGzipper{buf: buf, writer: writer}
+}
+
+// fetchTile requests a tile, retrying as the generator's retry policy allows,
+// and returns its data gzipped, or uncompressed, as the generator stores it.
+func (x *xyzJobGenerator) fetchTile(request *TileRequest, gzipper *tileGzipper) (*TileResponse, error) {
+	start := time.Now()
+
+	httpReq, err := http.NewRequest("GET", request.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create HTTP request: %+v", err)
+	}
+
+	if x.tileDeadline > 0 {
+		// The deadline covers reading the body too, so it's only cancelled
+		// once that's done
+		ctx, cancel := context.WithTimeout(context.Background(), x.tileDeadline)
+		defer cancel()
+
+		httpReq = httpReq.WithContext(ctx)
+	}
+
+	httpReq.Header.Add("User-Agent", x.userAgent)
+	httpReq.Header.Add("Accept-Encoding", "gzip")
+
+	for name, values := range x.headers {
+		httpReq.Header.Del(name)
+		for _, value := range values {
+			httpReq.Header.Add(name, value)
 		}
 	}
 
-	return f, nil
+	resp, err := doHTTPWithRetry(x.httpClient, httpReq, x.retry, x.limiter)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if x.contentType != "" {
+		contentType := resp.Header.Get("Content-Type")
+		mediaType, _, err := mime.ParseMediaType(contentType)
+
+		if err != nil || mediaType != x.contentType {
+			return nil, fmt.Errorf("Unexpected Content-Type %q", contentType)
+		}
+	}
+
+	var bodyData []byte
+	contentEncoding := resp.Header.Get("Content-Encoding")
+
+	switch {
+	case contentEncoding == "gzip" && x.uncompressed:
+		bodyData, err = gunzipBody(resp.Body)
+	case contentEncoding == "gzip":
+		// If the server reports content encoding of gzip, we can just copy the bytes as-is
+		bodyData, err = ioutil.ReadAll(resp.Body)
+	case x.uncompressed:
+		bodyData, err = ioutil.ReadAll(resp.Body)
+	default:
+		// Otherwise we'll gzip the data, so we should
+		// reset in case the last tile ran into an error
+		gzipper.buf.Reset()
+		gzipper.writer.Reset(gzipper.buf)
+
+		_, err = io.Copy(gzipper.writer, resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't copy to gzipper: %+v", err)
+		}
+
+		// Closing, rather than flushing, writes the gzip footer
+		err = gzipper.writer.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't close gzipper: %+v", err)
+		}
+
+		bodyData, err = ioutil.ReadAll(gzipper.buf)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't read bytes into byte array: %+v", err)
+		}
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("Error copying bytes from HTTP response: %+v", err)
+	}
+
+	response := &TileResponse{
+		Tile:       request.Tile,
+		Data:       bodyData,
+		Elapsed:    time.Since(start).Seconds(),
+		StatusCode: resp.StatusCode,
+	}
+
+	return response, nil
+}
+
+// gunzipBody returns the uncompressed contents of a gzipped response body.
+// Unlike Gunzip, a body without its gzip footer is an error: the response was
+// cut short, and saving it would store a truncated tile.
+func gunzipBody(body io.Reader) ([]byte, error) {
+	reader, err := gzip.NewReader(body)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
+
+// tileURL returns the URL to request tile from.
+func (x *xyzJobGenerator) tileURL(tile *Tile) string {
+	ratio := ""
+	if x.scale == 2 {
+		ratio = "@2x"
+	}
+
+	// The tile's Y is already a TMS row if InvertedY is set
+	tmsY := tile.Y
+	if !x.invertedY {
+		tmsY = (1 << tile.Z) - 1 - tile.Y
+	}
+
+	replacements := []string{
+		"{x}", fmt.Sprintf("%d", tile.X),
+		"{y}", fmt.Sprintf("%d", tile.Y),
+		"{-y}", fmt.Sprintf("%d", tmsY),
+		"{z}", fmt.Sprintf("%d", tile.Z),
+		"{q}", tile.Quadkey(),
+		"{r}", ratio,
+	}
+
+	if len(x.subdomains) > 0 {
+		// Spread neighbouring tiles across the subdomains
+		subdomain := x.subdomains[(tile.X+tile.Y)%uint(len(x.subdomains))]
+		replacements = append(replacements, "{s}", subdomain)
+	}
+
+	return strings.NewReplacer(replacements...).Replace(x.urlTemplate)
+}
+
+// Close stops the rate limiter shared by the generator's workers. It's called
+// once every pool of workers has finished, since workers created afterwards
+// can't make any requests.
+func (x *xyzJobGenerator) Close() error {
+	x.limiter.Stop()
+	return nil
 }
 
 func (x *xyzJobGenerator) CreateJobs(jobs chan *TileRequest) error {
+	return x.CreateJobsWithContext(context.Background(), jobs)
+}
+
+func (x *xyzJobGenerator) CreateJobsWithContext(ctx context.Context, jobs chan *TileRequest) error {
+	// Workers waiting for the rate limiter haven't started their requests, so
+	// they give up too rather than wait their turn
+	defer func() {
+		if ctx.Err() != nil {
+			x.limiter.Stop()
+		}
+	}()
+
 	consumer := func(tile *Tile) {
-		url := strings.NewReplacer(
-			"{x}", fmt.Sprintf("%d", tile.X),
-			"{y}", fmt.Sprintf("%d", tile.Y),
-			"{z}", fmt.Sprintf("%d", tile.Z)).Replace(x.urlTemplate)
+		// Nothing more is queued once ctx is cancelled
+		if ctx.Err() != nil {
+			return
+		}
 
 		jobs <- &TileRequest{
-			URL:  url,
+			URL:  x.tileURL(tile),
 			Tile: tile,
 		}
 	}
 
+	if x.tileList != nil {
+		queue := consumer
+
+		consumer = func(tile *Tile) {
+			// A bad list mustn't turn into requests for tiles that can't exist
+			if !tile.Valid() {
+				Logf(LogLevelWarn, "Skipping invalid tile %s", tile.ToString())
+				x.skip(&TileRequest{Tile: tile}, ErrInvalidTile)
+				return
+			}
+
+			queue(tile)
+		}
+
+		return ReadTileListWithContext(ctx, x.tileList, consumer)
+	}
+
+	if x.area != nil {
+		queue := consumer
+
+		consumer = func(tile *Tile) {
+			// Bounds are calculated from XYZ coordinates
+			t := tile
+			if x.invertedY {
+				t = &Tile{Z: tile.Z, X: tile.X, Y: (1 << tile.Z) - 1 - tile.Y}
+			}
+
+			if x.area.Intersects(t.Bounds()) {
+				queue(tile)
+			}
+		}
+	}
+
 	opts := &GenerateTilesOptions{
 		Bounds:       x.bounds,
+		Boxes:        x.boxes,
 		Zooms:        x.zooms,
 		ConsumerFunc: consumer,
 		InvertedY:    x.invertedY,
 	}
 
-	GenerateTiles(opts)
-
-	return nil
+	return GenerateTilesWithContext(ctx, opts)
 }
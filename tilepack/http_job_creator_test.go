@@ -0,0 +1,655 @@
+package tilepack
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestXYZJobGenerator_Proxy(t *testing.T) {
+	requested := make(chan string, 1)
+
+	// Requests made through a proxy use the absolute URL of the tile
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested <- r.URL.String()
+		w.Write([]byte("tile"))
+	}))
+	defer proxy.Close()
+
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	generator, err := NewXYZJobGeneratorWithOptions(&XYZJobGeneratorOptions{
+		URLTemplate: "http://tiles.example.com/{z}/{x}/{y}.mvt",
+		HTTPTimeout: 10 * time.Second,
+		Proxy:       proxyURL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	worker, err := generator.CreateWorker()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jobs := make(chan *TileRequest, 1)
+	results := make(chan *TileResponse, 1)
+
+	jobs <- &TileRequest{Tile: &Tile{Z: 1, X: 1, Y: 0}, URL: "http://tiles.example.com/1/1/0.mvt"}
+	close(jobs)
+
+	worker(0, jobs, results)
+
+	if got := <-requested; got != "http://tiles.example.com/1/1/0.mvt" {
+		t.Errorf("Proxy received a request for %s", got)
+	}
+
+	if len(results) != 1 {
+		t.Fatalf("Got %d results, want 1", len(results))
+	}
+
+	// The response wasn't gzipped, so the worker gzips it
+	reader, err := gzip.NewReader(bytes.NewReader((<-results).Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil || string(data) != "tile" {
+		t.Errorf("Got tile data %q, %v", data, err)
+	}
+}
+
+func TestXYZJobGenerator_Scale(t *testing.T) {
+	tests := []struct {
+		scale int
+		url   string
+	}{
+		{0, "http://tiles.example.com/0/0/0.png"},
+		{1, "http://tiles.example.com/0/0/0.png"},
+		{2, "http://tiles.example.com/0/0/0@2x.png"},
+	}
+
+	for _, test := range tests {
+		generator, err := NewXYZJobGeneratorWithOptions(&XYZJobGeneratorOptions{
+			URLTemplate: "http://tiles.example.com/{z}/{x}/{y}{r}.png",
+			Bounds:      &LngLatBbox{-180.0, -85.0, 180.0, 85.0},
+			Zooms:       []uint{0},
+			Scale:       test.scale,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		jobs := make(chan *TileRequest, 1)
+
+		err = generator.CreateJobs(jobs)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := (<-jobs).URL; got != test.url {
+			t.Errorf("Scale %d requested %s, want %s", test.scale, got, test.url)
+		}
+	}
+
+	_, err := NewXYZJobGeneratorWithOptions(&XYZJobGeneratorOptions{Scale: 3})
+	if err == nil {
+		t.Error("Expected an error for scale 3")
+	}
+}
+
+func TestXYZJobGenerator_TileURL(t *testing.T) {
+	tests := []struct {
+		invertedY bool
+		url       string
+	}{
+		{false, "http://tiles.example.com/2/1/0/3.mvt"},
+		{true, "http://tiles.example.com/2/1/0/0.mvt"},
+	}
+
+	for _, test := range tests {
+		x := &xyzJobGenerator{
+			urlTemplate: "http://tiles.example.com/{z}/{x}/{y}/{-y}.mvt",
+			invertedY:   test.invertedY,
+		}
+
+		if got := x.tileURL(&Tile{Z: 2, X: 1, Y: 0}); got != test.url {
+			t.Errorf("Inverted Y %t requested %s, want %s", test.invertedY, got, test.url)
+		}
+	}
+}
+
+func TestXYZJobGenerator_ExpectContentType(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/1/0/0.png" {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte("<html>Oops</html>"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("tile"))
+	}))
+	defer server.Close()
+
+	var failed bytes.Buffer
+	failures := NewTileListWriter(&failed)
+
+	generator, err := NewXYZJobGeneratorWithOptions(&XYZJobGeneratorOptions{
+		URLTemplate:       server.URL + "/{z}/{x}/{y}.png",
+		HTTPTimeout:       10 * time.Second,
+		ExpectContentType: "Image/PNG",
+		Failures:          failures,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	worker, err := generator.CreateWorker()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jobs := make(chan *TileRequest, 2)
+	results := make(chan *TileResponse, 2)
+
+	jobs <- &TileRequest{Tile: &Tile{Z: 1, X: 0, Y: 0}, URL: server.URL + "/1/0/0.png"}
+	jobs <- &TileRequest{Tile: &Tile{Z: 1, X: 1, Y: 0}, URL: server.URL + "/1/1/0.png"}
+	close(jobs)
+
+	worker(0, jobs, results)
+
+	if len(results) != 1 {
+		t.Fatalf("Got %d results, want 1", len(results))
+	}
+
+	if tile := (<-results).Tile; tile.X != 1 {
+		t.Errorf("Got result for %s, want 1/1/0", tile.ToString())
+	}
+
+	if failed.String() != "1/0/0\n" {
+		t.Errorf("Recorded failures %q, want \"1/0/0\\n\"", failed.String())
+	}
+}
+
+func TestXYZJobGenerator_UserAgent(t *testing.T) {
+	tests := []struct {
+		userAgent string
+		want      string
+	}{
+		{"", DefaultUserAgent},
+		{"my-tiles (tiles@example.com)", "my-tiles (tiles@example.com)"},
+	}
+
+	for _, test := range tests {
+		requested := make(chan string, 1)
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requested <- r.UserAgent()
+			w.Write([]byte("tile"))
+		}))
+
+		generator, err := NewXYZJobGeneratorWithOptions(&XYZJobGeneratorOptions{
+			URLTemplate: server.URL + "/{z}/{x}/{y}.mvt",
+			HTTPTimeout: 10 * time.Second,
+			UserAgent:   test.userAgent,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		worker, err := generator.CreateWorker()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		jobs := make(chan *TileRequest, 1)
+		results := make(chan *TileResponse, 1)
+
+		jobs <- &TileRequest{Tile: &Tile{Z: 0, X: 0, Y: 0}, URL: server.URL + "/0/0/0.mvt"}
+		close(jobs)
+
+		worker(0, jobs, results)
+		server.Close()
+
+		if got := <-requested; got != test.want {
+			t.Errorf("UserAgent %q sent %q, want %q", test.userAgent, got, test.want)
+		}
+	}
+}
+
+func TestXYZJobGenerator_GzipLevel(t *testing.T) {
+	// Text that compresses better the harder gzip tries
+	var body []byte
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		body = strconv.AppendInt(body, int64(random.Intn(100)), 10)
+		body = append(body, ',')
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	for _, level := range []int{-1, 10} {
+		_, err := NewXYZJobGeneratorWithOptions(&XYZJobGeneratorOptions{
+			URLTemplate: server.URL + "/{z}/{x}/{y}.mvt",
+			GzipLevel:   level,
+		})
+		if err == nil {
+			t.Errorf("GzipLevel %d expected an error", level)
+		}
+	}
+
+	sizes := make(map[int]int)
+
+	for _, level := range []int{0, 1, 9} {
+		generator, err := NewXYZJobGeneratorWithOptions(&XYZJobGeneratorOptions{
+			URLTemplate: server.URL + "/{z}/{x}/{y}.mvt",
+			HTTPTimeout: 10 * time.Second,
+			GzipLevel:   level,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		worker, err := generator.CreateWorker()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		jobs := make(chan *TileRequest, 1)
+		results := make(chan *TileResponse, 1)
+
+		jobs <- &TileRequest{Tile: &Tile{Z: 0, X: 0, Y: 0}, URL: server.URL + "/0/0/0.mvt"}
+		close(jobs)
+
+		worker(0, jobs, results)
+
+		result := <-results
+
+		reader, err := gzip.NewReader(bytes.NewReader(result.Data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(data, body) {
+			t.Errorf("GzipLevel %d didn't round trip", level)
+		}
+
+		sizes[level] = len(result.Data)
+	}
+
+	if sizes[9] >= sizes[1] {
+		t.Errorf("GzipLevel 9 gave %d bytes, want fewer than level 1's %d", sizes[9], sizes[1])
+	}
+}
+
+func TestXYZJobGenerator_Uncompressed(t *testing.T) {
+	body := []byte("not really a tile")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			t.Errorf("Request had Accept-Encoding %q, want gzip", r.Header.Get("Accept-Encoding"))
+		}
+
+		if r.URL.Path == "/gzipped" {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			gz.Write(body)
+			gz.Close()
+			return
+		}
+
+		// A response cut short, without its gzip footer
+		if r.URL.Path == "/truncated" {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			gz.Write(body)
+			gz.Flush()
+			return
+		}
+
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	var failed bytes.Buffer
+
+	generator, err := NewXYZJobGeneratorWithOptions(&XYZJobGeneratorOptions{
+		URLTemplate:  server.URL + "/{z}/{x}/{y}.mvt",
+		HTTPTimeout:  10 * time.Second,
+		Uncompressed: true,
+		Failures:     NewTileListWriter(&failed),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	worker, err := generator.CreateWorker()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jobs := make(chan *TileRequest, 3)
+	results := make(chan *TileResponse, 3)
+
+	jobs <- &TileRequest{Tile: &Tile{Z: 0, X: 0, Y: 0}, URL: server.URL + "/gzipped"}
+	jobs <- &TileRequest{Tile: &Tile{Z: 0, X: 0, Y: 0}, URL: server.URL + "/plain"}
+	jobs <- &TileRequest{Tile: &Tile{Z: 1, X: 1, Y: 1}, URL: server.URL + "/truncated"}
+	close(jobs)
+
+	worker(0, jobs, results)
+	close(results)
+
+	count := 0
+	for result := range results {
+		count++
+
+		if !bytes.Equal(result.Data, body) {
+			t.Errorf("Stored %q, want %q", result.Data, body)
+		}
+	}
+
+	if count != 2 {
+		t.Errorf("Got %d results, want 2", count)
+	}
+
+	if failed.String() != "1/1/1\n" {
+		t.Errorf("Failures were %q, want the truncated tile", failed.String())
+	}
+}
+
+func TestDoHTTPWithRetry_Backoff(t *testing.T) {
+	requests := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+
+		// The last failure asks for a specific wait
+		if requests == 6 {
+			w.Header().Set("Retry-After", "3")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	var sleeps []time.Duration
+
+	retry := &retryPolicy{
+		retries:      7,
+		initialDelay: 100 * time.Millisecond,
+		maxDelay:     500 * time.Millisecond,
+		sleep:        func(d time.Duration) { sleeps = append(sleeps, d) },
+	}
+
+	request, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := doHTTPWithRetry(server.Client(), request, retry, nil); err == nil {
+		t.Fatal("doHTTPWithRetry() didn't return an error")
+	}
+
+	if requests != 7 {
+		t.Errorf("doHTTPWithRetry() made %d requests, want 7", requests)
+	}
+
+	// No wait follows the last attempt
+	ceilings := []time.Duration{100, 200, 400, 500, 500}
+	if len(sleeps) != len(ceilings)+1 {
+		t.Fatalf("doHTTPWithRetry() slept %d times, want %d", len(sleeps), len(ceilings)+1)
+	}
+
+	jittered := false
+
+	for i, ceiling := range ceilings {
+		ceiling *= time.Millisecond
+
+		if sleeps[i] < 0 || sleeps[i] > ceiling {
+			t.Errorf("Wait %d was %v, want between 0 and %v", i, sleeps[i], ceiling)
+		}
+
+		if sleeps[i] != ceiling {
+			jittered = true
+		}
+	}
+
+	if !jittered {
+		t.Error("Every wait was as long as it could be, want random waits")
+	}
+
+	if sleeps[5] != 3*time.Second {
+		t.Errorf("Waited %v after a Retry-After of 3 seconds", sleeps[5])
+	}
+}
+
+func TestDoHTTPWithRetry_LongRetryAfter(t *testing.T) {
+	requests := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	var sleeps []time.Duration
+
+	retry := &retryPolicy{
+		retries:      2,
+		initialDelay: 100 * time.Millisecond,
+		maxDelay:     time.Second,
+		sleep:        func(d time.Duration) { sleeps = append(sleeps, d) },
+	}
+
+	request, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The server's Retry-After is honored even though it's longer than the
+	// maximum backoff
+	if _, err := doHTTPWithRetry(server.Client(), request, retry, nil); err == nil {
+		t.Fatal("doHTTPWithRetry() didn't return an error")
+	}
+
+	if requests != 2 || len(sleeps) != 1 || sleeps[0] != time.Hour {
+		t.Errorf("doHTTPWithRetry() made %d requests and waited %v, want 2 requests an hour apart", requests, sleeps)
+	}
+
+	// Unless the retry couldn't be made before the tile's deadline
+	requests = 0
+	sleeps = nil
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if _, err := doHTTPWithRetry(server.Client(), request.WithContext(ctx), retry, nil); err != context.DeadlineExceeded {
+		t.Errorf("doHTTPWithRetry() = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	if requests != 1 || len(sleeps) != 0 {
+		t.Errorf("doHTTPWithRetry() made %d requests and waited %v, want to give up after 1", requests, sleeps)
+	}
+}
+
+// mockDoer answers requests without a server.
+type mockDoer func(*http.Request) (*http.Response, error)
+
+func (m mockDoer) Do(r *http.Request) (*http.Response, error) {
+	return m(r)
+}
+
+func TestFetchTile(t *testing.T) {
+	statuses := []int{http.StatusServiceUnavailable, http.StatusOK}
+	requests := 0
+
+	client := mockDoer(func(r *http.Request) (*http.Response, error) {
+		if r.Header.Get("Accept-Encoding") != "gzip" || r.Header.Get("User-Agent") != DefaultUserAgent {
+			t.Errorf("Unexpected request headers %v", r.Header)
+		}
+
+		status := statuses[requests]
+		requests++
+
+		header := http.Header{}
+		// Retry straight away rather than backing off
+		header.Set("Retry-After", "0")
+
+		response := &http.Response{
+			StatusCode: status,
+			Status:     http.StatusText(status),
+			Header:     header,
+			Body:       ioutil.NopCloser(bytes.NewReader([]byte("tile"))),
+		}
+
+		return response, nil
+	})
+
+	request := &TileRequest{Tile: &Tile{X: 1, Y: 2, Z: 3}, URL: "http://tiles.example.com/3/1/2.mvt"}
+
+	response, err := FetchTile(client, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if requests != 2 || response.StatusCode != http.StatusOK || !response.Tile.Equals(request.Tile) {
+		t.Errorf("Got %+v after %d requests, want the tile after 2", response, requests)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(response.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadAll(gz)
+	if err != nil || string(data) != "tile" {
+		t.Errorf("Got %q, %v, want the tile's data gzipped", data, err)
+	}
+
+	statuses = []int{http.StatusNotFound}
+	requests = 0
+
+	_, err = FetchTile(client, request)
+
+	if httpErr, ok := err.(*HTTPError); !ok || httpErr.Code != http.StatusNotFound {
+		t.Errorf("Got error %v, want a 404 HTTPError", err)
+	}
+}
+
+func TestXYZJobGenerator_InvalidTile(t *testing.T) {
+	var failed bytes.Buffer
+
+	generator, err := NewXYZJobGeneratorWithOptions(&XYZJobGeneratorOptions{
+		URLTemplate: "http://tiles.example.com/{z}/{x}/{y}.png",
+		TileList:    strings.NewReader("1/1/1\n1/2/0\n2/3/3\n"),
+		Failures:    NewTileListWriter(&failed),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jobs := make(chan *TileRequest, 3)
+
+	if err := generator.CreateJobs(jobs); err != nil {
+		t.Fatal(err)
+	}
+
+	close(jobs)
+
+	var requested []string
+
+	for job := range jobs {
+		requested = append(requested, job.Tile.ToString())
+	}
+
+	if strings.Join(requested, ",") != "{1/1/1},{2/3/3}" {
+		t.Errorf("Requested %v, want 1/1/1 and 2/3/3", requested)
+	}
+
+	if failed.String() != "1/2/0\n" {
+		t.Errorf("Recorded failures %q, want \"1/2/0\\n\"", failed.String())
+	}
+}
+
+func TestXYZJobGenerator_TileDeadline(t *testing.T) {
+	handlers := map[string]http.HandlerFunc{
+		// Waiting for the retry would overrun the deadline
+		"retry": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		},
+		// The attempt itself overruns the deadline
+		"slow": func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+		},
+	}
+
+	for name, handler := range handlers {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			var failed bytes.Buffer
+
+			generator, err := NewXYZJobGeneratorWithOptions(&XYZJobGeneratorOptions{
+				URLTemplate:  server.URL + "/{z}/{x}/{y}.png",
+				HTTPTimeout:  10 * time.Second,
+				TileDeadline: 100 * time.Millisecond,
+				Failures:     NewTileListWriter(&failed),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			worker, err := generator.CreateWorker()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			jobs := make(chan *TileRequest, 1)
+			results := make(chan *TileResponse, 1)
+
+			jobs <- &TileRequest{Tile: &Tile{Z: 1, X: 0, Y: 0}, URL: server.URL + "/1/0/0.png"}
+			close(jobs)
+
+			start := time.Now()
+			worker(0, jobs, results)
+
+			if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+				t.Errorf("Worker took %v, want about the 100ms deadline", elapsed)
+			}
+
+			if len(results) != 0 || failed.String() != "1/0/0\n" {
+				t.Errorf("Got %d results and failures %q, want the tile to fail", len(results), failed.String())
+			}
+		})
+	}
+}
@@ -1,6 +1,13 @@
 package tilepack
 
+import (
+	"context"
+)
+
 type JobGenerator interface {
 	CreateWorker() (func(id int, jobs chan *TileRequest, results chan *TileResponse), error)
 	CreateJobs(jobs chan *TileRequest) error
+	// CreateJobsWithContext is like CreateJobs but stops adding jobs once ctx
+	// is cancelled, returning ctx.Err().
+	CreateJobsWithContext(ctx context.Context, jobs chan *TileRequest) error
 }
@@ -0,0 +1,62 @@
+package tilepack
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// LogLevel is the importance of a log message. Messages less important than
+// the level given to SetLogLevel aren't written.
+type LogLevel int32
+
+const (
+	LogLevelError LogLevel = iota
+	LogLevelWarn
+	LogLevelInfo
+	LogLevelDebug
+)
+
+// logLevelNames are the names ParseLogLevel accepts.
+var logLevelNames = map[string]LogLevel{
+	"error": LogLevelError,
+	"warn":  LogLevelWarn,
+	"info":  LogLevelInfo,
+	"debug": LogLevelDebug,
+}
+
+// logLevel is the current LogLevel, read and written atomically.
+var logLevel = int32(LogLevelInfo)
+
+// ParseLogLevel returns the LogLevel called name: error, warn, info or debug.
+func ParseLogLevel(name string) (LogLevel, error) {
+	level, ok := logLevelNames[strings.ToLower(name)]
+
+	if !ok {
+		return 0, fmt.Errorf("Unknown log level %s, must be error, warn, info or debug", name)
+	}
+
+	return level, nil
+}
+
+// SetLogLevel sets the least important messages that are written. It
+// defaults to LogLevelInfo.
+func SetLogLevel(level LogLevel) {
+	atomic.StoreInt32(&logLevel, int32(level))
+}
+
+// LogLevelEnabled returns true if messages at level are written.
+func LogLevelEnabled(level LogLevel) bool {
+	return int32(level) <= atomic.LoadInt32(&logLevel)
+}
+
+// Logf writes a message to the standard logger, as log.Printf does, if level
+// is enabled.
+func Logf(level LogLevel, format string, v ...interface{}) {
+	if !LogLevelEnabled(level) {
+		return
+	}
+
+	log.Output(2, fmt.Sprintf(format, v...))
+}
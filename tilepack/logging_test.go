@@ -0,0 +1,46 @@
+package tilepack
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLogf(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	defer SetLogLevel(LogLevelInfo)
+
+	level, err := ParseLogLevel("WARN")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	SetLogLevel(level)
+
+	Logf(LogLevelError, "an error")
+	Logf(LogLevelWarn, "a %s", "warning")
+	Logf(LogLevelInfo, "some info")
+	Logf(LogLevelDebug, "debugging")
+
+	got := buf.String()
+
+	for _, want := range []string{"an error", "a warning"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Logf() didn't write %q", want)
+		}
+	}
+
+	for _, unwanted := range []string{"some info", "debugging"} {
+		if strings.Contains(got, unwanted) {
+			t.Errorf("Logf() wrote %q at the warn level", unwanted)
+		}
+	}
+
+	if _, err := ParseLogLevel("verbose"); err == nil {
+		t.Error("ParseLogLevel(\"verbose\") expected an error")
+	}
+}
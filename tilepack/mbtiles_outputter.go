@@ -1,24 +1,177 @@
 package tilepack
 
 import (
+	"context"
 	"crypto/md5"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/url"
+	"strconv"
+	"strings"
 
 	_ "github.com/mattn/go-sqlite3" // Register sqlite3 database driver
 )
 
 const (
-	batchSize = 1000
+	// DefaultMbtilesBatchSize is the number of tiles mbtiles outputters save per transaction.
+	DefaultMbtilesBatchSize = 1000
+
+	// DefaultMbtilesJournalMode is the SQLite journal mode used by mbtiles outputters.
+	DefaultMbtilesJournalMode = "WAL"
+	// DefaultMbtilesSynchronous is the SQLite synchronous level used by mbtiles outputters.
+	DefaultMbtilesSynchronous = "OFF"
+	// DefaultMbtilesHash is the hash mbtiles outputters use to find identical tiles.
+	DefaultMbtilesHash = "md5"
+	// DefaultMbtilesPageSize is the SQLite page size, in bytes, of the
+	// databases mbtiles outputters create.
+	DefaultMbtilesPageSize = 4096
+	// DefaultMbtilesCacheSize is the SQLite cache_size pragma used by mbtiles
+	// outputters. Negative sizes are in KiB, so this is about 2MB per connection.
+	DefaultMbtilesCacheSize = -2000
 )
 
+// mbtilesHashes are the hash functions that can be used to find identical tiles.
+var mbtilesHashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha256": sha256.New,
+}
+
+// MbtilesOutputterOptions configures the outputter returned by NewMbtilesOutputterWithOptions.
+type MbtilesOutputterOptions struct {
+	// JournalMode is the SQLite journal_mode pragma: DELETE, TRUNCATE, PERSIST,
+	// MEMORY, WAL or OFF. Defaults to DefaultMbtilesJournalMode. WAL lets the
+	// database be read while tiles are being written to it.
+	JournalMode string
+	// Synchronous is the SQLite synchronous pragma: OFF, NORMAL, FULL or EXTRA.
+	// Defaults to DefaultMbtilesSynchronous, which is fastest but may leave the
+	// database corrupt if the machine crashes during a build.
+	Synchronous string
+	// BatchSize is the number of tiles saved in each transaction. Defaults to
+	// DefaultMbtilesBatchSize. Larger batches are faster to write but more
+	// tiles are lost if the process is killed before the batch is committed.
+	BatchSize int
+	// DisableDeduplication stores every tile's data in its own row of a tiles
+	// table rather than storing identical tiles once in the images table. It
+	// saves hashing each tile when nearly all of them are unique.
+	DisableDeduplication bool
+	// Hash is the function used to find identical tiles, md5 or sha256.
+	// Defaults to DefaultMbtilesHash.
+	Hash string
+	// TileID, if set, returns the key tiles are deduplicated by instead of the
+	// hex digest of Hash. Tiles with the same key are stored once, as the data
+	// of whichever was saved last, so it can treat tiles that differ byte for
+	// byte as identical, or be a faster, non-cryptographic hash.
+	TileID func([]byte) string
+	// PageSize is the SQLite page_size pragma, a power of two from 512 to
+	// 65536. Defaults to DefaultMbtilesPageSize. It only applies to databases
+	// the outputter creates: SQLite fixes the page size when the schema is
+	// created, so it's ignored if the database already has tables in it.
+	PageSize int
+	// CacheSize is the SQLite cache_size pragma: a number of pages if it's
+	// positive, or of KiB if it's negative. Defaults to DefaultMbtilesCacheSize.
+	CacheSize int
+	// Optimize runs Optimize when the outputter is closed. It's off by default
+	// because VACUUM needs as much free disk space as the database takes up.
+	Optimize bool
+}
+
 func NewMbtilesOutputter(dsn string) (*mbtilesOutputter, error) {
-	db, err := sql.Open("sqlite3", dsn)
+	return NewMbtilesOutputterWithOptions(dsn, &MbtilesOutputterOptions{})
+}
+
+// NewMbtilesOutputterWithOptions returns an outputter writing to the mbtiles
+// database at dsn, which may include go-sqlite3 connection parameters. The
+// pragmas are applied to every connection to the database, not just the first.
+func NewMbtilesOutputterWithOptions(dsn string, opts *MbtilesOutputterOptions) (*mbtilesOutputter, error) {
+	journalMode := opts.JournalMode
+	if journalMode == "" {
+		journalMode = DefaultMbtilesJournalMode
+	}
+
+	synchronous := opts.Synchronous
+	if synchronous == "" {
+		synchronous = DefaultMbtilesSynchronous
+	}
+
+	batchSize := opts.BatchSize
+	if batchSize == 0 {
+		batchSize = DefaultMbtilesBatchSize
+	}
+
+	if batchSize < 0 {
+		return nil, errors.New("Batch size must be positive")
+	}
+
+	pageSize := opts.PageSize
+	if pageSize == 0 {
+		pageSize = DefaultMbtilesPageSize
+	}
+
+	if pageSize < 512 || pageSize > 65536 || pageSize&(pageSize-1) != 0 {
+		return nil, fmt.Errorf("Page size %d must be a power of two from 512 to 65536", pageSize)
+	}
+
+	cacheSize := opts.CacheSize
+	if cacheSize == 0 {
+		cacheSize = DefaultMbtilesCacheSize
+	}
+
+	var tileID func([]byte) string
+
+	if !opts.DisableDeduplication {
+		hashName := opts.Hash
+		if hashName == "" {
+			hashName = DefaultMbtilesHash
+		}
+
+		newHash, ok := mbtilesHashes[hashName]
+
+		if !ok {
+			return nil, fmt.Errorf("Unknown hash %s", hashName)
+		}
+
+		tileID = opts.TileID
+		if tileID == nil {
+			tileID = hashTileID(newHash)
+		}
+	}
+
+	params := url.Values{}
+	params.Set("_journal_mode", journalMode)
+	params.Set("_synchronous", synchronous)
+	params.Set("_cache_size", strconv.Itoa(cacheSize))
+
+	// Parameters already in the DSN come first and so take precedence
+	separator := "?"
+	if strings.Contains(dsn, "?") {
+		separator = "&"
+	}
+
+	db, err := sql.Open("sqlite3", dsn+separator+params.Encode())
 	if err != nil {
 		return nil, err
 	}
 
-	return &mbtilesOutputter{db: db}, nil
+	// sql.Open doesn't connect, so check the pragmas are valid now
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	o := &mbtilesOutputter{
+		db:          db,
+		batchSize:   batchSize,
+		pageSize:    pageSize,
+		journalMode: journalMode,
+		optimize:    opts.Optimize,
+		tileID:      tileID,
+	}
+
+	return o, nil
 }
 
 type mbtilesOutputter struct {
@@ -26,14 +179,71 @@ type mbtilesOutputter struct {
 	db         *sql.DB
 	txn        *sql.Tx
 	batchCount int
+	batchSize  int
 	hasTiles   bool
+	hasFormat  bool
+	pageSize   int
+	// journalMode is restored after the page size is set
+	journalMode string
+	optimize    bool
+	// tileID is nil if tiles aren't deduplicated
+	tileID func([]byte) string
+}
+
+// hashTileID returns a function that keys tiles by the hex digest of a hash.
+func hashTileID(newHash func() hash.Hash) func([]byte) string {
+	return func(data []byte) string {
+		h := newHash()
+		h.Write(data)
+		return hex.EncodeToString(h.Sum(nil))
+	}
+}
+
+func (o *mbtilesOutputter) saveDeduped(tile *Tile, data []byte) error {
+	tileID := o.tileID(data)
+
+	_, err := o.txn.Exec("INSERT OR REPLACE INTO images (tile_id, tile_data) VALUES (?, ?);", tileID, data)
+	if err != nil {
+		return err
+	}
+
+	_, err = o.txn.Exec("INSERT OR REPLACE INTO map (zoom_level, tile_column, tile_row, tile_id) VALUES (?, ?, ?, ?);", tile.Z, tile.X, tile.Y, tileID)
+	return err
+}
+
+// Flush commits the open transaction, if there is one.
+func (o *mbtilesOutputter) Flush() error {
+	if o.txn == nil {
+		return nil
+	}
+
+	err := o.txn.Commit()
+	o.txn = nil
+	o.batchCount = 0
+
+	return err
+}
+
+// Optimize commits the open transaction, if there is one, then compacts the
+// database with VACUUM and updates the query planner's statistics with
+// ANALYZE. Builds that replace a lot of tiles leave the database larger and
+// slower to query than it needs to be.
+func (o *mbtilesOutputter) Optimize() error {
+	if err := o.Flush(); err != nil {
+		return err
+	}
+
+	Logf(LogLevelInfo, "Vacuuming and analyzing the database")
+
+	_, err := o.db.Exec("VACUUM; ANALYZE;")
+	return err
 }
 
 func (o *mbtilesOutputter) Close() error {
-	var err error
+	err := o.Flush()
 
-	if o.txn != nil {
-		err = o.txn.Commit()
+	if err == nil && o.optimize {
+		err = o.Optimize()
 	}
 
 	if o.db != nil {
@@ -45,47 +255,206 @@ func (o *mbtilesOutputter) Close() error {
 	return err
 }
 
+// mbtilesSchema stores each tile's data alongside its coordinates.
+const mbtilesSchema = `
+	BEGIN TRANSACTION;
+	CREATE TABLE IF NOT EXISTS tiles (
+		zoom_level INTEGER NOT NULL,
+		tile_column INTEGER NOT NULL,
+		tile_row INTEGER NOT NULL,
+		tile_data BLOB NOT NULL
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS tile_index ON tiles (zoom_level, tile_column, tile_row);
+	CREATE TABLE IF NOT EXISTS metadata (
+		name TEXT,
+		value TEXT
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS name ON metadata (name);
+	COMMIT;
+`
+
+// mbtilesDedupedSchema stores identical tiles once in the images table, keyed
+// by their hash, and maps coordinates to them in the map table.
+const mbtilesDedupedSchema = `
+	BEGIN TRANSACTION;
+	CREATE TABLE IF NOT EXISTS map (
+		zoom_level INTEGER NOT NULL,
+		tile_column INTEGER NOT NULL,
+		tile_row INTEGER NOT NULL,
+		tile_id TEXT NOT NULL
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS map_index ON map (zoom_level, tile_column, tile_row);
+	CREATE TABLE IF NOT EXISTS images (
+		tile_data BLOB NOT NULL,
+		tile_id TEXT NOT NULL
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS images_id ON images (tile_id);
+	CREATE TABLE IF NOT EXISTS metadata (
+		name TEXT,
+		value TEXT
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS name ON metadata (name);
+	CREATE VIEW IF NOT EXISTS tiles AS
+	SELECT
+		map.zoom_level AS zoom_level,
+		map.tile_column AS tile_column,
+		map.tile_row AS tile_row,
+		images.tile_data AS tile_data
+	FROM map
+	JOIN images ON images.tile_id = map.tile_id;
+	COMMIT;
+`
+
 func (o *mbtilesOutputter) CreateTiles() error {
 	if o.hasTiles {
 		return nil
 	}
-	if _, err := o.db.Exec(`
-		BEGIN TRANSACTION;
-		CREATE TABLE IF NOT EXISTS map (
-			zoom_level INTEGER NOT NULL,
-			tile_column INTEGER NOT NULL,
-			tile_row INTEGER NOT NULL,
-			tile_id TEXT NOT NULL
-		);
-		CREATE UNIQUE INDEX IF NOT EXISTS map_index ON map (zoom_level, tile_column, tile_row);
-		CREATE TABLE IF NOT EXISTS images (
-			tile_data BLOB NOT NULL,
-			tile_id TEXT NOT NULL
-		);
-		CREATE UNIQUE INDEX IF NOT EXISTS images_id ON images (tile_id);
-		CREATE TABLE IF NOT EXISTS metadata (
-			name TEXT,
-			value TEXT
-		);
-		CREATE UNIQUE INDEX IF NOT EXISTS name ON metadata (name);
-		CREATE VIEW IF NOT EXISTS tiles AS
-		SELECT
-			map.zoom_level AS zoom_level,
-			map.tile_column AS tile_column,
-			map.tile_row AS tile_row,
-			images.tile_data AS tile_data
-		FROM map
-		JOIN images ON images.tile_id = map.tile_id;
-		COMMIT;
-	    PRAGMA synchronous=OFF;
-	`); err != nil {
+
+	// Tiles added to an existing database are stored the way it already
+	// stores them, whatever the options say
+	var tilesType string
+	err := o.db.QueryRow("SELECT type FROM sqlite_master WHERE name = 'tiles'").Scan(&tilesType)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	switch tilesType {
+	case "table":
+		o.tileID = nil
+	case "view":
+		if o.tileID == nil {
+			o.tileID = hashTileID(mbtilesHashes[DefaultMbtilesHash])
+		}
+	}
+
+	if tilesType == "" {
+		if err := o.setPageSize(); err != nil {
+			return err
+		}
+	}
+
+	schema := mbtilesDedupedSchema
+
+	if o.tileID == nil {
+		schema = mbtilesSchema
+	}
+
+	if _, err := o.db.Exec(schema); err != nil {
 		return err
 	}
 	o.hasTiles = true
 	return nil
 }
 
+// setPageSize sets the page size of a database that has no tables yet. The
+// page size can't be changed in WAL mode, and the journal mode has already
+// been set by then, so it's changed with the database briefly in DELETE mode
+// and a VACUUM to rewrite it.
+func (o *mbtilesOutputter) setPageSize() error {
+	var tables int
+	if err := o.db.QueryRow("SELECT COUNT(*) FROM sqlite_master").Scan(&tables); err != nil {
+		return err
+	}
+
+	var pageSize int
+	if err := o.db.QueryRow("PRAGMA page_size").Scan(&pageSize); err != nil {
+		return err
+	}
+
+	if tables > 0 || pageSize == o.pageSize {
+		return nil
+	}
+
+	// Pragmas only apply to the connection they're run on
+	conn, err := o.db.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	statements := []string{
+		"PRAGMA journal_mode = DELETE",
+		fmt.Sprintf("PRAGMA page_size = %d", o.pageSize),
+		"VACUUM",
+		fmt.Sprintf("PRAGMA journal_mode = %s", o.journalMode),
+	}
+
+	for _, statement := range statements {
+		if _, err := conn.ExecContext(context.Background(), statement); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AssignMetadata writes the bounds, center and zoom range of the tileset to the
+// metadata table, replacing any values that are already there.
+func (o *mbtilesOutputter) AssignMetadata(bounds *LngLatBbox, minZoom uint, maxZoom uint) error {
+	if err := o.CreateTiles(); err != nil {
+		return err
+	}
+
+	for name, value := range boundsMetadata(bounds, minZoom, maxZoom) {
+		_, err := o.exec("INSERT OR REPLACE INTO metadata (name, value) VALUES (?, ?);", name, value)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetMetadata writes a single value to the metadata table, replacing any value
+// that is already there.
+func (o *mbtilesOutputter) SetMetadata(name string, value string) error {
+	if err := o.CreateTiles(); err != nil {
+		return err
+	}
+
+	_, err := o.exec("INSERT OR REPLACE INTO metadata (name, value) VALUES (?, ?);", name, value)
+	return err
+}
+
+// exec runs a statement in the open transaction, if there is one, so that it
+// doesn't contend with the transaction's lock on the database.
+func (o *mbtilesOutputter) exec(query string, args ...interface{}) (sql.Result, error) {
+	if o.txn != nil {
+		return o.txn.Exec(query, args...)
+	}
+
+	return o.db.Exec(query, args...)
+}
+
+// HasTile returns true if the tile has already been saved and committed. It
+// doesn't see tiles in the current, uncommitted, batch.
+func (o *mbtilesOutputter) HasTile(tile *Tile) (bool, error) {
+	var exists int
+
+	result := o.db.QueryRow("SELECT 1 FROM tiles WHERE zoom_level=? AND tile_column=? AND tile_row=? LIMIT 1", tile.Z, tile.X, tile.Y)
+	err := result.Scan(&exists)
+
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Save writes the tile's data under its Y as given, without inverting it, so
+// that MbtilesReader.GetTile finds it at the same coordinates. Builds that
+// should follow the mbtiles spec's TMS rows generate inverted Y values instead,
+// see GenerateTilesOptions.InvertedY.
 func (o *mbtilesOutputter) Save(tile *Tile, data []byte) error {
+	if !tile.Valid() {
+		return ErrInvalidTile
+	}
+
 	if err := o.CreateTiles(); err != nil {
 		return err
 	}
@@ -98,29 +467,35 @@ func (o *mbtilesOutputter) Save(tile *Tile, data []byte) error {
 		o.txn = tx
 	}
 
-	hash := md5.Sum(data)
-	tileID := hex.EncodeToString(hash[:])
+	// Record the format of the tiles, unless it has been set already
+	if !o.hasFormat {
+		if format := DetectFormat(data); format != "" {
+			_, err := o.txn.Exec("INSERT OR IGNORE INTO metadata (name, value) VALUES ('format', ?);", format)
+			if err != nil {
+				return err
+			}
+		}
 
-	_, err := o.txn.Exec("INSERT OR REPLACE INTO images (tile_id, tile_data) VALUES (?, ?);", tileID, data)
-	if err != nil {
-		return err
+		o.hasFormat = true
+	}
+
+	var err error
+
+	if o.tileID == nil {
+		_, err = o.txn.Exec("INSERT OR REPLACE INTO tiles (zoom_level, tile_column, tile_row, tile_data) VALUES (?, ?, ?, ?);", tile.Z, tile.X, tile.Y, data)
+	} else {
+		err = o.saveDeduped(tile, data)
 	}
 
-	_, err = o.txn.Exec("INSERT OR REPLACE INTO map (zoom_level, tile_column, tile_row, tile_id) VALUES (?, ?, ?, ?);", tile.Z, tile.X, tile.Y, tileID)
 	if err != nil {
 		return err
 	}
 
 	o.batchCount++
 
-	if o.batchCount%batchSize == 0 {
-		err := o.txn.Commit()
-		if err != nil {
-			return err
-		}
-		o.batchCount = 0
-		o.txn = nil
+	if o.batchCount%o.batchSize == 0 {
+		return o.Flush()
 	}
 
-	return err
+	return nil
 }
@@ -0,0 +1,534 @@
+package tilepack
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewMbtilesOutputterWithOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mbtiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		opts        *MbtilesOutputterOptions
+		journalMode string
+		synchronous int
+	}{
+		{&MbtilesOutputterOptions{}, "wal", 0},
+		{&MbtilesOutputterOptions{JournalMode: "DELETE", Synchronous: "FULL"}, "delete", 2},
+		{&MbtilesOutputterOptions{JournalMode: "WAL", Synchronous: "NORMAL"}, "wal", 1},
+	}
+
+	for i, test := range tests {
+		o, err := NewMbtilesOutputterWithOptions(filepath.Join(dir, fmt.Sprintf("%d.mbtiles", i)), test.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var journalMode string
+		var synchronous int
+
+		if err := o.db.QueryRow("PRAGMA journal_mode").Scan(&journalMode); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := o.db.QueryRow("PRAGMA synchronous").Scan(&synchronous); err != nil {
+			t.Fatal(err)
+		}
+
+		if journalMode != test.journalMode || synchronous != test.synchronous {
+			t.Errorf("%+v: journal_mode = %s, synchronous = %d, want %s, %d", test.opts, journalMode, synchronous, test.journalMode, test.synchronous)
+		}
+
+		o.Close()
+	}
+
+	_, err = NewMbtilesOutputterWithOptions(filepath.Join(dir, "invalid.mbtiles"), &MbtilesOutputterOptions{Synchronous: "SOMETIMES"})
+	if err == nil {
+		t.Error("Expected an error for an invalid synchronous level")
+	}
+}
+
+func TestMbtilesOutputter_PageSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mbtiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "pagesize.mbtiles")
+
+	tests := []struct {
+		opts     *MbtilesOutputterOptions
+		pageSize int
+	}{
+		{&MbtilesOutputterOptions{PageSize: 16384, CacheSize: -8000}, 16384},
+		// The page size is fixed once the database has been created
+		{&MbtilesOutputterOptions{PageSize: 1024, CacheSize: -8000}, 16384},
+	}
+
+	for _, test := range tests {
+		o, err := NewMbtilesOutputterWithOptions(path, test.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := o.CreateTiles(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := o.Save(&Tile{X: 0, Y: 0, Z: 0}, []byte("tile")); err != nil {
+			t.Fatal(err)
+		}
+
+		var pageSize, cacheSize int
+		var journalMode string
+
+		if err := o.db.QueryRow("PRAGMA page_size").Scan(&pageSize); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := o.db.QueryRow("PRAGMA cache_size").Scan(&cacheSize); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := o.db.QueryRow("PRAGMA journal_mode").Scan(&journalMode); err != nil {
+			t.Fatal(err)
+		}
+
+		if pageSize != test.pageSize || cacheSize != test.opts.CacheSize || journalMode != "wal" {
+			t.Errorf("%+v: page_size = %d, cache_size = %d, journal_mode = %s, want %d, %d, wal", test.opts, pageSize, cacheSize, journalMode, test.pageSize, test.opts.CacheSize)
+		}
+
+		if err := o.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, pageSize := range []int{256, 3000, 131072} {
+		_, err := NewMbtilesOutputterWithOptions(filepath.Join(dir, "invalid.mbtiles"), &MbtilesOutputterOptions{PageSize: pageSize})
+		if err == nil {
+			t.Errorf("Expected an error for a page size of %d", pageSize)
+		}
+	}
+}
+
+func TestMbtilesOutputter_Optimize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mbtiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, optimize := range []bool{false, true} {
+		path := filepath.Join(dir, fmt.Sprintf("%t.mbtiles", optimize))
+
+		o, err := NewMbtilesOutputterWithOptions(path, &MbtilesOutputterOptions{DisableDeduplication: true, Optimize: optimize})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Replacing large tiles with small ones leaves free pages behind
+		for _, size := range []int{10000, 10} {
+			for i := uint(0); i < 100; i++ {
+				if err := o.Save(&Tile{X: i, Y: 0, Z: 7}, make([]byte, size)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := o.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := o.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := sql.Open("sqlite3", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var freePages, stats int
+
+		if err := db.QueryRow("PRAGMA freelist_count").Scan(&freePages); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'sqlite_stat1'").Scan(&stats); err != nil {
+			t.Fatal(err)
+		}
+
+		db.Close()
+
+		if optimize != (freePages == 0) || optimize != (stats == 1) {
+			t.Errorf("Optimize %t: %d free pages, %d statistics tables", optimize, freePages, stats)
+		}
+	}
+}
+
+// BenchmarkMbtilesOutputter reports the write throughput of 100k tiles for
+// different journal modes and synchronous levels.
+func BenchmarkMbtilesOutputter(b *testing.B) {
+	const tiles = 100000
+
+	benchmarks := []*MbtilesOutputterOptions{
+		{JournalMode: "DELETE", Synchronous: "FULL"},
+		{JournalMode: "DELETE", Synchronous: "OFF"},
+		{JournalMode: "WAL", Synchronous: "NORMAL"},
+		{JournalMode: "WAL", Synchronous: "OFF"},
+	}
+
+	for _, opts := range benchmarks {
+		b.Run(opts.JournalMode+"/"+opts.Synchronous, func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "mbtiles")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			start := time.Now()
+
+			for n := 0; n < b.N; n++ {
+				o, err := NewMbtilesOutputterWithOptions(filepath.Join(dir, fmt.Sprintf("%d.mbtiles", n)), opts)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				for i := 0; i < tiles; i++ {
+					tile := &Tile{Z: 17, X: uint(i % 1024), Y: uint(i / 1024)}
+
+					if err := o.Save(tile, []byte(tile.ToString())); err != nil {
+						b.Fatal(err)
+					}
+				}
+
+				if err := o.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ReportMetric(float64(tiles*b.N)/time.Since(start).Seconds(), "tiles/s")
+		})
+	}
+}
+
+func TestMbtilesOutputter_AssignMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mbtiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bounds := &LngLatBbox{West: -180.0, South: -85.0, East: 180.0, North: 85.0}
+
+	reader := writeTestMbtiles(t, filepath.Join(dir, "metadata.mbtiles"), nil, func(o *mbtilesOutputter) error {
+		if err := o.AssignMetadata(bounds, 0, 3); err != nil {
+			return err
+		}
+
+		for i := 0; i < 10; i++ {
+			if err := o.Save(&Tile{Z: 3, X: uint(i % 8), Y: uint(i / 8)}, []byte{byte(i)}); err != nil {
+				return err
+			}
+		}
+
+		// Assigning metadata again replaces the existing rows
+		return o.AssignMetadata(bounds, 0, 4)
+	})
+	defer reader.Close()
+
+	metadata, err := reader.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(metadata) != 4 || metadata["maxzoom"] != "4" {
+		t.Errorf("Unexpected metadata %+v", metadata)
+	}
+
+	count := 0
+	err = reader.VisitAllTiles(func(tile *Tile, data []byte) {
+		count++
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 10 {
+		t.Errorf("Read %d tiles, want 10", count)
+	}
+}
+
+func TestMbtilesOutputter_SetMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mbtiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	reader := writeTestMbtiles(t, filepath.Join(dir, "metadata.mbtiles"), nil, func(o *mbtilesOutputter) error {
+		if err := o.SetMetadata("scale", "1"); err != nil {
+			return err
+		}
+
+		return o.SetMetadata("scale", "2")
+	})
+	defer reader.Close()
+
+	metadata, err := reader.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if metadata["scale"] != "2" {
+		t.Errorf("Unexpected metadata %+v", metadata)
+	}
+}
+
+func TestMbtilesOutputter_Flush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mbtiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	o, err := NewMbtilesOutputter(filepath.Join(dir, "flush.mbtiles"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+
+	tile := &Tile{Z: 1, X: 1, Y: 0}
+
+	if err := o.Save(tile, []byte("tile")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tiles in the open batch aren't visible until it's committed
+	if exists, err := o.HasTile(tile); err != nil || exists {
+		t.Fatalf("HasTile() before Flush = %v, %v, want false", exists, err)
+	}
+
+	if err := o.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if exists, err := o.HasTile(tile); err != nil || !exists {
+		t.Fatalf("HasTile() after Flush = %v, %v, want true", exists, err)
+	}
+}
+
+func TestMbtilesOutputter_Deduplication(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mbtiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []*MbtilesOutputterOptions{
+		{},
+		{Hash: "sha256"},
+		{DisableDeduplication: true},
+	}
+
+	// Two identical "ocean" tiles and one unique tile
+	tiles := map[Tile]string{
+		{Z: 1, X: 0, Y: 0}: "ocean",
+		{Z: 1, X: 1, Y: 0}: "ocean",
+		{Z: 1, X: 0, Y: 1}: "land",
+	}
+
+	for i, opts := range tests {
+		reader := writeTestMbtiles(t, filepath.Join(dir, fmt.Sprintf("%d.mbtiles", i)), opts, func(o *mbtilesOutputter) error {
+			for tile, data := range tiles {
+				tile := tile
+				if err := o.Save(&tile, []byte(data)); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+
+		for tile, want := range tiles {
+			tile := tile
+			result, err := reader.GetTile(&tile)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if result.Data == nil || string(*result.Data) != want {
+				t.Errorf("%+v: GetTile(%s) = %v, want %s", opts, tile.ToString(), result.Data, want)
+			}
+		}
+
+		reader.Close()
+	}
+
+	_, err = NewMbtilesOutputterWithOptions(filepath.Join(dir, "invalid.mbtiles"), &MbtilesOutputterOptions{Hash: "crc32"})
+	if err == nil {
+		t.Error("Expected an error for an unknown hash")
+	}
+}
+
+func TestMbtilesOutputter_TileID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mbtiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "tileid.mbtiles")
+
+	// Tiles that only differ in case are the same tile
+	tileID := func(data []byte) string {
+		return strings.ToLower(string(data))
+	}
+
+	o, err := NewMbtilesOutputterWithOptions(path, &MbtilesOutputterOptions{TileID: tileID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tiles := []struct {
+		tile *Tile
+		data string
+	}{
+		{&Tile{Z: 1, X: 0, Y: 0}, "Ocean"},
+		{&Tile{Z: 1, X: 1, Y: 0}, "OCEAN"},
+		{&Tile{Z: 1, X: 0, Y: 1}, "land"},
+	}
+
+	for _, tile := range tiles {
+		if err := o.Save(tile.tile, []byte(tile.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := o.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := o.db.Query("SELECT tile_id, tile_data FROM images ORDER BY tile_id")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var images []string
+
+	for rows.Next() {
+		var tileID, data string
+
+		if err := rows.Scan(&tileID, &data); err != nil {
+			t.Fatal(err)
+		}
+
+		images = append(images, tileID+"="+data)
+	}
+
+	rows.Close()
+
+	// The last tile saved with a key is the one stored
+	if strings.Join(images, ",") != "land=land,ocean=OCEAN" {
+		t.Errorf("Got images %v, want land=land and ocean=OCEAN", images)
+	}
+
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// BenchmarkMbtilesOutputter_Unique compares deduplicating with each hash to not
+// deduplicating at all, for 16KB tiles that are all different, like hillshade.
+func BenchmarkMbtilesOutputter_Unique(b *testing.B) {
+	const tiles = 10000
+
+	data := make([]byte, 16*1024)
+	for i := range data {
+		data[i] = byte(i * 31)
+	}
+
+	benchmarks := map[string]*MbtilesOutputterOptions{
+		"md5":    {Hash: "md5"},
+		"sha256": {Hash: "sha256"},
+		"none":   {DisableDeduplication: true},
+	}
+
+	for name, opts := range benchmarks {
+		b.Run(name, func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "mbtiles")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			start := time.Now()
+
+			for n := 0; n < b.N; n++ {
+				o, err := NewMbtilesOutputterWithOptions(filepath.Join(dir, fmt.Sprintf("%d.mbtiles", n)), opts)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				for i := 0; i < tiles; i++ {
+					// Make every tile unique
+					binary.LittleEndian.PutUint32(data, uint32(i))
+
+					if err := o.Save(&Tile{Z: 14, X: uint(i % 128), Y: uint(i / 128)}, data); err != nil {
+						b.Fatal(err)
+					}
+				}
+
+				if err := o.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ReportMetric(float64(tiles*b.N)/time.Since(start).Seconds(), "tiles/s")
+		})
+	}
+}
+
+func TestMbtilesOutputter_Append(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mbtiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Appending with the other storage layout uses the existing one
+	tests := [][2]*MbtilesOutputterOptions{
+		{{}, {DisableDeduplication: true}},
+		{{DisableDeduplication: true}, {}},
+	}
+
+	for i, test := range tests {
+		path := filepath.Join(dir, fmt.Sprintf("%d.mbtiles", i))
+
+		writeTestMbtiles(t, path, test[0], saveTestTiles(&Tile{Z: 0, X: 0, Y: 0})).Close()
+		reader := writeTestMbtiles(t, path, test[1], saveTestTiles(&Tile{Z: 1, X: 0, Y: 0}))
+
+		count, err := reader.CountTiles()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if count != 2 {
+			t.Errorf("%+v then %+v: got %d tiles, want 2", test[0], test[1], count)
+		}
+
+		reader.Close()
+	}
+}
@@ -1,8 +1,13 @@
 package tilepack
 
 import (
+	"context"
 	"database/sql"
-	"log"
+	"errors"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
 
 	_ "github.com/mattn/go-sqlite3" // Register sqlite3 database driver
 )
@@ -12,28 +17,157 @@ type TileData struct {
 	Data *[]byte
 }
 
+// TileExtent is the geographic extent covered by the tiles of an archive at a
+// given zoom level.
+type TileExtent struct {
+	Zoom   uint
+	Bounds *LngLatBbox
+}
+
+// MbtilesReader reads tiles from an archive. Tiles are addressed by the row
+// they are stored under, which for mbtiles is the TMS row, so no Y inversion
+// happens when reading.
 type MbtilesReader interface {
 	Close() error
+	CountTiles() (int, error)
+	CountTilesByZoom() (map[uint]int, error)
 	GetTile(tile *Tile) (*TileData, error)
+	HasTile(tile *Tile) (bool, error)
+	GetTileExtent() (*TileExtent, error)
+	GetTilesForBounds(bounds *LngLatBbox, zoom uint) ([]*TileData, error)
+	GetZoomRange() (uint, uint, error)
+	Metadata() (map[string]string, error)
 	VisitAllTiles(visitor func(*Tile, []byte)) error
+	VisitAllTilesWithContext(ctx context.Context, visitor func(*Tile, []byte) error) error
+	VisitAllTilesOrdered(visitor func(*Tile, []byte)) error
+	VisitAllTilesOrderedWithContext(ctx context.Context, visitor func(*Tile, []byte) error) error
+	VisitTilesForZoom(zoom uint, visitor func(*Tile, []byte)) error
+	VisitTilesForZoomWithContext(ctx context.Context, zoom uint, visitor func(*Tile, []byte) error) error
 }
 
 type tileDataFromDatabase struct {
 	Data *[]byte
 }
 
+// NewMbtilesReader returns a reader for the mbtiles at dsn. Its tiles may be in
+// a tiles table, as most tools write them, or in the map and images tables that
+// a mbtiles outputter writes, with or without a tiles view of them.
 func NewMbtilesReader(dsn string) (MbtilesReader, error) {
 	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
 		return nil, err
 	}
 
-	return &mbtilesReader{db: db}, nil
+	return newMbtilesReader(db)
+}
+
+// NewMbtilesReaderReadOnly returns a reader for serving tiles from dsn to many
+// goroutines at once. The database is opened read-only with a shared cache,
+// and a connection is kept open for each goroutine that can run in parallel
+// (GOMAXPROCS).
+// dsn may be a path or a "file:" URI.
+func NewMbtilesReaderReadOnly(dsn string) (MbtilesReader, error) {
+	// SQLite only reads URI parameters from "file:" DSNs
+	if !strings.HasPrefix(dsn, "file:") {
+		dsn = "file:" + dsn
+	}
+
+	params := url.Values{}
+	params.Set("mode", "ro")
+	params.Set("cache", "shared")
+
+	separator := "?"
+	if strings.Contains(dsn, "?") {
+		separator = "&"
+	}
+
+	db, err := sql.Open("sqlite3", dsn+separator+params.Encode())
+	if err != nil {
+		return nil, err
+	}
+
+	db.SetMaxOpenConns(runtime.GOMAXPROCS(0))
+	db.SetMaxIdleConns(runtime.GOMAXPROCS(0))
+
+	// Read-only databases aren't created, so fail now if it doesn't exist
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return newMbtilesReader(db)
+}
+
+// newMbtilesReader returns a reader for db, once it has found where its tiles
+// are stored. db is closed if they can't be found.
+func newMbtilesReader(db *sql.DB) (MbtilesReader, error) {
+	tiles, err := mbtilesTilesSource(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &mbtilesReader{db: db, tiles: tiles}, nil
+}
+
+// mbtilesTilesSource returns what to select tiles from in db: the tiles table
+// or view if there is one, otherwise a join of the map and images tables.
+func mbtilesTilesSource(db *sql.DB) (string, error) {
+	rows, err := db.Query("SELECT name FROM sqlite_master WHERE type IN ('table', 'view') AND name IN ('tiles', 'map', 'images')")
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	names := make(map[string]bool)
+
+	for rows.Next() {
+		var name string
+
+		if err := rows.Scan(&name); err != nil {
+			return "", err
+		}
+
+		names[name] = true
+	}
+
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	switch {
+	case names["tiles"]:
+		return "tiles", nil
+	case names["map"] && names["images"]:
+		return `(
+			SELECT
+				map.zoom_level AS zoom_level,
+				map.tile_column AS tile_column,
+				map.tile_row AS tile_row,
+				images.tile_data AS tile_data
+			FROM map
+			JOIN images ON images.tile_id = map.tile_id
+		)`, nil
+	default:
+		return "", errors.New("Archive has no tiles table or view, and no map and images tables")
+	}
+}
+
+// NewReader returns a disk reader if path is a directory and an mbtiles reader
+// otherwise.
+func NewReader(path string) (MbtilesReader, error) {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return NewDiskReader(path)
+	}
+
+	return NewMbtilesReader(path)
 }
 
 type mbtilesReader struct {
 	MbtilesReader
 	db *sql.DB
+	// tiles is the table, view or subquery tiles are selected from
+	tiles string
 }
 
 // Close gracefully tears down the mbtiles connection.
@@ -49,11 +183,45 @@ func (o *mbtilesReader) Close() error {
 	return err
 }
 
+// CountTiles returns the number of tiles in the archive. Identical tiles that
+// share data are counted separately.
+func (o *mbtilesReader) CountTiles() (int, error) {
+	var count int
+
+	err := o.db.QueryRow("SELECT COUNT(*) FROM " + o.tiles).Scan(&count)
+
+	return count, err
+}
+
+// CountTilesByZoom returns the number of tiles at each zoom level of the archive.
+func (o *mbtilesReader) CountTilesByZoom() (map[uint]int, error) {
+	rows, err := o.db.Query("SELECT zoom_level, COUNT(*) FROM " + o.tiles + " GROUP BY zoom_level")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[uint]int)
+
+	for rows.Next() {
+		var z uint
+		var count int
+
+		if err := rows.Scan(&z, &count); err != nil {
+			return nil, err
+		}
+
+		counts[z] = count
+	}
+
+	return counts, rows.Err()
+}
+
 // GetTile returns data for the given tile.
 func (o *mbtilesReader) GetTile(tile *Tile) (*TileData, error) {
 	var data []byte
 
-	result := o.db.QueryRow("SELECT tile_data FROM tiles WHERE zoom_level=? AND tile_column=? AND tile_row=? LIMIT 1", tile.Z, tile.X, tile.Y)
+	result := o.db.QueryRow("SELECT tile_data FROM "+o.tiles+" WHERE zoom_level=? AND tile_column=? AND tile_row=? LIMIT 1", tile.Z, tile.X, tile.Y)
 	err := result.Scan(&data)
 
 	if err != nil {
@@ -72,23 +240,229 @@ func (o *mbtilesReader) GetTile(tile *Tile) (*TileData, error) {
 	return tileData, nil
 }
 
+// HasTile returns true if the archive has data for the given tile, without
+// reading that data.
+func (o *mbtilesReader) HasTile(tile *Tile) (bool, error) {
+	var exists int
+
+	result := o.db.QueryRow("SELECT 1 FROM "+o.tiles+" WHERE zoom_level=? AND tile_column=? AND tile_row=? LIMIT 1", tile.Z, tile.X, tile.Y)
+	err := result.Scan(&exists)
+
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// GetTileExtent returns the extent of the tiles stored at the archive's maximum
+// zoom level. Rows are assumed to be stored in TMS order, per the mbtiles spec.
+func (o *mbtilesReader) GetTileExtent() (*TileExtent, error) {
+	var maxZoom sql.NullInt64
+
+	err := o.db.QueryRow("SELECT MAX(zoom_level) FROM " + o.tiles).Scan(&maxZoom)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !maxZoom.Valid {
+		return nil, errors.New("Archive has no tiles")
+	}
+
+	z := uint(maxZoom.Int64)
+
+	var minX, maxX, minRow, maxRow uint
+
+	result := o.db.QueryRow("SELECT MIN(tile_column), MAX(tile_column), MIN(tile_row), MAX(tile_row) FROM "+o.tiles+" WHERE zoom_level=?", z)
+	err = result.Scan(&minX, &maxX, &minRow, &maxRow)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Flip the TMS rows back to XYZ, so the highest row is the northernmost tile
+	numRows := uint(1) << z
+	northWest := &Tile{X: minX, Y: numRows - 1 - maxRow, Z: z}
+	southEast := &Tile{X: maxX, Y: numRows - 1 - minRow, Z: z}
+
+	nw := northWest.Bounds()
+	se := southEast.Bounds()
+
+	extent := &TileExtent{
+		Zoom: z,
+		Bounds: &LngLatBbox{
+			West:  nw.West,
+			South: se.South,
+			East:  se.East,
+			North: nw.North,
+		},
+	}
+
+	return extent, nil
+}
+
+// GetTilesForBounds returns the tiles at one zoom level that intersect bounds,
+// with a single ranged query. Rows are assumed to be stored in TMS order, per
+// the mbtiles spec, and the tiles are returned with the rows they're stored
+// under.
+func (o *mbtilesReader) GetTilesForBounds(bounds *LngLatBbox, zoom uint) ([]*TileData, error) {
+	r := tileRanges(generateTilesBoxes(bounds), zoom)
+
+	if len(r) == 0 {
+		return nil, nil
+	}
+
+	// Bounds crossing the antimeridian have a range on each side of it
+	clauses := make([]string, len(r))
+	args := []interface{}{zoom}
+
+	numRows := uint(1) << zoom
+
+	for i, rng := range r {
+		clauses[i] = "(tile_column BETWEEN ? AND ? AND tile_row BETWEEN ? AND ?)"
+		// The ranges are half-open XYZ rows, so the southernmost row is the lowest TMS row
+		args = append(args, rng[0], rng[1]-1, numRows-rng[3], numRows-1-rng[2])
+	}
+
+	query := "SELECT tile_column, tile_row, tile_data FROM " + o.tiles + " WHERE zoom_level=? AND (" + strings.Join(clauses, " OR ") + ") ORDER BY tile_column, tile_row"
+
+	rows, err := o.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tiles []*TileData
+
+	for rows.Next() {
+		var x, y uint
+		var data []byte
+
+		if err := rows.Scan(&x, &y, &data); err != nil {
+			return nil, err
+		}
+
+		tiles = append(tiles, &TileData{Tile: &Tile{Z: zoom, X: x, Y: y}, Data: &data})
+	}
+
+	return tiles, rows.Err()
+}
+
+// GetZoomRange returns the minimum and maximum zoom levels in this mbtiles archive.
+func (o *mbtilesReader) GetZoomRange() (uint, uint, error) {
+	var minZoom, maxZoom sql.NullInt64
+
+	err := o.db.QueryRow("SELECT MIN(zoom_level), MAX(zoom_level) FROM "+o.tiles).Scan(&minZoom, &maxZoom)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if !minZoom.Valid || !maxZoom.Valid {
+		return 0, 0, errors.New("Archive has no tiles")
+	}
+
+	return uint(minZoom.Int64), uint(maxZoom.Int64), nil
+}
+
+// Metadata returns the name/value pairs stored in the metadata table.
+func (o *mbtilesReader) Metadata() (map[string]string, error) {
+	rows, err := o.db.Query("SELECT name, value FROM metadata")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	metadata := make(map[string]string)
+
+	for rows.Next() {
+		var name, value sql.NullString
+		err := rows.Scan(&name, &value)
+		if err != nil {
+			return nil, err
+		}
+
+		metadata[name.String] = value.String
+	}
+
+	return metadata, rows.Err()
+}
+
 // VisitAllTiles runs the given function on all tiles in this mbtiles archive.
 func (o *mbtilesReader) VisitAllTiles(visitor func(*Tile, []byte)) error {
-	rows, err := o.db.Query("SELECT zoom_level, tile_column, tile_row, tile_data FROM tiles")
+	return o.VisitAllTilesWithContext(context.Background(), ignoreVisitorErrors(visitor))
+}
+
+// VisitAllTilesWithContext runs the given function on all tiles in this mbtiles
+// archive until it returns an error or ctx is cancelled, and returns that error.
+func (o *mbtilesReader) VisitAllTilesWithContext(ctx context.Context, visitor func(*Tile, []byte) error) error {
+	return o.visitTiles(ctx, visitor, "SELECT zoom_level, tile_column, tile_row, tile_data FROM "+o.tiles)
+}
+
+// VisitAllTilesOrdered runs the given function on all tiles in this mbtiles
+// archive, ordered by zoom level, then column, then row, as stored.
+func (o *mbtilesReader) VisitAllTilesOrdered(visitor func(*Tile, []byte)) error {
+	return o.VisitAllTilesOrderedWithContext(context.Background(), ignoreVisitorErrors(visitor))
+}
+
+// VisitAllTilesOrderedWithContext runs the given function on all tiles in this
+// mbtiles archive, ordered by zoom level, then column, then row, as stored,
+// until it returns an error or ctx is cancelled, and returns that error. The
+// tile index provides the order, so rows are streamed rather than sorted in
+// memory.
+func (o *mbtilesReader) VisitAllTilesOrderedWithContext(ctx context.Context, visitor func(*Tile, []byte) error) error {
+	return o.visitTiles(ctx, visitor, "SELECT zoom_level, tile_column, tile_row, tile_data FROM "+o.tiles+" ORDER BY zoom_level, tile_column, tile_row")
+}
+
+// VisitTilesForZoom runs the given function on the tiles at one zoom level of
+// this mbtiles archive.
+func (o *mbtilesReader) VisitTilesForZoom(zoom uint, visitor func(*Tile, []byte)) error {
+	return o.VisitTilesForZoomWithContext(context.Background(), zoom, ignoreVisitorErrors(visitor))
+}
+
+// VisitTilesForZoomWithContext runs the given function on the tiles at one zoom
+// level of this mbtiles archive until it returns an error or ctx is cancelled,
+// and returns that error.
+func (o *mbtilesReader) VisitTilesForZoomWithContext(ctx context.Context, zoom uint, visitor func(*Tile, []byte) error) error {
+	return o.visitTiles(ctx, visitor, "SELECT zoom_level, tile_column, tile_row, tile_data FROM "+o.tiles+" WHERE zoom_level=?", zoom)
+}
+
+func (o *mbtilesReader) visitTiles(ctx context.Context, visitor func(*Tile, []byte) error, query string, args ...interface{}) error {
+	rows, err := o.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return err
 	}
+	defer rows.Close()
 
 	var z, x, y uint
 	for rows.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		data := []byte{}
 		err := rows.Scan(&z, &x, &y, &data)
 		if err != nil {
-			log.Printf("Couldn't scan row: %+v", err)
+			Logf(LogLevelWarn, "Couldn't scan row: %+v", err)
 		}
 
 		t := &Tile{Z: z, X: x, Y: y}
+
+		if err := visitor(t, data); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func ignoreVisitorErrors(visitor func(*Tile, []byte)) func(*Tile, []byte) error {
+	return func(t *Tile, data []byte) error {
 		visitor(t, data)
+		return nil
 	}
-	return nil
 }
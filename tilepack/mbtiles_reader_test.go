@@ -0,0 +1,524 @@
+package tilepack
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// writeTestMbtiles creates an mbtiles at path with opts, or the default
+// options if it's nil, calls write to fill it, closes it and returns a reader
+// for it.
+func writeTestMbtiles(tb testing.TB, path string, opts *MbtilesOutputterOptions, write func(*mbtilesOutputter) error) MbtilesReader {
+	if opts == nil {
+		opts = &MbtilesOutputterOptions{}
+	}
+
+	o, err := NewMbtilesOutputterWithOptions(path, opts)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	if err := write(o); err != nil {
+		tb.Fatal(err)
+	}
+
+	if err := o.Close(); err != nil {
+		tb.Fatal(err)
+	}
+
+	reader, err := NewMbtilesReader(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return reader
+}
+
+// saveTestTiles returns a function for writeTestMbtiles that saves each of
+// tiles with its address as its data.
+func saveTestTiles(tiles ...*Tile) func(*mbtilesOutputter) error {
+	return func(o *mbtilesOutputter) error {
+		for _, tile := range tiles {
+			if err := o.Save(tile, []byte(tile.ToString())); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// zoomTiles returns every tile at each of zooms.
+func zoomTiles(zooms ...uint) []*Tile {
+	var tiles []*Tile
+
+	for _, z := range zooms {
+		for x := uint(0); x < 1<<z; x++ {
+			for y := uint(0); y < 1<<z; y++ {
+				tiles = append(tiles, &Tile{Z: z, X: x, Y: y})
+			}
+		}
+	}
+
+	return tiles
+}
+
+func TestMbtilesReader_HasTile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mbtiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Saved under TMS row 2, which is XYZ row 1 at zoom 2
+	reader := writeTestMbtiles(t, filepath.Join(dir, "has.mbtiles"), nil, saveTestTiles(&Tile{Z: 2, X: 3, Y: 2}))
+	defer reader.Close()
+
+	tests := []struct {
+		tile *Tile
+		want bool
+	}{
+		{&Tile{Z: 2, X: 3, Y: 2}, true},
+		{&Tile{Z: 2, X: 3, Y: 1}, false},
+		{&Tile{Z: 3, X: 3, Y: 2}, false},
+	}
+
+	for _, test := range tests {
+		got, err := reader.HasTile(test.tile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != test.want {
+			t.Errorf("HasTile(%s) = %v, want %v", test.tile.ToString(), got, test.want)
+		}
+	}
+}
+
+func TestNewMbtilesReader_Schemas(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schemas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	schemas := map[string]string{
+		"tiles table": `
+			CREATE TABLE tiles (zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, tile_data BLOB);
+			INSERT INTO tiles VALUES (2, 1, 3, 'tile'), (3, 4, 5, 'tile');
+		`,
+		"map and images": `
+			CREATE TABLE map (zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, tile_id TEXT);
+			CREATE TABLE images (tile_data BLOB, tile_id TEXT);
+			INSERT INTO map VALUES (2, 1, 3, 'a'), (3, 4, 5, 'a');
+			INSERT INTO images VALUES ('tile', 'a');
+		`,
+	}
+
+	for name, schema := range schemas {
+		path := filepath.Join(dir, strings.Replace(name, " ", "_", -1)+".mbtiles")
+
+		db, err := sql.Open("sqlite3", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := db.Exec(schema); err != nil {
+			t.Fatal(err)
+		}
+
+		db.Close()
+
+		reader, err := NewMbtilesReader(path)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		count, err := reader.CountTiles()
+		if err != nil || count != 2 {
+			t.Errorf("%s: CountTiles() = %d, %v, want 2", name, count, err)
+		}
+
+		tile, err := reader.GetTile(&Tile{Z: 3, X: 4, Y: 5})
+		if err != nil || tile.Data == nil || string(*tile.Data) != "tile" {
+			t.Errorf("%s: GetTile() = %v, %v, want tile", name, tile, err)
+		}
+
+		visited := 0
+		if err := reader.VisitTilesForZoom(2, func(*Tile, []byte) { visited++ }); err != nil || visited != 1 {
+			t.Errorf("%s: VisitTilesForZoom() visited %d tiles, %v, want 1", name, visited, err)
+		}
+
+		reader.Close()
+	}
+
+	if _, err := NewMbtilesReader(filepath.Join(dir, "empty.mbtiles")); err == nil {
+		t.Error("NewMbtilesReader() of a database without tiles didn't return an error")
+	}
+}
+
+func TestMbtilesReader_GetTileRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mbtiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Tiles whose inverted Y differs from their Y
+	tiles := []*Tile{
+		{Z: 3, X: 1, Y: 0},
+		{Z: 3, X: 1, Y: 7},
+		{Z: 10, X: 163, Y: 395},
+	}
+
+	reader := writeTestMbtiles(t, filepath.Join(dir, "roundtrip.mbtiles"), nil, saveTestTiles(tiles...))
+	defer reader.Close()
+
+	for _, tile := range tiles {
+		result, err := reader.GetTile(&Tile{Z: tile.Z, X: tile.X, Y: tile.Y})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if result.Data == nil || string(*result.Data) != tile.ToString() {
+			t.Errorf("GetTile(%s) = %v, want the saved data", tile.ToString(), result.Data)
+		}
+	}
+}
+
+func TestMbtilesReader_VisitTilesForZoom(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mbtiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	reader := writeTestMbtiles(t, filepath.Join(dir, "visit.mbtiles"), nil, saveTestTiles(zoomTiles(0, 1, 2)...))
+	defer reader.Close()
+
+	counts, err := reader.CountTilesByZoom()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(counts, map[uint]int{0: 1, 1: 4, 2: 16}) {
+		t.Errorf("CountTilesByZoom() = %v", counts)
+	}
+
+	total, err := reader.CountTiles()
+	if err != nil || total != 21 {
+		t.Errorf("CountTiles() = %d, %v, want 21", total, err)
+	}
+
+	count := 0
+	err = reader.VisitTilesForZoom(1, func(tile *Tile, data []byte) {
+		count++
+
+		if tile.Z != 1 || string(data) != tile.ToString() {
+			t.Errorf("Unexpected tile %s with data %s", tile.ToString(), data)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 4 {
+		t.Errorf("Visited %d tiles, want 4", count)
+	}
+}
+
+func TestMbtilesReader_VisitAllTilesWithContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mbtiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	reader := writeTestMbtiles(t, filepath.Join(dir, "visit.mbtiles"), nil, saveTestTiles(zoomTiles(0, 1, 2, 3)...))
+	defer reader.Close()
+
+	stop := errors.New("stop")
+
+	count := 0
+	err = reader.VisitAllTilesWithContext(context.Background(), func(tile *Tile, data []byte) error {
+		count++
+		if count == 5 {
+			return stop
+		}
+		return nil
+	})
+
+	if err != stop || count != 5 {
+		t.Errorf("Visitor error: got %v after %d tiles, want %v after 5", err, count, stop)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	count = 0
+	err = reader.VisitAllTilesWithContext(ctx, func(tile *Tile, data []byte) error {
+		count++
+		if count == 5 {
+			cancel()
+		}
+		return nil
+	})
+
+	if err != context.Canceled || count != 5 {
+		t.Errorf("Cancelled: got %v after %d tiles, want %v after 5", err, count, context.Canceled)
+	}
+}
+
+func TestNewMbtilesReaderReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mbtiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := NewMbtilesReaderReadOnly(filepath.Join(dir, "missing.mbtiles")); err == nil {
+		t.Error("Expected an error opening a missing database")
+	}
+
+	path := filepath.Join(dir, "ro.mbtiles")
+	writeTestMbtiles(t, path, nil, saveTestTiles(zoomTiles(4)...)).Close()
+
+	reader, err := NewMbtilesReaderReadOnly(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+
+	for x := uint(0); x < 16; x++ {
+		wg.Add(1)
+
+		go func(x uint) {
+			defer wg.Done()
+
+			for y := uint(0); y < 16; y++ {
+				tile := &Tile{Z: 4, X: x, Y: y}
+
+				result, err := reader.GetTile(tile)
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				if result.Data == nil || string(*result.Data) != tile.ToString() {
+					errs <- fmt.Errorf("Got the wrong data for 4/%d/%d", x, y)
+					return
+				}
+			}
+		}(x)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func BenchmarkMbtilesReader_GetTile(b *testing.B) {
+	dir, err := ioutil.TempDir("", "mbtiles")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "bench.mbtiles")
+	writeTestMbtiles(b, path, nil, saveTestTiles(zoomTiles(4)...)).Close()
+
+	readers := []struct {
+		name string
+		open func(string) (MbtilesReader, error)
+	}{
+		{"ReadWrite", NewMbtilesReader},
+		{"ReadOnly", NewMbtilesReaderReadOnly},
+	}
+
+	for _, r := range readers {
+		b.Run(r.name, func(b *testing.B) {
+			reader, err := r.open(path)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer reader.Close()
+
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				i := uint(0)
+
+				for pb.Next() {
+					if _, err := reader.GetTile(&Tile{Z: 4, X: i % 16, Y: (i / 16) % 16}); err != nil {
+						b.Error(err)
+						return
+					}
+					i++
+				}
+			})
+		})
+	}
+}
+
+func TestMbtilesReader_VisitAllTilesOrdered(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ordered")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	disk, err := NewDiskOutputter("root=" + filepath.Join(dir, "tiles") + " format=mvt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Saved out of order, with numbers that sort differently as strings
+	tiles := []*Tile{
+		{Z: 10, X: 5, Y: 3},
+		{Z: 2, X: 1, Y: 3},
+		{Z: 10, X: 10, Y: 0},
+		{Z: 2, X: 1, Y: 0},
+		{Z: 10, X: 9, Y: 1},
+		{Z: 2, X: 0, Y: 3},
+		{Z: 10, X: 9, Y: 0},
+	}
+
+	mbtilesReader := writeTestMbtiles(t, filepath.Join(dir, "ordered.mbtiles"), nil, saveTestTiles(tiles...))
+	defer mbtilesReader.Close()
+
+	memory := NewMemoryOutputter()
+
+	for _, o := range []TileOutputter{disk, memory} {
+		for _, tile := range tiles {
+			if err := o.Save(tile, []byte(tile.ToString())); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := o.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []string{"{2/0/3}", "{2/1/0}", "{2/1/3}", "{10/5/3}", "{10/9/0}", "{10/9/1}", "{10/10/0}"}
+
+	diskReader, err := NewDiskReader(filepath.Join(dir, "tiles"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, reader := range map[string]MbtilesReader{"mbtiles": mbtilesReader, "disk": diskReader, "memory": NewMemoryReader(memory)} {
+		var got []string
+
+		err := reader.VisitAllTilesOrdered(func(tile *Tile, data []byte) {
+			if string(data) != tile.ToString() {
+				t.Errorf("%s visited %s with data %q", name, tile.ToString(), data)
+			}
+
+			got = append(got, tile.ToString())
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s VisitAllTilesOrdered() visited %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestMbtilesReader_GetTilesForBounds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bounds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	disk, err := NewDiskOutputter("root=" + filepath.Join(dir, "tiles") + " format=mvt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	memory := NewMemoryOutputter()
+
+	tiles := zoomTiles(2)
+
+	// Every XYZ tile at zoom 2
+	for _, tile := range tiles {
+		for _, o := range []TileOutputter{disk, memory} {
+			if err := o.Save(tile, []byte(tile.ToString())); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := disk.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Saved under its TMS row in the mbtiles
+	mbtilesReader := writeTestMbtiles(t, filepath.Join(dir, "bounds.mbtiles"), nil, func(o *mbtilesOutputter) error {
+		for _, tile := range tiles {
+			if err := o.Save(&Tile{Z: 2, X: tile.X, Y: 3 - tile.Y}, []byte(tile.ToString())); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	defer mbtilesReader.Close()
+
+	diskReader, err := NewDiskReader(filepath.Join(dir, "tiles"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		bounds *LngLatBbox
+		zoom   uint
+		want   []string
+	}{
+		{"north west", &LngLatBbox{-170.0, 10.0, -10.0, 80.0}, 2, []string{"{2/0/0}", "{2/0/1}", "{2/1/0}", "{2/1/1}"}},
+		{"one tile", &LngLatBbox{10.0, -60.0, 80.0, -10.0}, 2, []string{"{2/2/2}"}},
+		{"antimeridian", &LngLatBbox{170.0, -10.0, -170.0, 10.0}, 2, []string{"{2/0/1}", "{2/0/2}", "{2/3/1}", "{2/3/2}"}},
+		{"missing zoom", &LngLatBbox{-180.0, -85.0, 180.0, 85.0}, 3, nil},
+	}
+
+	for name, reader := range map[string]MbtilesReader{"mbtiles": mbtilesReader, "disk": diskReader, "memory": NewMemoryReader(memory)} {
+		for _, test := range tests {
+			tiles, err := reader.GetTilesForBounds(test.bounds, test.zoom)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Both readers' data is the tile's XYZ address
+			var got []string
+			for _, tile := range tiles {
+				got = append(got, string(*tile.Data))
+			}
+
+			sort.Strings(got)
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("%s GetTilesForBounds(%s) returned %v, want %v", name, test.name, got, test.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package tilepack
+
+import (
+	"sync"
+)
+
+// NewMemoryOutputter returns an outputter that keeps tiles and metadata in
+// memory, for tests and other small tilesets that don't need to be written
+// anywhere. Read them back with NewMemoryReader.
+func NewMemoryOutputter() *memoryOutputter {
+	return &memoryOutputter{
+		tiles:    make(map[Tile][]byte),
+		metadata: make(map[string]string),
+	}
+}
+
+type memoryOutputter struct {
+	TileOutputter
+	mu       sync.RWMutex
+	tiles    map[Tile][]byte
+	metadata map[string]string
+}
+
+// AssignMetadata sets the bounds, center and zoom range metadata.
+func (o *memoryOutputter) AssignMetadata(bounds *LngLatBbox, minZoom uint, maxZoom uint) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for name, value := range boundsMetadata(bounds, minZoom, maxZoom) {
+		o.metadata[name] = value
+	}
+
+	return nil
+}
+
+// SetMetadata sets a metadata value.
+func (o *memoryOutputter) SetMetadata(name string, value string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.metadata[name] = value
+	return nil
+}
+
+// CreateTiles is a no-op, there is nothing to create.
+func (o *memoryOutputter) CreateTiles() error {
+	return nil
+}
+
+// HasTile returns true if the tile has been saved.
+func (o *memoryOutputter) HasTile(tile *Tile) (bool, error) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	_, ok := o.tiles[*tile]
+	return ok, nil
+}
+
+// SaveNew saves the tile, and returns true if it hadn't been saved before.
+func (o *memoryOutputter) SaveNew(tile *Tile, data []byte) (bool, error) {
+	if !tile.Valid() {
+		return false, ErrInvalidTile
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	_, exists := o.tiles[*tile]
+
+	// Callers may reuse data once Save returns
+	o.tiles[*tile] = append([]byte(nil), data...)
+
+	return !exists, nil
+}
+
+// Save saves a copy of the tile's data, replacing any it already had.
+func (o *memoryOutputter) Save(tile *Tile, data []byte) error {
+	_, err := o.SaveNew(tile, data)
+	return err
+}
+
+// Flush is a no-op, tiles are only ever in memory.
+func (o *memoryOutputter) Flush() error {
+	return nil
+}
+
+// Close is a no-op. The tiles can still be read once the outputter is closed.
+func (o *memoryOutputter) Close() error {
+	return nil
+}
@@ -0,0 +1,258 @@
+package tilepack
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+)
+
+// NewMemoryReader returns a reader for the tiles and metadata saved to a
+// memory outputter, including any saved after the reader is created. Like
+// disk, rows are assumed to be XYZ rows.
+func NewMemoryReader(o *memoryOutputter) MbtilesReader {
+	return &memoryReader{o: o}
+}
+
+type memoryReader struct {
+	MbtilesReader
+	o *memoryOutputter
+}
+
+// memoryTile is a tile and its data, as saved to a memory outputter.
+type memoryTile struct {
+	tile Tile
+	data []byte
+}
+
+// Close is a no-op, the tiles stay in the outputter.
+func (o *memoryReader) Close() error {
+	return nil
+}
+
+// CountTiles returns the number of tiles that have been saved.
+func (o *memoryReader) CountTiles() (int, error) {
+	o.o.mu.RLock()
+	defer o.o.mu.RUnlock()
+
+	return len(o.o.tiles), nil
+}
+
+// CountTilesByZoom returns the number of tiles that have been saved at each
+// zoom level.
+func (o *memoryReader) CountTilesByZoom() (map[uint]int, error) {
+	o.o.mu.RLock()
+	defer o.o.mu.RUnlock()
+
+	counts := make(map[uint]int)
+
+	for tile := range o.o.tiles {
+		counts[tile.Z]++
+	}
+
+	return counts, nil
+}
+
+// GetTile returns data for the given tile.
+func (o *memoryReader) GetTile(tile *Tile) (*TileData, error) {
+	o.o.mu.RLock()
+	defer o.o.mu.RUnlock()
+
+	data, ok := o.o.tiles[*tile]
+
+	if !ok {
+		return &TileData{Tile: tile, Data: nil}, nil
+	}
+
+	return &TileData{Tile: tile, Data: &data}, nil
+}
+
+// HasTile returns true if the tile has been saved.
+func (o *memoryReader) HasTile(tile *Tile) (bool, error) {
+	return o.o.HasTile(tile)
+}
+
+// GetTileExtent returns the extent of the tiles saved at the maximum zoom level.
+func (o *memoryReader) GetTileExtent() (*TileExtent, error) {
+	_, maxZoom, err := o.GetZoomRange()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var minX, minY uint = math.MaxUint32, math.MaxUint32
+	var maxX, maxY uint
+
+	for _, t := range o.tiles(func(tile Tile) bool { return tile.Z == maxZoom }) {
+		if t.tile.X < minX {
+			minX = t.tile.X
+		}
+		if t.tile.X > maxX {
+			maxX = t.tile.X
+		}
+		if t.tile.Y < minY {
+			minY = t.tile.Y
+		}
+		if t.tile.Y > maxY {
+			maxY = t.tile.Y
+		}
+	}
+
+	nw := (&Tile{X: minX, Y: minY, Z: maxZoom}).Bounds()
+	se := (&Tile{X: maxX, Y: maxY, Z: maxZoom}).Bounds()
+
+	extent := &TileExtent{
+		Zoom: maxZoom,
+		Bounds: &LngLatBbox{
+			West:  nw.West,
+			South: se.South,
+			East:  se.East,
+			North: nw.North,
+		},
+	}
+
+	return extent, nil
+}
+
+// GetTilesForBounds returns the tiles at one zoom level that intersect bounds,
+// ordered by column, then row.
+func (o *memoryReader) GetTilesForBounds(bounds *LngLatBbox, zoom uint) ([]*TileData, error) {
+	r := tileRanges(generateTilesBoxes(bounds), zoom)
+
+	var tiles []*TileData
+
+	for _, t := range o.tiles(func(tile Tile) bool { return tile.Z == zoom && r.contains(tile.X, tile.Y) }) {
+		tile := t.tile
+		data := t.data
+		tiles = append(tiles, &TileData{Tile: &tile, Data: &data})
+	}
+
+	sort.Slice(tiles, func(i, j int) bool { return tileLess(tiles[i].Tile, tiles[j].Tile) })
+
+	return tiles, nil
+}
+
+// GetZoomRange returns the minimum and maximum zoom levels of the saved tiles.
+func (o *memoryReader) GetZoomRange() (uint, uint, error) {
+	o.o.mu.RLock()
+	defer o.o.mu.RUnlock()
+
+	if len(o.o.tiles) == 0 {
+		return 0, 0, errors.New("Archive has no tiles")
+	}
+
+	var minZoom uint = math.MaxUint32
+	var maxZoom uint
+
+	for tile := range o.o.tiles {
+		if tile.Z < minZoom {
+			minZoom = tile.Z
+		}
+
+		if tile.Z > maxZoom {
+			maxZoom = tile.Z
+		}
+	}
+
+	return minZoom, maxZoom, nil
+}
+
+// Metadata returns a copy of the metadata that has been set.
+func (o *memoryReader) Metadata() (map[string]string, error) {
+	o.o.mu.RLock()
+	defer o.o.mu.RUnlock()
+
+	metadata := make(map[string]string, len(o.o.metadata))
+
+	for name, value := range o.o.metadata {
+		metadata[name] = value
+	}
+
+	return metadata, nil
+}
+
+// VisitAllTiles runs the given function on all saved tiles.
+func (o *memoryReader) VisitAllTiles(visitor func(*Tile, []byte)) error {
+	return o.VisitAllTilesWithContext(context.Background(), ignoreVisitorErrors(visitor))
+}
+
+// VisitAllTilesWithContext runs the given function on all saved tiles until it
+// returns an error or ctx is cancelled, and returns that error.
+func (o *memoryReader) VisitAllTilesWithContext(ctx context.Context, visitor func(*Tile, []byte) error) error {
+	return o.visitTiles(ctx, o.tiles(nil), visitor)
+}
+
+// VisitAllTilesOrdered runs the given function on all saved tiles, ordered by
+// zoom level, then column, then row.
+func (o *memoryReader) VisitAllTilesOrdered(visitor func(*Tile, []byte)) error {
+	return o.VisitAllTilesOrderedWithContext(context.Background(), ignoreVisitorErrors(visitor))
+}
+
+// VisitAllTilesOrderedWithContext runs the given function on all saved tiles,
+// ordered by zoom level, then column, then row, until it returns an error or
+// ctx is cancelled, and returns that error.
+func (o *memoryReader) VisitAllTilesOrderedWithContext(ctx context.Context, visitor func(*Tile, []byte) error) error {
+	tiles := o.tiles(nil)
+
+	sort.Slice(tiles, func(i, j int) bool { return tileLess(&tiles[i].tile, &tiles[j].tile) })
+
+	return o.visitTiles(ctx, tiles, visitor)
+}
+
+// VisitTilesForZoom runs the given function on the saved tiles at one zoom level.
+func (o *memoryReader) VisitTilesForZoom(zoom uint, visitor func(*Tile, []byte)) error {
+	return o.VisitTilesForZoomWithContext(context.Background(), zoom, ignoreVisitorErrors(visitor))
+}
+
+// VisitTilesForZoomWithContext runs the given function on the saved tiles at
+// one zoom level until it returns an error or ctx is cancelled, and returns
+// that error.
+func (o *memoryReader) VisitTilesForZoomWithContext(ctx context.Context, zoom uint, visitor func(*Tile, []byte) error) error {
+	return o.visitTiles(ctx, o.tiles(func(tile Tile) bool { return tile.Z == zoom }), visitor)
+}
+
+// tiles returns the saved tiles that match filter, or all of them if it's nil.
+// They're copied out so that visitors can save tiles without deadlocking.
+func (o *memoryReader) tiles(filter func(Tile) bool) []memoryTile {
+	o.o.mu.RLock()
+	defer o.o.mu.RUnlock()
+
+	var tiles []memoryTile
+
+	for tile, data := range o.o.tiles {
+		if filter == nil || filter(tile) {
+			tiles = append(tiles, memoryTile{tile: tile, data: data})
+		}
+	}
+
+	return tiles
+}
+
+func (o *memoryReader) visitTiles(ctx context.Context, tiles []memoryTile, visitor func(*Tile, []byte) error) error {
+	for _, t := range tiles {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		tile := t.tile
+
+		if err := visitor(&tile, t.data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// tileLess orders tiles by zoom level, then column, then row.
+func tileLess(a *Tile, b *Tile) bool {
+	if a.Z != b.Z {
+		return a.Z < b.Z
+	}
+
+	if a.X != b.X {
+		return a.X < b.X
+	}
+
+	return a.Y < b.Y
+}
@@ -0,0 +1,94 @@
+package tilepack
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestMemoryReader_RoundTrip(t *testing.T) {
+	o := NewMemoryOutputter()
+
+	data := []byte("tile")
+	tiles := []*Tile{{Z: 3, X: 1, Y: 2}, {Z: 5, X: 10, Y: 20}, {Z: 5, X: 11, Y: 20}}
+
+	for _, tile := range tiles {
+		if err := o.Save(tile, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The outputter keeps its own copy of the data
+	data[0] = 'x'
+
+	if err := o.SetMetadata("format", "pbf"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := NewMemoryReader(o)
+	defer reader.Close()
+
+	for _, tile := range tiles {
+		got, err := reader.GetTile(tile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got.Data == nil || !bytes.Equal(*got.Data, []byte("tile")) {
+			t.Errorf("GetTile(%s) returned %v, want tile", tile.ToString(), got.Data)
+		}
+	}
+
+	missing, err := reader.GetTile(&Tile{Z: 3, X: 2, Y: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if missing.Data != nil {
+		t.Errorf("GetTile() of a missing tile returned %q", *missing.Data)
+	}
+
+	counts, err := reader.CountTilesByZoom()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(counts, map[uint]int{3: 1, 5: 2}) {
+		t.Errorf("CountTilesByZoom() = %v, want map[3:1 5:2]", counts)
+	}
+
+	minZoom, maxZoom, err := reader.GetZoomRange()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if minZoom != 3 || maxZoom != 5 {
+		t.Errorf("GetZoomRange() = %d, %d, want 3, 5", minZoom, maxZoom)
+	}
+
+	metadata, err := reader.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if metadata["format"] != "pbf" {
+		t.Errorf("Metadata() = %v, want format pbf", metadata)
+	}
+
+	isNew, err := o.SaveNew(tiles[0], []byte("replaced"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if isNew {
+		t.Error("SaveNew() of a saved tile returned true")
+	}
+
+	if _, _, err := NewMemoryReader(NewMemoryOutputter()).GetZoomRange(); err == nil {
+		t.Error("GetZoomRange() of an empty outputter didn't return an error")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"archive/zip"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"fmt"
@@ -73,7 +74,7 @@ func (x *metatileJobGenerator) CreateWorker() (func(id int, jobs chan *TileReque
 				Key:    aws.String(metaTileRequest.URL),
 			})
 			if err != nil {
-				log.Printf("Unable to download item s3://%s/%s: %+v", x.bucket, metaTileRequest.URL, err)
+				Logf(LogLevelWarn, "Unable to download item s3://%s/%s: %+v", x.bucket, metaTileRequest.URL, err)
 				continue
 			}
 
@@ -82,7 +83,7 @@ func (x *metatileJobGenerator) CreateWorker() (func(id int, jobs chan *TileReque
 			readBytesReader := bytes.NewReader(readBytes)
 			zippedReader, err := zip.NewReader(readBytesReader, numBytes)
 			if err != nil {
-				log.Printf("Unable to unzip metatile archive %s: %+v", metaTileRequest.URL, err)
+				Logf(LogLevelWarn, "Unable to unzip metatile archive %s: %+v", metaTileRequest.URL, err)
 				continue
 			}
 
@@ -126,19 +127,19 @@ func (x *metatileJobGenerator) CreateWorker() (func(id int, jobs chan *TileReque
 
 				_, err = bodyGzipper.Write(b)
 				if err != nil {
-					log.Printf("Couldn't write to gzipper: %+v", err)
+					Logf(LogLevelWarn, "Couldn't write to gzipper: %+v", err)
 					continue
 				}
 
 				err = bodyGzipper.Flush()
 				if err != nil {
-					log.Printf("Couldn't flush gzipper: %+v", err)
+					Logf(LogLevelWarn, "Couldn't flush gzipper: %+v", err)
 					continue
 				}
 
 				bodyData, err := ioutil.ReadAll(bodyBuffer)
 				if err != nil {
-					log.Printf("Couldn't read bytes into byte array: %+v", err)
+					Logf(LogLevelWarn, "Couldn't read bytes into byte array: %+v", err)
 					continue
 				}
 
@@ -154,6 +155,10 @@ func (x *metatileJobGenerator) CreateWorker() (func(id int, jobs chan *TileReque
 }
 
 func (x *metatileJobGenerator) CreateJobs(jobs chan *TileRequest) error {
+	return x.CreateJobsWithContext(context.Background(), jobs)
+}
+
+func (x *metatileJobGenerator) CreateJobsWithContext(ctx context.Context, jobs chan *TileRequest) error {
 	// Convert the list of requested zooms into a list of zooms where metatiles are
 	metatileZooms := []uint{}
 
@@ -180,7 +185,7 @@ func (x *metatileJobGenerator) CreateJobs(jobs chan *TileRequest) error {
 	}
 
 	// Generate requests for metatiles in the bounding box
-	GenerateTiles(&GenerateTilesOptions{
+	return GenerateTilesWithContext(ctx, &GenerateTilesOptions{
 		Bounds:    x.bounds,
 		InvertedY: false,
 		Zooms:     metatileZooms,
@@ -201,6 +206,4 @@ func (x *metatileJobGenerator) CreateJobs(jobs chan *TileRequest) error {
 			}
 		},
 	})
-
-	return nil
 }
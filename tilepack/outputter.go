@@ -1,7 +1,56 @@
 package tilepack
 
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// ErrInvalidTile is returned by outputters asked to save a tile whose column or
+// row is outside the range of its zoom level, rather than saving it.
+var ErrInvalidTile = errors.New("Tile column or row is out of range for its zoom level")
+
 type TileOutputter interface {
 	CreateTiles() error
 	Save(tile *Tile, data []byte) error
+	// Flush writes the tiles saved so far to durable storage without closing
+	// the outputter, so that a crash doesn't lose them.
+	Flush() error
 	Close() error
 }
+
+// TileChecker is implemented by outputters that can report whether they already
+// have a tile, which allows builds to be resumed.
+type TileChecker interface {
+	HasTile(tile *Tile) (bool, error)
+}
+
+// NewTileSaver is implemented by outputters that can report whether a tile
+// they save is new, or replaces one they already had.
+type NewTileSaver interface {
+	SaveNew(tile *Tile, data []byte) (bool, error)
+}
+
+// MetadataOutputter is implemented by outputters that record the bounds and
+// zoom range of their tiles, such as mbtiles, pmtiles and disk.
+type MetadataOutputter interface {
+	TileOutputter
+	AssignMetadata(bounds *LngLatBbox, minZoom uint, maxZoom uint) error
+}
+
+// boundsMetadata returns the mbtiles bounds, center, minzoom and maxzoom
+// metadata values for a tileset.
+func boundsMetadata(bounds *LngLatBbox, minZoom uint, maxZoom uint) map[string]string {
+	return map[string]string{
+		"bounds":  fmt.Sprintf("%f,%f,%f,%f", bounds.West, bounds.South, bounds.East, bounds.North),
+		"center":  fmt.Sprintf("%f,%f,%d", (bounds.West+bounds.East)/2.0, (bounds.South+bounds.North)/2.0, minZoom),
+		"minzoom": strconv.FormatUint(uint64(minZoom), 10),
+		"maxzoom": strconv.FormatUint(uint64(maxZoom), 10),
+	}
+}
+
+// MetadataSetter is implemented by outputters that can store arbitrary
+// name/value metadata alongside their tiles.
+type MetadataSetter interface {
+	SetMetadata(name string, value string) error
+}
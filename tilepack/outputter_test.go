@@ -0,0 +1,48 @@
+package tilepack
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOutputters_InvalidTile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outputters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	disk, err := NewDiskOutputter("root=" + filepath.Join(dir, "disk") + " format=mvt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mbtiles, err := NewMbtilesOutputter(filepath.Join(dir, "invalid.mbtiles"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pmtiles, err := NewPMTilesOutputter(filepath.Join(dir, "invalid.pmtiles"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outputters := map[string]TileOutputter{
+		"disk":    disk,
+		"mbtiles": mbtiles,
+		"pmtiles": pmtiles,
+		"memory":  NewMemoryOutputter(),
+	}
+
+	for name, o := range outputters {
+		if err := o.Save(&Tile{X: 2, Y: 0, Z: 1}, []byte("tile")); err != ErrInvalidTile {
+			t.Errorf("%s: Save() = %v, want ErrInvalidTile", name, err)
+		}
+
+		if err := o.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
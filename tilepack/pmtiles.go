@@ -0,0 +1,479 @@
+package tilepack
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"math"
+)
+
+// Constants and (de)serialization helpers for the PMTiles v3 archive format.
+// See https://github.com/protomaps/PMTiles/blob/main/spec/v3/spec.md
+
+const (
+	pmtilesHeaderLength   = 127
+	pmtilesRootMaxLength  = 16384 - pmtilesHeaderLength
+	pmtilesLeafSizeStart  = 4096
+	pmtilesSpecVersion    = 3
+	pmtilesMagic          = "PMTiles"
+	pmtilesCoordinateUnit = 10000000
+)
+
+const (
+	pmtilesCompressionUnknown uint8 = 0
+	pmtilesCompressionNone    uint8 = 1
+	pmtilesCompressionGzip    uint8 = 2
+)
+
+const (
+	pmtilesTileTypeUnknown uint8 = 0
+	pmtilesTileTypeMvt     uint8 = 1
+	pmtilesTileTypePng     uint8 = 2
+	pmtilesTileTypeJpeg    uint8 = 3
+	pmtilesTileTypeWebp    uint8 = 4
+	pmtilesTileTypeAvif    uint8 = 5
+)
+
+type pmtilesHeader struct {
+	RootOffset          uint64
+	RootLength          uint64
+	MetadataOffset      uint64
+	MetadataLength      uint64
+	LeafDirectoryOffset uint64
+	LeafDirectoryLength uint64
+	TileDataOffset      uint64
+	TileDataLength      uint64
+	AddressedTilesCount uint64
+	TileEntriesCount    uint64
+	TileContentsCount   uint64
+	Clustered           bool
+	InternalCompression uint8
+	TileCompression     uint8
+	TileType            uint8
+	MinZoom             uint8
+	MaxZoom             uint8
+	Bounds              LngLatBbox
+	CenterZoom          uint8
+	Center              LngLat
+}
+
+// pmtilesEntry is a single directory entry. A RunLength of zero marks an
+// entry that points at a leaf directory rather than at tile data.
+type pmtilesEntry struct {
+	TileID    uint64
+	Offset    uint64
+	Length    uint32
+	RunLength uint32
+}
+
+func pmtilesRotate(n uint64, x *uint64, y *uint64, rx uint64, ry uint64) {
+	if ry == 0 {
+		if rx == 1 {
+			*x = n - 1 - *x
+			*y = n - 1 - *y
+		}
+		*x, *y = *y, *x
+	}
+}
+
+// ZxyToPMTilesID returns the PMTiles tile ID for a tile, which is its position
+// along a Hilbert curve at its zoom level offset by the number of tiles in all
+// lower zoom levels.
+func ZxyToPMTilesID(tile *Tile) uint64 {
+	var acc uint64
+	for z := uint(0); z < tile.Z; z++ {
+		acc += (uint64(1) << z) * (uint64(1) << z)
+	}
+
+	n := uint64(1) << tile.Z
+	tx := uint64(tile.X)
+	ty := uint64(tile.Y)
+
+	var d uint64
+	for s := n / 2; s > 0; s /= 2 {
+		var rx, ry uint64
+		if tx&s > 0 {
+			rx = 1
+		}
+		if ty&s > 0 {
+			ry = 1
+		}
+		d += s * s * ((3 * rx) ^ ry)
+		pmtilesRotate(s, &tx, &ty, rx, ry)
+	}
+
+	return acc + d
+}
+
+// PMTilesIDToZxy is the inverse of ZxyToPMTilesID.
+func PMTilesIDToZxy(id uint64) *Tile {
+	var acc uint64
+	var z uint
+	for {
+		numTiles := (uint64(1) << z) * (uint64(1) << z)
+		if acc+numTiles > id {
+			break
+		}
+		acc += numTiles
+		z++
+	}
+
+	n := uint64(1) << z
+	t := id - acc
+
+	var tx, ty uint64
+	for s := uint64(1); s < n; s *= 2 {
+		rx := 1 & (t / 2)
+		ry := 1 & (t ^ rx)
+		pmtilesRotate(s, &tx, &ty, rx, ry)
+		tx += s * rx
+		ty += s * ry
+		t /= 4
+	}
+
+	return &Tile{Z: z, X: uint(tx), Y: uint(ty)}
+}
+
+func serializePMTilesHeader(h *pmtilesHeader) []byte {
+	b := make([]byte, pmtilesHeaderLength)
+	copy(b[0:7], pmtilesMagic)
+	b[7] = pmtilesSpecVersion
+
+	binary.LittleEndian.PutUint64(b[8:16], h.RootOffset)
+	binary.LittleEndian.PutUint64(b[16:24], h.RootLength)
+	binary.LittleEndian.PutUint64(b[24:32], h.MetadataOffset)
+	binary.LittleEndian.PutUint64(b[32:40], h.MetadataLength)
+	binary.LittleEndian.PutUint64(b[40:48], h.LeafDirectoryOffset)
+	binary.LittleEndian.PutUint64(b[48:56], h.LeafDirectoryLength)
+	binary.LittleEndian.PutUint64(b[56:64], h.TileDataOffset)
+	binary.LittleEndian.PutUint64(b[64:72], h.TileDataLength)
+	binary.LittleEndian.PutUint64(b[72:80], h.AddressedTilesCount)
+	binary.LittleEndian.PutUint64(b[80:88], h.TileEntriesCount)
+	binary.LittleEndian.PutUint64(b[88:96], h.TileContentsCount)
+
+	if h.Clustered {
+		b[96] = 1
+	}
+
+	b[97] = h.InternalCompression
+	b[98] = h.TileCompression
+	b[99] = h.TileType
+	b[100] = h.MinZoom
+	b[101] = h.MaxZoom
+
+	putCoordinate := func(dst []byte, v float64) {
+		binary.LittleEndian.PutUint32(dst, uint32(int32(math.Round(v*pmtilesCoordinateUnit))))
+	}
+
+	putCoordinate(b[102:106], h.Bounds.West)
+	putCoordinate(b[106:110], h.Bounds.South)
+	putCoordinate(b[110:114], h.Bounds.East)
+	putCoordinate(b[114:118], h.Bounds.North)
+	b[118] = h.CenterZoom
+	putCoordinate(b[119:123], h.Center.Lng)
+	putCoordinate(b[123:127], h.Center.Lat)
+
+	return b
+}
+
+func deserializePMTilesHeader(b []byte) (*pmtilesHeader, error) {
+	if len(b) < pmtilesHeaderLength {
+		return nil, errors.New("PMTiles header is too short")
+	}
+
+	if string(b[0:7]) != pmtilesMagic {
+		return nil, errors.New("Not a PMTiles archive")
+	}
+
+	if b[7] != pmtilesSpecVersion {
+		return nil, errors.New("Unsupported PMTiles spec version")
+	}
+
+	getCoordinate := func(src []byte) float64 {
+		return float64(int32(binary.LittleEndian.Uint32(src))) / pmtilesCoordinateUnit
+	}
+
+	h := &pmtilesHeader{
+		RootOffset:          binary.LittleEndian.Uint64(b[8:16]),
+		RootLength:          binary.LittleEndian.Uint64(b[16:24]),
+		MetadataOffset:      binary.LittleEndian.Uint64(b[24:32]),
+		MetadataLength:      binary.LittleEndian.Uint64(b[32:40]),
+		LeafDirectoryOffset: binary.LittleEndian.Uint64(b[40:48]),
+		LeafDirectoryLength: binary.LittleEndian.Uint64(b[48:56]),
+		TileDataOffset:      binary.LittleEndian.Uint64(b[56:64]),
+		TileDataLength:      binary.LittleEndian.Uint64(b[64:72]),
+		AddressedTilesCount: binary.LittleEndian.Uint64(b[72:80]),
+		TileEntriesCount:    binary.LittleEndian.Uint64(b[80:88]),
+		TileContentsCount:   binary.LittleEndian.Uint64(b[88:96]),
+		Clustered:           b[96] == 1,
+		InternalCompression: b[97],
+		TileCompression:     b[98],
+		TileType:            b[99],
+		MinZoom:             b[100],
+		MaxZoom:             b[101],
+		Bounds: LngLatBbox{
+			West:  getCoordinate(b[102:106]),
+			South: getCoordinate(b[106:110]),
+			East:  getCoordinate(b[110:114]),
+			North: getCoordinate(b[114:118]),
+		},
+		CenterZoom: b[118],
+		Center: LngLat{
+			Lng: getCoordinate(b[119:123]),
+			Lat: getCoordinate(b[123:127]),
+		},
+	}
+
+	return h, nil
+}
+
+// serializePMTilesEntries encodes a (sorted) list of entries as a gzipped
+// PMTiles directory.
+func serializePMTilesEntries(entries []pmtilesEntry) ([]byte, error) {
+	var raw []byte
+	tmp := make([]byte, binary.MaxVarintLen64)
+
+	putUvarint := func(v uint64) {
+		n := binary.PutUvarint(tmp, v)
+		raw = append(raw, tmp[:n]...)
+	}
+
+	putUvarint(uint64(len(entries)))
+
+	var lastID uint64
+	for _, e := range entries {
+		putUvarint(e.TileID - lastID)
+		lastID = e.TileID
+	}
+
+	for _, e := range entries {
+		putUvarint(uint64(e.RunLength))
+	}
+
+	for _, e := range entries {
+		putUvarint(uint64(e.Length))
+	}
+
+	for i, e := range entries {
+		if i > 0 && e.Offset == entries[i-1].Offset+uint64(entries[i-1].Length) {
+			putUvarint(0)
+		} else {
+			putUvarint(e.Offset + 1)
+		}
+	}
+
+	return gzipBytes(raw)
+}
+
+// deserializePMTilesEntries decodes a PMTiles directory compressed with the
+// given internal compression.
+func deserializePMTilesEntries(data []byte, compression uint8) ([]pmtilesEntry, error) {
+	raw, err := decompressPMTiles(data, compression)
+
+	if err != nil {
+		return nil, err
+	}
+
+	r := bytes.NewReader(raw)
+
+	numEntries, err := binary.ReadUvarint(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]pmtilesEntry, numEntries)
+
+	var lastID uint64
+	for i := range entries {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		lastID += v
+		entries[i].TileID = lastID
+	}
+
+	for i := range entries {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		entries[i].RunLength = uint32(v)
+	}
+
+	for i := range entries {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		entries[i].Length = uint32(v)
+	}
+
+	for i := range entries {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if v == 0 && i > 0 {
+			entries[i].Offset = entries[i-1].Offset + uint64(entries[i-1].Length)
+		} else {
+			entries[i].Offset = v - 1
+		}
+	}
+
+	return entries, nil
+}
+
+// decompressPMTiles decompresses a directory or the metadata of a PMTiles
+// archive with the given internal compression.
+func decompressPMTiles(data []byte, compression uint8) ([]byte, error) {
+	switch compression {
+	case pmtilesCompressionNone:
+		return data, nil
+	case pmtilesCompressionGzip:
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+
+		if err != nil {
+			return nil, err
+		}
+
+		return ioutil.ReadAll(gz)
+	default:
+		return nil, errors.New("Unsupported PMTiles internal compression")
+	}
+}
+
+// buildPMTilesDirectories serializes entries into a root directory and, if the
+// root would not fit in the first 16K of the archive, a set of leaf directories.
+// Leaf entries in the root are offset relative to the start of the leaf section.
+func buildPMTilesDirectories(entries []pmtilesEntry) ([]byte, []byte, error) {
+	root, err := serializePMTilesEntries(entries)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(root) <= pmtilesRootMaxLength {
+		return root, nil, nil
+	}
+
+	leafSize := pmtilesLeafSizeStart
+
+	for {
+		rootEntries := make([]pmtilesEntry, 0)
+		leaves := bytes.NewBuffer(nil)
+
+		for i := 0; i < len(entries); i += leafSize {
+			end := i + leafSize
+			if end > len(entries) {
+				end = len(entries)
+			}
+
+			leaf, err := serializePMTilesEntries(entries[i:end])
+
+			if err != nil {
+				return nil, nil, err
+			}
+
+			rootEntries = append(rootEntries, pmtilesEntry{
+				TileID: entries[i].TileID,
+				Offset: uint64(leaves.Len()),
+				Length: uint32(len(leaf)),
+			})
+
+			leaves.Write(leaf)
+		}
+
+		root, err = serializePMTilesEntries(rootEntries)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(root) <= pmtilesRootMaxLength {
+			return root, leaves.Bytes(), nil
+		}
+
+		leafSize *= 2
+	}
+}
+
+// findPMTilesEntry returns the entry covering tileID in a sorted directory, or
+// nil if there isn't one.
+func findPMTilesEntry(entries []pmtilesEntry, tileID uint64) *pmtilesEntry {
+	lo := 0
+	hi := len(entries) - 1
+
+	for lo <= hi {
+		mid := (lo + hi) / 2
+		switch {
+		case entries[mid].TileID < tileID:
+			lo = mid + 1
+		case entries[mid].TileID > tileID:
+			hi = mid - 1
+		default:
+			return &entries[mid]
+		}
+	}
+
+	// At this point hi is the last entry with a lower tile ID, which can be a
+	// run of tiles or a leaf directory that covers tileID.
+	if hi >= 0 {
+		e := &entries[hi]
+		if e.RunLength == 0 {
+			return e
+		}
+		if tileID-e.TileID < uint64(e.RunLength) {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// sniffPMTilesType guesses the PMTiles tile type and compression of a tile.
+// The type of a gzipped tile, raster or not, is that of its uncompressed data.
+func sniffPMTilesType(data []byte) (uint8, uint8) {
+	compression := uint8(pmtilesCompressionNone)
+
+	if IsGzipped(data) {
+		compression = pmtilesCompressionGzip
+	}
+
+	switch DetectFormat(data) {
+	case FormatPbf:
+		return pmtilesTileTypeMvt, compression
+	case FormatPng:
+		return pmtilesTileTypePng, compression
+	case FormatJpeg:
+		return pmtilesTileTypeJpeg, compression
+	case FormatWebp:
+		return pmtilesTileTypeWebp, compression
+	case FormatAvif:
+		return pmtilesTileTypeAvif, compression
+	default:
+		return pmtilesTileTypeUnknown, pmtilesCompressionUnknown
+	}
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	gz := gzip.NewWriter(buf)
+
+	_, err := gz.Write(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = gz.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,109 @@
+package tilepack
+
+import (
+	"context"
+	"strconv"
+	"strings"
+)
+
+// PMTilesExportOptions configures ExportToPMTilesWithOptions.
+type PMTilesExportOptions struct {
+	// InvertY flips the rows of the tiles read from the reader. PMTiles
+	// archives use XYZ rows, so set it for mbtiles that store TMS rows, as the
+	// mbtiles spec requires.
+	InvertY bool
+}
+
+// pmtilesHeaderMetadata are the mbtiles metadata values that are stored in the
+// PMTiles header, rather than its JSON metadata.
+var pmtilesHeaderMetadata = map[string]bool{
+	"bounds":  true,
+	"center":  true,
+	"minzoom": true,
+	"maxzoom": true,
+	"format":  true,
+}
+
+// ExportToPMTiles writes every tile in reader to a deduplicated, clustered
+// PMTiles v3 archive at dst. Rows are copied as they are stored.
+func ExportToPMTiles(reader MbtilesReader, dst string) error {
+	return ExportToPMTilesWithOptions(reader, dst, &PMTilesExportOptions{})
+}
+
+// ExportToPMTilesWithOptions writes every tile in reader to a deduplicated,
+// clustered PMTiles v3 archive at dst. The bounds and zoom range in the header
+// come from the reader's metadata if it has them, otherwise from its tiles, and
+// its other metadata is copied to the archive's JSON metadata.
+//
+// Tiles are read a zoom level at a time, in the order their tile IDs are
+// allocated, and their contents are buffered in a temporary file next to dst
+// until the archive is written in tile ID order.
+func ExportToPMTilesWithOptions(reader MbtilesReader, dst string, opts *PMTilesExportOptions) error {
+	minZoom, maxZoom, err := reader.GetZoomRange()
+	if err != nil {
+		return err
+	}
+
+	metadata, err := reader.Metadata()
+	if err != nil {
+		return err
+	}
+
+	o, err := NewPMTilesOutputter(dst)
+	if err != nil {
+		return err
+	}
+
+	for name, value := range metadata {
+		if !pmtilesHeaderMetadata[name] {
+			o.metadata[name] = value
+		}
+	}
+
+	if bounds := parseMetadataBounds(metadata["bounds"]); bounds != nil {
+		o.AssignMetadata(bounds, minZoom, maxZoom)
+	}
+
+	visitor := func(tile *Tile, data []byte) error {
+		if opts.InvertY {
+			tile = &Tile{X: tile.X, Y: (1 << tile.Z) - 1 - tile.Y, Z: tile.Z}
+		}
+
+		return o.Save(tile, data)
+	}
+
+	for z := minZoom; z <= maxZoom; z++ {
+		err := reader.VisitTilesForZoomWithContext(context.Background(), z, visitor)
+
+		if err != nil {
+			o.discard()
+			return err
+		}
+	}
+
+	return o.Close()
+}
+
+// parseMetadataBounds parses an mbtiles "bounds" metadata value, in
+// west,south,east,north order. It returns nil if the value isn't valid.
+func parseMetadataBounds(value string) *LngLatBbox {
+	parts := strings.Split(value, ",")
+
+	if len(parts) != 4 {
+		return nil
+	}
+
+	floats := make([]float64, 4)
+
+	for i, part := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+
+		if err != nil {
+			return nil
+		}
+
+		floats[i] = f
+	}
+
+	return &LngLatBbox{West: floats[0], South: floats[1], East: floats[2], North: floats[3]}
+}
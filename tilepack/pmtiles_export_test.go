@@ -0,0 +1,117 @@
+package tilepack
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExportToPMTiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pmtiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "input.mbtiles")
+
+	o, err := NewMbtilesOutputter(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.AssignMetadata(&LngLatBbox{West: -122.5, South: 37.6, East: -122.3, North: 37.8}, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.SetMetadata("name", "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	water := []byte{0x1f, 0x8b, 0x01}
+	land := []byte{0x1f, 0x8b, 0x02}
+
+	// The TMS row 1 at zoom 1 is the northern half of the world
+	tiles := map[Tile][]byte{
+		{Z: 0, X: 0, Y: 0}: land,
+		{Z: 1, X: 0, Y: 0}: water,
+		{Z: 1, X: 1, Y: 0}: water,
+		{Z: 1, X: 0, Y: 1}: land,
+		{Z: 1, X: 1, Y: 1}: water,
+	}
+
+	for tile, data := range tiles {
+		tile := tile
+		if err := o.Save(&tile, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewMbtilesReader(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	output := filepath.Join(dir, "output.pmtiles")
+
+	if err := ExportToPMTilesWithOptions(reader, output, &PMTilesExportOptions{InvertY: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := deserializePMTilesHeader(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.AddressedTilesCount != 5 || h.TileContentsCount != 2 || !h.Clustered {
+		t.Errorf("Addressed %d tiles with %d contents (clustered %t), want 5 with 2 (clustered)", h.AddressedTilesCount, h.TileContentsCount, h.Clustered)
+	}
+
+	if h.MinZoom != 0 || h.MaxZoom != 1 || h.Bounds.West != -122.5 || h.Bounds.North != 37.8 {
+		t.Errorf("Header has zooms %d-%d and bounds %+v", h.MinZoom, h.MaxZoom, h.Bounds)
+	}
+
+	entries, err := deserializePMTilesEntries(data[h.RootOffset:h.RootOffset+h.RootLength], h.InternalCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// With the rows flipped, the land tile at zoom 1 is the north west tile 1/0/0
+	entry := findPMTilesEntry(entries, ZxyToPMTilesID(&Tile{Z: 1, X: 0, Y: 0}))
+	if entry == nil {
+		t.Fatal("Tile 1/0/0 isn't in the archive")
+	}
+
+	tileData := data[h.TileDataOffset+entry.Offset : h.TileDataOffset+entry.Offset+uint64(entry.Length)]
+	if !bytes.Equal(tileData, land) {
+		t.Errorf("Tile 1/0/0 = %v, want %v", tileData, land)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(data[h.MetadataOffset : h.MetadataOffset+h.MetadataLength]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var metadata map[string]string
+	if err := json.NewDecoder(gz).Decode(&metadata); err != nil {
+		t.Fatal(err)
+	}
+
+	if metadata["name"] != "test" || metadata["bounds"] != "" {
+		t.Errorf("Unexpected JSON metadata %+v", metadata)
+	}
+}
@@ -0,0 +1,360 @@
+package tilepack
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// NewPMTilesOutputter returns a TileOutputter that writes a PMTiles v3 archive
+// to the path dsn. Tiles are buffered in a temporary file next to the output
+// and the archive itself is written when Close is called.
+func NewPMTilesOutputter(dsn string) (*pmtilesOutputter, error) {
+	abs_path, err := filepath.Abs(dsn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	o := pmtilesOutputter{
+		path:     abs_path,
+		contents: make(map[string]pmtilesEntry),
+		metadata: make(map[string]string),
+		entries:  make([]pmtilesEntry, 0),
+	}
+
+	return &o, nil
+}
+
+type pmtilesOutputter struct {
+	TileOutputter
+	path        string
+	tmp         *os.File
+	tmpLength   uint64
+	entries     []pmtilesEntry
+	contents    map[string]pmtilesEntry
+	hasTiles    bool
+	hasMetadata bool
+	bounds      *LngLatBbox
+	minZoom     uint
+	maxZoom     uint
+	seenZoom    bool
+	tileType    uint8
+	compression uint8
+	metadata    map[string]string
+}
+
+// AssignMetadata sets the bounds and zoom range written to the PMTiles header.
+// If it is never called they are derived from the tiles that were saved.
+func (o *pmtilesOutputter) AssignMetadata(bounds *LngLatBbox, minZoom uint, maxZoom uint) error {
+	o.bounds = bounds
+	o.minZoom = minZoom
+	o.maxZoom = maxZoom
+	o.hasMetadata = true
+	return nil
+}
+
+// SetMetadata sets a value in the archive's JSON metadata.
+func (o *pmtilesOutputter) SetMetadata(name string, value string) error {
+	o.metadata[name] = value
+	return nil
+}
+
+func (o *pmtilesOutputter) CreateTiles() error {
+	if o.hasTiles {
+		return nil
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(o.path), filepath.Base(o.path)+".*.tmp")
+
+	if err != nil {
+		return err
+	}
+
+	o.tmp = tmp
+	o.hasTiles = true
+	return nil
+}
+
+func (o *pmtilesOutputter) Save(tile *Tile, data []byte) error {
+	if !tile.Valid() {
+		return ErrInvalidTile
+	}
+
+	if err := o.CreateTiles(); err != nil {
+		return err
+	}
+
+	hash := md5.Sum(data)
+	tileID := hex.EncodeToString(hash[:])
+
+	content, ok := o.contents[tileID]
+
+	if !ok {
+		_, err := o.tmp.Write(data)
+
+		if err != nil {
+			return err
+		}
+
+		content = pmtilesEntry{
+			Offset: o.tmpLength,
+			Length: uint32(len(data)),
+		}
+
+		o.contents[tileID] = content
+		o.tmpLength += uint64(len(data))
+	}
+
+	if o.tileType == pmtilesTileTypeUnknown {
+		o.tileType, o.compression = sniffPMTilesType(data)
+	}
+
+	o.entries = append(o.entries, pmtilesEntry{
+		TileID:    ZxyToPMTilesID(tile),
+		Offset:    content.Offset,
+		Length:    content.Length,
+		RunLength: 1,
+	})
+
+	if !o.hasMetadata {
+		o.updateExtent(tile)
+	}
+
+	return nil
+}
+
+// Flush syncs the tile data saved so far to disk. The archive itself can only
+// be written once all the tiles are known, by Close.
+func (o *pmtilesOutputter) Flush() error {
+	if o.tmp == nil {
+		return nil
+	}
+
+	return o.tmp.Sync()
+}
+
+func (o *pmtilesOutputter) updateExtent(tile *Tile) {
+	if !o.seenZoom {
+		o.minZoom = tile.Z
+		o.maxZoom = tile.Z
+		o.seenZoom = true
+	}
+
+	if tile.Z < o.minZoom {
+		o.minZoom = tile.Z
+	}
+
+	if tile.Z > o.maxZoom {
+		o.maxZoom = tile.Z
+	}
+
+	b := tile.Bounds()
+
+	if o.bounds == nil {
+		o.bounds = b
+		return
+	}
+
+	o.bounds = &LngLatBbox{
+		West:  math.Min(o.bounds.West, b.West),
+		South: math.Min(o.bounds.South, b.South),
+		East:  math.Max(o.bounds.East, b.East),
+		North: math.Max(o.bounds.North, b.North),
+	}
+}
+
+func (o *pmtilesOutputter) Close() error {
+	if o.tmp == nil {
+		return nil
+	}
+
+	defer func() {
+		o.tmp.Close()
+		os.Remove(o.tmp.Name())
+		o.tmp = nil
+	}()
+
+	entries, sources, tileDataLength, addressedCount := o.clusterEntries()
+
+	root, leaves, err := buildPMTilesDirectories(entries)
+
+	if err != nil {
+		return err
+	}
+
+	metadata, err := json.Marshal(o.metadata)
+
+	if err != nil {
+		return err
+	}
+
+	metadata, err = gzipBytes(metadata)
+
+	if err != nil {
+		return err
+	}
+
+	bounds := &LngLatBbox{-180.0, -webMercatorLatLimit, 180.0, webMercatorLatLimit}
+
+	if o.bounds != nil {
+		bounds = &LngLatBbox{
+			West:  math.Max(-180.0, o.bounds.West),
+			South: math.Max(-webMercatorLatLimit, o.bounds.South),
+			East:  math.Min(180.0, o.bounds.East),
+			North: math.Min(webMercatorLatLimit, o.bounds.North),
+		}
+	}
+
+	header := &pmtilesHeader{
+		RootOffset:          pmtilesHeaderLength,
+		RootLength:          uint64(len(root)),
+		MetadataOffset:      pmtilesHeaderLength + uint64(len(root)),
+		MetadataLength:      uint64(len(metadata)),
+		LeafDirectoryLength: uint64(len(leaves)),
+		TileDataLength:      tileDataLength,
+		AddressedTilesCount: addressedCount,
+		TileEntriesCount:    uint64(len(entries)),
+		TileContentsCount:   uint64(len(sources)),
+		Clustered:           true,
+		InternalCompression: pmtilesCompressionGzip,
+		TileCompression:     o.compression,
+		TileType:            o.tileType,
+		MinZoom:             uint8(o.minZoom),
+		MaxZoom:             uint8(o.maxZoom),
+		Bounds:              *bounds,
+		CenterZoom:          uint8(o.minZoom),
+		Center: LngLat{
+			Lng: (bounds.West + bounds.East) / 2.0,
+			Lat: (bounds.South + bounds.North) / 2.0,
+		},
+	}
+
+	header.LeafDirectoryOffset = header.MetadataOffset + header.MetadataLength
+	header.TileDataOffset = header.LeafDirectoryOffset + header.LeafDirectoryLength
+
+	fh, err := os.Create(o.path)
+
+	if err != nil {
+		return err
+	}
+
+	for _, b := range [][]byte{serializePMTilesHeader(header), root, metadata, leaves} {
+		_, err = fh.Write(b)
+
+		if err != nil {
+			fh.Close()
+			return err
+		}
+	}
+
+	err = o.writeTileData(fh, entries, sources)
+
+	if err != nil {
+		fh.Close()
+		return err
+	}
+
+	return fh.Close()
+}
+
+// discard removes the temporary file without writing the archive.
+func (o *pmtilesOutputter) discard() {
+	if o.tmp == nil {
+		return
+	}
+
+	o.tmp.Close()
+	os.Remove(o.tmp.Name())
+	o.tmp = nil
+}
+
+// clusterEntries sorts the saved entries by tile ID, collapses runs of
+// identical tiles and reassigns offsets so that tile contents are laid out in
+// the order they are first referenced. It returns the new entries, a map of new
+// offsets to offsets in the temporary file, the length of the tile data section
+// and the number of addressed tiles.
+func (o *pmtilesOutputter) clusterEntries() ([]pmtilesEntry, map[uint64]uint64, uint64, uint64) {
+	sort.SliceStable(o.entries, func(i, j int) bool {
+		return o.entries[i].TileID < o.entries[j].TileID
+	})
+
+	newOffsets := make(map[uint64]uint64)
+	sources := make(map[uint64]uint64)
+	entries := make([]pmtilesEntry, 0, len(o.entries))
+
+	var nextOffset uint64
+	var addressedCount uint64
+
+	for i, e := range o.entries {
+		// The same tile may have been saved more than once, in which case the
+		// last one wins.
+		if i+1 < len(o.entries) && o.entries[i+1].TileID == e.TileID {
+			continue
+		}
+
+		offset, ok := newOffsets[e.Offset]
+
+		if !ok {
+			offset = nextOffset
+			newOffsets[e.Offset] = offset
+			sources[offset] = e.Offset
+			nextOffset += uint64(e.Length)
+		}
+
+		addressedCount++
+
+		if len(entries) > 0 {
+			prev := &entries[len(entries)-1]
+			if prev.Offset == offset && prev.TileID+uint64(prev.RunLength) == e.TileID {
+				prev.RunLength++
+				continue
+			}
+		}
+
+		entries = append(entries, pmtilesEntry{
+			TileID:    e.TileID,
+			Offset:    offset,
+			Length:    e.Length,
+			RunLength: 1,
+		})
+	}
+
+	return entries, sources, nextOffset, addressedCount
+}
+
+func (o *pmtilesOutputter) writeTileData(w io.Writer, entries []pmtilesEntry, sources map[uint64]uint64) error {
+	var written uint64
+
+	for _, e := range entries {
+		// Entries are sorted by tile ID and contents were assigned offsets in
+		// that same order so anything below written has already been copied.
+		if e.Offset < written {
+			continue
+		}
+
+		buf := make([]byte, e.Length)
+
+		_, err := o.tmp.ReadAt(buf, int64(sources[e.Offset]))
+
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(buf)
+
+		if err != nil {
+			return err
+		}
+
+		written += uint64(e.Length)
+	}
+
+	return nil
+}
@@ -0,0 +1,475 @@
+package tilepack
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+)
+
+// pmtilesMaxDirectoryDepth is the most directories, the root and its leaves,
+// that are read to find a tile. The spec allows for no more than three.
+const pmtilesMaxDirectoryDepth = 4
+
+var errPMTilesTooDeep = errors.New("PMTiles directories are nested too deeply")
+
+// pmtilesTileFormats are the mbtiles formats of the PMTiles tile types.
+var pmtilesTileFormats = map[uint8]string{
+	pmtilesTileTypeMvt:  FormatPbf,
+	pmtilesTileTypePng:  FormatPng,
+	pmtilesTileTypeJpeg: FormatJpeg,
+	pmtilesTileTypeWebp: FormatWebp,
+	pmtilesTileTypeAvif: FormatAvif,
+}
+
+// NewPMTilesReader returns a reader for the PMTiles v3 archive at path. Only
+// the header, root directory and metadata are read when it's opened. Leaf
+// directories and tiles are read from the file as tiles are requested, so the
+// archive doesn't need to fit in memory. Like disk, rows are XYZ rows.
+func NewPMTilesReader(path string) (MbtilesReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &pmtilesReader{f: f}
+
+	if err := o.open(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return o, nil
+}
+
+type pmtilesReader struct {
+	MbtilesReader
+	f        *os.File
+	header   *pmtilesHeader
+	root     []pmtilesEntry
+	metadata map[string]string
+}
+
+func (o *pmtilesReader) open() error {
+	b, err := o.read(0, pmtilesHeaderLength)
+	if err != nil {
+		return err
+	}
+
+	o.header, err = deserializePMTilesHeader(b)
+	if err != nil {
+		return err
+	}
+
+	o.root, err = o.readDirectory(o.header.RootOffset, o.header.RootLength)
+	if err != nil {
+		return err
+	}
+
+	b, err = o.read(o.header.MetadataOffset, o.header.MetadataLength)
+	if err != nil {
+		return err
+	}
+
+	b, err = decompressPMTiles(b, o.header.InternalCompression)
+	if err != nil {
+		return err
+	}
+
+	o.metadata, err = pmtilesMetadata(o.header, b)
+	return err
+}
+
+// pmtilesMetadata returns an archive's JSON metadata as mbtiles metadata.
+// Values that aren't strings are kept as JSON. The bounds, center, zoom range
+// and format come from the header if the JSON doesn't have them.
+func pmtilesMetadata(h *pmtilesHeader, data []byte) (map[string]string, error) {
+	metadata := make(map[string]string)
+
+	if len(data) > 0 {
+		var values map[string]json.RawMessage
+
+		if err := json.Unmarshal(data, &values); err != nil {
+			return nil, err
+		}
+
+		for name, raw := range values {
+			var value string
+
+			if err := json.Unmarshal(raw, &value); err != nil {
+				value = string(raw)
+			}
+
+			metadata[name] = value
+		}
+	}
+
+	header := boundsMetadata(&h.Bounds, uint(h.MinZoom), uint(h.MaxZoom))
+	header["center"] = fmt.Sprintf("%f,%f,%d", h.Center.Lng, h.Center.Lat, h.CenterZoom)
+
+	if format, ok := pmtilesTileFormats[h.TileType]; ok {
+		header["format"] = format
+	}
+
+	for name, value := range header {
+		if _, ok := metadata[name]; !ok {
+			metadata[name] = value
+		}
+	}
+
+	return metadata, nil
+}
+
+// read reads length bytes of the archive from offset. ReadAt is safe to call
+// from several goroutines at once, so requests don't contend for the file.
+func (o *pmtilesReader) read(offset uint64, length uint64) ([]byte, error) {
+	b := make([]byte, length)
+
+	if _, err := o.f.ReadAt(b, int64(offset)); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func (o *pmtilesReader) readDirectory(offset uint64, length uint64) ([]pmtilesEntry, error) {
+	b, err := o.read(offset, length)
+	if err != nil {
+		return nil, err
+	}
+
+	return deserializePMTilesEntries(b, o.header.InternalCompression)
+}
+
+// Close closes the archive.
+func (o *pmtilesReader) Close() error {
+	return o.f.Close()
+}
+
+// CountTiles returns the number of tiles in the archive, as its header gives.
+func (o *pmtilesReader) CountTiles() (int, error) {
+	return int(o.header.AddressedTilesCount), nil
+}
+
+// CountTilesByZoom returns the number of tiles in the archive at each zoom
+// level. Only the directories are read.
+func (o *pmtilesReader) CountTilesByZoom() (map[uint]int, error) {
+	counts := make(map[uint]int)
+
+	err := o.walk(context.Background(), o.root, 0, math.MaxUint64, 0, func(entry *pmtilesEntry) error {
+		id := entry.TileID
+		end := entry.TileID + uint64(entry.RunLength)
+
+		// A run of tiles may carry on into the next zoom level
+		for zoom := PMTilesIDToZxy(id).Z; id < end; zoom++ {
+			next := pmtilesZoomStart(zoom + 1)
+			if next > end {
+				next = end
+			}
+
+			counts[zoom] += int(next - id)
+			id = next
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
+
+// GetTile returns data for the given tile, as it's stored.
+func (o *pmtilesReader) GetTile(tile *Tile) (*TileData, error) {
+	if tile.Z > uint(o.header.MaxZoom) {
+		return &TileData{Tile: tile, Data: nil}, nil
+	}
+
+	tileID := ZxyToPMTilesID(tile)
+	entries := o.root
+
+	for depth := 0; depth < pmtilesMaxDirectoryDepth; depth++ {
+		entry := findPMTilesEntry(entries, tileID)
+
+		if entry == nil {
+			return &TileData{Tile: tile, Data: nil}, nil
+		}
+
+		if entry.RunLength > 0 {
+			data, err := o.readTile(entry)
+			if err != nil {
+				return nil, err
+			}
+
+			return &TileData{Tile: tile, Data: &data}, nil
+		}
+
+		var err error
+		entries, err = o.readDirectory(o.header.LeafDirectoryOffset+entry.Offset, uint64(entry.Length))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, errPMTilesTooDeep
+}
+
+// HasTile returns true if the archive has the tile.
+func (o *pmtilesReader) HasTile(tile *Tile) (bool, error) {
+	result, err := o.GetTile(tile)
+	if err != nil {
+		return false, err
+	}
+
+	return result.Data != nil, nil
+}
+
+// GetTileExtent returns the bounds of the archive, as its header gives, at its
+// maximum zoom level.
+func (o *pmtilesReader) GetTileExtent() (*TileExtent, error) {
+	bounds := o.header.Bounds
+
+	return &TileExtent{Zoom: uint(o.header.MaxZoom), Bounds: &bounds}, nil
+}
+
+// GetTilesForBounds returns the tiles at one zoom level that intersect bounds,
+// ordered by column, then row.
+func (o *pmtilesReader) GetTilesForBounds(bounds *LngLatBbox, zoom uint) ([]*TileData, error) {
+	r := tileRanges(generateTilesBoxes(bounds), zoom)
+
+	var tiles []*TileData
+
+	visitor := func(tile *Tile, data []byte) error {
+		if r.contains(tile.X, tile.Y) {
+			tiles = append(tiles, &TileData{Tile: tile, Data: &data})
+		}
+
+		return nil
+	}
+
+	if err := o.visitZoom(context.Background(), zoom, visitor); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(tiles, func(i, j int) bool { return tileLess(tiles[i].Tile, tiles[j].Tile) })
+
+	return tiles, nil
+}
+
+// GetZoomRange returns the minimum and maximum zoom levels of the archive, as
+// its header gives.
+func (o *pmtilesReader) GetZoomRange() (uint, uint, error) {
+	if len(o.root) == 0 {
+		return 0, 0, errors.New("Archive has no tiles")
+	}
+
+	return uint(o.header.MinZoom), uint(o.header.MaxZoom), nil
+}
+
+// Metadata returns the archive's metadata.
+func (o *pmtilesReader) Metadata() (map[string]string, error) {
+	metadata := make(map[string]string, len(o.metadata))
+
+	for name, value := range o.metadata {
+		metadata[name] = value
+	}
+
+	return metadata, nil
+}
+
+// VisitAllTiles runs the given function on all tiles in the archive, in the
+// order of their tile IDs.
+func (o *pmtilesReader) VisitAllTiles(visitor func(*Tile, []byte)) error {
+	return o.VisitAllTilesWithContext(context.Background(), ignoreVisitorErrors(visitor))
+}
+
+// VisitAllTilesWithContext runs the given function on all tiles in the archive,
+// in the order of their tile IDs, until it returns an error or ctx is
+// cancelled, and returns that error.
+func (o *pmtilesReader) VisitAllTilesWithContext(ctx context.Context, visitor func(*Tile, []byte) error) error {
+	return o.visit(ctx, 0, math.MaxUint64, visitor)
+}
+
+// VisitAllTilesOrdered runs the given function on all tiles in the archive,
+// ordered by zoom level, then column, then row.
+func (o *pmtilesReader) VisitAllTilesOrdered(visitor func(*Tile, []byte)) error {
+	return o.VisitAllTilesOrderedWithContext(context.Background(), ignoreVisitorErrors(visitor))
+}
+
+// VisitAllTilesOrderedWithContext runs the given function on all tiles in the
+// archive, ordered by zoom level, then column, then row, until it returns an
+// error or ctx is cancelled, and returns that error. Tiles are stored in
+// Hilbert order, so the directory entries of a zoom level are held in memory
+// to sort them, but tiles are only read as they're visited.
+func (o *pmtilesReader) VisitAllTilesOrderedWithContext(ctx context.Context, visitor func(*Tile, []byte) error) error {
+	if len(o.root) == 0 {
+		return nil
+	}
+
+	type orderedTile struct {
+		tile  *Tile
+		entry *pmtilesEntry
+	}
+
+	for zoom := uint(o.header.MinZoom); zoom <= uint(o.header.MaxZoom); zoom++ {
+		start := pmtilesZoomStart(zoom)
+		end := pmtilesZoomStart(zoom + 1)
+
+		var tiles []orderedTile
+
+		err := o.walk(ctx, o.root, start, end, 0, func(entry *pmtilesEntry) error {
+			for id := pmtilesRunStart(entry, start); id < pmtilesRunEnd(entry, end); id++ {
+				tiles = append(tiles, orderedTile{tile: PMTilesIDToZxy(id), entry: entry})
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		sort.Slice(tiles, func(i, j int) bool { return tileLess(tiles[i].tile, tiles[j].tile) })
+
+		for _, t := range tiles {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			data, err := o.readTile(t.entry)
+			if err != nil {
+				return err
+			}
+
+			if err := visitor(t.tile, data); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// VisitTilesForZoom runs the given function on the tiles at one zoom level, in
+// the order of their tile IDs.
+func (o *pmtilesReader) VisitTilesForZoom(zoom uint, visitor func(*Tile, []byte)) error {
+	return o.VisitTilesForZoomWithContext(context.Background(), zoom, ignoreVisitorErrors(visitor))
+}
+
+// VisitTilesForZoomWithContext runs the given function on the tiles at one zoom
+// level, in the order of their tile IDs, until it returns an error or ctx is
+// cancelled, and returns that error.
+func (o *pmtilesReader) VisitTilesForZoomWithContext(ctx context.Context, zoom uint, visitor func(*Tile, []byte) error) error {
+	return o.visitZoom(ctx, zoom, visitor)
+}
+
+func (o *pmtilesReader) visitZoom(ctx context.Context, zoom uint, visitor func(*Tile, []byte) error) error {
+	if zoom > uint(o.header.MaxZoom) {
+		return nil
+	}
+
+	return o.visit(ctx, pmtilesZoomStart(zoom), pmtilesZoomStart(zoom+1), visitor)
+}
+
+// visit runs visitor on the tiles with IDs from start up to, but not
+// including, end, in the order of their tile IDs. A run of tiles is read once.
+func (o *pmtilesReader) visit(ctx context.Context, start uint64, end uint64, visitor func(*Tile, []byte) error) error {
+	return o.walk(ctx, o.root, start, end, 0, func(entry *pmtilesEntry) error {
+		data, err := o.readTile(entry)
+		if err != nil {
+			return err
+		}
+
+		for id := pmtilesRunStart(entry, start); id < pmtilesRunEnd(entry, end); id++ {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			if err := visitor(PMTilesIDToZxy(id), data); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// walk calls fn with each run of tiles in entries that has tile IDs from start
+// up to, but not including, end, in the order of their tile IDs. Leaf
+// directories are read as they're reached, and skipped if they can't hold any
+// tiles in the range.
+func (o *pmtilesReader) walk(ctx context.Context, entries []pmtilesEntry, start uint64, end uint64, depth int, fn func(*pmtilesEntry) error) error {
+	if depth >= pmtilesMaxDirectoryDepth {
+		return errPMTilesTooDeep
+	}
+
+	for i := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		entry := &entries[i]
+
+		if entry.TileID >= end {
+			break
+		}
+
+		if entry.RunLength > 0 {
+			if entry.TileID+uint64(entry.RunLength) > start {
+				if err := fn(entry); err != nil {
+					return err
+				}
+			}
+
+			continue
+		}
+
+		// A leaf directory holds the tiles up to the next entry's
+		if i+1 < len(entries) && entries[i+1].TileID <= start {
+			continue
+		}
+
+		leaf, err := o.readDirectory(o.header.LeafDirectoryOffset+entry.Offset, uint64(entry.Length))
+		if err != nil {
+			return err
+		}
+
+		if err := o.walk(ctx, leaf, start, end, depth+1, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (o *pmtilesReader) readTile(entry *pmtilesEntry) ([]byte, error) {
+	return o.read(o.header.TileDataOffset+entry.Offset, uint64(entry.Length))
+}
+
+// pmtilesRunStart returns the first tile ID of a run, or start if that's later.
+func pmtilesRunStart(entry *pmtilesEntry, start uint64) uint64 {
+	if entry.TileID > start {
+		return entry.TileID
+	}
+
+	return start
+}
+
+// pmtilesRunEnd returns the tile ID after the end of a run, or end if that's
+// sooner.
+func pmtilesRunEnd(entry *pmtilesEntry, end uint64) uint64 {
+	if last := entry.TileID + uint64(entry.RunLength); last < end {
+		return last
+	}
+
+	return end
+}
+
+// pmtilesZoomStart returns the tile ID of the first tile at zoom, which is the
+// number of tiles in all lower zoom levels.
+func pmtilesZoomStart(zoom uint) uint64 {
+	return ZxyToPMTilesID(&Tile{Z: zoom})
+}
@@ -0,0 +1,311 @@
+package tilepack
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// pmtilesReaderMaxZoom is enough zoom levels of distinct tiles that the root
+// directory doesn't fit in the first 16K of the archive, and tiles are found in
+// leaf directories.
+const pmtilesReaderMaxZoom = 8
+
+// pmtilesReaderTestTile returns distinct data for each tile, which looks like
+// an uncompressed vector tile, padded to a length that varies so that the
+// directories don't compress too well. The tiles in the top left 16x16 block
+// of the maximum zoom level, which have consecutive tile IDs, are the same, so
+// they're stored as a run.
+func pmtilesReaderTestTile(tile *Tile) []byte {
+	if tile.Z == pmtilesReaderMaxZoom && tile.X < 16 && tile.Y < 16 {
+		return []byte{0x1a, 'r', 'u', 'n'}
+	}
+
+	data := append([]byte{0x1a}, tile.ToString()...)
+	padding := md5.Sum(data)
+
+	return append(data, make([]byte, padding[0])...)
+}
+
+// writeTestPMTiles writes every tile up to pmtilesReaderMaxZoom to a PMTiles
+// archive in dir and returns a reader for it.
+func writeTestPMTiles(t *testing.T, dir string) MbtilesReader {
+	path := filepath.Join(dir, "test.pmtiles")
+
+	o, err := NewPMTilesOutputter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.SetMetadata("name", "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	for z := uint(0); z <= pmtilesReaderMaxZoom; z++ {
+		for x := uint(0); x < 1<<z; x++ {
+			for y := uint(0); y < 1<<z; y++ {
+				tile := &Tile{X: x, Y: y, Z: z}
+
+				if err := o.Save(tile, pmtilesReaderTestTile(tile)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewPMTilesReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return reader
+}
+
+func TestPMTilesReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pmtiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	reader := writeTestPMTiles(t, dir)
+	defer reader.Close()
+
+	const maxZoom = pmtilesReaderMaxZoom
+
+	if r := reader.(*pmtilesReader); r.header.LeafDirectoryLength == 0 {
+		t.Fatal("Expected the archive to have leaf directories")
+	}
+
+	for _, tile := range []*Tile{{0, 0, 0}, {1, 0, 1}, {5, 17, 6}, {0, 0, 8}, {255, 255, 8}, {200, 13, 8}} {
+		result, err := reader.GetTile(tile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := string(pmtilesReaderTestTile(tile))
+
+		if result.Data == nil || string(*result.Data) != want {
+			t.Errorf("%s: got %v, want %q", tile.ToString(), result.Data, want)
+		}
+	}
+
+	result, err := reader.GetTile(&Tile{X: 0, Y: 0, Z: 9})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Data != nil {
+		t.Errorf("Expected no tile above the maximum zoom, got %v", *result.Data)
+	}
+
+	minZoom, max, err := reader.GetZoomRange()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if minZoom != 0 || max != maxZoom {
+		t.Errorf("GetZoomRange() = %d, %d, want 0, %d", minZoom, max, maxZoom)
+	}
+
+	metadata, err := reader.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if metadata["name"] != "test" || metadata["format"] != FormatPbf || metadata["maxzoom"] != "8" {
+		t.Errorf("Unexpected metadata %v", metadata)
+	}
+}
+
+func TestPMTilesReader_Visit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pmtiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	reader := writeTestPMTiles(t, dir)
+	defer reader.Close()
+
+	if r := reader.(*pmtilesReader); r.header.TileEntriesCount == r.header.AddressedTilesCount {
+		t.Fatal("Expected the archive to have a run of tiles")
+	}
+
+	total := 0
+	want := make(map[uint]int)
+
+	for z := uint(0); z <= pmtilesReaderMaxZoom; z++ {
+		want[z] = 1 << (2 * z)
+		total += want[z]
+	}
+
+	count, err := reader.CountTiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != total {
+		t.Errorf("CountTiles() = %d, want %d", count, total)
+	}
+
+	counts, err := reader.CountTilesByZoom()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("CountTilesByZoom() = %v, want %v", counts, want)
+	}
+
+	ok, err := reader.HasTile(&Tile{X: 3, Y: 4, Z: 8})
+	if err != nil || !ok {
+		t.Errorf("HasTile() = %t, %v, want true", ok, err)
+	}
+
+	extent, err := reader.GetTileExtent()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if extent.Zoom != pmtilesReaderMaxZoom {
+		t.Errorf("GetTileExtent() zoom = %d, want %d", extent.Zoom, pmtilesReaderMaxZoom)
+	}
+
+	// checkData returns an error if data isn't tile's
+	checkData := func(tile *Tile, data []byte) error {
+		if string(data) != string(pmtilesReaderTestTile(tile)) {
+			return fmt.Errorf("%s has data %q", tile.ToString(), data)
+		}
+
+		return nil
+	}
+
+	visited := make(map[Tile]bool)
+
+	err = reader.VisitAllTiles(func(tile *Tile, data []byte) {
+		if err := checkData(tile, data); err != nil {
+			t.Error(err)
+		}
+
+		visited[*tile] = true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(visited) != total {
+		t.Errorf("VisitAllTiles() visited %d tiles, want %d", len(visited), total)
+	}
+
+	var previous *Tile
+	ordered := 0
+
+	err = reader.VisitAllTilesOrdered(func(tile *Tile, data []byte) {
+		if err := checkData(tile, data); err != nil {
+			t.Error(err)
+		}
+
+		if previous != nil && !tileLess(previous, tile) {
+			t.Errorf("VisitAllTilesOrdered() visited %s after %s", tile.ToString(), previous.ToString())
+		}
+
+		previous = tile
+		ordered++
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ordered != total {
+		t.Errorf("VisitAllTilesOrdered() visited %d tiles, want %d", ordered, total)
+	}
+
+	for _, zoom := range []uint{0, 5, pmtilesReaderMaxZoom, pmtilesReaderMaxZoom + 1} {
+		visited := 0
+
+		err := reader.VisitTilesForZoom(zoom, func(tile *Tile, data []byte) {
+			if tile.Z != zoom {
+				t.Errorf("VisitTilesForZoom(%d) visited %s", zoom, tile.ToString())
+			}
+
+			if err := checkData(tile, data); err != nil {
+				t.Error(err)
+			}
+
+			visited++
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if visited != want[zoom] {
+			t.Errorf("VisitTilesForZoom(%d) visited %d tiles, want %d", zoom, visited, want[zoom])
+		}
+	}
+
+	// The top left quarter of the world at zoom 2, without its edges
+	bounds := &LngLatBbox{West: -179, South: 1, East: -1, North: 84}
+
+	tiles, err := reader.GetTilesForBounds(bounds, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+
+	for _, tile := range tiles {
+		if err := checkData(tile.Tile, *tile.Data); err != nil {
+			t.Error(err)
+		}
+
+		got = append(got, tile.Tile.ToString())
+	}
+
+	if wantTiles := []string{"{2/0/0}", "{2/0/1}", "{2/1/0}", "{2/1/1}"}; !reflect.DeepEqual(got, wantTiles) {
+		t.Errorf("GetTilesForBounds() = %v, want %v", got, wantTiles)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	visitor := func(*Tile, []byte) error {
+		return nil
+	}
+
+	if err := reader.VisitAllTilesWithContext(ctx, visitor); err != context.Canceled {
+		t.Errorf("VisitAllTilesWithContext() = %v, want %v", err, context.Canceled)
+	}
+
+	if err := reader.VisitAllTilesOrderedWithContext(ctx, visitor); err != context.Canceled {
+		t.Errorf("VisitAllTilesOrderedWithContext() = %v, want %v", err, context.Canceled)
+	}
+
+	if err := reader.VisitTilesForZoomWithContext(ctx, 3, visitor); err != context.Canceled {
+		t.Errorf("VisitTilesForZoomWithContext() = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestNewPMTilesReader_NotPMTiles(t *testing.T) {
+	f, err := ioutil.TempFile("", "pmtiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	f.Write(make([]byte, pmtilesHeaderLength))
+	f.Close()
+
+	if _, err := NewPMTilesReader(f.Name()); err == nil {
+		t.Error("Expected an error opening a file that isn't a PMTiles archive")
+	}
+}
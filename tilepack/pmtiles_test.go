@@ -0,0 +1,168 @@
+package tilepack
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestZxyToPMTilesID(t *testing.T) {
+	tests := []struct {
+		tile *Tile
+		want uint64
+	}{
+		{&Tile{Z: 0, X: 0, Y: 0}, 0},
+		{&Tile{Z: 1, X: 0, Y: 0}, 1},
+		{&Tile{Z: 1, X: 0, Y: 1}, 2},
+		{&Tile{Z: 1, X: 1, Y: 1}, 3},
+		{&Tile{Z: 1, X: 1, Y: 0}, 4},
+		{&Tile{Z: 2, X: 0, Y: 0}, 5},
+		{&Tile{Z: 3, X: 0, Y: 0}, 21},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tile.ToString(), func(t *testing.T) {
+			got := ZxyToPMTilesID(tt.tile)
+			if got != tt.want {
+				t.Errorf("ZxyToPMTilesID() = %d, want %d", got, tt.want)
+			}
+			if back := PMTilesIDToZxy(got); !back.Equals(tt.tile) {
+				t.Errorf("PMTilesIDToZxy(%d) = %v, want %v", got, back, tt.tile)
+			}
+		})
+	}
+}
+
+func TestPMTilesOutputter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pmtiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.pmtiles")
+
+	o, err := NewPMTilesOutputter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	water := []byte{0x1f, 0x8b, 0x01}
+	land := []byte{0x1f, 0x8b, 0x02}
+
+	for _, tile := range []*Tile{{0, 0, 1}, {0, 1, 1}, {1, 1, 1}, {1, 0, 1}} {
+		if err := o.Save(tile, water); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := o.Save(&Tile{0, 0, 0}, land); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := deserializePMTilesHeader(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.MinZoom != 0 || h.MaxZoom != 1 {
+		t.Errorf("zoom range = %d-%d, want 0-1", h.MinZoom, h.MaxZoom)
+	}
+
+	if h.AddressedTilesCount != 5 || h.TileEntriesCount != 2 || h.TileContentsCount != 2 {
+		t.Errorf("counts = %d/%d/%d, want 5/2/2", h.AddressedTilesCount, h.TileEntriesCount, h.TileContentsCount)
+	}
+
+	entries, err := deserializePMTilesEntries(data[h.RootOffset:h.RootOffset+h.RootLength], h.InternalCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 2 || entries[1].RunLength != 4 {
+		t.Fatalf("unexpected root directory %+v", entries)
+	}
+
+	tileData := data[h.TileDataOffset+entries[0].Offset : h.TileDataOffset+entries[0].Offset+uint64(entries[0].Length)]
+	if string(tileData) != string(land) {
+		t.Errorf("tile 0/0/0 = %v, want %v", tileData, land)
+	}
+}
+
+func TestPMTilesOutputter_TileType(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pmtiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	png := []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n', 0x00, 0x00, 0x00, 0x0d}
+	jpeg := []byte{0xff, 0xd8, 0xff, 0xe0, 0x00, 0x10, 'J', 'F', 'I', 'F'}
+	mvt := []byte{0x1a, 0x2e, 0x78, 0x02, 0x0a, 0x05, 'w', 'a', 't', 'e', 'r'}
+
+	tests := []struct {
+		name        string
+		data        []byte
+		gzip        bool
+		tileType    uint8
+		compression uint8
+	}{
+		// Builds gzip raster tiles too, so the type comes from the
+		// uncompressed data
+		{"gzipped png", png, true, pmtilesTileTypePng, pmtilesCompressionGzip},
+		{"gzipped jpeg", jpeg, true, pmtilesTileTypeJpeg, pmtilesCompressionGzip},
+		{"gzipped mvt", mvt, true, pmtilesTileTypeMvt, pmtilesCompressionGzip},
+		{"png", png, false, pmtilesTileTypePng, pmtilesCompressionNone},
+	}
+
+	for i, tt := range tests {
+		path := filepath.Join(dir, fmt.Sprintf("%d.pmtiles", i))
+
+		o, err := NewPMTilesOutputter(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data := tt.data
+
+		if tt.gzip {
+			data, err = gzipBytes(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, tile := range []*Tile{{0, 0, 0}, {0, 0, 1}} {
+			if err := o.Save(tile, data); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := o.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		archive, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		h, err := deserializePMTilesHeader(archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if h.TileType != tt.tileType || h.TileCompression != tt.compression {
+			t.Errorf("%s: header has tile type %d and compression %d, want %d and %d", tt.name, h.TileType, h.TileCompression, tt.tileType, tt.compression)
+		}
+	}
+}
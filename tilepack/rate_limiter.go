@@ -0,0 +1,66 @@
+package tilepack
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// errRateLimiterStopped is returned to requests waiting for a limiter that's
+// been stopped.
+var errRateLimiterStopped = errors.New("Rate limiter stopped")
+
+// rateLimiter spaces out requests shared between workers so that, together,
+// they make no more than a fixed number of requests per second.
+type rateLimiter struct {
+	ticker   *time.Ticker
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+// newRateLimiter returns a limiter allowing perSecond requests per second, or
+// nil, which doesn't limit anything, if perSecond isn't positive.
+func newRateLimiter(perSecond float64) *rateLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+
+	interval := time.Duration(float64(time.Second) / perSecond)
+
+	if interval <= 0 {
+		interval = 1
+	}
+
+	return &rateLimiter{ticker: time.NewTicker(interval), stopped: make(chan struct{})}
+}
+
+// Wait blocks until the next request is allowed. It returns ctx's error if ctx
+// is done first, or an error if the limiter is stopped first.
+func (l *rateLimiter) Wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	select {
+	case <-l.ticker.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-l.stopped:
+		return errRateLimiterStopped
+	}
+}
+
+// Stop stops the limiter's ticker. Requests waiting for it, and any that wait
+// for it later, are refused. It's safe to call more than once.
+func (l *rateLimiter) Stop() {
+	if l == nil {
+		return
+	}
+
+	l.stopOnce.Do(func() {
+		l.ticker.Stop()
+		close(l.stopped)
+	})
+}
@@ -0,0 +1,176 @@
+package tilepack
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(100)
+	defer limiter.Stop()
+
+	start := time.Now()
+
+	// 4 workers sharing the limiter make 20 requests in total
+	wg := &sync.WaitGroup{}
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 5; i++ {
+				limiter.Wait(context.Background())
+			}
+		}()
+	}
+	wg.Wait()
+
+	if elapsed := time.Since(start); elapsed < 190*time.Millisecond {
+		t.Errorf("20 requests at 100 per second took %s, want at least 200ms", elapsed)
+	}
+
+	// A nil limiter doesn't wait at all
+	var unlimited *rateLimiter
+	if err := unlimited.Wait(context.Background()); err != nil {
+		t.Errorf("Wait() of a nil limiter = %v, want nil", err)
+	}
+
+	unlimited.Stop()
+}
+
+func TestRateLimiter_Interrupted(t *testing.T) {
+	// A request a minute, and the first isn't allowed for a minute either
+	limiter := newRateLimiter(1.0 / 60)
+	defer limiter.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := limiter.Wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Wait() = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	done := make(chan error)
+
+	go func() {
+		done <- limiter.Wait(context.Background())
+	}()
+
+	limiter.Stop()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Wait() of a stopped limiter = nil, want an error")
+		}
+	case <-time.After(time.Second):
+		t.Error("Wait() didn't return after the limiter was stopped")
+	}
+
+	// Stopping it again does nothing
+	limiter.Stop()
+}
+
+func TestXYZJobGenerator_StopsRateLimiter(t *testing.T) {
+	generator, err := NewXYZJobGeneratorWithOptions(&XYZJobGeneratorOptions{
+		URLTemplate: "http://tiles.example.com/{z}/{x}/{y}.mvt",
+		TileList:    strings.NewReader("1/1/1\n"),
+		RateLimit:   1.0 / 60,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limiter := generator.(*xyzJobGenerator).limiter
+
+	// Cancelling job creation releases workers waiting for the limiter
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := generator.CreateJobsWithContext(ctx, make(chan *TileRequest)); err != context.Canceled {
+		t.Fatalf("CreateJobsWithContext() = %v, want %v", err, context.Canceled)
+	}
+
+	select {
+	case <-limiter.stopped:
+	default:
+		t.Error("Cancelling job creation didn't stop the rate limiter")
+	}
+
+	generator, err = NewXYZJobGeneratorWithOptions(&XYZJobGeneratorOptions{
+		URLTemplate: "http://tiles.example.com/{z}/{x}/{y}.mvt",
+		RateLimit:   1.0 / 60,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limiter = generator.(*xyzJobGenerator).limiter
+
+	if err := generator.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-limiter.stopped:
+	default:
+		t.Error("Closing the generator didn't stop the rate limiter")
+	}
+}
+
+func TestXYZJobGenerator_RateLimitedPools(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("tile"))
+	}))
+	defer server.Close()
+
+	generator, err := NewXYZJobGeneratorWithOptions(&XYZJobGeneratorOptions{
+		URLTemplate: server.URL + "/{z}/{x}/{y}.mvt",
+		RateLimit:   1000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer generator.(io.Closer).Close()
+
+	// A pool of workers for each zoom in turn, the way build -zoom-by-zoom
+	// fetches them, shares the limiter
+	for z := uint(0); z < 3; z++ {
+		jobs := make(chan *TileRequest, 1<<(2*z))
+		results := make(chan *TileResponse, 1<<(2*z))
+
+		for x := uint(0); x < 1<<z; x++ {
+			for y := uint(0); y < 1<<z; y++ {
+				tile := &Tile{Z: z, X: x, Y: y}
+				jobs <- &TileRequest{Tile: tile, URL: fmt.Sprintf("%s/%d/%d/%d.mvt", server.URL, z, x, y)}
+			}
+		}
+
+		close(jobs)
+
+		wg := &sync.WaitGroup{}
+		for w := 0; w < 2; w++ {
+			worker, err := generator.CreateWorker()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			wg.Add(1)
+			go func(id int) {
+				defer wg.Done()
+				worker(id, jobs, results)
+			}(w)
+		}
+		wg.Wait()
+
+		if got, want := len(results), 1<<(2*z); got != want {
+			t.Errorf("Zoom %d returned %d results, want %d", z, got, want)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package tilepack
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+)
+
+// RecompressOptions configures Recompress.
+type RecompressOptions struct {
+	// JPEGQuality, if set, is the quality, 1 to 100, that JPEG tiles are
+	// re-encoded at.
+	JPEGQuality int
+	// PNG re-encodes PNG tiles at the best compression level, as paletted
+	// images if they have no more than 256 colors. No detail is lost.
+	PNG bool
+}
+
+// Recompress re-encodes JPEG and PNG tiles, which may be gzipped, as opts
+// asks. It returns data unchanged if the tile is in another format or
+// re-encoding it doesn't make it smaller.
+func Recompress(data []byte, opts *RecompressOptions) ([]byte, error) {
+	gzipped := IsGzipped(data)
+	tile := data
+
+	if gzipped {
+		uncompressed, err := Gunzip(data)
+		if err != nil {
+			return nil, err
+		}
+
+		tile = uncompressed
+	}
+
+	var buf bytes.Buffer
+
+	switch {
+	case opts.JPEGQuality > 0 && DetectFormat(tile) == FormatJpeg:
+		img, err := jpeg.Decode(bytes.NewReader(tile))
+		if err != nil {
+			return nil, err
+		}
+
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: opts.JPEGQuality}); err != nil {
+			return nil, err
+		}
+	case opts.PNG && DetectFormat(tile) == FormatPng:
+		img, err := png.Decode(bytes.NewReader(tile))
+		if err != nil {
+			return nil, err
+		}
+
+		if paletted, ok := toPaletted(img); ok {
+			img = paletted
+		}
+
+		encoder := &png.Encoder{CompressionLevel: png.BestCompression}
+
+		if err := encoder.Encode(&buf, img); err != nil {
+			return nil, err
+		}
+	default:
+		return data, nil
+	}
+
+	if buf.Len() >= len(tile) {
+		return data, nil
+	}
+
+	if gzipped {
+		return gzipBytes(buf.Bytes())
+	}
+
+	return buf.Bytes(), nil
+}
+
+// toPaletted returns img as a paletted image, if it isn't one already, has 8
+// bits per channel and has no more than 256 colors.
+func toPaletted(img image.Image) (*image.Paletted, bool) {
+	switch img.(type) {
+	case *image.Paletted, *image.RGBA64, *image.NRGBA64, *image.Gray16:
+		return nil, false
+	}
+
+	bounds := img.Bounds()
+	indexes := make(map[color.Color]uint8)
+	var palette color.Palette
+
+	paletted := image.NewPaletted(bounds, nil)
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			// Compare colors by value, whatever the image's color model
+			c := color.NRGBAModel.Convert(img.At(x, y))
+
+			index, ok := indexes[c]
+
+			if !ok {
+				if len(palette) == 256 {
+					return nil, false
+				}
+
+				index = uint8(len(palette))
+				indexes[c] = index
+				palette = append(palette, c)
+			}
+
+			paletted.SetColorIndex(x, y, index)
+		}
+	}
+
+	paletted.Palette = palette
+
+	return paletted, true
+}
@@ -0,0 +1,135 @@
+package tilepack
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// testImage returns a 256x256 image of two colored halves, with a little noise
+// in the bottom half so that JPEG quality matters.
+func testImage() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+
+	for y := 0; y < 256; y++ {
+		for x := 0; x < 256; x++ {
+			c := color.RGBA{R: 200, G: 220, B: 255, A: 255}
+
+			if y >= 128 {
+				c = color.RGBA{R: 240, G: uint8(230 + (x*y)%7), B: 210, A: 255}
+			}
+
+			img.Set(x, y, c)
+		}
+	}
+
+	return img
+}
+
+func TestRecompress_PNG(t *testing.T) {
+	img := testImage()
+
+	var buf bytes.Buffer
+	encoder := &png.Encoder{CompressionLevel: png.NoCompression}
+	if err := encoder.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+
+	original := buf.Bytes()
+
+	for _, gzipped := range []bool{false, true} {
+		data := original
+
+		if gzipped {
+			compressed, err := gzipBytes(original)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data = compressed
+		}
+
+		recompressed, err := Recompress(data, &RecompressOptions{PNG: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(recompressed) >= len(data) {
+			t.Errorf("Recompress() returned %d bytes, want fewer than %d", len(recompressed), len(data))
+		}
+
+		if IsGzipped(recompressed) != gzipped {
+			t.Errorf("Recompress() of a tile with gzipped %t returned gzipped %t", gzipped, IsGzipped(recompressed))
+		}
+
+		if gzipped {
+			recompressed, err = Gunzip(recompressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		decoded, err := png.Decode(bytes.NewReader(recompressed))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok := decoded.(*image.Paletted); !ok {
+			t.Errorf("Recompress() returned a %T, want *image.Paletted", decoded)
+		}
+
+		for _, p := range []image.Point{{0, 0}, {255, 127}, {3, 200}, {255, 255}} {
+			if got, want := color.NRGBAModel.Convert(decoded.At(p.X, p.Y)), color.NRGBAModel.Convert(img.At(p.X, p.Y)); got != want {
+				t.Errorf("Recompress() changed the color at %v from %v to %v", p, want, got)
+			}
+		}
+	}
+}
+
+func TestRecompress_JPEG(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(), &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	data := buf.Bytes()
+
+	recompressed, err := Recompress(data, &RecompressOptions{JPEGQuality: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(recompressed) >= len(data) {
+		t.Errorf("Recompress() returned %d bytes, want fewer than %d", len(recompressed), len(data))
+	}
+
+	if _, err := jpeg.Decode(bytes.NewReader(recompressed)); err != nil {
+		t.Errorf("Recompress() returned an invalid JPEG: %v", err)
+	}
+
+	// JPEGs are left alone without a quality
+	unchanged, err := Recompress(data, &RecompressOptions{PNG: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(unchanged, data) {
+		t.Error("Recompress() changed a JPEG without a JPEG quality")
+	}
+}
+
+func TestRecompress_OtherFormats(t *testing.T) {
+	data := []byte{0x1a, 0x00}
+
+	got, err := Recompress(data, &RecompressOptions{JPEGQuality: 50, PNG: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Errorf("Recompress() changed a vector tile to %v", got)
+	}
+}
@@ -0,0 +1,19 @@
+package tilepack
+
+// RepairMetadata recomputes the bounds, center and zoom range of the tiles in
+// reader and writes them to outputter, replacing whatever metadata is already
+// there. reader and outputter are usually the same archive, to repair it in
+// place. The bounds are the extent of the tiles at the maximum zoom level.
+func RepairMetadata(reader MbtilesReader, outputter MetadataOutputter) error {
+	minZoom, maxZoom, err := reader.GetZoomRange()
+	if err != nil {
+		return err
+	}
+
+	extent, err := reader.GetTileExtent()
+	if err != nil {
+		return err
+	}
+
+	return outputter.AssignMetadata(extent.Bounds, minZoom, maxZoom)
+}
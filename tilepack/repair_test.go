@@ -0,0 +1,77 @@
+package tilepack
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRepairMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "repair")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "repair.mbtiles")
+
+	o, err := NewMbtilesOutputter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The metadata doesn't match the tiles, the north west quarter of the
+	// world at zooms 2 and 3
+	if err := o.AssignMetadata(&LngLatBbox{West: 10.0, South: 10.0, East: 20.0, North: 20.0}, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	for z := uint(2); z <= 3; z++ {
+		n := uint(1) << z
+		for x := uint(0); x < n/2; x++ {
+			// Rows are TMS, so the northern half is the upper rows
+			for y := n / 2; y < n; y++ {
+				if err := o.Save(&Tile{Z: z, X: x, Y: y}, []byte("tile")); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+
+	if err := o.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewMbtilesReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	if err := RepairMetadata(reader, o); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	metadata, err := reader.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"minzoom": "2",
+		"maxzoom": "3",
+		"bounds":  "-180.000000,0.000000,0.000000,85.051129",
+		"center":  "-90.000000,42.525564,2",
+	}
+
+	for name, value := range want {
+		if metadata[name] != value {
+			t.Errorf("Metadata %s = %q, want %q", name, metadata[name], value)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package tilepack
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"sync"
+)
+
+// StatsWriter writes the size and fetch time of tiles to an io.Writer as CSV,
+// with a z,x,y,bytes,elapsed_seconds,http_status header. It is safe for
+// concurrent use.
+type StatsWriter struct {
+	mu     sync.Mutex
+	writer *csv.Writer
+}
+
+func NewStatsWriter(w io.Writer) (*StatsWriter, error) {
+	writer := csv.NewWriter(w)
+
+	err := writer.Write([]string{"z", "x", "y", "bytes", "elapsed_seconds", "http_status"})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &StatsWriter{writer: writer}, nil
+}
+
+// WriteResponse appends a row for response. The http_status column is empty if
+// the response didn't come from an HTTP request.
+func (w *StatsWriter) WriteResponse(response *TileResponse) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	status := ""
+	if response.StatusCode != 0 {
+		status = strconv.Itoa(response.StatusCode)
+	}
+
+	return w.writer.Write([]string{
+		strconv.FormatUint(uint64(response.Tile.Z), 10),
+		strconv.FormatUint(uint64(response.Tile.X), 10),
+		strconv.FormatUint(uint64(response.Tile.Y), 10),
+		strconv.Itoa(len(response.Data)),
+		strconv.FormatFloat(response.Elapsed, 'f', 6, 64),
+		status,
+	})
+}
+
+// Flush writes any buffered rows to the underlying io.Writer.
+func (w *StatsWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.writer.Flush()
+	return w.writer.Error()
+}
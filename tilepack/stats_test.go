@@ -0,0 +1,36 @@
+package tilepack
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestStatsWriter(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+
+	w, err := NewStatsWriter(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	responses := []*TileResponse{
+		{Tile: &Tile{Z: 4, X: 2, Y: 5}, Data: []byte("tile"), Elapsed: 0.25, StatusCode: 200},
+		{Tile: &Tile{Z: 4, X: 3, Y: 5}, Data: []byte{}, Elapsed: 1.5},
+	}
+
+	for _, response := range responses {
+		if err := w.WriteResponse(response); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "z,x,y,bytes,elapsed_seconds,http_status\n4,2,5,4,0.250000,200\n4,3,5,0,1.500000,\n"
+
+	if buf.String() != want {
+		t.Errorf("Wrote %q, want %q", buf.String(), want)
+	}
+}
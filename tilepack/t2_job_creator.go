@@ -3,6 +3,7 @@ package tilepack
 import (
 	"archive/zip"
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"fmt"
@@ -117,10 +118,14 @@ func (x *tapalcatl2JobGenerator) CreateWorker() (func(id int, jobs chan *TileReq
 }
 
 func (x *tapalcatl2JobGenerator) CreateJobs(jobs chan *TileRequest) error {
+	return x.CreateJobsWithContext(context.Background(), jobs)
+}
+
+func (x *tapalcatl2JobGenerator) CreateJobsWithContext(ctx context.Context, jobs chan *TileRequest) error {
 	// Iterate over the list of materialized zooms
 	for _, materializedZoom := range x.materializedZooms {
 		// Generate requests for tiles in the bounding box at this materialized zoom
-		GenerateTiles(&GenerateTilesOptions{
+		err := GenerateTilesWithContext(ctx, &GenerateTilesOptions{
 			Bounds:    x.bounds,
 			InvertedY: false,
 			Zooms:     []uint{materializedZoom},
@@ -141,6 +146,10 @@ func (x *tapalcatl2JobGenerator) CreateJobs(jobs chan *TileRequest) error {
 				}
 			},
 		})
+
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
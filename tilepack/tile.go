@@ -1,8 +1,11 @@
 package tilepack
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math"
+	"sort"
 )
 
 const threeSixty float64 = 360.0
@@ -13,7 +16,12 @@ const webMercatorLatLimit float64 = 85.05112877980659
 type GenerateTilesConsumerFunc func(tile *Tile)
 
 type GenerateTilesOptions struct {
-	Bounds       *LngLatBbox
+	Bounds *LngLatBbox
+	// Boxes, if set, are used instead of Bounds. Tiles in more than one box
+	// are only generated once.
+	Boxes []*LngLatBbox
+	// Zooms are generated in the order given, all of one zoom level's tiles
+	// before any of the next.
 	Zooms        []uint
 	ConsumerFunc GenerateTilesConsumerFunc
 	InvertedY    bool
@@ -41,6 +49,36 @@ func (b *LngLatBbox) Intersects(o *LngLatBbox) bool {
 	return latOverlaps && lngOverlaps
 }
 
+// TileRange returns the first and last columns and rows of the XYZ tiles at
+// zoom that cover the bounding box, which is clamped to the latitudes that web
+// mercator covers. If the box crosses the antimeridian (West is greater than
+// East) and doesn't cover every column, so does the range: minX is greater
+// than maxX, and the columns run from minX to the last column and then from 0
+// to maxX.
+func (b *LngLatBbox) TileRange(zoom uint) (minX uint, minY uint, maxX uint, maxY uint) {
+	boxes := generateTilesBoxes(b)
+
+	// The ranges are half-open
+	minX, maxX, minY, maxY = tileRange(boxes[0], zoom)
+	maxX--
+	maxY--
+
+	if len(boxes) == 2 {
+		westMinX, _, _, _ := tileRange(boxes[1], zoom)
+
+		// The box from the antimeridian east ends at maxX and the one west of
+		// it starts at westMinX, unless between them they cover every column
+		if westMinX > maxX+1 {
+			minX = westMinX
+		} else {
+			minX = 0
+			maxX = (1 << zoom) - 1
+		}
+	}
+
+	return minX, minY, maxX, maxY
+}
+
 //Bbox holds Spherical Mercator bounding box of a tile
 type Bbox struct {
 	Left, Bottom, Right, Top float64
@@ -94,11 +132,189 @@ func GetTile(lng float64, lat float64, zoom uint) *Tile {
 }
 
 func GenerateTiles(opts *GenerateTilesOptions) {
+	GenerateTilesWithContext(context.Background(), opts)
+}
+
+// GenerateTilesWithContext is like GenerateTiles but stops calling
+// opts.ConsumerFunc once ctx is cancelled, returning ctx.Err().
+func GenerateTilesWithContext(ctx context.Context, opts *GenerateTilesOptions) error {
 
-	bounds := opts.Bounds
-	zooms := opts.Zooms
 	consumer := opts.ConsumerFunc
+	boxes := opts.boxes()
+
+	// Every box is covered at one zoom level before moving on to the next
+	for _, z := range opts.Zooms {
+		for k, box := range boxes {
+
+			minX, maxX, minY, maxY := tileRange(box, z)
+
+			// Tiles in earlier boxes have already been generated
+			earlier := tileRanges(boxes[:k], z)
+
+			for i := minX; i < maxX; i++ {
+				for j := minY; j < maxY; j++ {
+
+					if err := ctx.Err(); err != nil {
+						return err
+					}
+
+					if earlier.contains(i, j) {
+						continue
+					}
+
+					x := i
+					y := j
+
+					if opts.InvertedY {
+						// https://gist.github.com/tmcw/4954720
+						y = uint(math.Pow(2.0, float64(z))) - 1 - y
+					}
+
+					consumer(&Tile{Z: z, X: x, Y: y})
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// GenerateTilesChannel returns a channel of the tiles GenerateTiles would pass
+// to opts.ConsumerFunc, which is ignored. The channel is closed once every
+// tile has been sent or ctx is cancelled. Callers that stop reading before
+// the channel is closed must cancel ctx, or the goroutine sending tiles leaks.
+func GenerateTilesChannel(ctx context.Context, opts *GenerateTilesOptions) <-chan *Tile {
+	tiles := make(chan *Tile)
+
+	channelOpts := *opts
+	channelOpts.ConsumerFunc = func(tile *Tile) {
+		select {
+		case tiles <- tile:
+		case <-ctx.Done():
+		}
+	}
+
+	go func() {
+		defer close(tiles)
+		GenerateTilesWithContext(ctx, &channelOpts)
+	}()
+
+	return tiles
+}
+
+// CountTiles returns the number of tiles GenerateTiles would pass to the
+// consumer for opts, without generating them.
+func CountTiles(opts *GenerateTilesOptions) (uint64, error) {
+	if opts.Bounds == nil && len(opts.Boxes) == 0 {
+		return 0, errors.New("Missing bounds")
+	}
+
+	var count uint64
+
+	boxes := opts.boxes()
+
+	for _, z := range opts.Zooms {
+		count += tileRanges(boxes, z).count()
+	}
+
+	return count, nil
+}
+
+// boxes returns the boxes to generate tiles for, split at the antimeridian.
+func (opts *GenerateTilesOptions) boxes() []*LngLatBbox {
+	bounds := opts.Boxes
+
+	if len(bounds) == 0 {
+		bounds = []*LngLatBbox{opts.Bounds}
+	}
+
+	var boxes []*LngLatBbox
+
+	for _, b := range bounds {
+		boxes = append(boxes, generateTilesBoxes(b)...)
+	}
+
+	return boxes
+}
+
+// ranges is a list of half-open minX, maxX, minY, maxY tile ranges at one zoom.
+type ranges [][4]uint
+
+func tileRanges(boxes []*LngLatBbox, z uint) ranges {
+	r := make(ranges, 0, len(boxes))
+
+	for _, box := range boxes {
+		minX, maxX, minY, maxY := tileRange(box, z)
+
+		if maxX > minX && maxY > minY {
+			r = append(r, [4]uint{minX, maxX, minY, maxY})
+		}
+	}
+
+	return r
+}
+
+func (r ranges) contains(x uint, y uint) bool {
+	for _, rng := range r {
+		if x >= rng[0] && x < rng[1] && y >= rng[2] && y < rng[3] {
+			return true
+		}
+	}
 
+	return false
+}
+
+// count returns the number of tiles in the union of the ranges.
+func (r ranges) count() uint64 {
+	// Split the columns wherever a range starts or ends, then add up the rows
+	// covered in each group of columns
+	var xs []uint
+
+	for _, rng := range r {
+		xs = append(xs, rng[0], rng[1])
+	}
+
+	sort.Slice(xs, func(i, j int) bool { return xs[i] < xs[j] })
+
+	var count uint64
+
+	for i := 1; i < len(xs); i++ {
+		if xs[i] == xs[i-1] {
+			continue
+		}
+
+		var rows [][2]uint
+
+		for _, rng := range r {
+			if rng[0] <= xs[i-1] && rng[1] >= xs[i] {
+				rows = append(rows, [2]uint{rng[2], rng[3]})
+			}
+		}
+
+		sort.Slice(rows, func(a, b int) bool { return rows[a][0] < rows[b][0] })
+
+		var covered, end uint
+
+		for _, row := range rows {
+			if row[0] > end {
+				end = row[0]
+			}
+
+			if row[1] > end {
+				covered += row[1] - end
+				end = row[1]
+			}
+		}
+
+		count += uint64(xs[i]-xs[i-1]) * uint64(covered)
+	}
+
+	return count
+}
+
+// generateTilesBoxes splits bounds that cross the antimeridian in two and
+// clamps them to web mercator limits.
+func generateTilesBoxes(bounds *LngLatBbox) []*LngLatBbox {
 	var boxes []*LngLatBbox
 	if bounds.West > bounds.East {
 		boxes = []*LngLatBbox{
@@ -109,46 +325,41 @@ func GenerateTiles(opts *GenerateTilesOptions) {
 		boxes = []*LngLatBbox{bounds}
 	}
 
-	for _, box := range boxes {
+	for i, box := range boxes {
 		// Clamp the individual boxes to web mercator limits
-		clampedBox := &LngLatBbox{
+		boxes[i] = &LngLatBbox{
 			West:  math.Max(-180.0, box.West),
 			South: math.Max(-webMercatorLatLimit, box.South),
 			East:  math.Min(180.0, box.East),
 			North: math.Min(webMercatorLatLimit, box.North),
 		}
+	}
 
-		for _, z := range zooms {
-
-			ll := GetTile(clampedBox.West, clampedBox.South, z)
-			ur := GetTile(clampedBox.East, clampedBox.North, z)
-
-			llx := ll.X
-			if llx < 0 {
-				llx = 0
-			}
+	return boxes
+}
 
-			ury := ur.Y
-			if ury < 0 {
-				ury = 0
-			}
+// tileRange returns the half-open ranges of XYZ columns and rows covering box at zoom z.
+func tileRange(box *LngLatBbox, z uint) (uint, uint, uint, uint) {
+	ll := GetTile(box.West, box.South, z)
+	ur := GetTile(box.East, box.North, z)
 
-			for i := llx; i < min(ur.X+1, 1<<z); i++ {
-				for j := ury; j < min(ll.Y+1, 1<<z); j++ {
+	llx := ll.X
+	if llx < 0 {
+		llx = 0
+	}
 
-					x := i
-					y := j
+	ury := ur.Y
+	if ury < 0 {
+		ury = 0
+	}
 
-					if opts.InvertedY {
-						// https://gist.github.com/tmcw/4954720
-						y = uint(math.Pow(2.0, float64(z))) - 1 - y
-					}
+	return llx, min(ur.X+1, 1<<z), ury, min(ll.Y+1, 1<<z)
+}
 
-					consumer(&Tile{Z: z, X: x, Y: y})
-				}
-			}
-		}
-	}
+// Valid returns true if the tile's column and row are within [0, 2^zoom).
+func (tile *Tile) Valid() bool {
+	// Shifting by 64 or more gives 0, so zooms that large are never valid
+	return tile.X < 1<<tile.Z && tile.Y < 1<<tile.Z
 }
 
 // Equals compares 2 tiles
@@ -177,26 +388,14 @@ func (tile *Tile) Bounds() *LngLatBbox {
 	return &LngLatBbox{a.Lng, b.Lat, b.Lng, a.Lat}
 }
 
-//Parent returns the tile above (i.e. at a lower zoon number) the given tile
+//Parent returns the tile above (i.e. at a lower zoon number) the given tile, or nil at zoom 0
 func (tile *Tile) Parent() *Tile {
 
-	if tile.Z == 0 && tile.X == 0 && tile.Y == 0 {
-		return tile
+	if tile.Z == 0 {
+		return nil
 	}
 
-	if math.Mod(float64(tile.X), 2) == 0 && math.Mod(float64(tile.Y), 2) == 0 {
-		return &Tile{tile.X / 2, tile.Y / 2, tile.Z - 1}
-	}
-	if math.Mod(float64(tile.X), 2) == 0 {
-		return &Tile{tile.X / 2, (tile.Y - 1) / 2, tile.Z - 1}
-	}
-	if math.Mod(float64(tile.X), 2) != 0 && math.Mod(float64(tile.Y), 2) != 0 {
-		return &Tile{(tile.X - 1) / 2, (tile.Y - 1) / 2, tile.Z - 1}
-	}
-	if math.Mod(float64(tile.X), 2) != 0 && math.Mod(float64(tile.Y), 2) == 0 {
-		return &Tile{(tile.X - 1) / 2, tile.Y / 2, tile.Z - 1}
-	}
-	return nil
+	return &Tile{tile.X / 2, tile.Y / 2, tile.Z - 1}
 }
 
 //Children returns the 4 tiles below (i.e. at a higher zoom number) the given tile
@@ -211,6 +410,58 @@ func (tile *Tile) Children() []*Tile {
 	return kids
 }
 
+// Quadkey returns the Bing Maps quadkey for the tile.
+// https://docs.microsoft.com/en-us/bingmaps/articles/bing-maps-tile-system
+func (tile *Tile) Quadkey() string {
+	quadkey := make([]byte, tile.Z)
+
+	for i := tile.Z; i > 0; i-- {
+		digit := byte('0')
+		mask := uint(1) << (i - 1)
+
+		if tile.X&mask != 0 {
+			digit++
+		}
+
+		if tile.Y&mask != 0 {
+			digit += 2
+		}
+
+		quadkey[tile.Z-i] = digit
+	}
+
+	return string(quadkey)
+}
+
+// TileFromQuadkey returns the tile for a Bing Maps quadkey, the reverse of
+// Tile.Quadkey. The zoom is the length of the quadkey, so "" is the z0 tile.
+func TileFromQuadkey(qk string) (*Tile, error) {
+	if len(qk) > 32 {
+		return nil, fmt.Errorf("Quadkey %q is too long", qk)
+	}
+
+	tile := &Tile{Z: uint(len(qk))}
+
+	for i := 0; i < len(qk); i++ {
+		mask := uint(1) << (tile.Z - uint(i) - 1)
+
+		switch qk[i] {
+		case '0':
+		case '1':
+			tile.X |= mask
+		case '2':
+			tile.Y |= mask
+		case '3':
+			tile.X |= mask
+			tile.Y |= mask
+		default:
+			return nil, fmt.Errorf("Invalid quadkey digit %q in %q", qk[i], qk)
+		}
+	}
+
+	return tile, nil
+}
+
 // ToString returns a string representation of the tile.
 func (tile *Tile) ToString() string {
 	return fmt.Sprintf("{%d/%d/%d}", tile.Z, tile.X, tile.Y)
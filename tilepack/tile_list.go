@@ -0,0 +1,103 @@
+package tilepack
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// ReadTileList reads "z/x/y" lines from r, calling consumer for each tile.
+// Blank lines are ignored.
+func ReadTileList(r io.Reader, consumer GenerateTilesConsumerFunc) error {
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+
+	for scanner.Scan() {
+		lineNumber++
+
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" {
+			continue
+		}
+
+		tile, err := ParseTile(line)
+
+		if err != nil {
+			return fmt.Errorf("Invalid tile on line %d: %+v", lineNumber, err)
+		}
+
+		consumer(tile)
+	}
+
+	return scanner.Err()
+}
+
+// ReadTileListWithContext is like ReadTileList but returns ctx.Err() once ctx
+// is cancelled, even if r is waiting for more lines, as stdin may be. r goes on
+// being read in the background until it returns, but no more tiles are passed
+// to consumer.
+func ReadTileListWithContext(ctx context.Context, r io.Reader, consumer GenerateTilesConsumerFunc) error {
+	tiles := make(chan *Tile)
+	done := make(chan error, 1)
+
+	go func() {
+		done <- ReadTileList(r, func(tile *Tile) {
+			select {
+			case tiles <- tile:
+			case <-ctx.Done():
+			}
+		})
+	}()
+
+	for {
+		select {
+		case tile := <-tiles:
+			consumer(tile)
+		case err := <-done:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// ParseTile parses a tile from a "z/x/y" string.
+func ParseTile(str string) (*Tile, error) {
+	var z, x, y uint
+
+	n, err := fmt.Sscanf(str, "%d/%d/%d", &z, &x, &y)
+
+	if err != nil || n != 3 {
+		return nil, fmt.Errorf("%s is not a z/x/y tile", str)
+	}
+
+	if fmt.Sprintf("%d/%d/%d", z, x, y) != str {
+		return nil, fmt.Errorf("%s is not a z/x/y tile", str)
+	}
+
+	return &Tile{Z: z, X: x, Y: y}, nil
+}
+
+// TileListWriter writes tiles to an io.Writer as "z/x/y" lines. It is safe for
+// concurrent use.
+type TileListWriter struct {
+	mu     sync.Mutex
+	writer io.Writer
+}
+
+func NewTileListWriter(w io.Writer) *TileListWriter {
+	return &TileListWriter{writer: w}
+}
+
+// WriteTile appends tile to the list.
+func (w *TileListWriter) WriteTile(tile *Tile) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	_, err := fmt.Fprintf(w.writer, "%d/%d/%d\n", tile.Z, tile.X, tile.Y)
+	return err
+}
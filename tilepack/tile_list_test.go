@@ -0,0 +1,50 @@
+package tilepack
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadTileListWithContext(t *testing.T) {
+	var got []string
+
+	err := ReadTileListWithContext(context.Background(), strings.NewReader("1/0/1\n\n2/3/1\n"), func(tile *Tile) {
+		got = append(got, tile.ToString())
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(got, ",") != "{1/0/1},{2/3/1}" {
+		t.Errorf("ReadTileListWithContext() read %v, want [{1/0/1} {2/3/1}]", got)
+	}
+
+	// A stream that stays open, like stdin, stops being read once cancelled
+	r, w := io.Pipe()
+	defer w.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	read := make(chan *Tile)
+	done := make(chan error)
+
+	go func() {
+		done <- ReadTileListWithContext(ctx, r, func(tile *Tile) { read <- tile })
+	}()
+
+	if _, err := io.WriteString(w, "3/2/1\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	if tile := <-read; tile.ToString() != "{3/2/1}" {
+		t.Errorf("ReadTileListWithContext() read %s, want {3/2/1}", tile.ToString())
+	}
+
+	cancel()
+
+	if err := <-done; err != context.Canceled {
+		t.Errorf("ReadTileListWithContext() returned %v, want %v", err, context.Canceled)
+	}
+}
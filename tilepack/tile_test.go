@@ -1,6 +1,8 @@
 package tilepack
 
 import (
+	"context"
+	"math"
 	"reflect"
 	"testing"
 )
@@ -17,6 +19,12 @@ func TestTile_Bounds(t *testing.T) {
 		want   *LngLatBbox
 	}{
 		{"z0 global", fields{0, 0, 0}, &LngLatBbox{-180.0, -webMercatorLatLimit, 180.0, webMercatorLatLimit}},
+		{"z1 north west", fields{0, 0, 1}, &LngLatBbox{-180.0, 0.0, 0.0, webMercatorLatLimit}},
+		{"z1 north east", fields{1, 0, 1}, &LngLatBbox{0.0, 0.0, 180.0, webMercatorLatLimit}},
+		{"z1 south west", fields{0, 1, 1}, &LngLatBbox{-180.0, -webMercatorLatLimit, 0.0, 0.0}},
+		{"z1 south east", fields{1, 1, 1}, &LngLatBbox{0.0, -webMercatorLatLimit, 180.0, 0.0}},
+		{"z2", fields{1, 1, 2}, &LngLatBbox{-90.0, 0.0, 0.0, 66.51326044311186}},
+		{"z14 San Francisco", fields{2620, 6332, 14}, &LngLatBbox{-122.431640625, 37.77071473849608, -122.40966796875, 37.78808138412046}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -25,9 +33,328 @@ func TestTile_Bounds(t *testing.T) {
 				Y: tt.fields.Y,
 				Z: tt.fields.Z,
 			}
-			if got := tile.Bounds(); !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("Tile.Bounds() = %v, want %v", got, tt.want)
+			got := tile.Bounds()
+			for _, d := range []float64{got.West - tt.want.West, got.South - tt.want.South, got.East - tt.want.East, got.North - tt.want.North} {
+				if math.Abs(d) > 1e-9 {
+					t.Errorf("Tile.Bounds() = %v, want %v", got, tt.want)
+					break
+				}
 			}
 		})
 	}
 }
+
+func TestTile_Valid(t *testing.T) {
+	tests := []struct {
+		tile *Tile
+		want bool
+	}{
+		{&Tile{X: 0, Y: 0, Z: 0}, true},
+		{&Tile{X: 1, Y: 0, Z: 0}, false},
+		{&Tile{X: 3, Y: 3, Z: 2}, true},
+		{&Tile{X: 3, Y: 4, Z: 2}, false},
+		{&Tile{X: 4, Y: 3, Z: 2}, false},
+		{&Tile{X: 0, Y: 0, Z: 64}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tile.ToString(), func(t *testing.T) {
+			if got := tt.tile.Valid(); got != tt.want {
+				t.Errorf("Tile.Valid() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTile_Quadkey(t *testing.T) {
+	tests := []struct {
+		tile *Tile
+		want string
+	}{
+		{&Tile{X: 0, Y: 0, Z: 0}, ""},
+		{&Tile{X: 0, Y: 0, Z: 1}, "0"},
+		{&Tile{X: 1, Y: 0, Z: 1}, "1"},
+		{&Tile{X: 0, Y: 1, Z: 1}, "2"},
+		{&Tile{X: 1, Y: 1, Z: 1}, "3"},
+		{&Tile{X: 3, Y: 5, Z: 3}, "213"},
+		{&Tile{X: 35210, Y: 21493, Z: 16}, "1202102332221212"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tile.ToString(), func(t *testing.T) {
+			if got := tt.tile.Quadkey(); got != tt.want {
+				t.Errorf("Tile.Quadkey() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTileFromQuadkey(t *testing.T) {
+	tiles := []*Tile{
+		{X: 0, Y: 0, Z: 0},
+		{X: 1, Y: 0, Z: 1},
+		{X: 0, Y: 1, Z: 1},
+		{X: 3, Y: 5, Z: 3},
+		{X: 35210, Y: 21493, Z: 16},
+		{X: 1<<20 - 1, Y: 0, Z: 20},
+	}
+	for _, tile := range tiles {
+		t.Run(tile.ToString(), func(t *testing.T) {
+			got, err := TileFromQuadkey(tile.Quadkey())
+			if err != nil {
+				t.Fatalf("TileFromQuadkey(%q) error = %v", tile.Quadkey(), err)
+			}
+			if *got != *tile {
+				t.Errorf("TileFromQuadkey(%q) = %v, want %v", tile.Quadkey(), got.ToString(), tile.ToString())
+			}
+		})
+	}
+
+	for _, qk := range []string{"4", "01a", "1-2", "012345"} {
+		if _, err := TileFromQuadkey(qk); err == nil {
+			t.Errorf("TileFromQuadkey(%q) expected an error", qk)
+		}
+	}
+}
+
+func TestLngLatBbox_TileRange(t *testing.T) {
+	tests := []struct {
+		name   string
+		bounds *LngLatBbox
+		zoom   uint
+		want   [4]uint
+	}{
+		{"world", &LngLatBbox{West: -180.0, South: -90.0, East: 180.0, North: 90.0}, 0, [4]uint{0, 0, 0, 0}},
+		{"world z2", &LngLatBbox{West: -180.0, South: -90.0, East: 180.0, North: 90.0}, 2, [4]uint{0, 0, 3, 3}},
+		{"san francisco", &LngLatBbox{West: -122.5, South: 37.7, East: -122.3, North: 37.8}, 10, [4]uint{163, 395, 164, 396}},
+		{"antimeridian", &LngLatBbox{West: 170.0, South: -10.0, East: -170.0, North: 10.0}, 2, [4]uint{3, 1, 0, 2}},
+		{"antimeridian z0", &LngLatBbox{West: 170.0, South: -10.0, East: -170.0, North: 10.0}, 0, [4]uint{0, 0, 0, 0}},
+		{"antimeridian every column", &LngLatBbox{West: -10.0, South: -10.0, East: -20.0, North: 10.0}, 1, [4]uint{0, 0, 1, 1}},
+		{"north pole", &LngLatBbox{West: 0.0, South: 80.0, East: 80.0, North: 90.0}, 3, [4]uint{4, 0, 5, 0}},
+	}
+
+	for _, test := range tests {
+		minX, minY, maxX, maxY := test.bounds.TileRange(test.zoom)
+
+		if got := [4]uint{minX, minY, maxX, maxY}; got != test.want {
+			t.Errorf("%s TileRange(%d) = %v, want %v", test.name, test.zoom, got, test.want)
+		}
+	}
+}
+
+func TestGenerateTilesWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	count := 0
+	opts := &GenerateTilesOptions{
+		Bounds: &LngLatBbox{West: -180.0, South: -85.0, East: 180.0, North: 85.0},
+		Zooms:  []uint{4},
+		ConsumerFunc: func(tile *Tile) {
+			count++
+			if count == 10 {
+				cancel()
+			}
+		},
+	}
+
+	err := GenerateTilesWithContext(ctx, opts)
+
+	if err != context.Canceled {
+		t.Errorf("GenerateTilesWithContext() error = %v, want %v", err, context.Canceled)
+	}
+
+	if count != 10 {
+		t.Errorf("GenerateTilesWithContext() generated %d tiles after cancelling, want 10", count)
+	}
+}
+
+func TestGenerateTilesChannel(t *testing.T) {
+	opts := &GenerateTilesOptions{
+		Bounds: &LngLatBbox{West: -180.0, South: -85.0, East: 180.0, North: 85.0},
+		Zooms:  []uint{0, 1, 2},
+	}
+
+	count := 0
+	for range GenerateTilesChannel(context.Background(), opts) {
+		count++
+	}
+
+	if count != 21 {
+		t.Errorf("Got %d tiles, want 21", count)
+	}
+
+	// Cancelling closes the channel without the rest being read
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	count = 0
+	for range GenerateTilesChannel(ctx, opts) {
+		count++
+		if count == 5 {
+			cancel()
+		}
+	}
+
+	if count > 6 {
+		t.Errorf("Got %d tiles after cancelling", count)
+	}
+}
+
+func TestCountTiles(t *testing.T) {
+	tests := []struct {
+		name   string
+		bounds *LngLatBbox
+		zooms  []uint
+		want   uint64
+	}{
+		{"world", &LngLatBbox{West: -180.0, South: -90.0, East: 180.0, North: 90.0}, []uint{0, 1, 2, 3}, 1 + 4 + 16 + 64},
+		{"antimeridian", &LngLatBbox{West: 170.0, South: -10.0, East: -170.0, North: 10.0}, []uint{2}, 4},
+		{"san francisco", &LngLatBbox{West: -122.5, South: 37.7, East: -122.3, North: 37.8}, []uint{10, 12, 14}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var generated uint64
+			opts := &GenerateTilesOptions{
+				Bounds:       tt.bounds,
+				Zooms:        tt.zooms,
+				ConsumerFunc: func(tile *Tile) { generated++ },
+			}
+
+			GenerateTiles(opts)
+
+			got, err := CountTiles(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != generated {
+				t.Errorf("CountTiles() = %d, GenerateTiles() generated %d", got, generated)
+			}
+
+			if tt.want != 0 && got != tt.want {
+				t.Errorf("CountTiles() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGenerateTiles_ZoomOrder(t *testing.T) {
+	var zooms []uint
+
+	opts := &GenerateTilesOptions{
+		// Crossing the antimeridian splits the bounds into two boxes
+		Bounds:       &LngLatBbox{West: 170.0, South: -10.0, East: -170.0, North: 10.0},
+		Zooms:        []uint{2, 3, 4},
+		ConsumerFunc: func(tile *Tile) { zooms = append(zooms, tile.Z) },
+	}
+
+	GenerateTiles(opts)
+
+	for i := 1; i < len(zooms); i++ {
+		if zooms[i] < zooms[i-1] {
+			t.Fatalf("GenerateTiles() generated zoom %d after zoom %d", zooms[i], zooms[i-1])
+		}
+	}
+}
+
+func TestGenerateTiles_Boxes(t *testing.T) {
+	// Two overlapping boxes around San Francisco and one on its own in New York
+	boxes := []*LngLatBbox{
+		{West: -122.5, South: 37.7, East: -122.35, North: 37.8},
+		{West: -122.45, South: 37.75, East: -122.3, North: 37.85},
+		{West: -74.05, South: 40.68, East: -73.9, North: 40.8},
+	}
+
+	for _, zooms := range [][]uint{{0, 1, 2}, {10, 12, 14}} {
+		seen := make(map[Tile]bool)
+		var duplicates int
+
+		opts := &GenerateTilesOptions{
+			Boxes: boxes,
+			Zooms: zooms,
+			ConsumerFunc: func(tile *Tile) {
+				if seen[*tile] {
+					duplicates++
+				}
+				seen[*tile] = true
+			},
+		}
+
+		GenerateTiles(opts)
+
+		if duplicates > 0 {
+			t.Errorf("Zooms %v generated %d duplicate tiles", zooms, duplicates)
+		}
+
+		// Every tile in any of the boxes is generated
+		var want int
+
+		for _, z := range zooms {
+			union := make(map[Tile]bool)
+
+			for _, box := range boxes {
+				GenerateTiles(&GenerateTilesOptions{
+					Bounds:       box,
+					Zooms:        []uint{z},
+					ConsumerFunc: func(tile *Tile) { union[*tile] = true },
+				})
+			}
+
+			want += len(union)
+		}
+
+		if len(seen) != want {
+			t.Errorf("Zooms %v generated %d tiles, want %d", zooms, len(seen), want)
+		}
+
+		count, err := CountTiles(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if count != uint64(want) {
+			t.Errorf("Zooms %v counted %d tiles, want %d", zooms, count, want)
+		}
+	}
+}
+
+func TestTile_Parent(t *testing.T) {
+	tests := []struct {
+		tile *Tile
+		want *Tile
+	}{
+		{&Tile{X: 0, Y: 0, Z: 0}, nil},
+		{&Tile{X: 1, Y: 1, Z: 1}, &Tile{X: 0, Y: 0, Z: 0}},
+		{&Tile{X: 4, Y: 5, Z: 3}, &Tile{X: 2, Y: 2, Z: 2}},
+		{&Tile{X: 7, Y: 6, Z: 3}, &Tile{X: 3, Y: 3, Z: 2}},
+	}
+
+	for _, test := range tests {
+		if got := test.tile.Parent(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s.Parent() = %v, want %v", test.tile.ToString(), got, test.want)
+		}
+	}
+}
+
+func TestTile_Children(t *testing.T) {
+	tile := &Tile{X: 2, Y: 3, Z: 2}
+
+	children := tile.Children()
+
+	if len(children) != 4 {
+		t.Fatalf("Got %d children, want 4", len(children))
+	}
+
+	seen := make(map[string]bool)
+
+	for _, child := range children {
+		if child.Z != 3 || !child.Parent().Equals(tile) {
+			t.Errorf("%s isn't a child of %s", child.ToString(), tile.ToString())
+		}
+
+		seen[child.ToString()] = true
+	}
+
+	if len(seen) != 4 {
+		t.Errorf("Children aren't distinct: %v", seen)
+	}
+}
@@ -0,0 +1,251 @@
+package tilepack
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Vector layer field types, as used in the vector_layers of the mbtiles "json"
+// metadata. Fields whose values have more than one type are "Mixed".
+const (
+	FieldTypeString  = "String"
+	FieldTypeNumber  = "Number"
+	FieldTypeBoolean = "Boolean"
+	FieldTypeMixed   = "Mixed"
+)
+
+// VectorLayers collects the names, attribute fields and zoom ranges of the
+// layers in vector tiles, to describe them as the vector_layers in the mbtiles
+// "json" metadata key. It isn't safe for concurrent use.
+type VectorLayers struct {
+	samplesPerZoom int
+	samples        map[uint]int
+	layers         map[string]*vectorLayer
+}
+
+// vectorLayer is an entry of vector_layers.
+type vectorLayer struct {
+	ID          string            `json:"id"`
+	Description string            `json:"description"`
+	MinZoom     uint              `json:"minzoom"`
+	MaxZoom     uint              `json:"maxzoom"`
+	Fields      map[string]string `json:"fields"`
+}
+
+// NewVectorLayers returns a VectorLayers that decodes up to samplesPerZoom
+// tiles at each zoom level, or every tile if it's 0. Layers that only appear
+// in tiles that aren't sampled are missed.
+func NewVectorLayers(samplesPerZoom int) *VectorLayers {
+	return &VectorLayers{
+		samplesPerZoom: samplesPerZoom,
+		samples:        make(map[uint]int),
+		layers:         make(map[string]*vectorLayer),
+	}
+}
+
+// Add records the layers in data, a vector tile that may be gzipped. Tiles
+// that aren't vector tiles, or are empty, are ignored, as are tiles at zoom
+// levels that have been sampled enough already.
+func (v *VectorLayers) Add(tile *Tile, data []byte) error {
+	if v.samplesPerZoom > 0 && v.samples[tile.Z] >= v.samplesPerZoom {
+		return nil
+	}
+
+	if IsGzipped(data) {
+		uncompressed, err := Gunzip(data)
+		if err != nil {
+			return err
+		}
+
+		data = uncompressed
+	}
+
+	if len(data) == 0 || DetectFormat(data) != FormatPbf {
+		return nil
+	}
+
+	var layers []*vectorLayer
+
+	err := visitProtobufFields(data, func(field uint64, wireType uint64, value []byte) error {
+		if field != 3 || wireType != protobufBytes {
+			return nil
+		}
+
+		layer, err := decodeVectorLayer(value)
+		if err != nil {
+			return fmt.Errorf("Invalid layer: %v", err)
+		}
+
+		layers = append(layers, layer)
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	v.samples[tile.Z]++
+
+	for _, layer := range layers {
+		existing, ok := v.layers[layer.ID]
+
+		if !ok {
+			layer.MinZoom = tile.Z
+			layer.MaxZoom = tile.Z
+			v.layers[layer.ID] = layer
+			continue
+		}
+
+		if tile.Z < existing.MinZoom {
+			existing.MinZoom = tile.Z
+		}
+
+		if tile.Z > existing.MaxZoom {
+			existing.MaxZoom = tile.Z
+		}
+
+		for name, fieldType := range layer.Fields {
+			existing.Fields[name] = mergeFieldTypes(existing.Fields[name], fieldType)
+		}
+	}
+
+	return nil
+}
+
+// JSON returns the mbtiles "json" metadata value describing the layers that
+// have been found, ordered by name.
+func (v *VectorLayers) JSON() (string, error) {
+	doc := struct {
+		VectorLayers []*vectorLayer `json:"vector_layers"`
+	}{
+		VectorLayers: make([]*vectorLayer, 0, len(v.layers)),
+	}
+
+	for _, layer := range v.layers {
+		doc.VectorLayers = append(doc.VectorLayers, layer)
+	}
+
+	sort.Slice(doc.VectorLayers, func(i, j int) bool { return doc.VectorLayers[i].ID < doc.VectorLayers[j].ID })
+
+	data, err := json.Marshal(doc)
+
+	return string(data), err
+}
+
+// Len returns the number of layers that have been found.
+func (v *VectorLayers) Len() int {
+	return len(v.layers)
+}
+
+// decodeVectorLayer returns the name of the vector tile layer message in data,
+// and the types of the values its features have for each key, as a vectorLayer.
+func decodeVectorLayer(data []byte) (*vectorLayer, error) {
+	layer := &vectorLayer{Fields: make(map[string]string)}
+
+	var keys []string
+	var valueTypes []string
+	var features [][]byte
+
+	err := visitProtobufFields(data, func(field uint64, wireType uint64, value []byte) error {
+		if wireType != protobufBytes {
+			return nil
+		}
+
+		switch field {
+		case 1:
+			layer.ID = string(value)
+		case 2:
+			features = append(features, value)
+		case 3:
+			keys = append(keys, string(value))
+		case 4:
+			valueType, err := decodeValueType(value)
+			if err != nil {
+				return err
+			}
+
+			valueTypes = append(valueTypes, valueType)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Features come before the keys and values they refer to
+	for _, feature := range features {
+		err := visitProtobufFields(feature, func(field uint64, wireType uint64, value []byte) error {
+			if field != 2 || wireType != protobufBytes {
+				return nil
+			}
+
+			// Tags are packed pairs of indexes into keys and values
+			for len(value) > 0 {
+				key, n := binary.Uvarint(value)
+				if n <= 0 {
+					return errors.New("Invalid tags")
+				}
+				value = value[n:]
+
+				index, n := binary.Uvarint(value)
+				if n <= 0 {
+					return errors.New("Invalid tags")
+				}
+				value = value[n:]
+
+				if key >= uint64(len(keys)) || index >= uint64(len(valueTypes)) {
+					return errors.New("Tag refers to a missing key or value")
+				}
+
+				name := keys[key]
+				layer.Fields[name] = mergeFieldTypes(layer.Fields[name], valueTypes[index])
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return layer, nil
+}
+
+// decodeValueType returns the field type of the vector tile value message in data.
+func decodeValueType(data []byte) (string, error) {
+	valueType := ""
+
+	err := visitProtobufFields(data, func(field uint64, wireType uint64, value []byte) error {
+		switch field {
+		case 1:
+			valueType = FieldTypeString
+		case 2, 3, 4, 5, 6:
+			valueType = FieldTypeNumber
+		case 7:
+			valueType = FieldTypeBoolean
+		}
+
+		return nil
+	})
+
+	return valueType, err
+}
+
+// mergeFieldTypes returns the type of a field with values of both types,
+// either of which may be empty.
+func mergeFieldTypes(a string, b string) string {
+	switch {
+	case a == "" || a == b:
+		return b
+	case b == "":
+		return a
+	default:
+		return FieldTypeMixed
+	}
+}
@@ -0,0 +1,98 @@
+package tilepack
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"testing"
+)
+
+// protobufField encodes a length-delimited protobuf field.
+func protobufField(field uint64, value []byte) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+
+	n := binary.PutUvarint(buf, field<<3|protobufBytes)
+	data := append([]byte{}, buf[:n]...)
+
+	n = binary.PutUvarint(buf, uint64(len(value)))
+	data = append(data, buf[:n]...)
+
+	return append(data, value...)
+}
+
+// testVectorTileLayer encodes a layer with one feature tagged with each of keys
+// and the matching values, which are already encoded value messages.
+func testVectorTileLayer(name string, keys []string, values [][]byte) []byte {
+	var tags []byte
+	for i := range keys {
+		tags = append(tags, byte(i), byte(i))
+	}
+
+	layer := protobufField(1, []byte(name))
+	layer = append(layer, protobufField(2, protobufField(2, tags))...)
+
+	for _, key := range keys {
+		layer = append(layer, protobufField(3, []byte(key))...)
+	}
+
+	for _, value := range values {
+		layer = append(layer, protobufField(4, value)...)
+	}
+
+	return protobufField(3, layer)
+}
+
+func TestVectorLayers(t *testing.T) {
+	stringValue := protobufField(1, []byte("river"))
+	numberValue := []byte{0x20, 0x05} // int_value (4) = 5
+	boolValue := []byte{0x38, 0x01}   // bool_value (7) = true
+
+	water := testVectorTileLayer("water", []string{"class", "area"}, [][]byte{stringValue, numberValue})
+	roads := testVectorTileLayer("roads", []string{"class", "oneway"}, [][]byte{stringValue, boolValue})
+	mixed := testVectorTileLayer("water", []string{"class"}, [][]byte{numberValue})
+
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write(append(append([]byte{}, water...), roads...))
+	gz.Close()
+
+	v := NewVectorLayers(2)
+
+	tiles := []struct {
+		tile *Tile
+		data []byte
+	}{
+		{&Tile{Z: 3, X: 0, Y: 0}, water},
+		{&Tile{Z: 5, X: 0, Y: 0}, gzipped.Bytes()},
+		{&Tile{Z: 4, X: 0, Y: 0}, mixed},
+		// Not vector tiles
+		{&Tile{Z: 2, X: 0, Y: 0}, []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n'}},
+		{&Tile{Z: 2, X: 0, Y: 0}, nil},
+		// Zoom 5 has been sampled twice already
+		{&Tile{Z: 5, X: 1, Y: 0}, roads},
+		{&Tile{Z: 5, X: 2, Y: 0}, testVectorTileLayer("ignored", nil, nil)},
+	}
+
+	for _, tile := range tiles {
+		if err := v.Add(tile.tile, tile.data); err != nil {
+			t.Fatalf("Add(%s) error = %v", tile.tile.ToString(), err)
+		}
+	}
+
+	if err := v.Add(&Tile{Z: 6, X: 0, Y: 0}, []byte{0x1a, 0x05, 0x12, 0x03, 0x12, 0x01, 0x00}); err == nil {
+		t.Error("Add() of a tile with a tag referring to a missing key expected an error")
+	}
+
+	got, err := v.JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{"vector_layers":[` +
+		`{"id":"roads","description":"","minzoom":5,"maxzoom":5,"fields":{"class":"String","oneway":"Boolean"}},` +
+		`{"id":"water","description":"","minzoom":3,"maxzoom":5,"fields":{"area":"Number","class":"Mixed"}}]}`
+
+	if got != want {
+		t.Errorf("JSON() = %s, want %s", got, want)
+	}
+}
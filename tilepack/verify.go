@@ -0,0 +1,149 @@
+package tilepack
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// VerifyTile returns an error if data isn't a valid tile in format, which is
+// an mbtiles "format" value (or "mvt" or "jpeg"). Gzipped tiles must
+// decompress, as Gunzip allows, and their contents are checked against format.
+// An empty format skips the format check. If parseMVT is true, vector tiles
+// must also be well-formed protobuf messages whose layers have names.
+func VerifyTile(data []byte, format string, parseMVT bool) error {
+	if IsGzipped(data) {
+		var err error
+
+		data, err = Gunzip(data)
+		if err != nil {
+			return fmt.Errorf("Couldn't gunzip tile: %v", err)
+		}
+	}
+
+	switch format {
+	case "mvt":
+		format = FormatPbf
+	case "jpeg":
+		format = FormatJpeg
+	}
+
+	detected := DetectFormat(data)
+
+	switch format {
+	case "":
+	case FormatPbf:
+		// An empty vector tile has no bytes at all
+		if len(data) > 0 && detected != FormatPbf {
+			return fmt.Errorf("Tile doesn't look like a vector tile (detected %q)", detected)
+		}
+	default:
+		if detected != format {
+			return fmt.Errorf("Tile doesn't look like a %s tile (detected %q)", format, detected)
+		}
+	}
+
+	if parseMVT && (format == FormatPbf || format == "" && detected == FormatPbf) {
+		return VerifyMVT(data)
+	}
+
+	return nil
+}
+
+// VerifyMVT returns an error if data, an uncompressed vector tile, isn't a
+// well-formed protobuf message or any of its layers (field 3) is missing a
+// name (field 1). The features within layers are only checked as far as
+// protobuf's wire format goes.
+func VerifyMVT(data []byte) error {
+	return visitProtobufFields(data, func(field uint64, wireType uint64, value []byte) error {
+		if field != 3 || wireType != protobufBytes {
+			return nil
+		}
+
+		hasName := false
+
+		err := visitProtobufFields(value, func(field uint64, wireType uint64, value []byte) error {
+			if field == 1 && wireType == protobufBytes {
+				hasName = true
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return fmt.Errorf("Invalid layer: %v", err)
+		}
+
+		if !hasName {
+			return errors.New("Layer has no name")
+		}
+
+		return nil
+	})
+}
+
+// Protobuf wire types
+const (
+	protobufVarint  = 0
+	protobufFixed64 = 1
+	protobufBytes   = 2
+	protobufFixed32 = 5
+)
+
+// visitProtobufFields walks the fields of the protobuf message in data and
+// calls visitor with the number, wire type and contents of each field. The
+// contents of a varint field are its encoded bytes, and of a length-delimited
+// field the bytes after the length.
+func visitProtobufFields(data []byte, visitor func(field uint64, wireType uint64, value []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("Invalid field key")
+		}
+		data = data[n:]
+
+		field := key >> 3
+
+		if field == 0 {
+			return errors.New("Invalid field number 0")
+		}
+
+		wireType := key & 7
+		var value []byte
+
+		switch wireType {
+		case protobufVarint:
+			_, n = binary.Uvarint(data)
+			if n <= 0 {
+				return fmt.Errorf("Invalid varint in field %d", field)
+			}
+			value = data[:n]
+		case protobufFixed64:
+			if len(data) < 8 {
+				return fmt.Errorf("Truncated field %d", field)
+			}
+			value = data[:8]
+		case protobufBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || length > uint64(len(data)-n) {
+				return fmt.Errorf("Truncated field %d", field)
+			}
+			data = data[n:]
+			value = data[:length]
+		case protobufFixed32:
+			if len(data) < 4 {
+				return fmt.Errorf("Truncated field %d", field)
+			}
+			value = data[:4]
+		default:
+			return fmt.Errorf("Unsupported wire type %d in field %d", wireType, field)
+		}
+
+		if err := visitor(field, wireType, value); err != nil {
+			return err
+		}
+		data = data[len(value):]
+	}
+
+	return nil
+}
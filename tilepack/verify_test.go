@@ -0,0 +1,71 @@
+package tilepack
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+)
+
+func TestVerifyTile(t *testing.T) {
+	// A layer named "water" with version 2
+	mvt := []byte{0x1a, 0x09, 0x0a, 0x05, 'w', 'a', 't', 'e', 'r', 0x78, 0x02}
+	png := []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n', 0x00, 0x00, 0x00, 0x0d}
+	jpeg := []byte{0xff, 0xd8, 0xff, 0xe0, 0x00, 0x10, 'J', 'F', 'I', 'F'}
+
+	gzipped := func(data []byte) []byte {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(data)
+		gz.Close()
+		return buf.Bytes()
+	}
+
+	// Older builds didn't write the gzip footer, which is accepted
+	unterminated := gzipped(mvt)
+	unterminated = unterminated[:len(unterminated)-8]
+
+	// Only the gzip header
+	truncated := gzipped(mvt)[:10]
+
+	tests := []struct {
+		name     string
+		data     []byte
+		format   string
+		parseMVT bool
+		valid    bool
+	}{
+		{"mvt", mvt, FormatPbf, true, true},
+		{"gzipped mvt", gzipped(mvt), FormatPbf, true, true},
+		{"mvt extension", gzipped(mvt), "mvt", true, true},
+		{"empty mvt", gzipped([]byte{}), FormatPbf, true, true},
+		{"gzipped png", gzipped(png), FormatPng, false, true},
+		{"png", png, FormatPng, false, true},
+		{"jpg", jpeg, FormatJpeg, false, true},
+		{"jpeg extension", jpeg, "jpeg", false, true},
+		{"png as jpeg", png, "jpeg", false, false},
+		{"unknown format", png, "", true, true},
+		{"gzip without footer", unterminated, FormatPbf, true, true},
+		{"truncated gzip", truncated, FormatPbf, false, false},
+		{"html", []byte("<html>Oops</html>"), FormatPbf, false, false},
+		{"png as mvt", png, FormatPbf, false, false},
+		{"mvt as png", mvt, FormatPng, false, false},
+		{"truncated mvt", mvt[:6], FormatPbf, false, true},
+		{"parsed truncated mvt", mvt[:6], FormatPbf, true, false},
+		{"unnamed layer", []byte{0x1a, 0x02, 0x78, 0x02}, FormatPbf, true, false},
+		{"undetected mvt", []byte{0x1a, 0x02, 0x78}, "", true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyTile(tt.data, tt.format, tt.parseMVT)
+
+			if tt.valid && err != nil {
+				t.Errorf("VerifyTile() = %v, want nil", err)
+			}
+
+			if !tt.valid && err == nil {
+				t.Error("VerifyTile() = nil, want an error")
+			}
+		})
+	}
+}